@@ -0,0 +1,342 @@
+package main
+
+/*
+	shuffle-appgen generates a Shuffle app from an OpenAPI 2 or 3 spec,
+	without the backend. The app is written to a directory or a zip file
+	that can be uploaded to Shuffle:
+
+		api.yaml
+		Dockerfile
+		requirements.txt
+		src/app.py
+		tests/conftest.py
+		tests/test_<action>.py
+
+	Usage:
+		shuffle-appgen [flags] <spec file>
+
+	With -dry-run nothing is written. The differences with the app already in
+	-out are shown instead, and the exit code is 1 if there are any.
+*/
+
+import (
+	"archive/zip"
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/frikky/kin-openapi/openapi2"
+	"github.com/frikky/kin-openapi/openapi2conv"
+	"github.com/frikky/kin-openapi/openapi3"
+	gyaml "github.com/ghodss/yaml"
+	"gopkg.in/yaml.v2"
+)
+
+//go:embed baseline/Dockerfile
+var baselineDockerfile []byte
+
+//go:embed baseline/requirements.txt
+var baselineRequirements []byte
+
+// Loads OpenAPI 3 specs, and converts OpenAPI 2 (swagger) to 3
+func loadSpec(data []byte) (*openapi3.Swagger, error) {
+	jsonData, err := gyaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var version struct {
+		Swagger string `json:"swagger"`
+		OpenAPI string `json:"openapi"`
+	}
+
+	err = json.Unmarshal(jsonData, &version)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.HasPrefix(version.Swagger, "2.") {
+		var swagger openapi2.Swagger
+		err = json.Unmarshal(jsonData, &swagger)
+		if err != nil {
+			return nil, err
+		}
+
+		return openapi2conv.ToV3Swagger(&swagger)
+	}
+
+	if !strings.HasPrefix(version.OpenAPI, "3.") && !strings.HasPrefix(version.Swagger, "3.") {
+		return nil, errors.New("The spec needs to be OpenAPI 2 or 3")
+	}
+
+	loader := openapi3.NewSwaggerLoader()
+	loader.IsExternalRefsAllowed = true
+	return loader.LoadSwaggerFromData(jsonData)
+}
+
+// All the files of the generated app, by their path in the app
+func getAppFiles(api WorkflowApp, actions []generatedAction, withTests bool) (map[string][]byte, error) {
+	data, err := yaml.Marshal(api)
+	if err != nil {
+		return map[string][]byte{}, err
+	}
+
+	pythonFunctions := []string{}
+	for _, action := range actions {
+		pythonFunctions = append(pythonFunctions, action.Code)
+	}
+
+	files := map[string][]byte{
+		"api.yaml":         data,
+		"Dockerfile":       baselineDockerfile,
+		"requirements.txt": baselineRequirements,
+		"src/app.py":       []byte(makePythonApp(api.Name, api.AppVersion, pythonFunctions)),
+	}
+
+	if withTests {
+		files["tests/conftest.py"] = []byte(makePythonConftest(api.Name))
+		for _, action := range actions {
+			files[fmt.Sprintf("tests/test_%s.py", action.Name)] = []byte(makePythonTest(action))
+		}
+	}
+
+	return files, nil
+}
+
+// Reads an existing app folder or zip. The app in a zip is found by its
+// api.yaml, so exported apps work as well.
+func readExistingApp(location string) (map[string][]byte, error) {
+	files := map[string][]byte{}
+	if strings.HasSuffix(strings.ToLower(location), ".zip") {
+		reader, err := zip.OpenReader(location)
+		if os.IsNotExist(err) {
+			return files, nil
+		} else if err != nil {
+			return files, err
+		}
+		defer reader.Close()
+
+		baseDir := ""
+		found := false
+		for _, file := range reader.File {
+			if filepath.Base(file.Name) != "api.yaml" {
+				continue
+			}
+
+			dir := strings.TrimSuffix(file.Name, "api.yaml")
+			if !found || strings.Count(dir, "/") < strings.Count(baseDir, "/") {
+				baseDir = dir
+				found = true
+			}
+		}
+
+		for _, file := range reader.File {
+			if file.FileInfo().IsDir() || !strings.HasPrefix(file.Name, baseDir) {
+				continue
+			}
+
+			opened, err := file.Open()
+			if err != nil {
+				return files, err
+			}
+
+			data, err := ioutil.ReadAll(opened)
+			opened.Close()
+			if err != nil {
+				return files, err
+			}
+
+			files[strings.TrimPrefix(file.Name, baseDir)] = data
+		}
+
+		return files, nil
+	}
+
+	err := filepath.Walk(location, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			if info.Name() == "__pycache__" || info.Name() == ".git" {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		relativePath, err := filepath.Rel(location, path)
+		if err != nil {
+			return err
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		files[filepath.ToSlash(relativePath)] = data
+		return nil
+	})
+
+	if os.IsNotExist(err) {
+		return files, nil
+	}
+
+	return files, err
+}
+
+func getSortedFileNames(files map[string][]byte) []string {
+	names := []string{}
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func writeAppFolder(location string, files map[string][]byte) error {
+	existing, err := readExistingApp(location)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range getSortedFileNames(existing) {
+		if strings.HasPrefix(name, "tests/test_") && files[name] == nil {
+			log.Printf("%s isn't generated anymore. Remove it if the action is gone", name)
+		}
+	}
+
+	for _, name := range getSortedFileNames(files) {
+		path := filepath.Join(location, filepath.FromSlash(name))
+		err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+		if err != nil {
+			return err
+		}
+
+		err = ioutil.WriteFile(path, files[name], 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeAppZip(location string, files map[string][]byte) error {
+	buf := new(bytes.Buffer)
+	writer := zip.NewWriter(buf)
+	for _, name := range getSortedFileNames(files) {
+		file, err := writer.Create(name)
+		if err != nil {
+			return err
+		}
+
+		_, err = file.Write(files[name])
+		if err != nil {
+			return err
+		}
+	}
+
+	err := writer.Close()
+	if err != nil {
+		return err
+	}
+
+	if dir := filepath.Dir(location); len(dir) > 0 {
+		os.MkdirAll(dir, os.ModePerm)
+	}
+
+	return ioutil.WriteFile(location, buf.Bytes(), 0644)
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] <spec file>\n\nGenerates a Shuffle app from an OpenAPI 2 or 3 spec.\n\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+
+	output := flag.String("out", "", "Directory or .zip file to write the app to (default generated/<name>/<version>)")
+	dryRun := flag.Bool("dry-run", false, "Show the differences with the app in -out instead of writing it. Exits with 1 if there are any")
+	withTests := flag.Bool("tests", true, "Generate a pytest file per action")
+	appVersion := flag.String("app-version", "", "Version of the generated app (default 1.0.0)")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	data, err := ioutil.ReadFile(flag.Arg(0))
+	if err != nil {
+		log.Printf("Failed reading spec: %s", err)
+		os.Exit(3)
+	}
+
+	swagger, err := loadSpec(data)
+	if err != nil {
+		log.Printf("Swagger validation error: %s", err)
+		os.Exit(3)
+	}
+
+	api, actions, err := generateYaml(swagger)
+	if err != nil {
+		log.Printf("Failed building and generating yaml: %s", err)
+		os.Exit(3)
+	}
+
+	if len(*appVersion) > 0 {
+		api.AppVersion = *appVersion
+	}
+
+	api = verifyApi(api)
+	files, err := getAppFiles(api, actions, *withTests)
+	if err != nil {
+		log.Printf("Failed generating app files: %s", err)
+		os.Exit(3)
+	}
+
+	if len(*output) == 0 {
+		*output = filepath.Join("generated", getPythonName(api.Name, map[string]bool{}), api.AppVersion)
+	}
+
+	if *dryRun {
+		existing, err := readExistingApp(*output)
+		if err != nil {
+			log.Printf("Failed reading existing app in %s: %s", *output, err)
+			os.Exit(3)
+		}
+
+		diff := diffApp(existing, files)
+		if len(diff) == 0 {
+			log.Printf("No changes to %s", *output)
+			return
+		}
+
+		fmt.Print(diff)
+		os.Exit(1)
+	}
+
+	if strings.HasSuffix(strings.ToLower(*output), ".zip") {
+		err = writeAppZip(*output, files)
+	} else {
+		err = writeAppFolder(*output, files)
+	}
+
+	if err != nil {
+		log.Printf("Failed writing app to %s: %s", *output, err)
+		os.Exit(3)
+	}
+
+	log.Printf("Generated %s %s with %d actions in %s", api.Name, api.AppVersion, len(api.Actions), *output)
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDiffFile(t *testing.T) {
+	if diff := diffFile("a.txt", []byte("a\nb\n"), []byte("a\nb\n")); diff != "" {
+		t.Errorf("expected no diff for equal files, got %q", diff)
+	}
+
+	diff := diffFile("a.txt", []byte("1\n2\n3\n4\n5\n6\n7\n8\n"), []byte("1\n2\n3\n4\nfive\n6\n7\n8\n"))
+	expected := "--- a/a.txt\n+++ b/a.txt\n@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+five\n 6\n 7\n 8\n"
+	if diff != expected {
+		t.Errorf("unexpected diff:\n%s", diff)
+	}
+
+	diff = diffFile("new.txt", nil, []byte("x\n"))
+	if diff != "--- /dev/null\n+++ b/new.txt\n@@ -0,0 +1,1 @@\n+x\n" {
+		t.Errorf("unexpected diff for a new file:\n%s", diff)
+	}
+}
+
+func TestGetAppFiles(t *testing.T) {
+	swagger, err := loadSpec([]byte(`
+swagger: "2.0"
+info:
+  title: Test API
+  version: "1.0"
+host: api.test.io
+schemes: [https]
+paths:
+  /tickets/{id}:
+    get:
+      operationId: getTicket
+      parameters:
+      - {name: id, in: path, required: true, type: string}
+      responses:
+        "200": {description: ok}
+`))
+	if err != nil {
+		t.Fatalf("failed loading spec: %s", err)
+	}
+
+	api, actions, err := generateYaml(swagger)
+	if err != nil {
+		t.Fatalf("failed generating: %s", err)
+	}
+
+	files, err := getAppFiles(verifyApi(api), actions, true)
+	if err != nil {
+		t.Fatalf("failed getting files: %s", err)
+	}
+
+	for _, name := range []string{"api.yaml", "Dockerfile", "requirements.txt", "src/app.py", "tests/conftest.py"} {
+		if len(files[name]) == 0 {
+			t.Errorf("missing %s", name)
+		}
+	}
+
+	if len(actions) != 1 || len(files["tests/test_"+actions[0].Name+".py"]) == 0 {
+		t.Fatalf("expected a test for the single action, got %d actions", len(actions))
+	}
+
+	if !strings.Contains(string(files["src/app.py"]), "https://api.test.io/tickets/") {
+		t.Errorf("expected the server url in the app")
+	}
+
+	if diff := diffApp(files, files); diff != "" {
+		t.Errorf("expected no diff against itself, got %s", diff)
+	}
+}
+
+func TestGetPagination(t *testing.T) {
+	swagger, err := loadSpec([]byte(`
+openapi: 3.0.0
+info: {title: Pager, version: "1"}
+servers: [{url: "https://api.test.io"}]
+paths:
+  /tickets:
+    get:
+      parameters:
+      - {name: cursor, in: query, schema: {type: string}}
+      responses:
+        "200":
+          description: ok
+          content:
+            application/json:
+              schema:
+                type: object
+                properties:
+                  data: {type: array, items: {type: object}}
+                  meta: {type: object, properties: {next_cursor: {type: string}}}
+  /search:
+    post:
+      x-shuffle-pagination: {type: page, items_path: hits}
+      responses: {"200": {description: ok}}
+  /users:
+    get:
+      x-shuffle-pagination: false
+      parameters:
+      - {name: page, in: query, schema: {type: integer}}
+      responses: {"200": {description: ok}}
+`))
+	if err != nil {
+		t.Fatalf("failed loading spec: %s", err)
+	}
+
+	tickets := swagger.Paths["/tickets"].Get
+	pagination := getPagination("get", tickets, getOperationParameters(swagger.Paths["/tickets"], tickets))
+	if pagination == nil || pagination.Type != "cursor" || pagination.CursorParam != "cursor" || pagination.CursorPath != "meta.next_cursor" || pagination.ItemsPath != "data" {
+		t.Errorf("unexpected cursor pagination: %#v", pagination)
+	}
+
+	search := swagger.Paths["/search"].Post
+	pagination = getPagination("post", search, getOperationParameters(swagger.Paths["/search"], search))
+	if pagination == nil || pagination.Type != "page" || pagination.PageParam != "page" || pagination.ItemsPath != "hits" {
+		t.Errorf("unexpected pagination from the extension: %#v", pagination)
+	}
+
+	users := swagger.Paths["/users"].Get
+	if pagination = getPagination("get", users, getOperationParameters(swagger.Paths["/users"], users)); pagination != nil {
+		t.Errorf("expected no pagination when it's turned off, got %#v", pagination)
+	}
+}
+
+// Generates the actions of a spec by name
+func getTestActions(t *testing.T, spec string) map[string]generatedAction {
+	t.Helper()
+
+	swagger, err := loadSpec([]byte(spec))
+	if err != nil {
+		t.Fatalf("failed loading spec: %s", err)
+	}
+
+	_, actions, err := generateYaml(swagger)
+	if err != nil {
+		t.Fatalf("failed generating: %s", err)
+	}
+
+	generated := map[string]generatedAction{}
+	for _, action := range actions {
+		generated[action.Name] = action
+	}
+
+	return generated
+}
+
+func checkActionCode(t *testing.T, actions map[string]generatedAction, name string, expected, unexpected []string) {
+	t.Helper()
+
+	action, ok := actions[name]
+	if !ok {
+		t.Errorf("missing action %s", name)
+		return
+	}
+
+	for _, part := range expected {
+		if !strings.Contains(action.Code, part) {
+			t.Errorf("expected %q in %s:\n%s", part, name, action.Code)
+		}
+	}
+
+	for _, part := range unexpected {
+		if strings.Contains(action.Code, part) {
+			t.Errorf("unexpected %q in %s:\n%s", part, name, action.Code)
+		}
+	}
+}
+
+func TestMakePythoncodeBodies(t *testing.T) {
+	actions := getTestActions(t, `
+openapi: 3.0.0
+info: {title: Bodies, version: "1"}
+servers: [{url: "https://api.test.io"}]
+paths:
+  /json:
+    post:
+      operationId: json
+      parameters:
+      - {name: X-Request-Id, in: header, required: true, schema: {type: string}}
+      - {name: session, in: cookie, schema: {type: string}}
+      requestBody:
+        required: true
+        content:
+          application/json:
+            schema:
+              type: object
+              required: [title]
+              properties:
+                title: {type: string}
+                tags: {type: array, items: {type: string}}
+      responses: {"200": {description: ok}}
+    put:
+      operationId: json
+      requestBody:
+        content:
+          application/json:
+            schema:
+              type: object
+              properties:
+                title: {type: string}
+      responses: {"200": {description: ok}}
+  /form:
+    post:
+      operationId: form
+      requestBody:
+        content:
+          application/x-www-form-urlencoded:
+            schema:
+              type: object
+              properties:
+                grant_type: {type: string}
+      responses: {"200": {description: ok}}
+  /multipart:
+    put:
+      operationId: multipart
+      requestBody:
+        content:
+          multipart/form-data:
+            schema:
+              type: object
+              properties:
+                comment: {type: string}
+      responses: {"200": {description: ok}}
+  /raw:
+    post:
+      operationId: raw
+      requestBody:
+        content:
+          text/plain:
+            schema: {type: string}
+      responses: {"200": {description: ok}}
+`)
+
+	checkActionCode(t, actions, "json_post", []string{
+		`headers["X-Request-Id"] = X_Request_Id`,
+		`cookies["session"] = session`,
+		`request_body["title"] = self.parse_value(title)`,
+		`request_body["tags"] = self.parse_value(tags)`,
+		`requests.request("POST", url, params=params, headers=headers, cookies=cookies, json=request_body, verify=self.verify)`,
+	}, []string{"data=", "files="})
+
+	checkActionCode(t, actions, "json_put", []string{
+		`requests.request("PUT", url, params=params, headers=headers, cookies=cookies, json=request_body, verify=self.verify)`,
+	}, nil)
+
+	checkActionCode(t, actions, "form_post", []string{
+		`request_body["grant_type"] = self.parse_value(grant_type)`,
+		`data=request_body`,
+	}, []string{"json=", "files="})
+
+	checkActionCode(t, actions, "multipart_put", []string{
+		`request_body["comment"] = comment`,
+		`requests.request("PUT", url, params=params, headers=headers, cookies=cookies, files={key: (None, value) for key, value in request_body.items()}, verify=self.verify)`,
+	}, []string{"json=", "data="})
+
+	checkActionCode(t, actions, "raw_post", []string{
+		`headers["Content-Type"] = "text/plain"`,
+		`data=body if body not in (None, "") else None`,
+	}, []string{"json=", "files=", "request_body"})
+
+	test := makePythonTest(actions["multipart_put"])
+	if !strings.Contains(test, `assert request["files"]["comment"] == (None, args["comment"])`) {
+		t.Errorf("expected the multipart field to be checked:\n%s", test)
+	}
+}
+
+func TestMakePythoncodeSecurity(t *testing.T) {
+	actions := getTestActions(t, `
+openapi: 3.0.0
+info: {title: Secure, version: "1"}
+servers: [{url: "https://api.test.io"}]
+security:
+- headerKey: []
+components:
+  securitySchemes:
+    headerKey: {type: apiKey, in: header, name: X-Api-Key}
+    queryKey: {type: apiKey, in: query, name: api_key}
+    cookieKey: {type: apiKey, in: cookie, name: token}
+    basicAuth: {type: http, scheme: basic}
+    bearerAuth: {type: http, scheme: bearer}
+    oauth:
+      type: oauth2
+      flows:
+        clientCredentials:
+          tokenUrl: https://auth.test.io/token
+          scopes: {read: Read access}
+paths:
+  /default:
+    get:
+      operationId: default
+      responses: {"200": {description: ok}}
+  /query:
+    get:
+      operationId: query
+      security: [{queryKey: []}]
+      responses: {"200": {description: ok}}
+  /cookie:
+    get:
+      operationId: cookie
+      security: [{cookieKey: []}]
+      responses: {"200": {description: ok}}
+  /basic:
+    get:
+      operationId: basic
+      security: [{basicAuth: []}]
+      responses: {"200": {description: ok}}
+  /bearer:
+    get:
+      operationId: bearer
+      security: [{bearerAuth: []}]
+      responses: {"200": {description: ok}}
+  /oauth:
+    get:
+      operationId: oauth
+      security: [{oauth: [read]}]
+      responses: {"200": {description: ok}}
+  /public:
+    get:
+      operationId: public
+      security: []
+      responses: {"200": {description: ok}}
+`)
+
+	// With more than one scheme the fields are optional, and the
+	// authentication is only applied when they're set
+	checkActionCode(t, actions, "default_get", []string{
+		"if apikey_3 not in (None, \"\"):\n            headers[\"X-Api-Key\"] = apikey_3",
+	}, []string{"params[", "cookies[", "auth="})
+
+	checkActionCode(t, actions, "query_get", []string{
+		`params["api_key"] = apikey_4`,
+	}, []string{"X-Api-Key", "auth="})
+
+	checkActionCode(t, actions, "cookie_get", []string{
+		`cookies["token"] = apikey_2`,
+	}, []string{"X-Api-Key", "auth="})
+
+	checkActionCode(t, actions, "basic_get", []string{
+		"auth = None\n",
+		"auth = (username_basic, password_basic)",
+		"auth=auth, verify=self.verify)",
+	}, []string{"X-Api-Key", "Authorization"})
+
+	checkActionCode(t, actions, "bearer_get", []string{
+		`headers["Authorization"] = "Bearer " + apikey`,
+	}, []string{"X-Api-Key", "auth="})
+
+	checkActionCode(t, actions, "oauth_get", []string{
+		`headers["Authorization"] = "Bearer " + self.get_oauth2_token("https://auth.test.io/token", client_id, client_secret, scope)`,
+	}, []string{"X-Api-Key", "auth="})
+
+	// An empty security list turns off the global one
+	checkActionCode(t, actions, "public_get", []string{
+		"async def public_get(self):",
+	}, []string{"apikey", "auth", "Authorization", "X-Api-Key"})
+
+	if len(actions["public_get"].AuthFields) != 0 || len(actions["public_get"].Securities) != 0 {
+		t.Errorf("expected no authentication for public_get, got %#v", actions["public_get"].Securities)
+	}
+
+	// A single scheme makes the fields required
+	actions = getTestActions(t, `
+openapi: 3.0.0
+info: {title: Basic, version: "1"}
+servers: [{url: "https://api.test.io"}]
+security:
+- basicAuth: []
+components:
+  securitySchemes:
+    basicAuth: {type: http, scheme: basic}
+paths:
+  /me:
+    get:
+      operationId: me
+      responses: {"200": {description: ok}}
+`)
+
+	checkActionCode(t, actions, "me_get", []string{
+		"async def me_get(self, username_basic, password_basic):",
+		"        auth = None\n        auth = (username_basic, password_basic)\n",
+	}, []string{"if username_basic"})
+
+	test := makePythonTest(actions["me_get"])
+	if !strings.Contains(test, `assert request["auth"] == (args["username_basic"], args["password_basic"])`) {
+		t.Errorf("expected basic auth to be checked:\n%s", test)
+	}
+}
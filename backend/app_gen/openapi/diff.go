@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Above this the changed part of a file is shown as fully replaced, as the
+// LCS table would get too big
+const maxDiffCells = 4000000
+
+const diffContext = 3
+
+type diffOp struct {
+	Kind byte
+	Line string
+}
+
+func splitDiffLines(data []byte) []string {
+	if len(data) == 0 {
+		return []string{}
+	}
+
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+// Finds the equal, removed and added lines between two files
+func getDiffOps(before, after []string) []diffOp {
+	prefix := 0
+	for prefix < len(before) && prefix < len(after) && before[prefix] == after[prefix] {
+		prefix++
+	}
+
+	suffix := 0
+	for suffix < len(before)-prefix && suffix < len(after)-prefix && before[len(before)-1-suffix] == after[len(after)-1-suffix] {
+		suffix++
+	}
+
+	ops := []diffOp{}
+	for _, line := range before[:prefix] {
+		ops = append(ops, diffOp{' ', line})
+	}
+
+	removed := before[prefix : len(before)-suffix]
+	added := after[prefix : len(after)-suffix]
+	if len(removed)*len(added) > maxDiffCells {
+		for _, line := range removed {
+			ops = append(ops, diffOp{'-', line})
+		}
+
+		for _, line := range added {
+			ops = append(ops, diffOp{'+', line})
+		}
+	} else {
+		lcs := make([][]int, len(removed)+1)
+		for i := range lcs {
+			lcs[i] = make([]int, len(added)+1)
+		}
+
+		for i := len(removed) - 1; i >= 0; i-- {
+			for j := len(added) - 1; j >= 0; j-- {
+				if removed[i] == added[j] {
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				} else if lcs[i+1][j] >= lcs[i][j+1] {
+					lcs[i][j] = lcs[i+1][j]
+				} else {
+					lcs[i][j] = lcs[i][j+1]
+				}
+			}
+		}
+
+		i, j := 0, 0
+		for i < len(removed) && j < len(added) {
+			if removed[i] == added[j] {
+				ops = append(ops, diffOp{' ', removed[i]})
+				i++
+				j++
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				ops = append(ops, diffOp{'-', removed[i]})
+				i++
+			} else {
+				ops = append(ops, diffOp{'+', added[j]})
+				j++
+			}
+		}
+
+		for ; i < len(removed); i++ {
+			ops = append(ops, diffOp{'-', removed[i]})
+		}
+
+		for ; j < len(added); j++ {
+			ops = append(ops, diffOp{'+', added[j]})
+		}
+	}
+
+	for _, line := range before[len(before)-suffix:] {
+		ops = append(ops, diffOp{' ', line})
+	}
+
+	return ops
+}
+
+func getDiffRange(start, length int) string {
+	if length == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+
+	return fmt.Sprintf("%d,%d", start+1, length)
+}
+
+// Makes a unified diff of a file. Missing files are nil.
+func diffFile(name string, before, after []byte) string {
+	if before != nil && after != nil && bytes.Equal(before, after) {
+		return ""
+	}
+
+	beforeName := fmt.Sprintf("a/%s", name)
+	afterName := fmt.Sprintf("b/%s", name)
+	if before == nil {
+		beforeName = "/dev/null"
+	} else if after == nil {
+		afterName = "/dev/null"
+	}
+
+	ops := getDiffOps(splitDiffLines(before), splitDiffLines(after))
+	output := fmt.Sprintf("--- %s\n+++ %s\n", beforeName, afterName)
+
+	beforeLine, afterLine := 0, 0
+	for index := 0; index < len(ops); {
+		if ops[index].Kind == ' ' {
+			beforeLine++
+			afterLine++
+			index++
+			continue
+		}
+
+		// A hunk goes on until there are more unchanged lines than the
+		// context on both sides
+		start := index - diffContext
+		if start < 0 {
+			start = 0
+		}
+
+		end := index
+		for end < len(ops) {
+			if ops[end].Kind != ' ' {
+				end++
+				continue
+			}
+
+			unchanged := 0
+			for end+unchanged < len(ops) && ops[end+unchanged].Kind == ' ' {
+				unchanged++
+			}
+
+			if end+unchanged == len(ops) || unchanged > diffContext*2 {
+				if unchanged > diffContext {
+					unchanged = diffContext
+				}
+
+				end += unchanged
+				break
+			}
+
+			end += unchanged
+		}
+
+		hunkBefore, hunkAfter := 0, 0
+		hunk := ""
+		for _, op := range ops[start:end] {
+			if op.Kind != '+' {
+				hunkBefore++
+			}
+
+			if op.Kind != '-' {
+				hunkAfter++
+			}
+
+			hunk += fmt.Sprintf("%c%s\n", op.Kind, op.Line)
+		}
+
+		hunkStart := index - start
+		output += fmt.Sprintf("@@ -%s +%s @@\n", getDiffRange(beforeLine-hunkStart, hunkBefore), getDiffRange(afterLine-hunkStart, hunkAfter))
+		output += hunk
+
+		beforeLine += hunkBefore - hunkStart
+		afterLine += hunkAfter - hunkStart
+		index = end
+	}
+
+	return output
+}
+
+// Summarizes which actions were added, removed or changed in api.yaml
+func diffActions(before, after []byte) string {
+	var beforeApi, afterApi WorkflowApp
+	yaml.Unmarshal(before, &beforeApi)
+	yaml.Unmarshal(after, &afterApi)
+
+	beforeActions := map[string]string{}
+	for _, action := range beforeApi.Actions {
+		data, _ := yaml.Marshal(action)
+		beforeActions[action.Name] = string(data)
+	}
+
+	added, changed := []string{}, []string{}
+	afterActions := map[string]bool{}
+	for _, action := range afterApi.Actions {
+		afterActions[action.Name] = true
+		data, _ := yaml.Marshal(action)
+		if existing, ok := beforeActions[action.Name]; !ok {
+			added = append(added, action.Name)
+		} else if existing != string(data) {
+			changed = append(changed, action.Name)
+		}
+	}
+
+	removed := []string{}
+	for name := range beforeActions {
+		if !afterActions[name] {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(removed)
+
+	output := ""
+	for _, change := range []struct {
+		Name    string
+		Actions []string
+	}{{"added", added}, {"removed", removed}, {"changed", changed}} {
+		if len(change.Actions) > 0 {
+			output += fmt.Sprintf("Actions %s: %s\n", change.Name, strings.Join(change.Actions, ", "))
+		}
+	}
+
+	return output
+}
+
+// Diffs the generated app against the existing files. Existing files that
+// aren't generated are left alone, so they're not part of the diff.
+func diffApp(existing, generated map[string][]byte) string {
+	names := []string{}
+	for name := range generated {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	output := ""
+	if _, ok := existing["api.yaml"]; ok {
+		output += diffActions(existing["api.yaml"], generated["api.yaml"])
+	}
+
+	for _, name := range names {
+		output += diffFile(name, existing[name], generated[name])
+	}
+
+	return output
+}
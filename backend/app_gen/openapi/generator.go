@@ -0,0 +1,1077 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/frikky/kin-openapi/openapi3"
+)
+
+type WorkflowApp struct {
+	Name        string `json:"name" yaml:"name" required:"true" datastore:"name"`
+	IsValid     bool   `json:"is_valid" yaml:"is_valid" required:"true" datastore:"is_valid"`
+	ID          string `json:"id" yaml:"id,omitempty" required:"false" datastore:"id"`
+	Link        string `json:"link" yaml:"link" required:"false" datastore:"link,noindex"`
+	AppVersion  string `json:"app_version" yaml:"app_version" required:"true" datastore:"app_version"`
+	Description string `json:"description" datastore:"description" required:"false" yaml:"description"`
+	Environment string `json:"environment" datastore:"environment" required:"true" yaml:"environment"`
+	SmallImage  string `json:"small_image" datastore:"small_image,noindex" required:"false" yaml:"small_image"`
+	LargeImage  string `json:"large_image" datastore:"large_image,noindex" yaml:"large_image" required:"false"`
+	ContactInfo struct {
+		Name string `json:"name" datastore:"name" yaml:"name"`
+		Url  string `json:"url" datastore:"url" yaml:"url"`
+	} `json:"contact_info" datastore:"contact_info" yaml:"contact_info" required:"false"`
+	Actions        []WorkflowAppAction `json:"actions" yaml:"actions" required:"true" datastore:"actions"`
+	Authentication Authentication      `json:"authentication" yaml:"authentication" required:"false" datastore:"authentication"`
+}
+
+type AuthenticationParams struct {
+	Description string           `json:"description" datastore:"description" yaml:"description"`
+	ID          string           `json:"id" datastore:"id" yaml:"id"`
+	Name        string           `json:"name" datastore:"name" yaml:"name"`
+	Example     string           `json:"example" datastore:"example" yaml:"example"`
+	Value       string           `json:"value,omitempty" datastore:"value" yaml:"value"`
+	Multiline   bool             `json:"multiline" datastore:"multiline" yaml:"multiline"`
+	Required    bool             `json:"required" datastore:"required" yaml:"required"`
+	Schema      SchemaDefinition `json:"schema" datastore:"schema" yaml:"schema"`
+}
+
+type Authentication struct {
+	Required   bool                   `json:"required" datastore:"required" yaml:"required" `
+	Parameters []AuthenticationParams `json:"parameters" datastore:"parameters" yaml:"parameters"`
+}
+
+type AuthenticationStore struct {
+	Key   string `json:"key" datastore:"key"`
+	Value string `json:"value" datastore:"value"`
+}
+
+type WorkflowAppActionParameter struct {
+	Description string           `json:"description" datastore:"description" yaml:"description"`
+	ID          string           `json:"id" datastore:"id" yaml:"id,omitempty"`
+	Name        string           `json:"name" datastore:"name" yaml:"name"`
+	Example     string           `json:"example" datastore:"example" yaml:"example"`
+	Value       string           `json:"value" datastore:"value" yaml:"value,omitempty"`
+	Multiline   bool             `json:"multiline" datastore:"multiline" yaml:"multiline"`
+	ActionField string           `json:"action_field" datastore:"action_field" yaml:"actionfield,omitempty"`
+	Variant     string           `json:"variant" datastore:"variant" yaml:"variant,omitempty"`
+	Required    bool             `json:"required" datastore:"required" yaml:"required"`
+	Schema      SchemaDefinition `json:"schema" datastore:"schema" yaml:"schema"`
+}
+
+type SchemaDefinition struct {
+	Type string `json:"type" datastore:"type"`
+}
+
+type WorkflowAppAction struct {
+	Description     string                       `json:"description" datastore:"description"`
+	ID              string                       `json:"id" datastore:"id" yaml:"id,omitempty"`
+	Name            string                       `json:"name" datastore:"name"`
+	NodeType        string                       `json:"node_type" datastore:"node_type"`
+	Environment     string                       `json:"environment" datastore:"environment"`
+	Authentication  []AuthenticationStore        `json:"authentication" datastore:"authentication" yaml:"authentication,omitempty"`
+	AuthNotRequired bool                         `json:"auth_not_required" datastore:"auth_not_required" yaml:"auth_not_required"`
+	Parameters      []WorkflowAppActionParameter `json:"parameters" datastore:"parameters"`
+	Pagination      *ActionPagination            `json:"pagination,omitempty" datastore:"pagination" yaml:"pagination,omitempty"`
+	Returns         struct {
+		Description string           `json:"description" datastore:"returns" yaml:"description,omitempty"`
+		ID          string           `json:"id" datastore:"id" yaml:"id,omitempty"`
+		Schema      SchemaDefinition `json:"schema" datastore:"schema" yaml:"schema"`
+	} `json:"returns" datastore:"returns"`
+}
+
+// Names that can't be used as python arguments in the generated functions,
+// either because they're keywords or because the function body uses them.
+var pythonReservedNames = []string{
+	"False", "None", "True", "and", "as", "assert", "async", "await", "break",
+	"class", "continue", "def", "del", "elif", "else", "except", "finally", "for",
+	"from", "global", "if", "import", "in", "is", "lambda", "nonlocal", "not",
+	"or", "pass", "raise", "return", "try", "while", "with", "yield",
+	"self", "json", "requests", "quote", "url", "params", "headers", "cookies",
+	"request_body", "ret", "auth",
+}
+
+var pythonNamePattern = regexp.MustCompile(`[^a-zA-Z0-9_]+`)
+var pythonUnderscorePattern = regexp.MustCompile(`_+`)
+var pathParameterPattern = regexp.MustCompile(`{([^{}]+)}`)
+
+// The generated operations, in the order they're added
+var generatorMethods = []string{"get", "post", "put", "patch", "delete"}
+
+// A parameter of a generated function. Name is the python argument and
+// action parameter name, Key the name the API expects. For raw bodies
+// Key is the content type.
+type generatedParameter struct {
+	Name      string
+	Key       string
+	In        string
+	Required  bool
+	Parameter WorkflowAppActionParameter
+}
+
+// A generated action, with what's needed to make its code and tests
+type generatedAction struct {
+	Name       string
+	Method     string
+	Url        string
+	BodyMode   string
+	Parameters []generatedParameter
+	AuthFields []generatedParameter
+	Securities []generatedSecurity
+	Pagination *ActionPagination
+	Code       string
+}
+
+// Makes a valid python identifier that isn't used yet
+func getPythonName(name string, used map[string]bool) string {
+	newName := pythonUnderscorePattern.ReplaceAllString(pythonNamePattern.ReplaceAllString(name, "_"), "_")
+	newName = strings.Trim(newName, "_")
+	if len(newName) == 0 {
+		newName = "param"
+	}
+
+	if newName[0] >= '0' && newName[0] <= '9' {
+		newName = fmt.Sprintf("_%s", newName)
+	}
+
+	for _, reserved := range pythonReservedNames {
+		if newName == reserved {
+			newName = fmt.Sprintf("%s_param", newName)
+			break
+		}
+	}
+
+	baseName := newName
+	for i := 2; used[newName]; i++ {
+		newName = fmt.Sprintf("%s_%d", baseName, i)
+	}
+
+	used[newName] = true
+	return newName
+}
+
+func getPythonString(value string) string {
+	data, _ := json.Marshal(value)
+	return string(data)
+}
+
+func getExampleString(example interface{}) string {
+	if example == nil {
+		return ""
+	}
+
+	if value, ok := example.(string); ok {
+		return value
+	}
+
+	data, err := json.Marshal(example)
+	if err != nil {
+		return ""
+	}
+
+	return string(data)
+}
+
+func getSchemaType(schema *openapi3.SchemaRef) string {
+	if schema == nil || schema.Value == nil || len(schema.Value.Type) == 0 {
+		return "string"
+	}
+
+	return schema.Value.Type
+}
+
+// Path parameters are defined on the path, and can be overridden per operation
+func getOperationParameters(path *openapi3.PathItem, operation *openapi3.Operation) []*openapi3.Parameter {
+	parameters := []*openapi3.Parameter{}
+	for _, param := range path.Parameters {
+		if param == nil || param.Value == nil {
+			continue
+		}
+
+		overridden := false
+		for _, opParam := range operation.Parameters {
+			if opParam != nil && opParam.Value != nil && opParam.Value.Name == param.Value.Name && opParam.Value.In == param.Value.In {
+				overridden = true
+				break
+			}
+		}
+
+		if !overridden {
+			parameters = append(parameters, param.Value)
+		}
+	}
+
+	for _, param := range operation.Parameters {
+		if param != nil && param.Value != nil {
+			parameters = append(parameters, param.Value)
+		}
+	}
+
+	return parameters
+}
+
+// Picks the request body type the generated code sends. JSON is preferred,
+// then forms. Anything else is sent as a raw body.
+func getRequestBodyContent(requestBody *openapi3.RequestBody) (string, *openapi3.MediaType) {
+	contentTypes := []string{}
+	for contentType := range requestBody.Content {
+		contentTypes = append(contentTypes, contentType)
+	}
+	sort.Strings(contentTypes)
+
+	for _, preferred := range []string{"json", "x-www-form-urlencoded", "form-data"} {
+		for _, contentType := range contentTypes {
+			if strings.Contains(strings.ToLower(contentType), preferred) {
+				return contentType, requestBody.Content[contentType]
+			}
+		}
+	}
+
+	if len(contentTypes) > 0 {
+		return contentTypes[0], requestBody.Content[contentTypes[0]]
+	}
+
+	return "application/json", nil
+}
+
+func getBodyMode(contentType string) string {
+	contentType = strings.ToLower(contentType)
+	if strings.Contains(contentType, "json") {
+		return "json"
+	} else if strings.Contains(contentType, "x-www-form-urlencoded") {
+		return "form"
+	} else if strings.Contains(contentType, "form-data") {
+		return "multipart"
+	}
+
+	return "raw"
+}
+
+// Turns the request body into parameters. Object schemas get one parameter
+// per property, anything else a single "body" parameter.
+func getBodyParameters(requestBody *openapi3.RequestBody, used map[string]bool) (string, []generatedParameter) {
+	contentType, mediaType := getRequestBodyContent(requestBody)
+	bodyMode := getBodyMode(contentType)
+	parameters := []generatedParameter{}
+
+	var schema *openapi3.Schema
+	if mediaType != nil && mediaType.Schema != nil {
+		schema = mediaType.Schema.Value
+	}
+
+	if bodyMode != "raw" && schema != nil && len(schema.Properties) > 0 {
+		propertyNames := []string{}
+		for name := range schema.Properties {
+			propertyNames = append(propertyNames, name)
+		}
+		sort.Strings(propertyNames)
+
+		for _, name := range propertyNames {
+			property := schema.Properties[name]
+			required := false
+			for _, requiredName := range schema.Required {
+				if requiredName == name {
+					required = requestBody.Required
+					break
+				}
+			}
+
+			pythonName := getPythonName(name, used)
+			description := ""
+			example := ""
+			propertyType := getSchemaType(property)
+			if property != nil && property.Value != nil {
+				description = property.Value.Description
+				example = getExampleString(property.Value.Example)
+			}
+
+			parameters = append(parameters, generatedParameter{
+				Name:     pythonName,
+				Key:      name,
+				In:       "body",
+				Required: required,
+				Parameter: WorkflowAppActionParameter{
+					Name:        pythonName,
+					Description: description,
+					Example:     example,
+					Multiline:   propertyType == "object" || propertyType == "array",
+					Required:    required,
+					Schema: SchemaDefinition{
+						Type: propertyType,
+					},
+				},
+			})
+		}
+
+		return bodyMode, parameters
+	}
+
+	example := ""
+	if mediaType != nil {
+		example = getExampleString(mediaType.Example)
+		if len(example) == 0 && schema != nil {
+			example = getExampleString(schema.Example)
+		}
+	}
+
+	pythonName := getPythonName("body", used)
+	parameters = append(parameters, generatedParameter{
+		Name:     pythonName,
+		Key:      contentType,
+		In:       "rawbody",
+		Required: requestBody.Required,
+		Parameter: WorkflowAppActionParameter{
+			Name:        pythonName,
+			Description: requestBody.Description,
+			Example:     example,
+			Multiline:   true,
+			Required:    requestBody.Required,
+			Schema: SchemaDefinition{
+				Type: "string",
+			},
+		},
+	})
+
+	return bodyMode, parameters
+}
+
+// An authentication scheme from components.securitySchemes. Fields are the
+// python arguments, named the same as the app authentication parameters so
+// they're filled in from the stored app authentication.
+type generatedSecurity struct {
+	Scheme   string
+	Type     string
+	In       string
+	Key      string
+	TokenUrl string
+	Fields   []generatedParameter
+}
+
+func getSecurityField(name, description, example string, required bool, used map[string]bool) generatedParameter {
+	pythonName := getPythonName(name, used)
+	return generatedParameter{
+		Name:     pythonName,
+		Key:      pythonName,
+		In:       "security",
+		Required: required,
+		Parameter: WorkflowAppActionParameter{
+			Name:        pythonName,
+			Description: description,
+			Example:     example,
+			Required:    required,
+			Schema: SchemaDefinition{
+				Type: "string",
+			},
+		},
+	}
+}
+
+// Maps the supported security schemes to authentication fields. apiKey
+// (header, query, cookie), HTTP basic/bearer and OAuth2 client credentials
+// are supported. With more than one scheme none of them are required, and the
+// generated code uses the ones that are set.
+func getSecuritySchemes(swagger *openapi3.Swagger, link string) ([]generatedSecurity, []AuthenticationParams) {
+	securities := []generatedSecurity{}
+	if swagger.Components.SecuritySchemes == nil {
+		return securities, []AuthenticationParams{}
+	}
+
+	schemeNames := []string{}
+	for name, scheme := range swagger.Components.SecuritySchemes {
+		if scheme != nil && scheme.Value != nil {
+			schemeNames = append(schemeNames, name)
+		}
+	}
+	sort.Strings(schemeNames)
+
+	used := map[string]bool{}
+	for _, name := range schemeNames {
+		scheme := swagger.Components.SecuritySchemes[name].Value
+		security := generatedSecurity{
+			Scheme: name,
+			Type:   strings.ToLower(scheme.Type),
+			In:     scheme.In,
+			Key:    scheme.Name,
+		}
+
+		switch security.Type {
+		case "apikey":
+			if security.In != openapi3.ParameterInHeader && security.In != openapi3.ParameterInQuery && security.In != openapi3.ParameterInCookie {
+				log.Printf("Skipping apiKey security scheme %s in unknown location %s", name, security.In)
+				continue
+			}
+
+			description := scheme.Description
+			if len(description) == 0 {
+				description = fmt.Sprintf("The API key, sent in the %s %s", security.Key, security.In)
+			}
+
+			security.Fields = []generatedParameter{
+				getSecurityField("apikey", description, "", true, used),
+			}
+		case "http":
+			security.Type = strings.ToLower(scheme.Scheme)
+			if security.Type == "basic" {
+				security.Fields = []generatedParameter{
+					getSecurityField("username_basic", "The username for basic authentication", "", true, used),
+					getSecurityField("password_basic", "The password for basic authentication", "", true, used),
+				}
+			} else if security.Type == "bearer" {
+				description := scheme.Description
+				if len(description) == 0 {
+					description = "The bearer token, sent in the Authorization header"
+				}
+
+				security.Fields = []generatedParameter{
+					getSecurityField("apikey", description, "", true, used),
+				}
+			} else {
+				log.Printf("Skipping unsupported HTTP security scheme %s: %s", name, scheme.Scheme)
+				continue
+			}
+		case "oauth2":
+			if scheme.Flows == nil || scheme.Flows.ClientCredentials == nil || len(scheme.Flows.ClientCredentials.TokenURL) == 0 {
+				log.Printf("Skipping OAuth2 security scheme %s without a client credentials flow", name)
+				continue
+			}
+
+			flow := scheme.Flows.ClientCredentials
+			security.TokenUrl = flow.TokenURL
+			if !strings.HasPrefix(security.TokenUrl, "http://") && !strings.HasPrefix(security.TokenUrl, "https://") {
+				security.TokenUrl = fmt.Sprintf("%s/%s", link, strings.TrimPrefix(security.TokenUrl, "/"))
+			}
+
+			scopes := []string{}
+			for scope := range flow.Scopes {
+				scopes = append(scopes, scope)
+			}
+			sort.Strings(scopes)
+
+			security.Fields = []generatedParameter{
+				getSecurityField("client_id", "The OAuth2 client ID", "", true, used),
+				getSecurityField("client_secret", "The OAuth2 client secret", "", true, used),
+				getSecurityField("scope", "Space separated OAuth2 scopes to request", strings.Join(scopes, " "), false, used),
+			}
+		default:
+			log.Printf("Skipping unsupported security scheme %s of type %s", name, scheme.Type)
+			continue
+		}
+
+		securities = append(securities, security)
+	}
+
+	authParams := []AuthenticationParams{}
+	for index, security := range securities {
+		for fieldIndex, field := range security.Fields {
+			if len(securities) > 1 {
+				field.Required = false
+				field.Parameter.Required = false
+				securities[index].Fields[fieldIndex] = field
+			}
+
+			authParams = append(authParams, AuthenticationParams{
+				Name:        field.Name,
+				Description: field.Parameter.Description,
+				Example:     field.Parameter.Example,
+				Required:    field.Required,
+				Schema:      field.Parameter.Schema,
+			})
+		}
+	}
+
+	return securities, authParams
+}
+
+// The schemes an operation uses. The operation security overrides the global
+// one, and without any security requirements all the schemes are used.
+func getOperationSecurity(swagger *openapi3.Swagger, operation *openapi3.Operation, securities []generatedSecurity) []generatedSecurity {
+	requirements := swagger.Security
+	if operation.Security != nil {
+		requirements = *operation.Security
+	}
+
+	if requirements == nil {
+		return securities
+	}
+
+	operationSecurities := []generatedSecurity{}
+	for _, security := range securities {
+		for _, requirement := range requirements {
+			if _, ok := requirement[security.Scheme]; ok {
+				operationSecurities = append(operationSecurities, security)
+				break
+			}
+		}
+	}
+
+	return operationSecurities
+}
+
+// Some specs define the API key as a parameter as well
+func isSecurityParameter(param *openapi3.Parameter, securities []generatedSecurity) bool {
+	for _, security := range securities {
+		if security.Type != "apikey" || security.In != param.In {
+			continue
+		}
+
+		if security.Key == param.Name || (param.In == openapi3.ParameterInHeader && strings.EqualFold(security.Key, param.Name)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Applies an authentication scheme to the request
+func makePythonSecurity(security generatedSecurity) string {
+	switch security.Type {
+	case "apikey":
+		field := security.Fields[0]
+		target := map[string]string{
+			openapi3.ParameterInHeader: "headers",
+			openapi3.ParameterInQuery:  "params",
+			openapi3.ParameterInCookie: "cookies",
+		}[security.In]
+
+		return makePythonAssignment(target, security.Key, field.Name, field.Name, field.Required)
+	case "bearer":
+		field := security.Fields[0]
+		return makePythonAssignment("headers", "Authorization", field.Name, fmt.Sprintf("\"Bearer \" + %s", field.Name), field.Required)
+	case "basic":
+		username := security.Fields[0]
+		password := security.Fields[1]
+		return makePythonAssignment("auth", "", username.Name, fmt.Sprintf("(%s, %s)", username.Name, password.Name), username.Required)
+	case "oauth2":
+		clientId := security.Fields[0]
+		clientSecret := security.Fields[1]
+		scope := security.Fields[2]
+		value := fmt.Sprintf("\"Bearer \" + self.get_oauth2_token(%s, %s, %s, %s)", getPythonString(security.TokenUrl), clientId.Name, clientSecret.Name, scope.Name)
+		return makePythonAssignment("headers", "Authorization", clientId.Name, value, clientId.Required)
+	}
+
+	return ""
+}
+
+// Builds the action name and python function name for an operation
+func getFunctionName(operation *openapi3.Operation, method, actualPath string, usedFunctions map[string]bool) string {
+	name := operation.Summary
+	if len(name) == 0 {
+		name = operation.OperationID
+	}
+
+	if len(name) == 0 {
+		name = actualPath
+	}
+
+	name = strings.ToLower(fmt.Sprintf("%s_%s", name, method))
+	return getPythonName(name, usedFunctions)
+}
+
+// Makes the url for a python f-string with the path parameters in it. Other
+// braces, such as server variables, are escaped.
+func getPythonUrl(url string, parameters []generatedParameter) string {
+	url = strings.ReplaceAll(url, "{", "{{")
+	url = strings.ReplaceAll(url, "}", "}}")
+	for _, param := range parameters {
+		if param.In == "path" {
+			url = strings.ReplaceAll(url, fmt.Sprintf("{{%s}}", param.Key), fmt.Sprintf("{quote(str(%s), safe='')}", param.Name))
+		}
+	}
+
+	return strings.ReplaceAll(url, `"`, `\"`)
+}
+
+// Adds a value to one of the request dicts if the argument is set. Without
+// a key the value is assigned to the target itself.
+func makePythonAssignment(target, key, name, value string, required bool) string {
+	if len(key) > 0 {
+		target = fmt.Sprintf("%s[%s]", target, getPythonString(key))
+	}
+
+	if required {
+		return fmt.Sprintf("        %s = %s\n", target, value)
+	}
+
+	return fmt.Sprintf("        if %s not in (None, \"\"):\n            %s = %s\n", name, target, value)
+}
+
+// Makes the python function for a single operation. Path parameters are put in
+// the url, query/header/cookie parameters and the body are only sent when set.
+// Authentication is applied last. The function takes all the authentication
+// fields, as they're added to every action that requires authentication.
+// Returns the status code and the parsed JSON body (or text) of the response.
+// Paginated actions return the items of all the pages they followed instead.
+func makePythoncode(name, url, method, bodyMode string, parameters, authFields []generatedParameter, securities []generatedSecurity, pagination *ActionPagination) string {
+	method = strings.ToUpper(method)
+
+	fields := append([]generatedParameter{}, authFields...)
+	fields = append(fields, parameters...)
+
+	arguments := []string{}
+	for _, param := range fields {
+		if param.Required {
+			arguments = append(arguments, param.Name)
+		}
+	}
+
+	for _, param := range fields {
+		if !param.Required {
+			arguments = append(arguments, fmt.Sprintf("%s=\"\"", param.Name))
+		}
+	}
+
+	argumentString := ""
+	if len(arguments) > 0 {
+		argumentString = fmt.Sprintf(", %s", strings.Join(arguments, ", "))
+	}
+
+	code := fmt.Sprintf("    async def %s(self%s):\n", name, argumentString)
+	code += fmt.Sprintf("        url = f\"%s\"\n", getPythonUrl(url, parameters))
+	code += "        params = {}\n        headers = {}\n        cookies = {}\n"
+
+	hasBody := false
+	rawBody := ""
+	maxItems := ""
+	for _, param := range parameters {
+		switch param.In {
+		case "query":
+			code += makePythonAssignment("params", param.Key, param.Name, param.Name, param.Required)
+		case "header":
+			code += makePythonAssignment("headers", param.Key, param.Name, param.Name, param.Required)
+		case "cookie":
+			code += makePythonAssignment("cookies", param.Key, param.Name, param.Name, param.Required)
+		case "body":
+			if !hasBody {
+				code += "        request_body = {}\n"
+				hasBody = true
+			}
+
+			// Properties may be JSON objects or lists. Multipart fields are
+			// sent as they are.
+			value := fmt.Sprintf("self.parse_value(%s)", param.Name)
+			if bodyMode == "multipart" {
+				value = param.Name
+			}
+
+			code += makePythonAssignment("request_body", param.Key, param.Name, value, param.Required)
+		case "rawbody":
+			rawBody = param.Name
+			code += fmt.Sprintf("        headers[\"Content-Type\"] = %s\n", getPythonString(param.Key))
+		case "maxitems":
+			maxItems = param.Name
+		}
+	}
+
+	authArgument := ""
+	for _, security := range securities {
+		if security.Type == "basic" && len(authArgument) == 0 {
+			code += "        auth = None\n"
+			authArgument = ", auth=auth"
+		}
+
+		code += makePythonSecurity(security)
+	}
+
+	bodyArgument := ""
+	if hasBody {
+		switch bodyMode {
+		case "json":
+			bodyArgument = ", json=request_body"
+		case "multipart":
+			// requests only makes a multipart body out of files. A part
+			// without a filename is a regular form field.
+			bodyArgument = ", files={key: (None, value) for key, value in request_body.items()}"
+		default:
+			bodyArgument = ", data=request_body"
+		}
+	} else if len(rawBody) > 0 {
+		bodyArgument = fmt.Sprintf(", data=%s if %s not in (None, \"\") else None", rawBody, rawBody)
+	}
+
+	if pagination != nil && len(maxItems) > 0 {
+		code += fmt.Sprintf("\n        return self.paginate(%s, url, %s, %s, params=params, headers=headers, cookies=cookies%s%s)\n", getPythonString(method), makePythonPagination(pagination), maxItems, bodyArgument, authArgument)
+		return code
+	}
+
+	code += fmt.Sprintf("\n        ret = requests.request(%s, url, params=params, headers=headers, cookies=cookies%s%s, verify=self.verify)\n", getPythonString(method), bodyArgument, authArgument)
+	code += "        return self.prepare_response(ret)\n"
+
+	return code
+}
+
+// The generated app class. The helpers are used by every generated function.
+func makePythonApp(name, version string, pythonFunctions []string) string {
+	className := getPythonName(name, map[string]bool{})
+
+	return fmt.Sprintf(`import json
+import time
+import asyncio
+from urllib.parse import quote, urljoin
+
+import requests
+import urllib3
+
+from walkoff_app_sdk.app_base import AppBase
+
+class %s(AppBase):
+    """
+    Autogenerated class by Shuffler
+    """
+
+    __version__ = "%s"
+    app_name = "%s"
+
+    def __init__(self, redis, logger, console_logger=None):
+        self.verify = False
+        self.oauth2_tokens = {}
+        urllib3.disable_warnings(urllib3.exceptions.InsecureRequestWarning)
+        super().__init__(redis, logger, console_logger)
+
+    def parse_value(self, value):
+        if isinstance(value, str):
+            try:
+                return json.loads(value)
+            except ValueError:
+                pass
+
+        return value
+
+    def prepare_response(self, ret):
+        try:
+            body = ret.json()
+        except ValueError:
+            body = ret.text
+
+        return json.dumps({
+            "success": ret.ok,
+            "status": ret.status_code,
+            "body": body,
+        })
+
+    def get_oauth2_token(self, token_url, client_id, client_secret, scope=""):
+        cache_key = (token_url, client_id, scope)
+        token = self.oauth2_tokens.get(cache_key)
+        if token and token["expires"] > time.time():
+            return token["access_token"]
+
+        data = {"grant_type": "client_credentials"}
+        if scope:
+            data["scope"] = scope
+
+        ret = requests.post(token_url, data=data, auth=(client_id, client_secret), verify=self.verify)
+        ret.raise_for_status()
+        body = ret.json()
+
+        self.oauth2_tokens[cache_key] = {
+            "access_token": body["access_token"],
+            "expires": time.time() + int(body.get("expires_in", 3600)) - 30,
+        }
+
+        return body["access_token"]
+
+    def get_path(self, body, path):
+        for key in path.split(".") if path else []:
+            if isinstance(body, dict):
+                body = body.get(key)
+            elif isinstance(body, list) and key.isdigit() and int(key) < len(body):
+                body = body[int(key)]
+            else:
+                return None
+
+        return body
+
+    def paginate(self, method, url, pagination, max_items, params=None, **kwargs):
+        """
+        Follows the pages of a response until there are max_items items.
+        Returns the first response as is if it doesn't have a list of items.
+        """
+        try:
+            max_items = int(max_items)
+        except (TypeError, ValueError):
+            max_items = pagination["max_items"]
+
+        params = dict(params or {})
+        if pagination["type"] == "page":
+            if params.get(pagination["page_param"]) in (None, ""):
+                params[pagination["page_param"]] = pagination["start_page"]
+
+        items = []
+        while True:
+            ret = requests.request(method, url, params=dict(params), verify=self.verify, **kwargs)
+            if max_items <= 0 or not ret.ok:
+                return self.prepare_response(ret)
+
+            try:
+                body = ret.json()
+            except ValueError:
+                body = None
+
+            page_items = self.get_path(body, pagination.get("items_path", ""))
+            if not isinstance(page_items, list):
+                if not items:
+                    return self.prepare_response(ret)
+
+                break
+
+            items.extend(page_items)
+            if not page_items or len(items) >= max_items:
+                break
+
+            if pagination["type"] == "cursor":
+                cursor = self.get_path(body, pagination["cursor_path"])
+                if cursor in (None, ""):
+                    break
+
+                if "cursor_param" not in pagination:
+                    url = urljoin(ret.url or url, str(cursor))
+                    params = {}
+                elif str(cursor) != str(params.get(pagination["cursor_param"])):
+                    params[pagination["cursor_param"]] = cursor
+                else:
+                    break
+            elif pagination["type"] == "page":
+                limit = params.get(pagination.get("limit_param", ""))
+                if limit not in (None, "") and str(limit).isdigit() and len(page_items) < int(limit):
+                    break
+
+                params[pagination["page_param"]] = int(params[pagination["page_param"]]) + 1
+            elif pagination["type"] == "link":
+                next_url = ret.links.get("next", {}).get("url")
+                if not next_url:
+                    break
+
+                url = urljoin(ret.url or url, next_url)
+                params = {}
+            else:
+                break
+
+        return json.dumps({
+            "success": True,
+            "status": ret.status_code,
+            "body": items[:max_items],
+        })
+
+%s
+
+if __name__ == "__main__":
+    asyncio.run(%s.run(), debug=True)
+`, className, version, name, strings.Join(pythonFunctions, "\n"), className)
+}
+
+func generateYaml(swagger *openapi3.Swagger) (WorkflowApp, []generatedAction, error) {
+	api := WorkflowApp{}
+
+	if swagger.Info == nil || len(swagger.Info.Title) == 0 {
+		return WorkflowApp{}, []generatedAction{}, errors.New("Swagger.Info.Title can't be empty.")
+	}
+
+	if len(swagger.Servers) == 0 {
+		return WorkflowApp{}, []generatedAction{}, errors.New("Swagger.Servers can't be empty. Add 'servers':[{'url':'hostname.com'}'")
+	}
+
+	api.Name = swagger.Info.Title
+	api.Description = swagger.Info.Description
+	api.IsValid = true
+	api.Link = strings.TrimSuffix(swagger.Servers[0].URL, "/") // host does not exist lol
+	api.AppVersion = "1.0.0"
+	api.Environment = "cloud"
+	api.ID = ""
+	api.SmallImage = ""
+	api.LargeImage = ""
+
+	securities, authParams := getSecuritySchemes(swagger, api.Link)
+	if len(authParams) > 0 {
+		api.Authentication = Authentication{
+			Required:   true,
+			Parameters: authParams,
+		}
+	}
+
+	// This is the python code to be generated
+	// Could just as well be go at this point lol
+	actions := []generatedAction{}
+
+	// Sorted to generate the same app every time
+	paths := []string{}
+	for actualPath := range swagger.Paths {
+		paths = append(paths, actualPath)
+	}
+	sort.Strings(paths)
+
+	usedFunctions := map[string]bool{}
+	for _, actualPath := range paths {
+		path := swagger.Paths[actualPath]
+		operations := map[string]*openapi3.Operation{
+			"get":    path.Get,
+			"post":   path.Post,
+			"put":    path.Put,
+			"patch":  path.Patch,
+			"delete": path.Delete,
+		}
+
+		for _, method := range generatorMethods {
+			operation := operations[method]
+			if operation == nil {
+				continue
+			}
+
+			functionName := getFunctionName(operation, method, actualPath, usedFunctions)
+			action := WorkflowAppAction{
+				Description: operation.Description,
+				Name:        functionName,
+				NodeType:    "action",
+				Environment: api.Environment,
+				Parameters:  []WorkflowAppActionParameter{},
+			}
+
+			if len(action.Description) == 0 {
+				action.Description = operation.Summary
+			}
+
+			operationSecurities := getOperationSecurity(swagger, operation, securities)
+			action.AuthNotRequired = len(securities) > 0 && len(operationSecurities) == 0
+
+			authFields := []generatedParameter{}
+			if !action.AuthNotRequired {
+				for _, security := range securities {
+					authFields = append(authFields, security.Fields...)
+				}
+			}
+
+			action.Returns.Schema.Type = "string"
+			baseUrl := fmt.Sprintf("%s%s", api.Link, actualPath)
+
+			// The authentication fields are added to every action when the app is loaded
+			usedNames := map[string]bool{}
+			for _, param := range authParams {
+				usedNames[param.Name] = true
+			}
+
+			parameters := []generatedParameter{}
+			for _, param := range getOperationParameters(path, operation) {
+				// These are controlled by the generated code, as in the OpenAPI spec
+				if param.In == openapi3.ParameterInHeader {
+					lowerName := strings.ToLower(param.Name)
+					if lowerName == "accept" || lowerName == "content-type" || lowerName == "authorization" {
+						continue
+					}
+				}
+
+				if isSecurityParameter(param, operationSecurities) {
+					continue
+				}
+
+				if param.In != openapi3.ParameterInPath && param.In != openapi3.ParameterInQuery && param.In != openapi3.ParameterInHeader && param.In != openapi3.ParameterInCookie {
+					log.Printf("Skipping parameter %s in unknown location %s", param.Name, param.In)
+					continue
+				}
+
+				// Path parameters are always required
+				required := param.Required || param.In == openapi3.ParameterInPath
+				pythonName := getPythonName(param.Name, usedNames)
+				example := getExampleString(param.Example)
+				if len(example) == 0 && param.Schema != nil && param.Schema.Value != nil {
+					example = getExampleString(param.Schema.Value.Example)
+				}
+
+				parameters = append(parameters, generatedParameter{
+					Name:     pythonName,
+					Key:      param.Name,
+					In:       param.In,
+					Required: required,
+					Parameter: WorkflowAppActionParameter{
+						Name:        pythonName,
+						Description: param.Description,
+						Example:     example,
+						Multiline:   false,
+						Required:    required,
+						Schema: SchemaDefinition{
+							Type: getSchemaType(param.Schema),
+						},
+					},
+				})
+			}
+
+			// Not every spec defines all the parameters in the path
+			for _, match := range pathParameterPattern.FindAllStringSubmatch(actualPath, -1) {
+				found := false
+				for _, param := range parameters {
+					if param.In == openapi3.ParameterInPath && param.Key == match[1] {
+						found = true
+						break
+					}
+				}
+
+				if found {
+					continue
+				}
+
+				pythonName := getPythonName(match[1], usedNames)
+				parameters = append(parameters, generatedParameter{
+					Name:     pythonName,
+					Key:      match[1],
+					In:       openapi3.ParameterInPath,
+					Required: true,
+					Parameter: WorkflowAppActionParameter{
+						Name:     pythonName,
+						Required: true,
+						Schema: SchemaDefinition{
+							Type: "string",
+						},
+					},
+				})
+			}
+
+			bodyMode := ""
+			if operation.RequestBody != nil && operation.RequestBody.Value != nil {
+				var bodyParameters []generatedParameter
+				bodyMode, bodyParameters = getBodyParameters(operation.RequestBody.Value, usedNames)
+				parameters = append(parameters, bodyParameters...)
+			}
+
+			action.Pagination = getPagination(method, operation, getOperationParameters(path, operation))
+			if action.Pagination != nil {
+				parameters = append(parameters, getMaxItemsParameter(action.Pagination, usedNames))
+			}
+
+			// ensuring that they end up last in the specification
+			// (order is ish important for optional params) - they need to be last.
+			for _, required := range []bool{true, false} {
+				for _, param := range parameters {
+					if param.Required == required {
+						action.Parameters = append(action.Parameters, param.Parameter)
+					}
+				}
+			}
+
+			actions = append(actions, generatedAction{
+				Name:       functionName,
+				Method:     strings.ToUpper(method),
+				Url:        baseUrl,
+				BodyMode:   bodyMode,
+				Parameters: parameters,
+				AuthFields: authFields,
+				Securities: operationSecurities,
+				Pagination: action.Pagination,
+				Code:       makePythoncode(functionName, baseUrl, method, bodyMode, parameters, authFields, operationSecurities, action.Pagination),
+			})
+
+			api.Actions = append(api.Actions, action)
+		}
+	}
+
+	return api, actions, nil
+}
+
+func verifyApi(api WorkflowApp) WorkflowApp {
+	if api.AppVersion == "" {
+		api.AppVersion = "1.0.0"
+	}
+
+	return api
+}
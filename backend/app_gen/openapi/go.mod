@@ -0,0 +1,15 @@
+module shuffle-appgen
+
+go 1.19
+
+require (
+	github.com/frikky/kin-openapi v0.42.0
+	github.com/ghodss/yaml v1.0.0
+	gopkg.in/yaml.v2 v2.4.0
+)
+
+require (
+	github.com/go-openapi/jsonpointer v0.19.5 // indirect
+	github.com/go-openapi/swag v0.19.5 // indirect
+	github.com/mailru/easyjson v0.0.0-20190626092158-b2ccc519800e // indirect
+)
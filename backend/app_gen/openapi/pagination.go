@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/frikky/kin-openapi/openapi3"
+)
+
+// How a generated action follows the pages of a response. Paths are dotted
+// paths in the JSON response, e.g. meta.next_cursor.
+//   - cursor: the next cursor is read from CursorPath and sent in the
+//     CursorParam query parameter. Without a CursorParam the cursor is
+//     the url of the next page.
+//   - page: PageParam is counted up from StartPage until a page is empty,
+//     or has less items than the LimitParam asked for.
+//   - link: the next url is read from the Link response header (RFC 8288)
+//
+// It can be set on an operation with the x-shuffle-pagination extension, in
+// the same format as in api.yaml. x-shuffle-pagination: false turns off
+// detection for an operation.
+type ActionPagination struct {
+	Type        string `json:"type" datastore:"type" yaml:"type"`
+	ItemsPath   string `json:"items_path,omitempty" datastore:"items_path" yaml:"items_path,omitempty"`
+	CursorParam string `json:"cursor_param,omitempty" datastore:"cursor_param" yaml:"cursor_param,omitempty"`
+	CursorPath  string `json:"cursor_path,omitempty" datastore:"cursor_path" yaml:"cursor_path,omitempty"`
+	PageParam   string `json:"page_param,omitempty" datastore:"page_param" yaml:"page_param,omitempty"`
+	LimitParam  string `json:"limit_param,omitempty" datastore:"limit_param" yaml:"limit_param,omitempty"`
+	StartPage   *int   `json:"start_page,omitempty" datastore:"start_page" yaml:"start_page,omitempty"`
+	MaxItems    int    `json:"max_items,omitempty" datastore:"max_items" yaml:"max_items,omitempty"`
+}
+
+const paginationExtension = "x-shuffle-pagination"
+
+// Used when max_items isn't set, so an action can't page forever
+const defaultMaxItems = 1000
+
+// Query parameters and response fields that are recognized without the extension
+var cursorParamNames = []string{"cursor", "page_token", "pagetoken", "next_token", "nexttoken", "continuation_token", "continuationtoken", "starting_after", "after"}
+var cursorFieldNames = []string{"next_cursor", "nextcursor", "next_page_token", "nextpagetoken", "next_token", "nexttoken", "continuation_token", "continuationtoken", "cursor", "after"}
+var nextUrlFieldNames = []string{"next", "next_url", "nexturl", "next_link", "nextlink", "@odata.nextlink"}
+var pageParamNames = []string{"page", "page_number", "pagenumber", "pageno"}
+var limitParamNames = []string{"limit", "per_page", "perpage", "page_size", "pagesize", "size", "count", "max_results", "maxresults"}
+var itemsFieldNames = []string{"data", "items", "results", "values", "value", "records", "entries", "list"}
+
+// The wrapper objects next cursors are commonly found in
+var cursorParentNames = []string{"meta", "metadata", "response_metadata", "pagination", "paging", "links", "_links", "page_info", "pageinfo"}
+
+func findName(names []string, name string) bool {
+	name = strings.ToLower(name)
+	for _, item := range names {
+		if item == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Sorted so the first match is the same every time
+func getSchemaPropertyNames(schema *openapi3.Schema) []string {
+	names := []string{}
+	for name := range schema.Properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Finds the first property (by the order of names) in the schema
+func findSchemaProperty(schema *openapi3.Schema, names []string) (string, *openapi3.Schema) {
+	properties := getSchemaPropertyNames(schema)
+	for _, name := range names {
+		for _, property := range properties {
+			ref := schema.Properties[property]
+			if strings.ToLower(property) == name && ref != nil && ref.Value != nil {
+				return property, ref.Value
+			}
+		}
+	}
+
+	return "", nil
+}
+
+// The schema of the successful JSON response
+func getResponseSchema(operation *openapi3.Operation) (*openapi3.Response, *openapi3.Schema) {
+	for _, status := range []string{"200", "206", "2XX", "default"} {
+		ref := operation.Responses[status]
+		if ref == nil || ref.Value == nil {
+			continue
+		}
+
+		for contentType, mediaType := range ref.Value.Content {
+			if strings.Contains(strings.ToLower(contentType), "json") && mediaType != nil && mediaType.Schema != nil && mediaType.Schema.Value != nil {
+				return ref.Value, mediaType.Schema.Value
+			}
+		}
+
+		return ref.Value, nil
+	}
+
+	return nil, nil
+}
+
+// The path to the list of items, which is empty if the response is the list
+func getItemsPath(schema *openapi3.Schema) (string, bool) {
+	if schema == nil || schema.Type == "array" {
+		return "", true
+	}
+
+	if name, property := findSchemaProperty(schema, itemsFieldNames); property != nil && property.Type == "array" {
+		return name, true
+	}
+
+	for _, name := range getSchemaPropertyNames(schema) {
+		ref := schema.Properties[name]
+		if ref != nil && ref.Value != nil && ref.Value.Type == "array" {
+			return name, true
+		}
+	}
+
+	return "", false
+}
+
+// Finds the next cursor or next url in the response, either at the top or
+// in one of the wrapper objects. Objects such as HAL links aren't cursors.
+func getCursorPath(schema *openapi3.Schema, names []string) string {
+	if schema == nil {
+		return ""
+	}
+
+	if name, property := findSchemaProperty(schema, names); property != nil && property.Type != "object" && property.Type != "array" {
+		return name
+	}
+
+	parentName, parent := findSchemaProperty(schema, cursorParentNames)
+	if parent == nil {
+		return ""
+	}
+
+	if name, property := findSchemaProperty(parent, names); property != nil && property.Type != "object" && property.Type != "array" {
+		return fmt.Sprintf("%s.%s", parentName, name)
+	}
+
+	return ""
+}
+
+// Reads x-shuffle-pagination. The second return value is false if the
+// extension isn't set.
+func getPaginationExtension(operation *openapi3.Operation) (*ActionPagination, bool) {
+	value, ok := operation.Extensions[paginationExtension]
+	if !ok {
+		return nil, false
+	}
+
+	data, ok := value.(json.RawMessage)
+	if !ok {
+		data, _ = json.Marshal(value)
+	}
+
+	disabled := true
+	if err := json.Unmarshal(data, &disabled); err == nil {
+		if disabled {
+			log.Printf("%s: true isn't a pagination type. Detecting it instead", paginationExtension)
+			return nil, false
+		}
+
+		return nil, true
+	}
+
+	pagination := ActionPagination{}
+	err := json.Unmarshal(data, &pagination)
+	if err != nil {
+		log.Printf("Skipping invalid %s: %s", paginationExtension, err)
+		return nil, true
+	}
+
+	pagination.Type = strings.ToLower(pagination.Type)
+	switch pagination.Type {
+	case "cursor":
+		if len(pagination.CursorPath) == 0 {
+			log.Printf("Skipping %s of type cursor without cursor_path", paginationExtension)
+			return nil, true
+		}
+	case "page":
+		if len(pagination.PageParam) == 0 {
+			pagination.PageParam = "page"
+		}
+	case "link":
+	default:
+		log.Printf("Skipping unsupported %s type '%s'. Use cursor, page or link", paginationExtension, pagination.Type)
+		return nil, true
+	}
+
+	return &pagination, true
+}
+
+// Finds how an operation paginates, from the extension or from the
+// parameter and response names. Only GET operations are detected.
+func getPagination(method string, operation *openapi3.Operation, parameters []*openapi3.Parameter) *ActionPagination {
+	if pagination, ok := getPaginationExtension(operation); ok {
+		return pagination
+	}
+
+	if method != "get" {
+		return nil
+	}
+
+	cursorParam, pageParam, limitParam := "", "", ""
+	for _, param := range parameters {
+		if param.In != openapi3.ParameterInQuery {
+			continue
+		}
+
+		if len(cursorParam) == 0 && findName(cursorParamNames, param.Name) {
+			cursorParam = param.Name
+		} else if len(pageParam) == 0 && findName(pageParamNames, param.Name) {
+			pageParam = param.Name
+		} else if len(limitParam) == 0 && findName(limitParamNames, param.Name) {
+			limitParam = param.Name
+		}
+	}
+
+	response, schema := getResponseSchema(operation)
+	itemsPath, isList := getItemsPath(schema)
+	if !isList {
+		return nil
+	}
+
+	if len(cursorParam) > 0 {
+		if cursorPath := getCursorPath(schema, cursorFieldNames); len(cursorPath) > 0 {
+			return &ActionPagination{
+				Type:        "cursor",
+				ItemsPath:   itemsPath,
+				CursorParam: cursorParam,
+				CursorPath:  cursorPath,
+				LimitParam:  limitParam,
+			}
+		}
+	}
+
+	if nextPath := getCursorPath(schema, nextUrlFieldNames); len(nextPath) > 0 {
+		return &ActionPagination{
+			Type:       "cursor",
+			ItemsPath:  itemsPath,
+			CursorPath: nextPath,
+			LimitParam: limitParam,
+		}
+	}
+
+	if response != nil {
+		for header := range response.Headers {
+			if strings.ToLower(header) == "link" {
+				return &ActionPagination{
+					Type:       "link",
+					ItemsPath:  itemsPath,
+					LimitParam: limitParam,
+				}
+			}
+		}
+	}
+
+	if len(pageParam) > 0 {
+		return &ActionPagination{
+			Type:       "page",
+			ItemsPath:  itemsPath,
+			PageParam:  pageParam,
+			LimitParam: limitParam,
+		}
+	}
+
+	return nil
+}
+
+// The max items argument of a paginated action
+func getMaxItemsParameter(pagination *ActionPagination, used map[string]bool) generatedParameter {
+	maxItems := pagination.MaxItems
+	if maxItems <= 0 {
+		maxItems = defaultMaxItems
+	}
+
+	name := getPythonName("max_items", used)
+	return generatedParameter{
+		Name:     name,
+		Key:      "max_items",
+		In:       "maxitems",
+		Required: false,
+		Parameter: WorkflowAppActionParameter{
+			Name:        name,
+			Description: fmt.Sprintf("The most items to get by following the pages (%s). Defaults to %d. 0 returns the first page as is", pagination.Type, maxItems),
+			Example:     fmt.Sprintf("%d", maxItems),
+			Required:    false,
+			Schema: SchemaDefinition{
+				Type: "integer",
+			},
+		},
+	}
+}
+
+// The pagination for the paginate() helper in the generated app, as a python dict
+func makePythonPagination(pagination *ActionPagination) string {
+	generated := *pagination
+	if generated.MaxItems <= 0 {
+		generated.MaxItems = defaultMaxItems
+	}
+
+	if generated.Type == "page" && generated.StartPage == nil {
+		startPage := 1
+		generated.StartPage = &startPage
+	}
+
+	// Only strings and numbers, so the JSON is a valid python dict
+	data, _ := json.Marshal(generated)
+	return string(data)
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// The generated tests run without the app SDK and without network access.
+// requests.request is replaced, and every test checks the request an action
+// sends when it's called with the example values.
+const pytestConftest = `import json
+import os
+import sys
+import types
+
+import pytest
+
+sdk = types.ModuleType("walkoff_app_sdk")
+app_base = types.ModuleType("walkoff_app_sdk.app_base")
+
+
+class AppBase:
+    def __init__(self, redis, logger, console_logger=None):
+        self.redis = redis
+        self.logger = logger
+        self.console_logger = console_logger
+
+    @classmethod
+    async def run(cls):
+        pass
+
+
+app_base.AppBase = AppBase
+sdk.app_base = app_base
+sys.modules["walkoff_app_sdk"] = sdk
+sys.modules["walkoff_app_sdk.app_base"] = app_base
+sys.path.insert(0, os.path.join(os.path.dirname(os.path.abspath(__file__)), "..", "src"))
+
+import app as generated_app  # noqa: E402
+
+
+class FakeResponse:
+    status_code = 200
+    ok = True
+    url = ""
+
+    def __init__(self, text='{"success": true}', links=None):
+        self.text = text
+        self.links = links or {}
+
+    def json(self):
+        return json.loads(self.text)
+
+
+@pytest.fixture
+def app(monkeypatch):
+    instance = generated_app.%s(None, None)
+    monkeypatch.setattr(instance, "get_oauth2_token", lambda *args: "token")
+    return instance
+
+
+@pytest.fixture
+def responses():
+    return []
+
+
+@pytest.fixture
+def sent_requests(monkeypatch, responses):
+    calls = []
+
+    def request(method, url, **kwargs):
+        calls.append(dict(kwargs, method=method, url=url))
+        if responses:
+            return FakeResponse(**responses.pop(0))
+
+        return FakeResponse()
+
+    monkeypatch.setattr(generated_app.requests, "request", request)
+    return calls
+`
+
+func makePythonConftest(name string) string {
+	return fmt.Sprintf(pytestConftest, getPythonName(name, map[string]bool{}))
+}
+
+func getTestValue(param generatedParameter) string {
+	if len(param.Parameter.Example) > 0 {
+		return param.Parameter.Example
+	}
+
+	return "test"
+}
+
+func getTestArgument(param generatedParameter) string {
+	return fmt.Sprintf("args[%s]", getPythonString(param.Name))
+}
+
+// Checks that the authentication is applied. With more than one scheme the
+// last one wins, so it's only checked for a single scheme.
+func makePythonSecurityTest(security generatedSecurity) string {
+	switch security.Type {
+	case "apikey":
+		target := map[string]string{
+			"header": "headers",
+			"query":  "params",
+			"cookie": "cookies",
+		}[security.In]
+
+		return fmt.Sprintf("    assert request[%s][%s] == %s\n", getPythonString(target), getPythonString(security.Key), getTestArgument(security.Fields[0]))
+	case "bearer":
+		return fmt.Sprintf("    assert request[\"headers\"][\"Authorization\"] == \"Bearer \" + %s\n", getTestArgument(security.Fields[0]))
+	case "basic":
+		return fmt.Sprintf("    assert request[\"auth\"] == (%s, %s)\n", getTestArgument(security.Fields[0]), getTestArgument(security.Fields[1]))
+	case "oauth2":
+		return "    assert request[\"headers\"][\"Authorization\"] == \"Bearer token\"\n"
+	}
+
+	return ""
+}
+
+// Makes the pytest file for a single action
+func makePythonTest(action generatedAction) string {
+	// The url is checked with the same quoting as the generated code
+	urlParameters := []generatedParameter{}
+	for _, param := range action.Parameters {
+		param.Name = fmt.Sprintf("args['%s']", param.Name)
+		urlParameters = append(urlParameters, param)
+	}
+
+	url := getPythonUrl(action.Url, urlParameters)
+
+	code := "import asyncio\nimport json\n"
+	if strings.Contains(url, "quote(") {
+		code += "from urllib.parse import quote\n"
+	}
+
+	code += fmt.Sprintf("\n\ndef test_%s(app, sent_requests):\n", action.Name)
+
+	fields := append([]generatedParameter{}, action.AuthFields...)
+	fields = append(fields, action.Parameters...)
+
+	code += "    args = {\n"
+	for _, param := range fields {
+		code += fmt.Sprintf("        %s: %s,\n", getPythonString(param.Name), getPythonString(getTestValue(param)))
+	}
+	code += "    }\n\n"
+
+	code += fmt.Sprintf("    ret = asyncio.run(app.%s(**args))\n\n", action.Name)
+	code += "    assert len(sent_requests) == 1\n"
+	code += "    request = sent_requests[0]\n"
+	code += fmt.Sprintf("    assert request[\"method\"] == %s\n", getPythonString(action.Method))
+
+	code += fmt.Sprintf("    assert request[\"url\"] == f\"%s\"\n", url)
+
+	for _, param := range action.Parameters {
+		argument := getTestArgument(param)
+		switch param.In {
+		case "query":
+			code += fmt.Sprintf("    assert request[\"params\"][%s] == %s\n", getPythonString(param.Key), argument)
+		case "header":
+			code += fmt.Sprintf("    assert request[\"headers\"][%s] == %s\n", getPythonString(param.Key), argument)
+		case "cookie":
+			code += fmt.Sprintf("    assert request[\"cookies\"][%s] == %s\n", getPythonString(param.Key), argument)
+		case "body":
+			switch action.BodyMode {
+			case "json":
+				code += fmt.Sprintf("    assert request[\"json\"][%s] == app.parse_value(%s)\n", getPythonString(param.Key), argument)
+			case "multipart":
+				code += fmt.Sprintf("    assert request[\"files\"][%s] == (None, %s)\n", getPythonString(param.Key), argument)
+			default:
+				code += fmt.Sprintf("    assert request[\"data\"][%s] == app.parse_value(%s)\n", getPythonString(param.Key), argument)
+			}
+		case "rawbody":
+			code += fmt.Sprintf("    assert request[\"data\"] == %s\n", argument)
+			code += fmt.Sprintf("    assert request[\"headers\"][\"Content-Type\"] == %s\n", getPythonString(param.Key))
+		}
+	}
+
+	if len(action.Securities) == 1 {
+		code += makePythonSecurityTest(action.Securities[0])
+	}
+
+	code += "\n    result = json.loads(ret)\n"
+	code += "    assert result[\"success\"]\n"
+	code += "    assert result[\"status\"] == 200\n"
+
+	if action.Pagination != nil {
+		code += makePythonPaginationTest(action)
+	}
+
+	return code
+}
+
+// Puts a value at a dotted path in a response body
+func setTestPath(body map[string]interface{}, path string, value interface{}) {
+	keys := strings.Split(path, ".")
+	for _, key := range keys[:len(keys)-1] {
+		child, ok := body[key].(map[string]interface{})
+		if !ok {
+			child = map[string]interface{}{}
+			body[key] = child
+		}
+
+		body = child
+	}
+
+	body[keys[len(keys)-1]] = value
+}
+
+// A fake response with the items (and next cursor) at the paths of the pagination
+func getTestPage(pagination *ActionPagination, items []int, cursor string) string {
+	var body interface{} = items
+	if len(pagination.ItemsPath) > 0 || (pagination.Type == "cursor" && len(cursor) > 0) {
+		page := map[string]interface{}{}
+		if len(pagination.ItemsPath) > 0 {
+			setTestPath(page, pagination.ItemsPath, items)
+		}
+
+		if pagination.Type == "cursor" && len(cursor) > 0 {
+			setTestPath(page, pagination.CursorPath, cursor)
+		}
+
+		body = page
+	}
+
+	data, _ := json.Marshal(body)
+	return string(data)
+}
+
+// Checks that the pages are followed until the last one, and that the
+// items of every page are returned
+func makePythonPaginationTest(action generatedAction) string {
+	// The cursor can't be in the body if the body is the list of items
+	pagination := action.Pagination
+	if pagination.Type == "cursor" && len(pagination.ItemsPath) == 0 {
+		return ""
+	}
+
+	code := fmt.Sprintf("\n\ndef test_%s_pagination(app, sent_requests, responses):\n", action.Name)
+	code += "    args = {\n"
+
+	fields := append([]generatedParameter{}, action.AuthFields...)
+	fields = append(fields, action.Parameters...)
+	for _, param := range fields {
+		value := getTestValue(param)
+		if param.In == "query" && (param.Key == pagination.CursorParam || param.Key == pagination.PageParam || param.Key == pagination.LimitParam) {
+			value = ""
+		}
+
+		code += fmt.Sprintf("        %s: %s,\n", getPythonString(param.Name), getPythonString(value))
+	}
+	code += "    }\n\n"
+
+	pages := []string{}
+	expectedRequests := 2
+	switch pagination.Type {
+	case "cursor":
+		nextCursor := "next"
+		if len(pagination.CursorParam) == 0 {
+			nextCursor = "https://next.page/2"
+		}
+
+		pages = append(pages, fmt.Sprintf("{\"text\": %s}", getPythonString(getTestPage(pagination, []int{1}, nextCursor))))
+		pages = append(pages, fmt.Sprintf("{\"text\": %s}", getPythonString(getTestPage(pagination, []int{2}, ""))))
+	case "page":
+		pages = append(pages, fmt.Sprintf("{\"text\": %s}", getPythonString(getTestPage(pagination, []int{1}, ""))))
+		pages = append(pages, fmt.Sprintf("{\"text\": %s}", getPythonString(getTestPage(pagination, []int{2}, ""))))
+		pages = append(pages, fmt.Sprintf("{\"text\": %s}", getPythonString(getTestPage(pagination, []int{}, ""))))
+		expectedRequests = 3
+	case "link":
+		pages = append(pages, fmt.Sprintf("{\"text\": %s, \"links\": {\"next\": {\"url\": \"https://next.page/2\"}}}", getPythonString(getTestPage(pagination, []int{1}, ""))))
+		pages = append(pages, fmt.Sprintf("{\"text\": %s}", getPythonString(getTestPage(pagination, []int{2}, ""))))
+	}
+
+	code += fmt.Sprintf("    responses.extend([\n        %s,\n    ])\n", strings.Join(pages, ",\n        "))
+	code += fmt.Sprintf("    ret = asyncio.run(app.%s(**args))\n\n", action.Name)
+	code += fmt.Sprintf("    assert len(sent_requests) == %d\n", expectedRequests)
+
+	switch pagination.Type {
+	case "cursor":
+		if len(pagination.CursorParam) > 0 {
+			code += fmt.Sprintf("    assert sent_requests[1][\"params\"][%s] == \"next\"\n", getPythonString(pagination.CursorParam))
+		} else {
+			code += "    assert sent_requests[1][\"url\"] == \"https://next.page/2\"\n"
+		}
+	case "page":
+		code += fmt.Sprintf("    assert int(sent_requests[1][\"params\"][%s]) == int(sent_requests[0][\"params\"][%s]) + 1\n", getPythonString(pagination.PageParam), getPythonString(pagination.PageParam))
+	case "link":
+		code += "    assert sent_requests[1][\"url\"] == \"https://next.page/2\"\n"
+	}
+
+	code += "\n    result = json.loads(ret)\n"
+	code += "    assert result[\"success\"]\n"
+	code += "    assert result[\"body\"] == [1, 2]\n"
+
+	return code
+}
@@ -0,0 +1,709 @@
+package main
+
+// App image builds go through a queue with a bounded number of workers, so
+// hotloads and uploads at the same time don't overload the Docker daemon.
+// Builds of the same tags from the same build context (the tar made by
+// getParsedTar/getParsedTarMemory) share one build, and the images of earlier
+// identical builds are retagged by their image ID instead of rebuilt. The status and logs of
+// every build are stored in the app_builds index, with the org the app is
+// built for. Builds without an org are of the backend's own app folders.
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	uuid "github.com/satori/go.uuid"
+	"github.com/shuffle/shuffle-shared"
+)
+
+// The last part of the logs is kept
+const maxAppBuildLogSize = 1024 * 1024
+
+// How often the logs of a running build are stored
+const appBuildSaveInterval = 5 * time.Second
+
+const maxAppBuildQueue = 1000
+
+// A build of an app image. Name and AppVersion are read from the tags.
+type appBuild struct {
+	Id          string   `json:"id"`
+	Name        string   `json:"name"`
+	AppVersion  string   `json:"app_version"`
+	Tags        []string `json:"tags"`
+	Location    string   `json:"location"`
+	OrgId       string   `json:"org_id"`
+	ContextHash string   `json:"context_hash"`
+	Status      string   `json:"status"`
+	CachedFrom  string   `json:"cached_from,omitempty"`
+	ImageId     string   `json:"image_id,omitempty"`
+	Error       string   `json:"error,omitempty"`
+	Logs        string   `json:"logs"`
+	Created     int64    `json:"created"`
+	Started     int64    `json:"started,omitempty"`
+	Finished    int64    `json:"finished,omitempty"`
+}
+
+type appBuildJob struct {
+	Build appBuild
+
+	lock      sync.Mutex
+	ctx       context.Context
+	cancel    context.CancelFunc
+	run       func(ctx context.Context, job *appBuildJob) error
+	done      chan bool
+	doneOnce  sync.Once
+	err       error
+	lastSaved time.Time
+}
+
+// Queued and running builds by ID
+var appBuildJobs = map[string]*appBuildJob{}
+var appBuildJobsLock sync.Mutex
+
+var appBuildQueue = make(chan *appBuildJob, maxAppBuildQueue)
+var appBuildWorkersOnce sync.Once
+
+// Builds are finished when their status is one of these
+var finishedAppBuildStatuses = []string{"success", "failed", "cancelled"}
+
+func getAppBuildWorkers() int {
+	workers, err := strconv.Atoi(os.Getenv("SHUFFLE_APP_BUILD_WORKERS"))
+	if err != nil || workers <= 0 {
+		return 2
+	}
+
+	return workers
+}
+
+func startAppBuildWorkers() {
+	appBuildWorkersOnce.Do(func() {
+		workers := getAppBuildWorkers()
+		log.Printf("[INFO] Starting %d app build workers", workers)
+		for i := 0; i < workers; i++ {
+			go runAppBuildWorker()
+		}
+	})
+}
+
+func getAppBuildContextHash(buildContext []byte) string {
+	if len(buildContext) == 0 {
+		return ""
+	}
+
+	hash := sha256.Sum256(buildContext)
+	return hex.EncodeToString(hash[:])
+}
+
+// Reads the app name and version from a <name>_<version> tag
+func getAppBuildVersion(tags []string) (string, string) {
+	for _, tag := range tags {
+		tagName := tag[strings.LastIndex(tag, ":")+1:]
+		versionIndex := strings.LastIndex(tagName, "_")
+		if versionIndex > 0 && versionIndex < len(tagName)-1 {
+			return tagName[:versionIndex], tagName[versionIndex+1:]
+		}
+	}
+
+	return "", ""
+}
+
+func isSameAppBuildTags(tags, otherTags []string) bool {
+	if len(tags) != len(otherTags) {
+		return false
+	}
+
+	sortedTags := append([]string{}, tags...)
+	sortedOtherTags := append([]string{}, otherTags...)
+	sort.Strings(sortedTags)
+	sort.Strings(sortedOtherTags)
+	for i := range sortedTags {
+		if sortedTags[i] != sortedOtherTags[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func isFinishedAppBuild(status string) bool {
+	for _, item := range finishedAppBuildStatuses {
+		if item == status {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (job *appBuildJob) getBuild() appBuild {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+
+	return job.Build
+}
+
+// Stores the build. Running builds are only stored every appBuildSaveInterval,
+// unless force is set.
+func (job *appBuildJob) save(force bool) {
+	job.lock.Lock()
+	if !force && time.Since(job.lastSaved) < appBuildSaveInterval {
+		job.lock.Unlock()
+		return
+	}
+
+	job.lastSaved = time.Now()
+	build := job.Build
+	job.lock.Unlock()
+
+	err := setEsDocument(context.Background(), "app_builds", build.Id, build)
+	if err != nil {
+		log.Printf("[WARNING] Failed storing app build %s: %s", build.Id, err)
+	}
+}
+
+func (job *appBuildJob) appendLog(data string) {
+	if len(data) == 0 {
+		return
+	}
+
+	job.lock.Lock()
+	job.Build.Logs += data
+	if len(job.Build.Logs) > maxAppBuildLogSize {
+		job.Build.Logs = job.Build.Logs[len(job.Build.Logs)-maxAppBuildLogSize:]
+	}
+	job.lock.Unlock()
+
+	job.save(false)
+}
+
+func (job *appBuildJob) finish(err error) {
+	job.doneOnce.Do(func() {
+		job.lock.Lock()
+		job.Build.Finished = time.Now().Unix()
+		if err == nil {
+			job.Build.Status = "success"
+		} else if job.ctx.Err() == context.Canceled {
+			job.Build.Status = "cancelled"
+			job.Build.Error = "The build was cancelled"
+			err = errors.New(fmt.Sprintf("The build of %s was cancelled", strings.Join(job.Build.Tags, ", ")))
+		} else {
+			job.Build.Status = "failed"
+			job.Build.Error = err.Error()
+		}
+		job.err = err
+		job.lock.Unlock()
+
+		job.save(true)
+		job.cancel()
+
+		appBuildJobsLock.Lock()
+		delete(appBuildJobs, job.Build.Id)
+		appBuildJobsLock.Unlock()
+
+		close(job.done)
+	})
+}
+
+// Waits for the build to finish
+func (job *appBuildJob) wait() error {
+	<-job.done
+	return job.err
+}
+
+// Queues a build. If the same tags are already being built from the same
+// build context for the same org, that build is returned instead.
+func queueAppBuild(tags []string, location, orgId string, buildContext []byte, run func(ctx context.Context, job *appBuildJob) error) *appBuildJob {
+	startAppBuildWorkers()
+
+	contextHash := getAppBuildContextHash(buildContext)
+	appBuildJobsLock.Lock()
+	if len(contextHash) > 0 {
+		for _, job := range appBuildJobs {
+			if job.Build.ContextHash == contextHash && job.Build.OrgId == orgId && isSameAppBuildTags(job.Build.Tags, tags) {
+				appBuildJobsLock.Unlock()
+				log.Printf("[INFO] Build of %s is already queued as %s", strings.Join(tags, ", "), job.Build.Id)
+				return job
+			}
+		}
+	}
+
+	name, appVersion := getAppBuildVersion(tags)
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &appBuildJob{
+		Build: appBuild{
+			Id:          uuid.NewV4().String(),
+			Name:        name,
+			AppVersion:  appVersion,
+			Tags:        tags,
+			Location:    location,
+			OrgId:       orgId,
+			ContextHash: contextHash,
+			Status:      "queued",
+			Created:     time.Now().Unix(),
+		},
+		ctx:    ctx,
+		cancel: cancel,
+		run:    run,
+		done:   make(chan bool),
+	}
+
+	appBuildJobs[job.Build.Id] = job
+	appBuildJobsLock.Unlock()
+
+	job.save(true)
+
+	select {
+	case appBuildQueue <- job:
+		log.Printf("[INFO] Queued build %s of %s", job.Build.Id, strings.Join(tags, ", "))
+	default:
+		job.finish(errors.New("The app build queue is full. Try again later"))
+	}
+
+	return job
+}
+
+func runAppBuildWorker() {
+	for job := range appBuildQueue {
+		job.lock.Lock()
+		if isFinishedAppBuild(job.Build.Status) {
+			job.lock.Unlock()
+			continue
+		}
+
+		job.Build.Status = "running"
+		job.Build.Started = time.Now().Unix()
+		job.lock.Unlock()
+		job.save(true)
+
+		log.Printf("[INFO] Starting build %s of %s", job.Build.Id, strings.Join(job.Build.Tags, ", "))
+		err := job.run(job.ctx, job)
+		if err != nil {
+			log.Printf("[WARNING] Build %s of %s failed: %s", job.Build.Id, strings.Join(job.Build.Tags, ", "), err)
+		} else {
+			log.Printf("[INFO] Build %s of %s succeeded", job.Build.Id, strings.Join(job.Build.Tags, ", "))
+		}
+
+		job.finish(err)
+	}
+}
+
+func cancelAppBuild(id string, user shuffle.User) (appBuild, error) {
+	appBuildJobsLock.Lock()
+	job, ok := appBuildJobs[id]
+	appBuildJobsLock.Unlock()
+	if !ok || !canSeeAppBuild(job.getBuild(), user) {
+		return appBuild{}, errors.New("The build isn't queued or running")
+	}
+
+	log.Printf("[INFO] Cancelling build %s of %s", id, strings.Join(job.Build.Tags, ", "))
+	job.cancel()
+
+	// Running builds finish when the build stops
+	if job.getBuild().Status == "queued" {
+		job.finish(context.Canceled)
+	}
+
+	return job.getBuild(), nil
+}
+
+// Builds of the user's org. The ones of the backend's own app folders have
+// no org, and are only for instance admins (support access).
+func canSeeAppBuild(build appBuild, user shuffle.User) bool {
+	if len(build.OrgId) == 0 {
+		return user.SupportAccess
+	}
+
+	return build.OrgId == user.ActiveOrg.Id
+}
+
+// Gets a build the user can see
+func getAppBuild(ctx context.Context, id string, user shuffle.User) (appBuild, error) {
+	appBuildJobsLock.Lock()
+	job, ok := appBuildJobs[id]
+	appBuildJobsLock.Unlock()
+
+	build := appBuild{}
+	if ok {
+		build = job.getBuild()
+	} else {
+		document, err := getEsDocument(ctx, "app_builds", id)
+		if err != nil {
+			return build, err
+		}
+
+		err = json.Unmarshal(document.Source, &build)
+		if err != nil {
+			return build, err
+		}
+	}
+
+	if !canSeeAppBuild(build, user) {
+		return appBuild{}, errEsNotFound
+	}
+
+	return build, nil
+}
+
+// The builds the user can see, newest first. Empty filters match everything.
+func getAppBuilds(ctx context.Context, user shuffle.User, name, appVersion, status string) ([]appBuild, error) {
+	filters := []map[string]interface{}{}
+	for field, value := range map[string]string{"name": name, "app_version": appVersion, "status": status} {
+		if len(value) > 0 {
+			filters = append(filters, map[string]interface{}{
+				"term": map[string]interface{}{
+					fmt.Sprintf("%s.keyword", field): value,
+				},
+			})
+		}
+	}
+
+	query := map[string]interface{}{
+		"bool": map[string]interface{}{
+			"filter": filters,
+		},
+	}
+
+	builds := []appBuild{}
+	documents, err := searchEsDocuments(ctx, "app_builds", query, 10000)
+	if err != nil {
+		return builds, err
+	}
+
+	for _, document := range documents {
+		build := appBuild{}
+		err = json.Unmarshal(document.Source, &build)
+		if err != nil {
+			log.Printf("[WARNING] Failed unmarshalling app build %s: %s", document.Id, err)
+			continue
+		}
+
+		if !canSeeAppBuild(build, user) {
+			continue
+		}
+
+		// Running builds are more up to date in memory
+		appBuildJobsLock.Lock()
+		job, ok := appBuildJobs[build.Id]
+		appBuildJobsLock.Unlock()
+		if ok {
+			build = job.getBuild()
+		}
+
+		builds = append(builds, build)
+	}
+
+	sort.Slice(builds, func(i, j int) bool {
+		return builds[i].Created > builds[j].Created
+	})
+
+	return builds, nil
+}
+
+// Retags the image of an earlier successful build of the same build context.
+// The image is found by the ID it was built as, since its tags may have been
+// rebuilt from something else since. Returns false if there isn't one, or if
+// its image is gone.
+func reuseAppBuildImage(ctx context.Context, dockerClient *client.Client, job *appBuildJob) bool {
+	build := job.getBuild()
+	if len(build.ContextHash) == 0 {
+		return false
+	}
+
+	query := map[string]interface{}{
+		"bool": map[string]interface{}{
+			"filter": []map[string]interface{}{
+				map[string]interface{}{"term": map[string]interface{}{"context_hash.keyword": build.ContextHash}},
+				map[string]interface{}{"term": map[string]interface{}{"status.keyword": "success"}},
+			},
+		},
+	}
+
+	documents, err := searchEsDocuments(ctx, "app_builds", query, 100)
+	if err != nil {
+		log.Printf("[WARNING] Failed searching for earlier builds of %s: %s", strings.Join(build.Tags, ", "), err)
+		return false
+	}
+
+	earlierBuilds := []appBuild{}
+	for _, document := range documents {
+		earlierBuild := appBuild{}
+		if json.Unmarshal(document.Source, &earlierBuild) == nil && earlierBuild.Id != build.Id && len(earlierBuild.ImageId) > 0 {
+			earlierBuilds = append(earlierBuilds, earlierBuild)
+		}
+	}
+
+	sort.Slice(earlierBuilds, func(i, j int) bool {
+		return earlierBuilds[i].Finished > earlierBuilds[j].Finished
+	})
+
+	for _, earlierBuild := range earlierBuilds {
+		image := earlierBuild.ImageId
+		_, _, err := dockerClient.ImageInspectWithRaw(ctx, image)
+		if err != nil {
+			continue
+		}
+
+		for _, tag := range build.Tags {
+			err = dockerClient.ImageTag(ctx, image, tag)
+			if err != nil {
+				log.Printf("[WARNING] Failed tagging %s as %s: %s", image, tag, err)
+				return false
+			}
+		}
+
+		job.lock.Lock()
+		job.Build.CachedFrom = earlierBuild.Id
+		job.Build.ImageId = image
+		job.lock.Unlock()
+
+		job.appendLog(fmt.Sprintf("Reused image %s from the identical build %s\n", image, earlierBuild.Id))
+		return true
+	}
+
+	return false
+}
+
+// A message in the output of a docker build
+type dockerBuildMessage struct {
+	Stream      string `json:"stream"`
+	Status      string `json:"status"`
+	Progress    string `json:"progress"`
+	Id          string `json:"id"`
+	Error       string `json:"error"`
+	ErrorDetail struct {
+		Message string `json:"message"`
+	} `json:"errorDetail"`
+}
+
+// Builds an image from a tar with the Docker daemon, and streams the output
+// to the build logs
+func runDockerBuild(ctx context.Context, job *appBuildJob, buildContext []byte) error {
+	dockerClient, err := client.NewEnvClient()
+	if err != nil {
+		log.Printf("Unable to create docker client: %s", err)
+		return err
+	}
+	defer dockerClient.Close()
+
+	if reuseAppBuildImage(ctx, dockerClient, job) {
+		return nil
+	}
+
+	build := job.getBuild()
+	buildOptions := types.ImageBuildOptions{
+		Remove:    true,
+		Tags:      build.Tags,
+		BuildArgs: map[string]*string{},
+		Labels:    map[string]string{},
+	}
+
+	httpProxy := os.Getenv("HTTP_PROXY")
+	if len(httpProxy) > 0 {
+		buildOptions.BuildArgs["HTTP_PROXY"] = &httpProxy
+	}
+	httpsProxy := os.Getenv("HTTPS_PROXY")
+	if len(httpsProxy) > 0 {
+		buildOptions.BuildArgs["HTTPS_PROXY"] = &httpsProxy
+	}
+
+	log.Printf(`[INFO] Building %s with proxy "%s". Tags: "%s". This may take up to a few minutes.`, build.Location, httpsProxy, strings.Join(build.Tags, ","))
+	imageBuildResponse, err := dockerClient.ImageBuild(ctx, bytes.NewReader(buildContext), buildOptions)
+	if err != nil {
+		return err
+	}
+	defer imageBuildResponse.Body.Close()
+
+	decoder := json.NewDecoder(imageBuildResponse.Body)
+	for {
+		message := dockerBuildMessage{}
+		err = decoder.Decode(&message)
+		if err == io.EOF {
+			// What identical builds are retagged from later
+			if len(build.Tags) > 0 {
+				image, _, err := dockerClient.ImageInspectWithRaw(ctx, build.Tags[0])
+				if err != nil {
+					log.Printf("[WARNING] Failed getting the image ID of build %s: %s", build.Id, err)
+					return nil
+				}
+
+				job.lock.Lock()
+				job.Build.ImageId = image.ID
+				job.lock.Unlock()
+			}
+
+			return nil
+		}
+
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			return errors.New(fmt.Sprintf("Failed reading Docker build output: %s", err))
+		}
+
+		if len(message.Error) > 0 {
+			job.appendLog(fmt.Sprintf("%s\n", message.Error))
+			return errors.New(message.Error)
+		}
+
+		if len(message.Stream) > 0 {
+			job.appendLog(message.Stream)
+		} else if len(message.Status) > 0 && len(message.Progress) == 0 {
+			if len(message.Id) > 0 {
+				job.appendLog(fmt.Sprintf("%s: %s\n", message.Id, message.Status))
+			} else {
+				job.appendLog(fmt.Sprintf("%s\n", message.Status))
+			}
+		}
+	}
+}
+
+// Queues a build of a tar with the Docker daemon
+func queueDockerBuild(tags []string, location, orgId string, buildContext []byte) *appBuildJob {
+	return queueAppBuild(tags, location, orgId, buildContext, func(ctx context.Context, job *appBuildJob) error {
+		return runDockerBuild(ctx, job, buildContext)
+	})
+}
+
+// Only admins can see builds, and only the ones canSeeAppBuild allows
+func getAppBuildRequestUser(resp http.ResponseWriter, request *http.Request) (shuffle.User, bool) {
+	user, err := shuffle.HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in app builds: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return user, false
+	}
+
+	if user.Role != "admin" {
+		log.Printf("[WARNING] Not admin during app builds: %s (%s).", user.Username, user.Id)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Must be admin to see app builds"}`))
+		return user, false
+	}
+
+	return user, true
+}
+
+// GET /api/v1/apps/builds?name=<app>&version=<app_version>&status=<status>
+// GET /api/v1/apps/builds/{buildId} (includes the logs)
+func handleGetAppBuilds(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, ok := getAppBuildRequestUser(resp, request)
+	if !ok {
+		return
+	}
+
+	ctx := shuffle.GetContext(request)
+	location := strings.Split(request.URL.Path, "/")
+
+	var result interface{}
+	if len(location) > 5 && len(location[5]) > 0 {
+		build, err := getAppBuild(ctx, location[5], user)
+		if err != nil {
+			resp.WriteHeader(404)
+			resp.Write([]byte(`{"success": false, "reason": "Build doesn't exist"}`))
+			return
+		}
+
+		result = struct {
+			Success bool     `json:"success"`
+			Build   appBuild `json:"build"`
+		}{
+			Success: true,
+			Build:   build,
+		}
+	} else {
+		query := request.URL.Query()
+		builds, err := getAppBuilds(ctx, user, strings.ToLower(query.Get("name")), query.Get("version"), query.Get("status"))
+		if err != nil {
+			log.Printf("[WARNING] Failed getting app builds: %s", err)
+			resp.WriteHeader(500)
+			resp.Write([]byte(`{"success": false, "reason": "Failed getting app builds"}`))
+			return
+		}
+
+		limit, err := strconv.Atoi(query.Get("limit"))
+		if err != nil || limit <= 0 {
+			limit = 50
+		}
+
+		if len(builds) > limit {
+			builds = builds[:limit]
+		}
+
+		// The logs can be big. They're in the single build.
+		for i := range builds {
+			builds[i].Logs = ""
+		}
+
+		result = struct {
+			Success bool       `json:"success"`
+			Builds  []appBuild `json:"builds"`
+		}{
+			Success: true,
+			Builds:  builds,
+		}
+	}
+
+	newjson, err := json.Marshal(result)
+	if err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed marshalling app builds"}`))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write(newjson)
+}
+
+// POST /api/v1/apps/builds/{buildId}/cancel
+func handleCancelAppBuild(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, ok := getAppBuildRequestUser(resp, request)
+	if !ok {
+		return
+	}
+
+	location := strings.Split(request.URL.Path, "/")
+	if len(location) < 7 {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Build ID is missing"}`))
+		return
+	}
+
+	build, err := cancelAppBuild(location[5], user)
+	if err != nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+		return
+	}
+
+	log.Printf("[AUDIT] User %s (%s) cancelled app build %s of %s", user.Username, user.Id, build.Id, strings.Join(build.Tags, ", "))
+	resp.WriteHeader(200)
+	resp.Write([]byte(fmt.Sprintf(`{"success": true, "id": "%s", "status": "%s"}`, build.Id, build.Status)))
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/shuffle/shuffle-shared"
+)
+
+func TestGetAppBuildVersion(t *testing.T) {
+	name, appVersion := getAppBuildVersion([]string{"frikky/shuffle:5c6b0a5e", "frikky/shuffle:my-app_1.0.0"})
+	if name != "my-app" || appVersion != "1.0.0" {
+		t.Errorf("expected my-app 1.0.0, got %s %s", name, appVersion)
+	}
+
+	if name, _ = getAppBuildVersion([]string{"frikky/shuffle:latest"}); name != "" {
+		t.Errorf("expected no app name, got %s", name)
+	}
+}
+
+func TestQueueAppBuild(t *testing.T) {
+	opensearch := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, request *http.Request) {
+		resp.Write([]byte(`{}`))
+	}))
+	defer opensearch.Close()
+	os.Setenv("SHUFFLE_OPENSEARCH_URL", opensearch.URL)
+	defer os.Unsetenv("SHUFFLE_OPENSEARCH_URL")
+
+	release := make(chan bool)
+	run := func(ctx context.Context, job *appBuildJob) error {
+		job.appendLog("building\n")
+		select {
+		case <-release:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	tags := []string{"frikky/shuffle:test_1.0.0"}
+	first := queueAppBuild(tags, "test/1.0.0", "org", []byte("context"), run)
+	duplicate := queueAppBuild(tags, "test/1.0.0", "org", []byte("context"), run)
+	if first != duplicate {
+		t.Errorf("expected the identical build to be shared")
+	}
+
+	other := queueAppBuild(tags, "test/1.0.0", "org", []byte("changed context"), run)
+	if other == first {
+		t.Fatalf("expected a new build for a changed context")
+	}
+
+	user := shuffle.User{ActiveOrg: shuffle.OrgMini{Id: "org"}}
+	if _, err := cancelAppBuild(other.Build.Id, shuffle.User{ActiveOrg: shuffle.OrgMini{Id: "other-org"}}); err == nil {
+		t.Errorf("expected builds of another org to not be cancellable")
+	}
+
+	build, err := cancelAppBuild(other.Build.Id, user)
+	if err != nil {
+		t.Fatalf("failed cancelling: %s", err)
+	}
+
+	if err = other.wait(); err == nil || other.getBuild().Status != "cancelled" {
+		t.Errorf("expected the build to be cancelled, got %s (%s)", other.getBuild().Status, build.Status)
+	}
+
+	close(release)
+	if err = first.wait(); err != nil {
+		t.Fatalf("expected the build to succeed: %s", err)
+	}
+
+	build = first.getBuild()
+	if build.Status != "success" || build.Name != "test" || build.AppVersion != "1.0.0" || build.Logs != "building\n" {
+		t.Errorf("unexpected build: %#v", build)
+	}
+
+	if _, err = cancelAppBuild(first.Build.Id, user); err == nil {
+		t.Errorf("expected finished builds to not be cancellable")
+	}
+}
+
+func TestGetAppBuildsByOrg(t *testing.T) {
+	documents := startFakeOpensearch(t)
+	for _, build := range []appBuild{
+		{Id: "own", OrgId: "org", Created: 1},
+		{Id: "hotloaded", Created: 2},
+		{Id: "foreign", OrgId: "other-org", Created: 3},
+	} {
+		documents["app_builds/"+build.Id], _ = json.Marshal(build)
+	}
+
+	ctx := context.Background()
+	user := shuffle.User{ActiveOrg: shuffle.OrgMini{Id: "org"}}
+	builds, err := getAppBuilds(ctx, user, "", "", "")
+	if err != nil {
+		t.Fatalf("failed getting builds: %s", err)
+	}
+
+	if len(builds) != 1 || builds[0].Id != "own" {
+		t.Errorf("expected only the org's builds, got %#v", builds)
+	}
+
+	if _, err = getAppBuild(ctx, "foreign", user); err == nil {
+		t.Errorf("expected the build of another org to not be found")
+	}
+
+	if _, err = getAppBuild(ctx, "hotloaded", user); err == nil {
+		t.Errorf("expected the backend's own build to not be found without support access")
+	}
+
+	if build, err := getAppBuild(ctx, "own", user); err != nil || build.Id != "own" {
+		t.Errorf("expected the org's build, got %#v (%v)", build, err)
+	}
+
+	user.SupportAccess = true
+	builds, _ = getAppBuilds(ctx, user, "", "", "")
+	if len(builds) != 2 || builds[0].Id != "hotloaded" || builds[1].Id != "own" {
+		t.Errorf("expected the org's and the backend's own builds with support access, got %#v", builds)
+	}
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/shuffle/shuffle-shared"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	gyaml "github.com/ghodss/yaml"
+	"github.com/go-git/go-billy/v5"
+)
+
+// Bumped whenever the bundle layout changes in a way importers have to know about
+const appBundleFormatVersion = 1
+
+// Sources larger than this aren't stored, and have to be exported from the image
+const maxAppSourceSize = 10 << 20
+
+// The files an app was built from, relative to the app folder
+// (api.yaml, Dockerfile, requirements.txt, src/app.py, ...)
+type appSource struct {
+	AppId      string            `json:"app_id"`
+	Name       string            `json:"name"`
+	AppVersion string            `json:"app_version"`
+	Hash       string            `json:"hash"`
+	Origin     string            `json:"origin"`
+	Files      map[string][]byte `json:"files"`
+	Created    int64             `json:"created"`
+}
+
+// Written as shuffle-bundle.json in the root of every exported bundle
+type appBundleManifest struct {
+	Format        string   `json:"format"`
+	FormatVersion int      `json:"format_version"`
+	Id            string   `json:"id"`
+	Name          string   `json:"name"`
+	AppVersion    string   `json:"app_version"`
+	Hash          string   `json:"hash"`
+	Origin        string   `json:"origin"`
+	Partial       bool     `json:"partial"`
+	Folder        string   `json:"folder"`
+	Files         []string `json:"files"`
+	Image         string   `json:"image"`
+	ImageFile     string   `json:"image_file,omitempty"`
+	Exported      int64    `json:"exported"`
+}
+
+func getAppSource(ctx context.Context, appId string) (appSource, error) {
+	source := appSource{}
+	document, err := getEsDocument(ctx, "app_sources", appId)
+	if err != nil {
+		return source, err
+	}
+
+	err = json.Unmarshal(document.Source, &source)
+	return source, err
+}
+
+func deleteAppSource(ctx context.Context, appId string) error {
+	err := deleteEsDocument(ctx, "app_sources", appId)
+	if err == errEsNotFound {
+		return nil
+	}
+
+	return err
+}
+
+// Reads every file in an app folder, keyed by the path inside the folder
+func getAppFolderFiles(fs billy.Filesystem, baseDir, extra string, files map[string][]byte) error {
+	dir, err := fs.ReadDir(fmt.Sprintf("%s%s", baseDir, extra))
+	if err != nil {
+		return err
+	}
+
+	for _, file := range dir {
+		filename := fmt.Sprintf("%s%s", extra, file.Name())
+		switch mode := file.Mode(); {
+		case mode.IsDir():
+			err = getAppFolderFiles(fs, baseDir, fmt.Sprintf("%s/", filename), files)
+			if err != nil {
+				return err
+			}
+		case mode.IsRegular():
+			fileReader, err := fs.Open(fmt.Sprintf("%s%s", baseDir, filename))
+			if err != nil {
+				return err
+			}
+
+			data, err := ioutil.ReadAll(fileReader)
+			fileReader.Close()
+			if err != nil {
+				return err
+			}
+
+			files[filename] = data
+		}
+	}
+
+	return nil
+}
+
+// Stores the source of an app so it can be exported later. The origin is
+// where it came from, e.g. "folder" for app folders or "upload" for zips.
+func setAppSource(ctx context.Context, workflowapp shuffle.WorkflowApp, fs billy.Filesystem, baseDir, origin string) error {
+	files := map[string][]byte{}
+	err := getAppFolderFiles(fs, baseDir, "", files)
+	if err != nil {
+		return err
+	}
+
+	totalSize := 0
+	for _, data := range files {
+		totalSize += len(data)
+	}
+
+	if totalSize > maxAppSourceSize {
+		return fmt.Errorf("Source of %s:%s is %d bytes, which is more than the max of %d", workflowapp.Name, workflowapp.AppVersion, totalSize, maxAppSourceSize)
+	}
+
+	source := appSource{
+		AppId:      workflowapp.ID,
+		Name:       workflowapp.Name,
+		AppVersion: workflowapp.AppVersion,
+		Hash:       workflowapp.Hash,
+		Origin:     origin,
+		Files:      files,
+		Created:    time.Now().Unix(),
+	}
+
+	return setEsDocument(ctx, "app_sources", workflowapp.ID, source)
+}
+
+func getAppImageName(workflowapp shuffle.WorkflowApp) string {
+	newName := strings.ToLower(strings.ReplaceAll(workflowapp.Name, " ", "-"))
+	return fmt.Sprintf("%s:%s_%s", baseDockerName, newName, workflowapp.AppVersion)
+}
+
+// Same layout as the apps in the shuffle-apps repository
+var defaultAppDockerfile = `FROM frikky/shuffle:app_sdk as base
+FROM base as builder
+
+RUN apk --no-cache add --update alpine-sdk libffi libffi-dev musl-dev openssl-dev
+
+RUN mkdir /install
+WORKDIR /install
+COPY requirements.txt /requirements.txt
+RUN pip3 install --prefix="/install" -r /requirements.txt
+
+FROM base
+COPY --from=builder /install /usr/local
+COPY src /app
+
+WORKDIR /app
+CMD ["python", "app.py", "--log-level", "DEBUG"]
+`
+
+// Fallback for apps without a stored source. The code is copied out of the
+// image, while api.yaml and the Dockerfile are regenerated. Requirements are
+// installed in a separate build stage, so they can't be recovered.
+func getAppSourceFromImage(ctx context.Context, workflowapp shuffle.WorkflowApp) (appSource, error) {
+	source := appSource{
+		AppId:      workflowapp.ID,
+		Name:       workflowapp.Name,
+		AppVersion: workflowapp.AppVersion,
+		Hash:       workflowapp.Hash,
+		Origin:     "image",
+		Files:      map[string][]byte{},
+	}
+
+	dockercli, err := client.NewEnvClient()
+	if err != nil {
+		return source, err
+	}
+	defer dockercli.Close()
+
+	config := &container.Config{
+		Image:      getAppImageName(workflowapp),
+		Entrypoint: []string{"true"},
+	}
+
+	created, err := dockercli.ContainerCreate(ctx, config, nil, nil, nil, "")
+	if err != nil {
+		return source, err
+	}
+
+	defer func() {
+		err := dockercli.ContainerRemove(context.Background(), created.ID, types.ContainerRemoveOptions{Force: true})
+		if err != nil {
+			log.Printf("[WARNING] Failed removing export container %s: %s", created.ID, err)
+		}
+	}()
+
+	reader, _, err := dockercli.CopyFromContainer(ctx, created.ID, "/app")
+	if err != nil {
+		return source, err
+	}
+	defer reader.Close()
+
+	totalSize := 0
+	tarReader := tar.NewReader(reader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return source, err
+		}
+
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		// Everything is inside app/ in the archive
+		filename := strings.TrimPrefix(path.Clean(header.Name), "app/")
+		if strings.Contains(filename, "__pycache__") || strings.HasPrefix(filename, "..") {
+			continue
+		}
+
+		totalSize += int(header.Size)
+		if totalSize > maxAppSourceSize {
+			return source, fmt.Errorf("Source in image is larger than %d bytes", maxAppSourceSize)
+		}
+
+		data, err := ioutil.ReadAll(tarReader)
+		if err != nil {
+			return source, err
+		}
+
+		source.Files[fmt.Sprintf("src/%s", filename)] = data
+	}
+
+	if _, ok := source.Files["src/app.py"]; !ok {
+		return source, fmt.Errorf("No src/app.py found in image %s", config.Image)
+	}
+
+	// Runtime and ownership fields don't belong in api.yaml
+	exportApp := workflowapp
+	exportApp.ID = ""
+	exportApp.Owner = ""
+	exportApp.ReferenceOrg = ""
+	exportApp.PrivateID = ""
+	exportApp.Hash = ""
+	exportApp.Documentation = ""
+	apiYaml, err := gyaml.Marshal(exportApp)
+	if err != nil {
+		return source, err
+	}
+
+	source.Files["api.yaml"] = apiYaml
+	source.Files["Dockerfile"] = []byte(defaultAppDockerfile)
+	source.Files["requirements.txt"] = []byte{}
+	if len(workflowapp.Documentation) > 0 {
+		source.Files["README.md"] = []byte(workflowapp.Documentation)
+	}
+
+	return source, nil
+}
+
+// Exports an app as a zip in the same layout IterateAppGithubFolders
+// and the zip upload consume:
+//
+//	shuffle-bundle.json
+//	<name>/<version>/api.yaml, Dockerfile, requirements.txt, src/...
+//	images/<name>_<version>.tar (docker save, with ?include_image=true)
+func handleAppExport(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := shuffle.HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in app export: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	location := strings.Split(request.URL.Path, "/")
+	var appId string
+	if location[1] == "api" {
+		if len(location) <= 5 {
+			resp.WriteHeader(401)
+			resp.Write([]byte(`{"success": false}`))
+			return
+		}
+
+		appId = location[4]
+	}
+
+	ctx := shuffle.GetContext(request)
+	app, err := shuffle.GetApp(ctx, appId, user, false)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting app %s for export: %s", appId, err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "App doesn't exist"}`))
+		return
+	}
+
+	// Private apps are only exported within the org they belong to, admin or not
+	if user.Id != app.Owner && app.ReferenceOrg != user.ActiveOrg.Id && !app.Sharing && !app.Public {
+		log.Printf("[AUDIT] User %s (%s) tried to export app %s without access", user.Username, user.Id, app.ID)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "You don't have access to this app"}`))
+		return
+	}
+
+	source, err := getAppSource(ctx, app.ID)
+	if err != nil {
+		if err != errEsNotFound {
+			log.Printf("[WARNING] Failed getting stored source for app %s: %s", app.ID, err)
+		}
+
+		source, err = getAppSourceFromImage(ctx, *app)
+		if err != nil {
+			log.Printf("[WARNING] Failed getting source for app %s from its image: %s", app.ID, err)
+			resp.WriteHeader(400)
+			resp.Write([]byte(`{"success": false, "reason": "No source found for this app. Make sure its image exists on this instance."}`))
+			return
+		}
+	}
+
+	folderName := strings.ToLower(strings.ReplaceAll(app.Name, " ", "-"))
+	folder := fmt.Sprintf("%s/%s", folderName, app.AppVersion)
+	filenames := []string{}
+	for filename := range source.Files {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+
+	manifest := appBundleManifest{
+		Format:        "shuffle-app-bundle",
+		FormatVersion: appBundleFormatVersion,
+		Id:            app.ID,
+		Name:          app.Name,
+		AppVersion:    app.AppVersion,
+		Hash:          source.Hash,
+		Origin:        source.Origin,
+		Partial:       source.Origin == "image",
+		Folder:        folder,
+		Files:         filenames,
+		Image:         getAppImageName(*app),
+		Exported:      time.Now().Unix(),
+	}
+
+	// Starting the image export before writing anything,
+	// so a missing image still gives a proper error
+	var imageReader io.ReadCloser
+	if request.URL.Query().Get("include_image") == "true" {
+		dockercli, err := client.NewEnvClient()
+		if err == nil {
+			defer dockercli.Close()
+			imageReader, err = dockercli.ImageSave(ctx, []string{manifest.Image})
+		}
+
+		if err != nil {
+			log.Printf("[WARNING] Failed saving image %s for export: %s", manifest.Image, err)
+			resp.WriteHeader(400)
+			resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Failed exporting image %s"}`, manifest.Image)))
+			return
+		}
+
+		defer imageReader.Close()
+		manifest.ImageFile = fmt.Sprintf("images/%s_%s.tar", folderName, app.AppVersion)
+	}
+
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed creating bundle manifest"}`))
+		return
+	}
+
+	// Sources are small, so the zip is built in memory unless the image is included
+	var output io.Writer = resp
+	buf := new(bytes.Buffer)
+	if imageReader == nil {
+		output = buf
+	}
+
+	zipWriter := zip.NewWriter(output)
+	resp.Header().Set("Content-Type", "application/zip")
+	resp.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s_%s.zip"`, folderName, app.AppVersion))
+	if imageReader != nil {
+		resp.WriteHeader(200)
+	}
+
+	err = writeAppBundle(zipWriter, manifestData, folder, source.Files, filenames)
+	if err == nil && imageReader != nil {
+		var imageFile io.Writer
+		imageFile, err = zipWriter.CreateHeader(&zip.FileHeader{Name: manifest.ImageFile, Method: zip.Store})
+		if err == nil {
+			_, err = io.Copy(imageFile, imageReader)
+		}
+	}
+
+	if err == nil {
+		err = zipWriter.Close()
+	}
+
+	if err != nil {
+		log.Printf("[WARNING] Failed writing bundle for app %s: %s", app.ID, err)
+		if imageReader == nil {
+			resp.Header().Set("Content-Type", "application/json")
+			resp.Header().Del("Content-Disposition")
+			resp.WriteHeader(500)
+			resp.Write([]byte(`{"success": false, "reason": "Failed creating bundle"}`))
+		}
+
+		return
+	}
+
+	log.Printf("[AUDIT] User %s (%s) exported app %s:%s (%s). Image included: %t", user.Username, user.Id, app.Name, app.AppVersion, app.ID, imageReader != nil)
+	if imageReader == nil {
+		resp.WriteHeader(200)
+		resp.Write(buf.Bytes())
+	}
+}
+
+func writeAppBundle(zipWriter *zip.Writer, manifestData []byte, folder string, files map[string][]byte, filenames []string) error {
+	file, err := zipWriter.Create("shuffle-bundle.json")
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(manifestData)
+	if err != nil {
+		return err
+	}
+
+	for _, filename := range filenames {
+		file, err := zipWriter.Create(fmt.Sprintf("%s/%s", folder, filename))
+		if err != nil {
+			return err
+		}
+
+		_, err = file.Write(files[filename])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+)
+
+func TestWriteAppBundle(t *testing.T) {
+	files := map[string][]byte{
+		"api.yaml":         []byte("name: tools"),
+		"Dockerfile":       []byte("FROM frikky/shuffle:app_sdk"),
+		"src/app.py":       []byte("print('hi')"),
+		"requirements.txt": []byte(""),
+	}
+
+	filenames := []string{"Dockerfile", "api.yaml", "requirements.txt", "src/app.py"}
+	manifestData, _ := json.Marshal(appBundleManifest{Format: "shuffle-app-bundle", FormatVersion: appBundleFormatVersion, Folder: "tools/1.0.0", Files: filenames})
+
+	buf := new(bytes.Buffer)
+	zipWriter := zip.NewWriter(buf)
+	err := writeAppBundle(zipWriter, manifestData, "tools/1.0.0", files, filenames)
+	if err == nil {
+		err = zipWriter.Close()
+	}
+
+	if err != nil {
+		t.Fatalf("failed writing bundle: %s", err)
+	}
+
+	reader, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("failed reading bundle: %s", err)
+	}
+
+	expected := []string{"shuffle-bundle.json", "tools/1.0.0/Dockerfile", "tools/1.0.0/api.yaml", "tools/1.0.0/requirements.txt", "tools/1.0.0/src/app.py"}
+	if len(reader.File) != len(expected) {
+		t.Fatalf("expected %d files in the bundle, got %d", len(expected), len(reader.File))
+	}
+
+	for i, file := range reader.File {
+		if file.Name != expected[i] {
+			t.Errorf("expected %s at position %d, got %s", expected[i], i, file.Name)
+		}
+	}
+
+	manifestFile, _ := reader.File[0].Open()
+	manifest := appBundleManifest{}
+	data, _ := ioutil.ReadAll(manifestFile)
+	if json.Unmarshal(data, &manifest) != nil || manifest.Folder != "tools/1.0.0" || len(manifest.Files) != len(filenames) {
+		t.Errorf("expected the manifest first with the folder and files, got %s", string(data))
+	}
+
+	// Bundles can be imported again as they are
+	fs, baseDir, importErrors := readAppZip(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if len(importErrors) > 0 || baseDir != "tools/1.0.0/" {
+		t.Fatalf("expected the bundle to be importable from tools/1.0.0/, got %#v: %#v", baseDir, importErrors)
+	}
+
+	if _, err := fs.Stat(baseDir + "src/app.py"); err != nil {
+		t.Errorf("src/app.py not found in the imported bundle: %s", err)
+	}
+}
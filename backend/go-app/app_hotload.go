@@ -0,0 +1,290 @@
+package main
+
+// Watches SHUFFLE_APP_HOTLOAD_FOLDER for changes when
+// SHUFFLE_APP_HOTLOAD_WATCH=true, so apps developed in a mounted folder
+// don't need /api/v1/apps/run_hotload. Changes are debounced, and only the
+// apps that changed are validated, loaded and rebuilt.
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	gyaml "github.com/ghodss/yaml"
+	"github.com/shuffle/shuffle-shared"
+)
+
+// How long changes have to stop for before apps are reloaded.
+// SHUFFLE_APP_HOTLOAD_DEBOUNCE overrides it in seconds.
+var hotloadDebounce = 3 * time.Second
+
+// Editor and build leftovers that don't change an app
+func isIgnoredHotloadPath(path string) bool {
+	for _, part := range strings.Split(filepath.ToSlash(path), "/") {
+		if part == ".git" || part == "__pycache__" || part == "node_modules" || part == ".pytest_cache" {
+			return true
+		}
+	}
+
+	name := filepath.Base(path)
+	return strings.HasPrefix(name, ".#") || strings.HasSuffix(name, "~") || strings.HasSuffix(name, ".swp") || strings.HasSuffix(name, ".swx") || strings.HasSuffix(name, ".pyc") || name == "4913"
+}
+
+func fileExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir()
+}
+
+// Whether dir is location or below it. A plain prefix check would also match
+// siblings such as /apps2 for /apps.
+func isInHotloadLocation(location, dir string) bool {
+	rel, err := filepath.Rel(location, dir)
+	if err != nil {
+		return false
+	}
+
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Finds the app folder (with a Dockerfile and api.yaml) a changed path is
+// in. Returns an empty string if it isn't in an app.
+func getHotloadAppDir(location, path string) string {
+	location = filepath.Clean(location)
+	dir := filepath.Clean(path)
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		dir = filepath.Dir(dir)
+	}
+
+	for isInHotloadLocation(location, dir) {
+		if fileExists(filepath.Join(dir, "Dockerfile")) && (fileExists(filepath.Join(dir, "api.yaml")) || fileExists(filepath.Join(dir, "api.yml"))) {
+			return dir
+		}
+
+		if dir == location {
+			break
+		}
+
+		dir = filepath.Dir(dir)
+	}
+
+	return ""
+}
+
+// Every app in the hotload folder, for when changes were missed
+func getHotloadAppDirs(location string) []string {
+	location = filepath.Clean(location)
+	appDirs := []string{}
+	filepath.Walk(location, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+
+		if isIgnoredHotloadPath(path) {
+			return filepath.SkipDir
+		}
+
+		if getHotloadAppDir(location, path) == path {
+			appDirs = append(appDirs, path)
+		}
+
+		return nil
+	})
+
+	return appDirs
+}
+
+// Checks api.yaml and the files the app needs to build, the same way as
+// when apps are loaded
+func validateHotloadApp(appDir string) (shuffle.WorkflowApp, error) {
+	workflowapp := shuffle.WorkflowApp{}
+
+	apiPath := filepath.Join(appDir, "api.yaml")
+	if !fileExists(apiPath) {
+		apiPath = filepath.Join(appDir, "api.yml")
+	}
+
+	appfileData, err := ioutil.ReadFile(apiPath)
+	if err != nil {
+		return workflowapp, err
+	}
+
+	if len(appfileData) == 0 {
+		return workflowapp, errors.New(fmt.Sprintf("%s is empty", filepath.Base(apiPath)))
+	}
+
+	err = gyaml.Unmarshal(appfileData, &workflowapp)
+	if err != nil {
+		return workflowapp, errors.New(fmt.Sprintf("Invalid %s: %s", filepath.Base(apiPath), err))
+	}
+
+	if !fileExists(filepath.Join(appDir, "src", "app.py")) {
+		return workflowapp, errors.New("src/app.py doesn't exist")
+	}
+
+	err = checkWorkflowApp(appendAuthenticationParameters(workflowapp))
+	if err != nil {
+		return workflowapp, err
+	}
+
+	return workflowapp, nil
+}
+
+// Hotloaded apps don't belong to an org, so the notification goes to the
+// default org, the same one schedules without an org run in
+func createHotloadNotification(ctx context.Context, orgId, appDir, reason string) {
+	if len(orgId) == 0 {
+		log.Printf("[WARNING] No org to notify about the failed hotload of %s", appDir)
+		return
+	}
+
+	err := shuffle.CreateOrgNotification(
+		ctx,
+		fmt.Sprintf("App hotload failed"),
+		fmt.Sprintf("The app in %s failed to hotload: %s", appDir, reason),
+		fmt.Sprintf("/apps"),
+		orgId,
+		false,
+	)
+
+	if err != nil {
+		log.Printf("[WARNING] Failed creating app hotload notification: %s", err)
+	}
+}
+
+// Loads and rebuilds a single app in the hotload folder
+func reloadHotloadApp(ctx context.Context, location, appDir string) error {
+	workflowapp, err := validateHotloadApp(appDir)
+	if err != nil {
+		return err
+	}
+
+	extra, err := filepath.Rel(location, appDir)
+	if err != nil {
+		return err
+	}
+	extra = fmt.Sprintf("%s/", filepath.ToSlash(extra))
+
+	fs, err := shuffle.CreateFs("base", location)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Failed to find directory %s", location))
+	}
+
+	dir, err := fs.ReadDir(extra)
+	if err != nil {
+		return err
+	}
+
+	// Apps in subfolders aren't built by IterateAppGithubFolders, which
+	// leaves the build of only this app to us
+	buildFirst, buildLast, err := IterateAppGithubFolders(ctx, fs, dir, extra, "", true)
+	if err != nil {
+		return err
+	}
+
+	shuffle.DeleteCache(ctx, "workflowapps-sorted")
+
+	builds := append(buildFirst, buildLast...)
+	if len(builds) == 0 {
+		return errors.New(fmt.Sprintf("%s:%s wasn't loaded. Check the backend logs", workflowapp.Name, workflowapp.AppVersion))
+	}
+
+	for _, item := range builds {
+		log.Printf("[INFO] Rebuilding hotloaded app %s:%s with tags %s", workflowapp.Name, workflowapp.AppVersion, strings.Join(item.Tags, ", "))
+		err = buildImage(item.Tags, filepath.Join(location, filepath.FromSlash(item.Extra), "Dockerfile"), "")
+		if err != nil {
+			return errors.New(fmt.Sprintf("Failed building %s: %s", strings.Join(item.Tags, ", "), err))
+		}
+	}
+
+	return nil
+}
+
+// Watches the hotload folder until ctx is done. Changes are collected until
+// none have happened for hotloadDebounce, then every changed app is reloaded.
+// Failures are notified to defaultOrgId.
+func startAppHotloadWatcher(ctx context.Context, location, defaultOrgId string) {
+	if len(location) == 0 {
+		log.Printf("[WARNING] SHUFFLE_APP_HOTLOAD_WATCH is set, but SHUFFLE_APP_HOTLOAD_FOLDER isn't")
+		return
+	}
+
+	if debounce, err := strconv.Atoi(os.Getenv("SHUFFLE_APP_HOTLOAD_DEBOUNCE")); err == nil && debounce > 0 {
+		hotloadDebounce = time.Duration(debounce) * time.Second
+	}
+
+	location, err := filepath.Abs(location)
+	if err != nil {
+		log.Printf("[WARNING] Bad app hotload folder %s: %s", location, err)
+		return
+	}
+
+	changes := make(chan string, 1000)
+	err = watchHotloadFolder(ctx, location, changes)
+	if err != nil {
+		log.Printf("[WARNING] Failed watching app hotload folder %s: %s", location, err)
+		return
+	}
+
+	log.Printf("[INFO] Watching %s for app changes", location)
+
+	changedApps := map[string]bool{}
+	timer := time.NewTimer(hotloadDebounce)
+	timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case path := <-changes:
+			if isIgnoredHotloadPath(path) {
+				continue
+			}
+
+			appDir := getHotloadAppDir(location, path)
+			if len(appDir) == 0 {
+				continue
+			}
+
+			changedApps[appDir] = true
+
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(hotloadDebounce)
+		case <-timer.C:
+			appDirs := []string{}
+			for appDir := range changedApps {
+				appDirs = append(appDirs, appDir)
+			}
+			sort.Strings(appDirs)
+			changedApps = map[string]bool{}
+
+			for _, appDir := range appDirs {
+				// Removed apps are kept, like with the regular hotload
+				if getHotloadAppDir(location, appDir) != appDir {
+					continue
+				}
+
+				log.Printf("[INFO] Hotloading changed app in %s", appDir)
+				err := reloadHotloadApp(ctx, location, appDir)
+				if err != nil {
+					log.Printf("[WARNING] Failed hotloading app in %s: %s", appDir, err)
+					createHotloadNotification(ctx, defaultOrgId, appDir, err.Error())
+					continue
+				}
+
+				log.Printf("[INFO] Hotloaded app in %s", appDir)
+			}
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const hotloadWatchMask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_MODIFY | syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_ATTRIB
+
+// Watches a folder and all its subfolders with inotify. Folders created
+// later are watched as well. Changed paths are sent to changes.
+type hotloadWatcher struct {
+	fd       int
+	location string
+	watches  map[int32]string
+	lock     sync.Mutex
+}
+
+func (watcher *hotloadWatcher) addWatch(location string) error {
+	wd, err := syscall.InotifyAddWatch(watcher.fd, location, hotloadWatchMask)
+	if err != nil {
+		return err
+	}
+
+	watcher.lock.Lock()
+	watcher.watches[int32(wd)] = location
+	watcher.lock.Unlock()
+	return nil
+}
+
+func (watcher *hotloadWatcher) addRecursive(location string) error {
+	return filepath.Walk(location, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Removed while walking
+			if os.IsNotExist(err) {
+				return nil
+			}
+
+			return err
+		}
+
+		if !info.IsDir() {
+			return nil
+		}
+
+		if isIgnoredHotloadPath(path) {
+			return filepath.SkipDir
+		}
+
+		err = watcher.addWatch(path)
+		if err != nil {
+			log.Printf("[WARNING] Failed watching %s for app hotload: %s", path, err)
+		}
+
+		return nil
+	})
+}
+
+func (watcher *hotloadWatcher) read(changes chan<- string) {
+	buf := make([]byte, syscall.SizeofInotifyEvent*4096)
+	for {
+		n, err := syscall.Read(watcher.fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+
+		if err != nil || n <= 0 {
+			log.Printf("[DEBUG] Stopped watching for app hotload: %s", err)
+			return
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+
+			// The name is padded with null bytes
+			name := string(bytes.TrimRight(nameBytes, "\x00"))
+
+			// Not for any watch (wd is -1). Folders created in the meantime
+			// weren't watched either.
+			if event.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				log.Printf("[WARNING] Too many changes in the app hotload folder. Reloading every app in it.")
+				watcher.addRecursive(watcher.location)
+				for _, appDir := range getHotloadAppDirs(watcher.location) {
+					changes <- appDir
+				}
+
+				continue
+			}
+
+			watcher.lock.Lock()
+			parent, ok := watcher.watches[event.Wd]
+			if event.Mask&syscall.IN_IGNORED != 0 {
+				delete(watcher.watches, event.Wd)
+			}
+			watcher.lock.Unlock()
+
+			if !ok {
+				continue
+			}
+
+			path := parent
+			if len(name) > 0 {
+				path = filepath.Join(parent, name)
+			}
+
+			if event.Mask&syscall.IN_ISDIR != 0 && event.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+				watcher.addRecursive(path)
+			}
+
+			changes <- path
+		}
+	}
+}
+
+// Starts watching the folder. The changed paths are sent until ctx is done.
+func watchHotloadFolder(ctx context.Context, location string, changes chan<- string) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Failed starting inotify: %s", err))
+	}
+
+	watcher := &hotloadWatcher{
+		fd:       fd,
+		location: location,
+		watches:  map[int32]string{},
+	}
+
+	err = watcher.addRecursive(location)
+	if err != nil {
+		syscall.Close(fd)
+		return err
+	}
+
+	go watcher.read(changes)
+	go func() {
+		<-ctx.Done()
+		syscall.Close(fd)
+	}()
+
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// Watching uses inotify, which is only on linux. /api/v1/apps/run_hotload
+// still works everywhere.
+func watchHotloadFolder(ctx context.Context, location string, changes chan<- string) error {
+	return errors.New("Watching the app hotload folder is only supported on linux")
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGetHotloadAppDir(t *testing.T) {
+	location, err := ioutil.TempDir("", "hotload")
+	if err != nil {
+		t.Fatalf("failed creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(location)
+
+	appDir := filepath.Join(location, "http", "1.0.0")
+	os.MkdirAll(filepath.Join(appDir, "src"), 0755)
+	for _, name := range []string{"Dockerfile", "api.yaml", "src/app.py"} {
+		ioutil.WriteFile(filepath.Join(appDir, filepath.FromSlash(name)), []byte("x"), 0644)
+	}
+
+	if dir := getHotloadAppDir(location, filepath.Join(appDir, "src", "app.py")); dir != appDir {
+		t.Errorf("expected %s for a changed file, got %s", appDir, dir)
+	}
+
+	if dir := getHotloadAppDir(location, filepath.Join(appDir, "src", "removed.py")); dir != appDir {
+		t.Errorf("expected %s for a removed file, got %s", appDir, dir)
+	}
+
+	if dir := getHotloadAppDir(location, filepath.Join(location, "http")); dir != "" {
+		t.Errorf("expected no app above the app folder, got %s", dir)
+	}
+
+	// An app in a sibling folder with the same prefix, e.g. /apps2 for /apps
+	siblingDir := filepath.Join(location+"2", "http", "1.0.0")
+	os.MkdirAll(siblingDir, 0755)
+	defer os.RemoveAll(location + "2")
+	for _, name := range []string{"Dockerfile", "api.yaml"} {
+		ioutil.WriteFile(filepath.Join(siblingDir, name), []byte("x"), 0644)
+	}
+
+	if dir := getHotloadAppDir(location, filepath.Join(siblingDir, "api.yaml")); dir != "" {
+		t.Errorf("expected no app outside the hotload folder, got %s", dir)
+	}
+
+	if !isIgnoredHotloadPath(filepath.Join(appDir, "src", "__pycache__", "app.cpython-39.pyc")) || !isIgnoredHotloadPath(filepath.Join(appDir, "src", ".app.py.swp")) {
+		t.Errorf("expected cache and swap files to be ignored")
+	}
+
+	if isIgnoredHotloadPath(filepath.Join(appDir, "api.yaml")) {
+		t.Errorf("expected api.yaml to not be ignored")
+	}
+
+	// Rescanned after missed changes
+	otherDir := filepath.Join(location, "tools", "1.0.0")
+	os.MkdirAll(otherDir, 0755)
+	for _, name := range []string{"Dockerfile", "api.yml"} {
+		ioutil.WriteFile(filepath.Join(otherDir, name), []byte("x"), 0644)
+	}
+
+	appDirs := getHotloadAppDirs(location)
+	if len(appDirs) != 2 || appDirs[0] != appDir || appDirs[1] != otherDir {
+		t.Errorf("expected %s and %s in the hotload folder, got %#v", appDir, otherDir, appDirs)
+	}
+}
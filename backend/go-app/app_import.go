@@ -0,0 +1,676 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/shuffle/shuffle-shared"
+
+	"github.com/docker/docker/client"
+	gyaml "github.com/ghodss/yaml"
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+	uuid "github.com/satori/go.uuid"
+	"gopkg.in/yaml.v3"
+)
+
+// Limits for uploaded app zips. The uncompressed limit protects
+// against zip bombs, as the whole app is kept in memory while building.
+// Images in exported bundles are streamed into docker instead, and
+// have their own limit on top of the app itself.
+const (
+	maxAppUploadSize         = 50 << 20
+	maxAppUploadUncompressed = 200 << 20
+	maxAppUploadFiles        = 1000
+	maxAppUploadImageSize    = 4 << 30
+)
+
+// A single problem found while importing an app. File is relative to
+// the app folder inside the zip.
+type appImportError struct {
+	File   string `json:"file"`
+	Reason string `json:"reason"`
+}
+
+type appImportResult struct {
+	Success    bool             `json:"success"`
+	Reason     string           `json:"reason,omitempty"`
+	Id         string           `json:"id,omitempty"`
+	Name       string           `json:"name,omitempty"`
+	AppVersion string           `json:"app_version,omitempty"`
+	Errors     []appImportError `json:"errors"`
+}
+
+// The uploaded app folder. Same layout as in the shuffle-apps repository
+type appImport struct {
+	Fs         billy.Filesystem
+	BaseDir    string
+	App        shuffle.WorkflowApp
+	Hash       string
+	Dockerfile []byte
+	AppPython  []byte
+}
+
+func isAppZipImage(name string) bool {
+	return strings.HasPrefix(name, "images/") && strings.HasSuffix(name, ".tar")
+}
+
+// Unpacks an app zip into memory. Rejects absolute paths and paths
+// leaving the archive, and returns the folder containing api.yaml.
+func readAppZip(data io.ReaderAt, size int64) (billy.Filesystem, string, []appImportError) {
+	zipdata, err := zip.NewReader(data, size)
+	if err != nil {
+		return nil, "", []appImportError{appImportError{File: "", Reason: fmt.Sprintf("Not a valid zip file: %s", err)}}
+	}
+
+	if len(zipdata.File) > maxAppUploadFiles {
+		return nil, "", []appImportError{appImportError{File: "", Reason: fmt.Sprintf("Zip contains more than %d files", maxAppUploadFiles)}}
+	}
+
+	fs := memfs.New()
+	importErrors := []appImportError{}
+	apiFolders := []string{}
+	var totalSize uint64
+	for _, item := range zipdata.File {
+		name := strings.ReplaceAll(item.Name, "\\", "/")
+		if strings.HasPrefix(name, "__MACOSX/") {
+			continue
+		}
+
+		// Images in exported bundles are loaded with loadAppZipImage
+		if isAppZipImage(name) {
+			continue
+		}
+
+		cleaned := path.Clean(name)
+		if strings.HasPrefix(name, "/") || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+			importErrors = append(importErrors, appImportError{File: item.Name, Reason: "Path is outside the app folder"})
+			continue
+		}
+
+		if item.FileInfo().IsDir() {
+			continue
+		}
+
+		totalSize += item.UncompressedSize64
+		if totalSize > maxAppUploadUncompressed {
+			return nil, "", []appImportError{appImportError{File: item.Name, Reason: fmt.Sprintf("Uncompressed app is larger than %d bytes", maxAppUploadUncompressed)}}
+		}
+
+		reader, err := item.Open()
+		if err != nil {
+			importErrors = append(importErrors, appImportError{File: item.Name, Reason: fmt.Sprintf("Failed reading file: %s", err)})
+			continue
+		}
+
+		// UncompressedSize64 comes from the archive itself, so don't trust it
+		fileData, err := ioutil.ReadAll(io.LimitReader(reader, int64(maxAppUploadUncompressed)+1))
+		reader.Close()
+		if err != nil {
+			importErrors = append(importErrors, appImportError{File: item.Name, Reason: fmt.Sprintf("Failed reading file: %s", err)})
+			continue
+		}
+
+		if uint64(len(fileData)) > item.UncompressedSize64 {
+			return nil, "", []appImportError{appImportError{File: item.Name, Reason: "File is larger than stated in the zip header"}}
+		}
+
+		err = fs.MkdirAll(path.Dir(cleaned), 0755)
+		if err != nil {
+			importErrors = append(importErrors, appImportError{File: item.Name, Reason: fmt.Sprintf("Failed creating folder: %s", err)})
+			continue
+		}
+
+		file, err := fs.Create(cleaned)
+		if err != nil {
+			importErrors = append(importErrors, appImportError{File: item.Name, Reason: fmt.Sprintf("Failed creating file: %s", err)})
+			continue
+		}
+
+		_, err = file.Write(fileData)
+		file.Close()
+		if err != nil {
+			importErrors = append(importErrors, appImportError{File: item.Name, Reason: fmt.Sprintf("Failed writing file: %s", err)})
+			continue
+		}
+
+		filename := path.Base(cleaned)
+		if filename == "api.yaml" || filename == "api.yml" {
+			apiFolders = append(apiFolders, path.Dir(cleaned))
+		}
+	}
+
+	if len(importErrors) > 0 {
+		return nil, "", importErrors
+	}
+
+	if len(apiFolders) == 0 {
+		return nil, "", []appImportError{appImportError{File: "api.yaml", Reason: "No api.yaml or api.yml found in the zip"}}
+	}
+
+	// The shallowest api.yaml is the app. Anything else is ambiguous.
+	getDepth := func(folder string) int {
+		if folder == "." {
+			return 0
+		}
+
+		return strings.Count(folder, "/") + 1
+	}
+
+	baseDir := apiFolders[0]
+	ambiguous := false
+	for _, folder := range apiFolders[1:] {
+		if getDepth(folder) < getDepth(baseDir) {
+			baseDir = folder
+			ambiguous = false
+		} else if getDepth(folder) == getDepth(baseDir) {
+			ambiguous = true
+		}
+	}
+
+	if ambiguous {
+		return nil, "", []appImportError{appImportError{File: "api.yaml", Reason: "Zip contains more than one app. Upload one app at a time"}}
+	}
+
+	if baseDir == "." {
+		return fs, "", nil
+	}
+
+	return fs, fmt.Sprintf("%s/", baseDir), nil
+}
+
+// Finds the docker save tar in an exported bundle, if any
+func getAppZipImage(data io.ReaderAt, size int64) (*zip.File, []appImportError) {
+	zipdata, err := zip.NewReader(data, size)
+	if err != nil {
+		return nil, []appImportError{appImportError{File: "", Reason: fmt.Sprintf("Not a valid zip file: %s", err)}}
+	}
+
+	var imageFile *zip.File
+	for _, item := range zipdata.File {
+		if !isAppZipImage(strings.ReplaceAll(item.Name, "\\", "/")) {
+			continue
+		}
+
+		if imageFile != nil {
+			return nil, []appImportError{appImportError{File: item.Name, Reason: "Zip contains more than one image"}}
+		}
+
+		if item.UncompressedSize64 > maxAppUploadImageSize {
+			return nil, []appImportError{appImportError{File: item.Name, Reason: fmt.Sprintf("Image is larger than %d bytes", maxAppUploadImageSize)}}
+		}
+
+		imageFile = item
+	}
+
+	return imageFile, nil
+}
+
+// Docker tags images with docker.io/ when no registry is given
+func normalizeImageTag(tag string) string {
+	tag = strings.TrimPrefix(tag, "docker.io/")
+	return strings.TrimPrefix(tag, "library/")
+}
+
+// Reads the tags docker load would set from a docker save tar. Both the
+// classic manifest.json and the OCI index.json used by the containerd
+// image store are checked.
+func getImageTarTags(reader io.Reader) ([]string, error) {
+	tarReader := tar.NewReader(reader)
+	foundManifest := false
+	tags := []string{}
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return tags, err
+		}
+
+		if header.Name != "manifest.json" && header.Name != "index.json" {
+			continue
+		}
+
+		data, err := ioutil.ReadAll(io.LimitReader(tarReader, 1<<20))
+		if err != nil {
+			return tags, err
+		}
+
+		if header.Name == "manifest.json" {
+			foundManifest = true
+			manifest := []struct {
+				RepoTags []string `json:"RepoTags"`
+			}{}
+
+			err = json.Unmarshal(data, &manifest)
+			if err != nil {
+				return tags, fmt.Errorf("Invalid manifest.json: %s", err)
+			}
+
+			for _, image := range manifest {
+				for _, tag := range image.RepoTags {
+					tags = append(tags, normalizeImageTag(tag))
+				}
+			}
+		} else {
+			index := struct {
+				Manifests []struct {
+					Annotations map[string]string `json:"annotations"`
+				} `json:"manifests"`
+			}{}
+
+			err = json.Unmarshal(data, &index)
+			if err != nil {
+				return tags, fmt.Errorf("Invalid index.json: %s", err)
+			}
+
+			for _, manifest := range index.Manifests {
+				if tag, ok := manifest.Annotations["io.containerd.image.name"]; ok {
+					tags = append(tags, normalizeImageTag(tag))
+				}
+			}
+		}
+	}
+
+	if !foundManifest {
+		return tags, errors.New("No manifest.json found. Export the image with docker save")
+	}
+
+	return tags, nil
+}
+
+// Loads the image from an exported bundle instead of building it. The
+// image may only be tagged as the app itself, as docker load would
+// otherwise replace any image on the host.
+func loadAppZipImage(ctx context.Context, imageFile *zip.File, tag string) error {
+	reader, err := imageFile.Open()
+	if err != nil {
+		return err
+	}
+
+	tags, err := getImageTarTags(io.LimitReader(reader, maxAppUploadImageSize))
+	reader.Close()
+	if err != nil {
+		return err
+	}
+
+	if len(tags) == 0 {
+		return fmt.Errorf("Image isn't tagged. Expected %s", tag)
+	}
+
+	for _, imageTag := range tags {
+		if imageTag != tag {
+			return fmt.Errorf("Image is tagged %s. Expected %s", imageTag, tag)
+		}
+	}
+
+	reader, err = imageFile.Open()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	dockercli, err := client.NewEnvClient()
+	if err != nil {
+		return err
+	}
+	defer dockercli.Close()
+
+	loadResp, err := dockercli.ImageLoad(ctx, io.LimitReader(reader, maxAppUploadImageSize), true)
+	if err != nil {
+		return err
+	}
+	defer loadResp.Body.Close()
+
+	// Failures while loading are only reported in the response stream
+	decoder := json.NewDecoder(loadResp.Body)
+	for {
+		message := struct {
+			Error string `json:"error"`
+		}{}
+
+		err = decoder.Decode(&message)
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if len(message.Error) > 0 {
+			return errors.New(message.Error)
+		}
+	}
+
+	_, _, err = dockercli.ImageInspectWithRaw(ctx, tag)
+	return err
+}
+
+func readAppImportFile(fs billy.Filesystem, baseDir string, filenames ...string) (string, []byte, error) {
+	for _, filename := range filenames {
+		fileReader, err := fs.Open(fmt.Sprintf("%s%s", baseDir, filename))
+		if err != nil {
+			continue
+		}
+
+		data, err := ioutil.ReadAll(fileReader)
+		fileReader.Close()
+		if err != nil {
+			return filename, nil, err
+		}
+
+		return filename, data, nil
+	}
+
+	return filenames[0], nil, errors.New("File doesn't exist")
+}
+
+// Validates an unpacked app with the same rules as apps loaded from
+// the app folders, and returns every problem found instead of the first.
+func validateAppImport(fs billy.Filesystem, baseDir string) (appImport, []appImportError) {
+	importErrors := []appImportError{}
+	imported := appImport{
+		Fs:      fs,
+		BaseDir: baseDir,
+	}
+
+	apiName, apiData, err := readAppImportFile(fs, baseDir, "api.yaml", "api.yml")
+	if err != nil || len(apiData) == 0 {
+		return imported, []appImportError{appImportError{File: apiName, Reason: "Missing or empty"}}
+	}
+
+	apiYaml := ApiYaml{}
+	err = yaml.Unmarshal(apiData, &apiYaml)
+	if err != nil {
+		importErrors = append(importErrors, appImportError{File: apiName, Reason: fmt.Sprintf("Invalid YAML: %s", err)})
+	} else {
+		err = validateApiYaml(apiYaml)
+		if err != nil {
+			importErrors = append(importErrors, appImportError{File: apiName, Reason: err.Error()})
+		}
+	}
+
+	err = gyaml.Unmarshal(apiData, &imported.App)
+	if err != nil {
+		importErrors = append(importErrors, appImportError{File: apiName, Reason: fmt.Sprintf("Failed parsing app: %s", err)})
+	} else {
+		err = checkWorkflowApp(imported.App)
+		if err != nil {
+			importErrors = append(importErrors, appImportError{File: apiName, Reason: err.Error()})
+		}
+
+		if len(imported.App.Actions) == 0 {
+			importErrors = append(importErrors, appImportError{File: apiName, Reason: "App has no actions"})
+		}
+	}
+
+	_, imported.Dockerfile, err = readAppImportFile(fs, baseDir, "Dockerfile")
+	if err != nil || len(imported.Dockerfile) == 0 {
+		importErrors = append(importErrors, appImportError{File: "Dockerfile", Reason: "Missing or empty"})
+	} else if !regexp.MustCompile(`(?mi)^\s*FROM\s+\S+`).Match(imported.Dockerfile) {
+		importErrors = append(importErrors, appImportError{File: "Dockerfile", Reason: "No FROM instruction found"})
+	}
+
+	_, requirements, err := readAppImportFile(fs, baseDir, "requirements.txt")
+	if err != nil || requirements == nil {
+		importErrors = append(importErrors, appImportError{File: "requirements.txt", Reason: "Missing"})
+	}
+
+	_, imported.AppPython, err = readAppImportFile(fs, baseDir, "src/app.py")
+	if err != nil || len(imported.AppPython) == 0 {
+		importErrors = append(importErrors, appImportError{File: "src/app.py", Reason: "Missing or empty"})
+	} else {
+		// Every action has to map to a function in the app class
+		for _, action := range imported.App.Actions {
+			if len(action.Name) == 0 {
+				importErrors = append(importErrors, appImportError{File: apiName, Reason: "Action without a name"})
+				continue
+			}
+
+			functionPattern := fmt.Sprintf(`(?m)^\s*(async\s+)?def\s+%s\s*\(`, regexp.QuoteMeta(action.Name))
+			if !regexp.MustCompile(functionPattern).Match(imported.AppPython) {
+				importErrors = append(importErrors, appImportError{File: "src/app.py", Reason: fmt.Sprintf("No function found for action %s", action.Name)})
+			}
+		}
+	}
+
+	if len(importErrors) > 0 {
+		return imported, importErrors
+	}
+
+	// Same hash as apps loaded from the app folders (api.yaml+src/app.py+Dockerfile)
+	combined := []byte{}
+	combined = append(combined, apiData...)
+	combined = append(combined, imported.AppPython...)
+	combined = append(combined, imported.Dockerfile...)
+	imported.Hash = md5sum(combined)
+
+	return imported, nil
+}
+
+func writeAppImportResult(resp http.ResponseWriter, status int, result appImportResult) {
+	if result.Errors == nil {
+		result.Errors = []appImportError{}
+	}
+
+	newjson, err := json.Marshal(result)
+	if err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed marshalling import result"}`))
+		return
+	}
+
+	resp.WriteHeader(status)
+	resp.Write(newjson)
+}
+
+// Imports an app zip with the same layout as the shuffle-apps repository
+// (api.yaml, Dockerfile, requirements.txt, src/app.py), builds it and
+// registers it for the uploaders' organization.
+func handleAppZipUpload(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := shuffle.HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in app zip upload: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if user.Role == "org-reader" {
+		log.Printf("[WARNING] Org-reader doesn't have access to upload apps: %s (%s)", user.Username, user.Id)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Read only user"}`))
+		return
+	}
+
+	// Larger files than the memory limit are kept on disk by ParseMultipartForm
+	//https://stackoverflow.com/questions/22964950/http-request-formfile-handle-zip-files
+	request.Body = http.MaxBytesReader(resp, request.Body, maxAppUploadSize+maxAppUploadImageSize+(1<<20))
+	request.ParseMultipartForm(32 << 20)
+	f, header, err := request.FormFile("shuffle_file")
+	if err != nil {
+		log.Printf("[ERROR] Couldn't upload file: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Failed uploading file. Correct usage is: shuffle_file=@filepath"}`))
+		return
+	}
+	defer f.Close()
+
+	imageFile, importErrors := getAppZipImage(f, header.Size)
+	if len(importErrors) > 0 {
+		log.Printf("[INFO] Rejected app zip from %s (%s): %d error(s)", user.Username, user.Id, len(importErrors))
+		writeAppImportResult(resp, 400, appImportResult{Reason: "Invalid app zip", Errors: importErrors})
+		return
+	}
+
+	// Only the image is allowed to go past the app limit
+	fileSize := header.Size
+	if imageFile != nil {
+		fileSize -= int64(imageFile.CompressedSize64)
+	}
+
+	if fileSize > maxAppUploadSize {
+		writeAppImportResult(resp, 400, appImportResult{Reason: fmt.Sprintf("Zip is larger than %d bytes", maxAppUploadSize)})
+		return
+	}
+
+	fs, baseDir, importErrors := readAppZip(f, header.Size)
+	if len(importErrors) > 0 {
+		log.Printf("[INFO] Rejected app zip from %s (%s): %d error(s)", user.Username, user.Id, len(importErrors))
+		writeAppImportResult(resp, 400, appImportResult{Reason: "Invalid app zip", Errors: importErrors})
+		return
+	}
+
+	imported, importErrors := validateAppImport(fs, baseDir)
+	if len(importErrors) > 0 {
+		log.Printf("[INFO] App zip from %s (%s) failed validation: %d error(s)", user.Username, user.Id, len(importErrors))
+		writeAppImportResult(resp, 400, appImportResult{
+			Reason:     "App validation failed",
+			Name:       imported.App.Name,
+			AppVersion: imported.App.AppVersion,
+			Errors:     importErrors,
+		})
+		return
+	}
+
+	workflowapp := imported.App
+	result := appImportResult{
+		Name:       workflowapp.Name,
+		AppVersion: workflowapp.AppVersion,
+	}
+
+	// Images are tagged by name and version only, so apps from every
+	// organization are checked, not just the ones the user can see.
+	// Can't overwrite apps from other organizations or public apps.
+	ctx := shuffle.GetContext(request)
+	workflowApps, err := shuffle.GetAllWorkflowApps(ctx, 0, 0)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting apps to verify app zip upload: %s", err)
+		result.Reason = "Failed to verify existence"
+		writeAppImportResult(resp, 500, result)
+		return
+	}
+
+	workflowapp = appendAuthenticationParameters(workflowapp)
+	tags := []string{
+		getAppImageName(workflowapp),
+	}
+
+	existingId := ""
+	for _, app := range workflowApps {
+		if getAppImageName(app) != tags[0] {
+			continue
+		}
+
+		if app.Owner != user.Id && (app.ReferenceOrg != user.ActiveOrg.Id || user.Role != "admin") {
+			log.Printf("[AUDIT] User %s (%s) tried to upload %s, which belongs to app %s in org %s", user.Username, user.Id, tags[0], app.ID, app.ReferenceOrg)
+			result.Reason = fmt.Sprintf("App %s:%s already exists and is owned by someone else", workflowapp.Name, workflowapp.AppVersion)
+			result.Errors = []appImportError{appImportError{File: "api.yaml", Reason: "Change the name or app_version"}}
+			writeAppImportResult(resp, 409, result)
+			return
+		}
+
+		existingId = app.ID
+	}
+
+	if imageFile != nil {
+		err = loadAppZipImage(ctx, imageFile, tags[0])
+		if err != nil {
+			log.Printf("[WARNING] Failed loading image of uploaded app %s:%s: %s", workflowapp.Name, workflowapp.AppVersion, err)
+			result.Reason = "Failed loading app image"
+			result.Errors = []appImportError{appImportError{File: imageFile.Name, Reason: err.Error()}}
+			writeAppImportResult(resp, 400, result)
+			return
+		}
+	} else {
+		err = buildImageMemory(imported.Fs, tags, imported.BaseDir, false, user.ActiveOrg.Id)
+		if err != nil {
+			log.Printf("[WARNING] Failed building uploaded app %s:%s: %s", workflowapp.Name, workflowapp.AppVersion, err)
+			result.Reason = "Failed building app image"
+			result.Errors = []appImportError{appImportError{File: "Dockerfile", Reason: err.Error()}}
+			writeAppImportResult(resp, 400, result)
+			return
+		}
+	}
+
+	if len(existingId) > 0 {
+		workflowapp.ID = existingId
+	} else {
+		workflowapp.ID = uuid.NewV4().String()
+	}
+
+	workflowapp.IsValid = true
+	workflowapp.Generated = false
+	workflowapp.Activated = true
+	workflowapp.Downloaded = true
+	workflowapp.Sharing = false
+	workflowapp.Public = false
+	workflowapp.Verified = false
+	workflowapp.Hash = imported.Hash
+	workflowapp.Owner = user.Id
+	workflowapp.ReferenceOrg = user.ActiveOrg.Id
+
+	err = shuffle.SetWorkflowAppDatastore(ctx, workflowapp, workflowapp.ID)
+	if err != nil {
+		log.Printf("[WARNING] Failed setting uploaded workflowapp %s: %s", workflowapp.ID, err)
+		result.Reason = "Failed saving app"
+		writeAppImportResult(resp, 500, result)
+		return
+	}
+
+	err = setAppSource(ctx, workflowapp, imported.Fs, imported.BaseDir, "upload")
+	if err != nil {
+		log.Printf("[WARNING] Failed storing source of uploaded app %s: %s", workflowapp.ID, err)
+	}
+
+	found := false
+	for appCounter, app := range user.PrivateApps {
+		if app.ID == workflowapp.ID {
+			user.PrivateApps[appCounter] = workflowapp
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		user.PrivateApps = append(user.PrivateApps, workflowapp)
+	}
+
+	err = shuffle.SetUser(ctx, &user, true)
+	if err != nil {
+		log.Printf("[WARNING] Failed adding uploaded app %s to user %s: %s", workflowapp.ID, user.Username, err)
+	}
+
+	cacheKey := fmt.Sprintf("workflowapps-sorted-100")
+	shuffle.DeleteCache(ctx, cacheKey)
+	cacheKey = fmt.Sprintf("workflowapps-sorted-500")
+	shuffle.DeleteCache(ctx, cacheKey)
+	cacheKey = fmt.Sprintf("workflowapps-sorted-1000")
+	shuffle.DeleteCache(ctx, cacheKey)
+	shuffle.DeleteCache(ctx, fmt.Sprintf("apps_%s", user.Id))
+
+	log.Printf("[AUDIT] User %s (%s) uploaded app %s:%s (%s) for org %s", user.Username, user.Id, workflowapp.Name, workflowapp.AppVersion, workflowapp.ID, user.ActiveOrg.Id)
+
+	result.Success = true
+	result.Id = workflowapp.ID
+	writeAppImportResult(resp, 200, result)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"testing"
+)
+
+func getTestAppZip(t *testing.T, files map[string]string) []byte {
+	buf := new(bytes.Buffer)
+	writer := zip.NewWriter(buf)
+	for name, content := range files {
+		file, err := writer.Create(name)
+		if err != nil {
+			t.Fatalf("failed creating %s: %s", name, err)
+		}
+
+		file.Write([]byte(content))
+	}
+
+	writer.Close()
+	return buf.Bytes()
+}
+
+func TestReadAppZip(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   map[string]string
+		baseDir string
+		valid   bool
+	}{
+		{"root", map[string]string{"api.yaml": "name: x", "Dockerfile": "FROM x"}, "", true},
+		{"folder", map[string]string{"app/1.0.0/api.yaml": "name: x", "app/1.0.0/src/app.py": ""}, "app/1.0.0/", true},
+		{"nested example", map[string]string{"app/api.yaml": "name: x", "app/examples/api.yaml": "name: y"}, "app/", true},
+		{"exported bundle", map[string]string{"shuffle-bundle.json": "{}", "tools/1.0.0/api.yaml": "name: x", "images/tools_1.0.0.tar": "x"}, "tools/1.0.0/", true},
+		{"traversal", map[string]string{"api.yaml": "name: x", "../../etc/cron.d/x": "x"}, "", false},
+		{"absolute", map[string]string{"/api.yaml": "name: x"}, "", false},
+		{"no api.yaml", map[string]string{"Dockerfile": "FROM x"}, "", false},
+		{"two apps", map[string]string{"a/api.yaml": "name: x", "b/api.yml": "name: y"}, "", false},
+	}
+
+	for _, test := range tests {
+		data := getTestAppZip(t, test.files)
+		fs, baseDir, importErrors := readAppZip(bytes.NewReader(data), int64(len(data)))
+		if test.valid != (len(importErrors) == 0) {
+			t.Errorf("%s: expected valid=%t, got errors %#v", test.name, test.valid, importErrors)
+			continue
+		}
+
+		if !test.valid {
+			continue
+		}
+
+		if baseDir != test.baseDir {
+			t.Errorf("%s: expected base dir %#v, got %#v", test.name, test.baseDir, baseDir)
+		}
+
+		if _, err := fs.Stat(baseDir + "api.yaml"); err != nil {
+			t.Errorf("%s: api.yaml not found in %#v: %s", test.name, baseDir, err)
+		}
+	}
+
+	_, _, importErrors := readAppZip(bytes.NewReader([]byte("not a zip")), 9)
+	if len(importErrors) == 0 {
+		t.Errorf("expected error for invalid zip")
+	}
+}
+
+func getTestImageTar(t *testing.T, files map[string]string) []byte {
+	buf := new(bytes.Buffer)
+	writer := tar.NewWriter(buf)
+	for name, content := range files {
+		err := writer.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))})
+		if err != nil {
+			t.Fatalf("failed creating %s: %s", name, err)
+		}
+
+		writer.Write([]byte(content))
+	}
+
+	writer.Close()
+	return buf.Bytes()
+}
+
+func TestGetImageTarTags(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		tags  []string
+		valid bool
+	}{
+		{"docker save", map[string]string{"manifest.json": `[{"RepoTags": ["frikky/shuffle:tools_1.0.0"]}]`}, []string{"frikky/shuffle:tools_1.0.0"}, true},
+		{"containerd", map[string]string{"manifest.json": `[{"RepoTags": ["frikky/shuffle:tools_1.0.0"]}]`, "index.json": `{"manifests": [{"annotations": {"io.containerd.image.name": "docker.io/frikky/shuffle:tools_1.0.0"}}]}`}, []string{"frikky/shuffle:tools_1.0.0", "frikky/shuffle:tools_1.0.0"}, true},
+		{"other image", map[string]string{"manifest.json": `[{"RepoTags": ["frikky/shuffle:tools_1.0.0", "docker.io/library/alpine:latest"]}]`}, []string{"frikky/shuffle:tools_1.0.0", "alpine:latest"}, true},
+		{"no manifest", map[string]string{"repositories": `{"alpine": {"latest": "x"}}`}, nil, false},
+		{"invalid manifest", map[string]string{"manifest.json": "x"}, nil, false},
+	}
+
+	for _, test := range tests {
+		tags, err := getImageTarTags(bytes.NewReader(getTestImageTar(t, test.files)))
+		if test.valid != (err == nil) {
+			t.Errorf("%s: expected valid=%t, got %v", test.name, test.valid, err)
+			continue
+		}
+
+		if !test.valid {
+			continue
+		}
+
+		if len(tags) != len(test.tags) {
+			t.Errorf("%s: expected tags %#v, got %#v", test.name, test.tags, tags)
+			continue
+		}
+
+		// Tar entries come in map order
+		for _, tag := range test.tags {
+			found := false
+			for _, foundTag := range tags {
+				if foundTag == tag {
+					found = true
+				}
+			}
+
+			if !found {
+				t.Errorf("%s: expected tag %s in %#v", test.name, tag, tags)
+			}
+		}
+	}
+}
+
+func TestGetAppZipImage(t *testing.T) {
+	data := getTestAppZip(t, map[string]string{"tools/1.0.0/api.yaml": "name: x", "images/tools_1.0.0.tar": "x"})
+	imageFile, importErrors := getAppZipImage(bytes.NewReader(data), int64(len(data)))
+	if len(importErrors) > 0 || imageFile == nil || imageFile.Name != "images/tools_1.0.0.tar" {
+		t.Errorf("expected images/tools_1.0.0.tar, got %#v: %#v", imageFile, importErrors)
+	}
+
+	data = getTestAppZip(t, map[string]string{"tools/1.0.0/api.yaml": "name: x"})
+	imageFile, importErrors = getAppZipImage(bytes.NewReader(data), int64(len(data)))
+	if len(importErrors) > 0 || imageFile != nil {
+		t.Errorf("expected no image, got %#v: %#v", imageFile, importErrors)
+	}
+
+	data = getTestAppZip(t, map[string]string{"images/a.tar": "x", "images/b.tar": "x"})
+	_, importErrors = getAppZipImage(bytes.NewReader(data), int64(len(data)))
+	if len(importErrors) == 0 {
+		t.Errorf("expected an error for more than one image")
+	}
+}
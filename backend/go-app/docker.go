@@ -206,122 +206,64 @@ func fixTags(tags []string) []string {
 }
 */
 
-// Custom Docker image builder wrapper in memory
-func buildImageMemory(fs billy.Filesystem, tags []string, dockerfileFolder string, downloadIfFail bool) error {
-	ctx := context.Background()
-	client, err := client.NewEnvClient()
-	if err != nil {
-		log.Printf("Unable to create docker client: %s", err)
-		return err
-	}
-
+// Custom Docker image builder wrapper in memory. The build goes through the
+// app build queue.
+func buildImageMemory(fs billy.Filesystem, tags []string, dockerfileFolder string, downloadIfFail bool, orgId string) error {
 	buf := new(bytes.Buffer)
 	tw := tar.NewWriter(buf)
-	defer tw.Close()
 
 	log.Printf("[INFO] Setting up memory build structure for folder: %s", dockerfileFolder)
-	err = getParsedTarMemory(fs, tw, dockerfileFolder, "")
+	err := getParsedTarMemory(fs, tw, dockerfileFolder, "")
 	if err != nil {
 		log.Printf("Tar issue: %s", err)
 		return err
 	}
 
-	dockerFileTarReader := bytes.NewReader(buf.Bytes())
-
-	// Dockerfile is inside the TAR itself. Not local context
-	// docker build --build-arg http_proxy=http://my.proxy.url
-	// Attempt at setting name according to #359: https://github.com/frikky/Shuffle/issues/359
-	labels := map[string]string{}
-	//target := ""
-	//if len(tags) > 0 {
-	//	if strings.Contains(tags[0], ":") {
-	//		version := strings.Split(tags[0], ":")
-	//		if len(version) == 2 {
-	//			target = fmt.Sprintf("shuffle-build-%s", version[1])
-	//			tags = append(tags, target)
-	//			labels["name"] = target
-	//		}
-	//	}
-	//}
-
-	buildOptions := types.ImageBuildOptions{
-		Remove:    true,
-		Tags:      tags,
-		BuildArgs: map[string]*string{},
-		Labels:    labels,
+	err = tw.Close()
+	if err != nil {
+		return err
 	}
-	// NetworkMode: "host",
 
-	httpProxy := os.Getenv("HTTP_PROXY")
-	if len(httpProxy) > 0 {
-		buildOptions.BuildArgs["HTTP_PROXY"] = &httpProxy
-	}
-	httpsProxy := os.Getenv("HTTPS_PROXY")
-	if len(httpProxy) > 0 {
-		buildOptions.BuildArgs["HTTPS_PROXY"] = &httpsProxy
+	// Dockerfile is inside the TAR itself. Not local context
+	job := queueDockerBuild(tags, dockerfileFolder, orgId, buf.Bytes())
+	err = job.wait()
+	if err == nil || !downloadIfFail || job.getBuild().Status == "cancelled" {
+		return err
 	}
 
-	// Build the actual image
-	log.Printf(`[INFO] Building %s with proxy "%s". Tags: "%s". This may take up to a few minutes.`, dockerfileFolder, httpsProxy, strings.Join(tags, ","))
-	imageBuildResponse, err := client.ImageBuild(
-		ctx,
-		dockerFileTarReader,
-		buildOptions,
-	)
+	log.Printf("[ERROR] Docker build %s failed: %s. Trying to pull tags from: %s", job.Build.Id, err, strings.Join(tags, "\n"))
 
-	//log.Printf("RESPONSE: %#v", imageBuildResponse)
-	//log.Printf("Response: %#v", imageBuildResponse.Body)
-	//log.Printf("[DEBUG] IMAGERESPONSE: %#v", imageBuildResponse.Body)
-
-	if imageBuildResponse.Body != nil {
-		defer imageBuildResponse.Body.Close()
-		buildBuf := new(strings.Builder)
-		_, newerr := io.Copy(buildBuf, imageBuildResponse.Body)
-		if newerr != nil {
-			log.Printf("[WARNING] Failed reading Docker build STDOUT: %s", newerr)
-		} else {
-			log.Printf("[INFO] STRING: %s", buildBuf.String())
-			if strings.Contains(buildBuf.String(), "errorDetail") {
-				log.Printf("[ERROR] Docker build:\n%s\nERROR ABOVE: Trying to pull tags from: %s", buildBuf.String(), strings.Join(tags, "\n"))
-
-				// Handles pulling of the same image if applicable
-				// This fixes some issues with older versions of Docker which can't build
-				// on their own ( <17.05 )
-				pullOptions := types.ImagePullOptions{}
-				downloaded := false
-				for _, image := range tags {
-					// Is this ok? Not sure. Tags shouldn't be controlled here prolly.
-					image = strings.ToLower(image)
-
-					newImage := fmt.Sprintf("%s/%s", registryName, image)
-					log.Printf("[INFO] Pulling image %s", newImage)
-					reader, err := client.ImagePull(ctx, newImage, pullOptions)
-					if err != nil {
-						log.Printf("[ERROR] Failed getting image %s: %s", newImage, err)
-						continue
-					}
-
-					// Attempt to retag the image to not contain registry...
-
-					//newBuf := buildBuf
-					downloaded = true
-					io.Copy(os.Stdout, reader)
-					log.Printf("[INFO] Successfully downloaded and built %s", newImage)
-				}
-
-				if !downloaded {
+	// Handles pulling of the same image if applicable
+	// This fixes some issues with older versions of Docker which can't build
+	// on their own ( <17.05 )
+	ctx := context.Background()
+	client, err := client.NewEnvClient()
+	if err != nil {
+		log.Printf("Unable to create docker client: %s", err)
+		return err
+	}
 
-					return errors.New(fmt.Sprintf("Failed to build / download images %s", strings.Join(tags, ",")))
-				}
-				//baseDockerName
-			}
+	pullOptions := types.ImagePullOptions{}
+	downloaded := false
+	for _, image := range tags {
+		// Is this ok? Not sure. Tags shouldn't be controlled here prolly.
+		image = strings.ToLower(image)
+
+		newImage := fmt.Sprintf("%s/%s", registryName, image)
+		log.Printf("[INFO] Pulling image %s", newImage)
+		reader, err := client.ImagePull(ctx, newImage, pullOptions)
+		if err != nil {
+			log.Printf("[ERROR] Failed getting image %s: %s", newImage, err)
+			continue
 		}
-	}
 
-	if err != nil {
-		// Read the STDOUT from the build process
+		downloaded = true
+		io.Copy(os.Stdout, reader)
+		log.Printf("[INFO] Successfully downloaded and built %s", newImage)
+	}
 
-		return err
+	if !downloaded {
+		return errors.New(fmt.Sprintf("Failed to build / download images %s", strings.Join(tags, ",")))
 	}
 
 	return nil
@@ -348,200 +290,164 @@ func deleteJob(client *kubernetes.Clientset, jobName, namespace string) error {
 	})
 }
 
-func buildImage(tags []string, dockerfileFolder string) error {
+// Builds a folder with a Dockerfile through the app build queue. orgId is
+// the org the app is built for, or empty for the backend's own apps.
+func buildImage(tags []string, dockerfileFolder, orgId string) error {
+	dockerfileSplit := strings.Split(dockerfileFolder, "/")
+	baseDir := strings.Join(dockerfileSplit[0:len(dockerfileSplit)-1], "/")
+
+	// Builds the entire folder into buf. It's also what identical builds
+	// are found by.
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	err := getParsedTar(tw, baseDir, "")
+	if err != nil {
+		log.Printf("Tar issue: %s", err)
+	}
+	tw.Close()
 
-	isKubernetes := false
 	if os.Getenv("IS_KUBERNETES") == "true" {
-		isKubernetes = true
+		job := queueAppBuild(tags, dockerfileFolder, orgId, buf.Bytes(), func(ctx context.Context, job *appBuildJob) error {
+			return buildImageKubernetes(ctx, tags, dockerfileFolder)
+		})
+
+		return job.wait()
 	}
 
-	if isKubernetes {
-		// log.Printf("K8S ###################")
-		// log.Print("dockerfileFolder: ", dockerfileFolder)
-		// log.Print("tags: ", tags)
-		// log.Print("only tag: ", tags[1])
+	log.Printf("[INFO] Docker Tags: %s", tags)
+	job := queueDockerBuild(tags, dockerfileFolder, orgId, buf.Bytes())
+	err = job.wait()
+	if err != nil && job.getBuild().Status == "failed" {
+		return errors.New(fmt.Sprintf("Failed building %s: %s. The logs are in /api/v1/apps/builds/%s", strings.Join(tags, ","), err, job.Build.Id))
+	}
 
-		registryName := ""
-		if len(os.Getenv("REGISTRY_URL")) > 0 {
-			registryName = os.Getenv("REGISTRY_URL")
-		}
+	return err
+}
 
-		log.Printf("[INFO] registry name: %s", registryName)
+// Builds the image with a kaniko job in the cluster
+func buildImageKubernetes(ctx context.Context, tags []string, dockerfileFolder string) error {
+	// log.Printf("K8S ###################")
+	// log.Print("dockerfileFolder: ", dockerfileFolder)
+	// log.Print("tags: ", tags)
+	// log.Print("only tag: ", tags[1])
 
-		contextDir := strings.Replace(dockerfileFolder, "Dockerfile", "", -1)
-		contextDir = "/app/" + contextDir
-		log.Print("contextDir: ", contextDir)
-		dockerFile := "./Dockerfile"
+	registryName := ""
+	if len(os.Getenv("REGISTRY_URL")) > 0 {
+		registryName = os.Getenv("REGISTRY_URL")
+	}
 
-		client, err := getK8sClient()
-		if err != nil {
-			fmt.Printf("Unable to authencticate : %v\n", err)
-			return err
-		}
+	log.Printf("[INFO] registry name: %s", registryName)
 
-		BackendPodLabel := "io.kompose.service=backend"
+	contextDir := strings.Replace(dockerfileFolder, "Dockerfile", "", -1)
+	contextDir = "/app/" + contextDir
+	log.Print("contextDir: ", contextDir)
+	dockerFile := "./Dockerfile"
 
-		backendPodList, podListErr := client.CoreV1().Pods("shuffle").List(context.TODO(), metav1.ListOptions{
-			LabelSelector: BackendPodLabel,
-		})
+	client, err := getK8sClient()
+	if err != nil {
+		fmt.Printf("Unable to authencticate : %v\n", err)
+		return err
+	}
 
-		if podListErr != nil || len(backendPodList.Items) == 0 {
-			fmt.Println("Error getting backend pod or no pod found:", podListErr)
-			return podListErr
-		}
+	BackendPodLabel := "io.kompose.service=backend"
 
-		backendNodeName := backendPodList.Items[0].Spec.NodeName
-		log.Printf("[INFO] Backend running on: %s", backendNodeName)
+	backendPodList, podListErr := client.CoreV1().Pods("shuffle").List(ctx, metav1.ListOptions{
+		LabelSelector: BackendPodLabel,
+	})
 
-		job := &batchv1.Job{
-			ObjectMeta: metav1.ObjectMeta{
-				Name: "shuffle-app-builder",
-			},
-			Spec: batchv1.JobSpec{
-				Template: corev1.PodTemplateSpec{
-					Spec: corev1.PodSpec{
-						Containers: []corev1.Container{
-							{
-								Name:  "kaniko",
-								Image: "gcr.io/kaniko-project/executor:latest",
-								Args: []string{
-									"--verbosity=debug",
-									"--dockerfile=" + dockerFile,
-									"--context=dir://" + contextDir,
-									"--skip-tls-verify",
-									"--destination=" + registryName + "/" + tags[1],
-								},
-								VolumeMounts: []corev1.VolumeMount{
-									{
-										Name:      "kaniko-workspace",
-										MountPath: "/app/generated",
-									},
+	if podListErr != nil || len(backendPodList.Items) == 0 {
+		fmt.Println("Error getting backend pod or no pod found:", podListErr)
+		return podListErr
+	}
+
+	backendNodeName := backendPodList.Items[0].Spec.NodeName
+	log.Printf("[INFO] Backend running on: %s", backendNodeName)
+
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "shuffle-app-builder-",
+		},
+		Spec: batchv1.JobSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name:  "kaniko",
+							Image: "gcr.io/kaniko-project/executor:latest",
+							Args: []string{
+								"--verbosity=debug",
+								"--dockerfile=" + dockerFile,
+								"--context=dir://" + contextDir,
+								"--skip-tls-verify",
+								"--destination=" + registryName + "/" + tags[1],
+							},
+							VolumeMounts: []corev1.VolumeMount{
+								{
+									Name:      "kaniko-workspace",
+									MountPath: "/app/generated",
 								},
 							},
 						},
-						NodeSelector: map[string]string{
-							"node": backendNodeName,
-						},
-						RestartPolicy: corev1.RestartPolicyNever,
-						Volumes: []corev1.Volume{
-							{
-								Name: "kaniko-workspace",
-								VolumeSource: corev1.VolumeSource{
-									PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
-										ClaimName: "backend-apps-claim",
-									},
+					},
+					NodeSelector: map[string]string{
+						"node": backendNodeName,
+					},
+					RestartPolicy: corev1.RestartPolicyNever,
+					Volumes: []corev1.Volume{
+						{
+							Name: "kaniko-workspace",
+							VolumeSource: corev1.VolumeSource{
+								PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+									ClaimName: "backend-apps-claim",
 								},
 							},
 						},
 					},
 				},
 			},
-		}
+		},
+	}
 
-		createdJob, err := client.BatchV1().Jobs("shuffle").Create(context.TODO(), job, metav1.CreateOptions{})
-		if err != nil {
-			log.Printf("Failed to start image builder job: %s", err)
-			return err
-		}
+	createdJob, err := client.BatchV1().Jobs("shuffle").Create(ctx, job, metav1.CreateOptions{})
+	if err != nil {
+		log.Printf("Failed to start image builder job: %s", err)
+		return err
+	}
 
-		timeout := time.After(5 * time.Minute)
-		tick := time.Tick(5 * time.Second)
+	timeout := time.After(5 * time.Minute)
+	tick := time.Tick(5 * time.Second)
 
-		for {
-			select {
-			case <-timeout:
-				return fmt.Errorf("job didn't complete within the expected time")
-			case <-tick:
-				currentJob, err := client.BatchV1().Jobs("shuffle").Get(context.TODO(), createdJob.Name, metav1.GetOptions{})
+	for {
+		select {
+		case <-ctx.Done():
+			deleteJob(client, createdJob.Name, "shuffle")
+			return ctx.Err()
+		case <-timeout:
+			return fmt.Errorf("job didn't complete within the expected time")
+		case <-tick:
+			currentJob, err := client.BatchV1().Jobs("shuffle").Get(ctx, createdJob.Name, metav1.GetOptions{})
+			if err != nil {
+				return fmt.Errorf("[ERROR] failed to fetch %s status: %v", createdJob.Name, err)
+			}
+
+			if currentJob.Status.Succeeded > 0 {
+				log.Printf("[INFO] Job %s completed successfully!", createdJob.Name)
+				log.Printf("[INFO] Cleaning up the job %s", createdJob.Name)
+				err := deleteJob(client, createdJob.Name, "shuffle")
 				if err != nil {
-					return fmt.Errorf("[ERROR] failed to fetch %s status: %v", createdJob.Name, err)
+					return fmt.Errorf("[ERROR] failed deleting job %s with error: %s", createdJob.Name, err)
 				}
-
-				if currentJob.Status.Succeeded > 0 {
-					log.Printf("[INFO] Job %s completed successfully!", createdJob.Name)
-					log.Printf("[INFO] Cleaning up the job %s", createdJob.Name)
-					err := deleteJob(client, createdJob.Name, "shuffle")
-					if err != nil {
-						return fmt.Errorf("[ERROR] failed deleting job %s with error: %s", createdJob.Name, err)
-					}
-					log.Println("Job deleted successfully!")
-					return nil
-				} else if currentJob.Status.Failed > 0 {
-					log.Printf("[ERROR] %s job failed with error: %s", createdJob.Name, err)
-					err := deleteJob(client, createdJob.Name, "shuffle")
-					if err != nil {
-						return fmt.Errorf("[ERROR] failed deleting job %s with error: %s", createdJob.Name, err)
-					}
+				log.Println("Job deleted successfully!")
+				return nil
+			} else if currentJob.Status.Failed > 0 {
+				log.Printf("[ERROR] %s job failed with error: %s", createdJob.Name, err)
+				err := deleteJob(client, createdJob.Name, "shuffle")
+				if err != nil {
+					return fmt.Errorf("[ERROR] failed deleting job %s with error: %s", createdJob.Name, err)
 				}
 			}
 		}
-	} else {
-
-		ctx := context.Background()
-		client, err := client.NewEnvClient()
-		if err != nil {
-			log.Printf("Unable to create docker client: %s", err)
-			return err
-		}
-
-		log.Printf("[INFO] Docker Tags: %s", tags)
-		dockerfileSplit := strings.Split(dockerfileFolder, "/")
-
-		// Create a buffer
-		buf := new(bytes.Buffer)
-		tw := tar.NewWriter(buf)
-		defer tw.Close()
-		baseDir := strings.Join(dockerfileSplit[0:len(dockerfileSplit)-1], "/")
-
-		// Builds the entire folder into buf
-		err = getParsedTar(tw, baseDir, "")
-		if err != nil {
-			log.Printf("Tar issue: %s", err)
-		}
-
-		dockerFileTarReader := bytes.NewReader(buf.Bytes())
-		buildOptions := types.ImageBuildOptions{
-			Remove:    true,
-			Tags:      tags,
-			BuildArgs: map[string]*string{},
-		}
-		//NetworkMode: "host",
-
-		httpProxy := os.Getenv("HTTP_PROXY")
-		if len(httpProxy) > 0 {
-			buildOptions.BuildArgs["HTTP_PROXY"] = &httpProxy
-		}
-		httpsProxy := os.Getenv("HTTPS_PROXY")
-		if len(httpProxy) > 0 {
-			buildOptions.BuildArgs["https_proxy"] = &httpsProxy
-		}
-
-		// Build the actual image
-		imageBuildResponse, err := client.ImageBuild(
-			ctx,
-			dockerFileTarReader,
-			buildOptions,
-		)
-
-		if err != nil {
-			return err
-		}
-
-		// Read the STDOUT from the build process
-		defer imageBuildResponse.Body.Close()
-		buildBuf := new(strings.Builder)
-		_, err = io.Copy(buildBuf, imageBuildResponse.Body)
-		if err != nil {
-			return err
-		} else {
-			if strings.Contains(buildBuf.String(), "errorDetail") {
-				log.Printf("[ERROR] Docker build:\n%s\nERROR ABOVE: Trying to pull tags from: %s", buildBuf.String(), strings.Join(tags, "\n"))
-				return errors.New(fmt.Sprintf("Failed building %s. Check backend logs for details. Most likely means you have an old version of Docker.", strings.Join(tags, ",")))
-			}
-		}
-
 	}
-	return nil
 }
 
 // Checks if an image exists
@@ -0,0 +1,703 @@
+package main
+
+// Hooks that listen for events themselves instead of being called over HTTP:
+// syslog (UDP/TCP) and inbound SMTP. Every event goes through the hook's
+// filters and transforms before starting executions with handleExecution.
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shuffle/shuffle-shared"
+)
+
+var listenerHookTypes = []string{"syslog", "smtp"}
+
+// Max size of a single syslog message or email
+var hookListenerMaxSize = 10 * 1024 * 1024
+
+// Events handled at the same time per listener. Syslog over UDP stops reading
+// while they're all busy, and the OS drops what doesn't fit in its buffer.
+var hookListenerMaxEvents = 20
+
+// Open TCP connections per listener. More are closed right away.
+var hookListenerMaxConnections = 50
+
+// TCP connections without data for this long are closed
+var hookListenerIdleTimeout = 5 * time.Minute
+
+type hookListenerConfig struct {
+	// syslog: udp or tcp
+	Protocol string `json:"protocol"`
+
+	// Address to bind to. Defaults to 127.0.0.1, so other hosts can only
+	// send events when the address is set, e.g. to 0.0.0.0.
+	Address string `json:"address"`
+	Port    int    `json:"port"`
+}
+
+type hookListener struct {
+	Hook    shuffle.Hook
+	Config  hookConfig
+	Started time.Time
+
+	quit        chan bool
+	closers     []io.Closer
+	stopOnce    sync.Once
+	events      chan bool
+	connections chan bool
+}
+
+var hookListeners = map[string]*hookListener{}
+var hookListenersLock sync.Mutex
+
+func isListenerHookType(hookType string) bool {
+	for _, item := range listenerHookTypes {
+		if item == hookType {
+			return true
+		}
+	}
+
+	return false
+}
+
+func validateHookListener(hookType string, listener hookListenerConfig) error {
+	if listener.Port < 1 || listener.Port > 65535 {
+		return errors.New("A port between 1 and 65535 is required")
+	}
+
+	if hookType == "syslog" && listener.Protocol != "udp" && listener.Protocol != "tcp" {
+		return errors.New("Protocol has to be udp or tcp")
+	}
+
+	return nil
+}
+
+// Starts, restarts or stops the listener based on the hook status
+func syncHookListener(hook shuffle.Hook, config hookConfig) error {
+	stopHookListener(hook.Id)
+	if !isListenerHookType(hook.Type) || hook.Status != "running" {
+		return nil
+	}
+
+	return startHookListener(hook, config)
+}
+
+func startHookListener(hook shuffle.Hook, config hookConfig) error {
+	listener := &hookListener{
+		Hook:    hook,
+		Config:  config,
+		Started: time.Now(),
+		quit:    make(chan bool),
+		events:  make(chan bool, hookListenerMaxEvents),
+
+		connections: make(chan bool, hookListenerMaxConnections),
+	}
+
+	var err error
+	switch hook.Type {
+	case "syslog":
+		err = listener.startSyslog()
+	case "smtp":
+		err = listener.startSmtp()
+	default:
+		err = errors.New(fmt.Sprintf("Hook type %s doesn't have a listener", hook.Type))
+	}
+
+	if err != nil {
+		listener.Stop()
+		return err
+	}
+
+	hookListenersLock.Lock()
+	hookListeners[hook.Id] = listener
+	hookListenersLock.Unlock()
+
+	log.Printf("[INFO] Started %s listener for hook %s", hook.Type, hook.Id)
+	return nil
+}
+
+func stopHookListener(hookId string) bool {
+	hookListenersLock.Lock()
+	listener, exists := hookListeners[hookId]
+	delete(hookListeners, hookId)
+	hookListenersLock.Unlock()
+
+	if !exists {
+		return false
+	}
+
+	listener.Stop()
+	log.Printf("[INFO] Stopped %s listener for hook %s", listener.Hook.Type, hookId)
+	return true
+}
+
+func (listener *hookListener) Stop() {
+	listener.stopOnce.Do(func() {
+		close(listener.quit)
+		for _, closer := range listener.closers {
+			closer.Close()
+		}
+	})
+}
+
+func (listener *hookListener) stopped() bool {
+	select {
+	case <-listener.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// Runs the hook's workflows with the event, the same way as a webhook call.
+// Returns an error if no execution could be started. Events that are
+// filtered out or can't be transformed aren't errors, as retrying won't help.
+func (listener *hookListener) handleEvent(event map[string]interface{}) error {
+	hook := listener.Hook
+	config := listener.Config
+	ctx := context.Background()
+
+	// Same allowlist as for webhook calls
+	sourceIp, _ := event["source_ip"].(string)
+	if !listener.isIpAllowed(sourceIp) {
+		log.Printf("[AUDIT] Dropping %s event to hook %s from %s, which isn't in the allowed IPs", hook.Type, hook.Id, sourceIp)
+		return nil
+	}
+
+	parsedEvent := map[string]interface{}{
+		"body":    event,
+		"headers": map[string]interface{}{},
+		"query":   map[string]interface{}{},
+	}
+
+	if !matchWebhookFilters(parsedEvent, config.Filters, config.FilterMode) {
+		return nil
+	}
+
+	var argument string
+	if len(config.Transforms) > 0 {
+		var err error
+		argument, err = getWebhookTransformedArgument(parsedEvent, config.Transforms)
+		if err != nil {
+			log.Printf("[WARNING] Failed transforming %s event for hook %s: %s", hook.Type, hook.Id, err)
+			return nil
+		}
+	} else {
+		marshalled, err := json.Marshal(event)
+		if err != nil {
+			log.Printf("[WARNING] Failed marshalling %s event for hook %s: %s", hook.Type, hook.Id, err)
+			return nil
+		}
+
+		argument = string(marshalled)
+	}
+
+	newBody := shuffle.ExecutionStruct{
+		Start:             hook.Start,
+		ExecutionSource:   hook.Type,
+		ExecutionArgument: argument,
+	}
+
+	if len(hook.Workflows) == 1 {
+		workflow, err := shuffle.GetWorkflow(ctx, hook.Workflows[0])
+		if err == nil {
+			for _, branch := range workflow.Branches {
+				if branch.SourceID == hook.Id && branch.DestinationID != hook.Start {
+					newBody.Start = branch.DestinationID
+					break
+				}
+			}
+		}
+	}
+
+	b, err := json.Marshal(newBody)
+	if err != nil {
+		log.Printf("[ERROR] Failed marshalling execution for hook %s: %s", hook.Id, err)
+		return nil
+	}
+
+	started := 0
+	for _, item := range hook.Workflows {
+		newRequest := &http.Request{
+			URL:    &url.URL{},
+			Method: "POST",
+			Body:   ioutil.NopCloser(bytes.NewReader(b)),
+		}
+
+		workflowExecution, _, err := handleExecution(item, shuffle.Workflow{ID: ""}, newRequest, hook.OrgId)
+		if err != nil {
+			log.Printf("[WARNING] Failed running workflow %s from %s hook %s: %s", item, hook.Type, hook.Id, err)
+			continue
+		}
+
+		started += 1
+		log.Printf("[INFO] Started execution %s for workflow %s from %s hook %s", workflowExecution.ExecutionId, item, hook.Type, hook.Id)
+	}
+
+	if started == 0 && len(hook.Workflows) > 0 {
+		return errors.New(fmt.Sprintf("None of the %d workflows could be started", len(hook.Workflows)))
+	}
+
+	return nil
+}
+
+// Handles the event in the background. Waits while hookListenerMaxEvents
+// events are being handled already.
+func (listener *hookListener) handleEventAsync(event map[string]interface{}) {
+	select {
+	case listener.events <- true:
+	case <-listener.quit:
+		return
+	}
+
+	go func() {
+		defer func() {
+			<-listener.events
+		}()
+
+		listener.handleEvent(event)
+	}()
+}
+
+func (listener *hookListener) isIpAllowed(sourceIp string) bool {
+	allowedIps := listener.Config.Verification.AllowedIps
+	return len(allowedIps) == 0 || isWebhookIpAllowed(sourceIp, allowedIps)
+}
+
+func (listener *hookListener) getListenAddress() string {
+	address := listener.Config.Listener.Address
+	if len(address) == 0 {
+		address = "127.0.0.1"
+	}
+
+	return net.JoinHostPort(address, strconv.Itoa(listener.Config.Listener.Port))
+}
+
+// Accepts TCP connections until the listener stops. Connections over
+// hookListenerMaxConnections or from IPs that aren't allowed are closed.
+func (listener *hookListener) acceptConnections(tcpListener net.Listener, handler func(net.Conn)) {
+	for {
+		conn, err := tcpListener.Accept()
+		if err != nil {
+			if !listener.stopped() {
+				log.Printf("[WARNING] %s listener for hook %s stopped: %s", listener.Hook.Type, listener.Hook.Id, err)
+			}
+
+			return
+		}
+
+		sourceIp := getAddressHost(conn.RemoteAddr().String())
+		if !listener.isIpAllowed(sourceIp) {
+			log.Printf("[AUDIT] Closing connection to %s hook %s from %s, which isn't in the allowed IPs", listener.Hook.Type, listener.Hook.Id, sourceIp)
+			conn.Close()
+			continue
+		}
+
+		select {
+		case listener.connections <- true:
+		default:
+			log.Printf("[WARNING] Closing connection to %s hook %s from %s: %d connections are open already", listener.Hook.Type, listener.Hook.Id, sourceIp, hookListenerMaxConnections)
+			conn.Close()
+			continue
+		}
+
+		go func() {
+			defer func() {
+				<-listener.connections
+			}()
+
+			handler(conn)
+		}()
+	}
+}
+
+func (listener *hookListener) startSyslog() error {
+	address := listener.getListenAddress()
+	if listener.Config.Listener.Protocol == "udp" {
+		conn, err := net.ListenPacket("udp", address)
+		if err != nil {
+			return err
+		}
+
+		listener.closers = append(listener.closers, conn)
+		go func() {
+			buffer := make([]byte, 65536)
+			for {
+				length, addr, err := conn.ReadFrom(buffer)
+				if err != nil {
+					if !listener.stopped() {
+						log.Printf("[WARNING] Syslog listener for hook %s stopped: %s", listener.Hook.Id, err)
+					}
+
+					return
+				}
+
+				event := parseSyslogMessage(string(buffer[:length]))
+				event["source_ip"] = getAddressHost(addr.String())
+				listener.handleEventAsync(event)
+			}
+		}()
+
+		return nil
+	}
+
+	tcpListener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	listener.closers = append(listener.closers, tcpListener)
+	go listener.acceptConnections(tcpListener, listener.handleSyslogConnection)
+	return nil
+}
+
+// One message per line (non-transparent framing)
+func (listener *hookListener) handleSyslogConnection(conn net.Conn) {
+	defer conn.Close()
+
+	sourceIp := getAddressHost(conn.RemoteAddr().String())
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 65536), hookListenerMaxSize)
+	conn.SetReadDeadline(time.Now().Add(hookListenerIdleTimeout))
+	for scanner.Scan() {
+		if listener.stopped() {
+			return
+		}
+
+		conn.SetReadDeadline(time.Now().Add(hookListenerIdleTimeout))
+
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+
+		event := parseSyslogMessage(line)
+		event["source_ip"] = sourceIp
+		listener.handleEventAsync(event)
+	}
+}
+
+func getAddressHost(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+
+	return host
+}
+
+// Parses RFC 5424 and RFC 3164 messages. Fields that can't be found are left out.
+func parseSyslogMessage(raw string) map[string]interface{} {
+	raw = strings.TrimRight(raw, "\r\n\x00")
+	event := map[string]interface{}{
+		"raw":     raw,
+		"message": raw,
+	}
+
+	if !strings.HasPrefix(raw, "<") {
+		return event
+	}
+
+	end := strings.Index(raw, ">")
+	if end < 2 || end > 4 {
+		return event
+	}
+
+	priority, err := strconv.Atoi(raw[1:end])
+	if err != nil || priority > 191 {
+		return event
+	}
+
+	event["priority"] = priority
+	event["facility"] = priority / 8
+	event["severity"] = priority % 8
+	rest := raw[end+1:]
+
+	// RFC 5424: VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+	if strings.HasPrefix(rest, "1 ") {
+		fields := strings.SplitN(rest, " ", 7)
+		if len(fields) == 7 {
+			names := []string{"version", "timestamp", "hostname", "app_name", "proc_id", "msg_id"}
+			for index, name := range names {
+				if fields[index] != "-" {
+					event[name] = fields[index]
+				}
+			}
+
+			message := fields[6]
+			if strings.HasPrefix(message, "- ") || message == "-" {
+				message = strings.TrimPrefix(strings.TrimPrefix(message, "-"), " ")
+			} else if strings.HasPrefix(message, "[") {
+				sdEnd := strings.LastIndex(message, "] ")
+				if sdEnd == -1 {
+					event["structured_data"] = message
+					message = ""
+				} else {
+					event["structured_data"] = message[:sdEnd+1]
+					message = message[sdEnd+2:]
+				}
+			}
+
+			event["message"] = strings.TrimPrefix(message, "\ufeff")
+			return event
+		}
+	}
+
+	// RFC 3164: Mmm dd hh:mm:ss HOSTNAME TAG: MSG
+	if len(rest) > 16 {
+		if _, err := time.Parse(time.Stamp, rest[:15]); err == nil {
+			event["timestamp"] = rest[:15]
+			rest = strings.TrimSpace(rest[15:])
+			fields := strings.SplitN(rest, " ", 2)
+			if len(fields) == 2 {
+				event["hostname"] = fields[0]
+				rest = fields[1]
+			}
+
+			tagEnd := strings.Index(rest, ":")
+			if tagEnd > 0 && tagEnd < 48 && !strings.Contains(rest[:tagEnd], " ") {
+				event["app_name"] = rest[:tagEnd]
+				rest = strings.TrimSpace(rest[tagEnd+1:])
+			}
+		}
+	}
+
+	event["message"] = rest
+	return event
+}
+
+func (listener *hookListener) startSmtp() error {
+	tcpListener, err := net.Listen("tcp", listener.getListenAddress())
+	if err != nil {
+		return err
+	}
+
+	listener.closers = append(listener.closers, tcpListener)
+	go listener.acceptConnections(tcpListener, listener.handleSmtpConnection)
+	return nil
+}
+
+// Minimal SMTP server that turns each message into an event. It doesn't
+// support TLS or authentication, so only the IP allowlist decides who can
+// send. It should only be reachable from a trusted mail relay.
+func (listener *hookListener) handleSmtpConnection(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Minute))
+
+	reader := bufio.NewReader(conn)
+	write := func(line string) {
+		conn.Write([]byte(line + "\r\n"))
+	}
+
+	sourceIp := getAddressHost(conn.RemoteAddr().String())
+	from := ""
+	recipients := []string{}
+
+	write("220 Shuffle ESMTP ready")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		command := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch command {
+		case "HELO":
+			write("250 Shuffle")
+		case "EHLO":
+			write("250-Shuffle")
+			write(fmt.Sprintf("250 SIZE %d", hookListenerMaxSize))
+		case "MAIL":
+			from = getSmtpAddress(line)
+			recipients = []string{}
+			write("250 OK")
+		case "RCPT":
+			recipients = append(recipients, getSmtpAddress(line))
+			write("250 OK")
+		case "DATA":
+			if len(from) == 0 || len(recipients) == 0 {
+				write("503 Need MAIL and RCPT first")
+				continue
+			}
+
+			write("354 End data with <CR><LF>.<CR><LF>")
+			data, err := readSmtpData(reader)
+			if err != nil {
+				write("552 Message too big or broken")
+				return
+			}
+
+			event, err := parseEmailMessage(data)
+			if err != nil {
+				log.Printf("[WARNING] Failed parsing email to hook %s: %s", listener.Hook.Id, err)
+				write("554 Failed parsing message")
+				continue
+			}
+
+			event["smtp_from"] = from
+			event["smtp_to"] = recipients
+			event["source_ip"] = sourceIp
+			listener.handleEventAsync(event)
+
+			from = ""
+			recipients = []string{}
+			write("250 OK: queued")
+		case "RSET":
+			from = ""
+			recipients = []string{}
+			write("250 OK")
+		case "NOOP":
+			write("250 OK")
+		case "QUIT":
+			write("221 Bye")
+			return
+		default:
+			write("502 Command not implemented")
+		}
+	}
+}
+
+// Gets the address from e.g. "MAIL FROM:<user@example.com> SIZE=123"
+func getSmtpAddress(line string) string {
+	start := strings.Index(line, "<")
+	end := strings.Index(line, ">")
+	if start != -1 && end > start {
+		return line[start+1 : end]
+	}
+
+	parts := strings.SplitN(line, ":", 2)
+	if len(parts) == 2 {
+		return strings.TrimSpace(parts[1])
+	}
+
+	return ""
+}
+
+// Reads until a line with only a dot, removing dot stuffing
+func readSmtpData(reader *bufio.Reader) ([]byte, error) {
+	data := []byte{}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return data, err
+		}
+
+		if strings.TrimRight(line, "\r\n") == "." {
+			return data, nil
+		}
+
+		if strings.HasPrefix(line, "..") {
+			line = line[1:]
+		}
+
+		data = append(data, []byte(line)...)
+		if len(data) > hookListenerMaxSize {
+			return data, errors.New("Message too big")
+		}
+	}
+}
+
+func parseEmailMessage(data []byte) (map[string]interface{}, error) {
+	message, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := ioutil.ReadAll(message.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	headers := map[string]interface{}{}
+	for key, values := range message.Header {
+		headers[key] = strings.Join(values, ", ")
+	}
+
+	return map[string]interface{}{
+		"from":       message.Header.Get("From"),
+		"to":         message.Header.Get("To"),
+		"cc":         message.Header.Get("Cc"),
+		"subject":    message.Header.Get("Subject"),
+		"date":       message.Header.Get("Date"),
+		"message_id": message.Header.Get("Message-Id"),
+		"headers":    headers,
+		"body":       string(body),
+	}, nil
+}
+
+// Keeps the status code written through it
+type statusResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (writer *statusResponseWriter) WriteHeader(status int) {
+	writer.status = status
+	writer.ResponseWriter.WriteHeader(status)
+}
+
+// DELETE /api/v1/hooks/{key}/delete. Deletes the hook with
+// shuffle.HandleDeleteHook, then stops its listener and removes its config.
+func handleDeleteHook(resp http.ResponseWriter, request *http.Request) {
+	writer := &statusResponseWriter{ResponseWriter: resp, status: 200}
+	shuffle.HandleDeleteHook(writer, request)
+	if request.Method != "DELETE" || writer.status != 200 {
+		return
+	}
+
+	location := strings.Split(request.URL.Path, "/")
+	if len(location) <= 4 {
+		return
+	}
+
+	hookId := strings.TrimPrefix(location[4], "webhook_")
+	stopHookListener(hookId)
+	err := deleteHookConfig(context.Background(), hookId)
+	if err != nil {
+		log.Printf("[WARNING] Failed deleting config of deleted hook %s: %s", hookId, err)
+	}
+}
+
+// Starts listeners for running hooks. Listener hooks always have a config.
+func startHookListeners(ctx context.Context) {
+	documents, err := searchEsDocuments(ctx, "hook_configs", nil, 10000)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting hook configs to start listeners: %s", err)
+		return
+	}
+
+	for _, document := range documents {
+		config := hookConfig{}
+		err = json.Unmarshal(document.Source, &config)
+		if err != nil || !isListenerHookType(config.Type) {
+			continue
+		}
+
+		hook, err := shuffle.GetHook(ctx, config.HookId)
+		if err != nil {
+			log.Printf("[WARNING] Failed getting hook %s to start its listener: %s", config.HookId, err)
+			continue
+		}
+
+		err = syncHookListener(*hook, config)
+		if err != nil {
+			log.Printf("[ERROR] Failed starting %s listener for hook %s: %s", hook.Type, hook.Id, err)
+		}
+	}
+}
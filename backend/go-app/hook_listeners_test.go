@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/shuffle/shuffle-shared"
+)
+
+func TestParseSyslogMessage(t *testing.T) {
+	event := parseSyslogMessage("<34>1 2024-01-01T10:00:00Z host1 sshd 1234 ID47 - Failed password for root")
+	expected := map[string]interface{}{
+		"priority":  34,
+		"facility":  4,
+		"severity":  2,
+		"timestamp": "2024-01-01T10:00:00Z",
+		"hostname":  "host1",
+		"app_name":  "sshd",
+		"proc_id":   "1234",
+		"msg_id":    "ID47",
+		"message":   "Failed password for root",
+	}
+
+	for key, value := range expected {
+		if event[key] != value {
+			t.Errorf("RFC 5424 %s: got %v, expected %v", key, event[key], value)
+		}
+	}
+
+	event = parseSyslogMessage("<13>Feb  5 17:32:18 host2 kernel: Out of memory")
+	expected = map[string]interface{}{
+		"priority":  13,
+		"timestamp": "Feb  5 17:32:18",
+		"hostname":  "host2",
+		"app_name":  "kernel",
+		"message":   "Out of memory",
+	}
+
+	for key, value := range expected {
+		if event[key] != value {
+			t.Errorf("RFC 3164 %s: got %v, expected %v", key, event[key], value)
+		}
+	}
+
+	event = parseSyslogMessage("plain message\n")
+	if event["message"] != "plain message" || event["priority"] != nil {
+		t.Errorf("Plain message parsed wrong: %#v", event)
+	}
+}
+
+func startTestSyslogListener(t *testing.T, allowedIps []string) (*hookListener, string) {
+	listener := &hookListener{
+		Hook:        shuffle.Hook{Id: "hook", Type: "syslog"},
+		Config:      hookConfig{Listener: hookListenerConfig{Protocol: "tcp"}},
+		quit:        make(chan bool),
+		events:      make(chan bool, hookListenerMaxEvents),
+		connections: make(chan bool, 1),
+	}
+
+	listener.Config.Verification.AllowedIps = allowedIps
+	err := listener.startSyslog()
+	if err != nil {
+		t.Fatalf("Failed starting syslog listener: %s", err)
+	}
+
+	t.Cleanup(listener.Stop)
+	return listener, listener.closers[0].(net.Listener).Addr().String()
+}
+
+func isTestConnectionClosed(t *testing.T, address string) bool {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("Failed connecting: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, err = conn.Read(make([]byte, 1))
+	netErr, isNetErr := err.(net.Error)
+	return err != nil && !(isNetErr && netErr.Timeout())
+}
+
+func TestHookListenerConnections(t *testing.T) {
+	listener := &hookListener{Config: hookConfig{Listener: hookListenerConfig{Port: 514}}}
+	if address := listener.getListenAddress(); address != "127.0.0.1:514" {
+		t.Errorf("Expected listeners to bind to 127.0.0.1 by default, got %s", address)
+	}
+
+	// Only one connection is allowed at a time in these tests
+	_, address := startTestSyslogListener(t, nil)
+	if isTestConnectionClosed(t, address) || !isTestConnectionClosed(t, address) {
+		t.Errorf("Expected only the connection over the limit to be closed")
+	}
+
+	listener, address = startTestSyslogListener(t, []string{"10.0.0.0/8"})
+	if !isTestConnectionClosed(t, address) {
+		t.Errorf("Expected the connection from an IP outside the allowlist to be closed")
+	}
+
+	if listener.isIpAllowed("127.0.0.1") || !listener.isIpAllowed("10.1.2.3") {
+		t.Errorf("Expected events to be checked against the allowed IPs")
+	}
+}
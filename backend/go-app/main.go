@@ -4,7 +4,6 @@ import (
 	uuid "github.com/satori/go.uuid"
 	"github.com/shuffle/shuffle-shared"
 
-	"archive/zip"
 	"bufio"
 	"bytes"
 	"context"
@@ -1366,10 +1365,10 @@ func handleSetHook(resp http.ResponseWriter, request *http.Request) {
 			return
 		}
 
-		workflowId = location[4]
+		workflowId = strings.TrimPrefix(location[4], "webhook_")
 	}
 
-	if len(workflowId) != 32 {
+	if len(workflowId) != 36 {
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false, "message": "ID not valid"}`))
 		return
@@ -1384,8 +1383,6 @@ func handleSetHook(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	log.Println(jsonPrettyPrint(string(body)))
-
 	var hook shuffle.Hook
 	err = json.Unmarshal(body, &hook)
 	if err != nil {
@@ -1395,10 +1392,10 @@ func handleSetHook(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	if user.Id != hook.Owner && user.Role != "admin" && user.Role != "scheduler" {
-		log.Printf("Wrong user (%s) for hook %s", user.Username, hook.Id)
+	if user.Role == "org-reader" {
+		log.Printf("[WARNING] Org-reader doesn't have access to edit hook %s: %s (%s)", workflowId, user.Username, user.Id)
 		resp.WriteHeader(401)
-		resp.Write([]byte(`{"success": false}`))
+		resp.Write([]byte(`{"success": false, "reason": "Read only user"}`))
 		return
 	}
 
@@ -1420,16 +1417,84 @@ func handleSetHook(resp http.ResponseWriter, request *http.Request) {
 	}
 
 	// Get the ID to see whether it exists
-	// FIXME - use return and set READONLY fields (don't allow change from User)
 	ctx := context.Background()
-	_, err = shuffle.GetHook(ctx, workflowId)
-	if err != nil {
-		log.Printf("[WARNING] Failed getting hook %s (set): %s", workflowId, err)
+	existingHook, err := shuffle.GetHook(ctx, workflowId)
+	if err != nil || existingHook.OrgId != user.ActiveOrg.Id {
+		log.Printf("[WARNING] Failed getting hook %s (set): %v", workflowId, err)
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false, "message": "Invalid ID"}`))
 		return
 	}
 
+	if user.Id != existingHook.Owner && user.Role != "admin" && user.Role != "scheduler" {
+		log.Printf("Wrong user (%s) for hook %s", user.Username, hook.Id)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	// Listener hooks open ports on the backend
+	if (isListenerHookType(hook.Type) || isListenerHookType(existingHook.Type)) && user.Role != "admin" {
+		log.Printf("[AUDIT] User %s (%s) tried to set up %s listener hook %s without being admin", user.Username, user.Id, hook.Type, hook.Id)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "message": "Only admins can set up syslog and SMTP hooks"}`))
+		return
+	}
+
+	// Read-only fields are kept from the stored hook
+	hook.Id = existingHook.Id
+	hook.OrgId = existingHook.OrgId
+	hook.Owner = existingHook.Owner
+
+	for _, hookWorkflowId := range hook.Workflows {
+		workflow, err := shuffle.GetWorkflow(ctx, hookWorkflowId)
+		if err != nil || workflow.OrgId != user.ActiveOrg.Id {
+			log.Printf("[WARNING] User %s (%s) tried to point hook %s at workflow %s outside their org", user.Username, user.Id, hook.Id, hookWorkflowId)
+			resp.WriteHeader(401)
+			resp.Write([]byte(`{"success": false, "message": "Invalid workflow"}`))
+			return
+		}
+	}
+
+	// Listener settings for syslog and smtp hooks
+	extraOptions := struct {
+		Listener *hookListenerConfig `json:"listener"`
+	}{}
+	json.Unmarshal(body, &extraOptions)
+
+	hookConf, err := loadHookConfig(ctx, hook.Id)
+	if err != nil {
+		log.Printf("[WARNING] Failed loading config for hook %s (set): %s", hook.Id, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "message": "Failed loading hook config"}`))
+		return
+	}
+
+	if extraOptions.Listener != nil {
+		hookConf.Listener = *extraOptions.Listener
+	}
+
+	if isListenerHookType(hook.Type) {
+		err = validateHookListener(hook.Type, hookConf.Listener)
+		if err != nil {
+			writeHookFailure(resp, 400, "message", fmt.Sprintf("Invalid listener for %s hook: %s", hook.Type, err))
+			return
+		}
+	}
+
+	if isListenerHookType(hook.Type) || hookConf.Type != hook.Type {
+		hookConf.OrgId = existingHook.OrgId
+		hookConf.Type = hook.Type
+		hookConf.Updated = time.Now().Unix()
+		err = setHookConfig(ctx, hookConf)
+		if err != nil {
+			log.Printf("[WARNING] Failed setting config for hook %s: %s", hook.Id, err)
+			resp.WriteHeader(500)
+			resp.Write([]byte(`{"success": false, "message": "Failed saving hook config"}`))
+			return
+		}
+	}
+
 	// Update the fields
 	err = shuffle.SetHook(ctx, hook)
 	if err != nil {
@@ -1439,6 +1504,14 @@ func handleSetHook(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	// The status decides whether the listener runs
+	err = syncHookListener(hook, hookConf)
+	if err != nil {
+		log.Printf("[WARNING] Failed starting %s listener for hook %s: %s", hook.Type, hook.Id, err)
+		writeHookFailure(resp, 400, "message", fmt.Sprintf("Hook saved, but the listener failed to start: %s", err))
+		return
+	}
+
 	resp.WriteHeader(200)
 	resp.Write([]byte(`{"success": true}`))
 }
@@ -1455,7 +1528,7 @@ func verifyHook(hook shuffle.Hook) (bool, string) {
 	}
 
 	// Validate type stuff
-	validTypes := []string{"webhook"}
+	validTypes := append([]string{"webhook"}, listenerHookTypes...)
 	found := false
 	for _, key := range validTypes {
 		if hook.Type == key {
@@ -1524,6 +1597,7 @@ func verifyHook(hook shuffle.Hook) (bool, string) {
 	//Id         string   `json:"id" datastore:"id"`
 	//Info       Info     `json:"info" datastore:"info"`
 	//Transforms struct{} `json:"transforms" datastore:"transforms"`
+	// ^ Transforms and filters are in the hook config instead. See webhook.go
 	//Actions    []HookAction `json:"actions" datastore:"actions"`
 	//Type       string   `json:"type" datastore:"type"`
 	//Status     string   `json:"status" datastore:"status"`
@@ -1828,6 +1902,12 @@ func handleWebhookCallback(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	if isListenerHookType(hook.Type) {
+		resp.WriteHeader(400)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "This is a %s hook, and can't be called over HTTP"}`, hook.Type)))
+		return
+	}
+
 	if len(hook.Workflows) == 0 {
 		log.Printf("[DEBUG] Not running because hook isn't connected to any workflows")
 		resp.WriteHeader(401)
@@ -1858,6 +1938,23 @@ func handleWebhookCallback(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	// Signature, basic/bearer and IP checks configured for the hook
+	hookConf, err := loadHookConfig(ctx, hook.Id)
+	if err != nil {
+		log.Printf("[ERROR] Failed loading config for hook %s: %s", hook.Id, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed loading webhook config"}`))
+		return
+	}
+
+	_, err = verifyWebhookRequest(hookConf.Verification, request, body)
+	if err != nil {
+		log.Printf("[AUDIT] Rejected call to hook %s from %s (verification '%s'): %s", hook.Id, getWebhookClientIp(request), hookConf.Verification.Type, err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Webhook verification failed"}`))
+		return
+	}
+
 	if len(queries) > 0 && len(body) == 0 {
 		body = []byte(queries)
 	}
@@ -1870,6 +1967,26 @@ func handleWebhookCallback(resp http.ResponseWriter, request *http.Request) {
 
 	//log.Printf("\n\nPARSEDBODY: %s", parsedBody)
 	parsedBody := shuffle.GetExecutionbody(body)
+	if len(hookConf.Filters) > 0 || len(hookConf.Transforms) > 0 {
+		event := getWebhookEvent(request.Header, queries, body)
+		if !matchWebhookFilters(event, hookConf.Filters, hookConf.FilterMode) {
+			log.Printf("[DEBUG] Dropping event to hook %s as it didn't match the hook filters", hook.Id)
+			resp.WriteHeader(200)
+			resp.Write([]byte(`{"success": true, "filtered": true, "reason": "The event didn't match the webhook filters"}`))
+			return
+		}
+
+		if len(hookConf.Transforms) > 0 {
+			parsedBody, err = getWebhookTransformedArgument(event, hookConf.Transforms)
+			if err != nil {
+				log.Printf("[WARNING] Failed transforming event to hook %s: %s", hook.Id, err)
+				resp.WriteHeader(400)
+				resp.Write([]byte(`{"success": false, "reason": "Failed transforming the webhook body"}`))
+				return
+			}
+		}
+	}
+
 	newBody := shuffle.ExecutionStruct{
 		Start:             hook.Start,
 		ExecutionSource:   "webhook",
@@ -1899,6 +2016,25 @@ func handleWebhookCallback(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	// Retried deliveries get the execution from the first one. The key is
+	// reserved before anything runs so concurrent retries can't both start.
+	idempotencyKey := getWebhookIdempotencyKey(hookConf.Idempotency, request.Header, body)
+	if len(idempotencyKey) > 0 {
+		if executionId, reserved := reserveWebhookDelivery(ctx, hook.Id, idempotencyKey, hookConf.Idempotency.TtlMinutes); !reserved {
+			if len(executionId) == 0 {
+				log.Printf("[INFO] Duplicate delivery to hook %s while the first one is still starting", hook.Id)
+				resp.WriteHeader(409)
+				resp.Write([]byte(`{"success": false, "reason": "A delivery with the same idempotency key is still being handled"}`))
+				return
+			}
+
+			log.Printf("[INFO] Duplicate delivery to hook %s. Returning existing execution %s", hook.Id, executionId)
+			resp.WriteHeader(200)
+			resp.Write([]byte(fmt.Sprintf(`{"success": true, "execution_id": "%s", "duplicate": true}`, executionId)))
+			return
+		}
+	}
+
 	// Should wrap the response input Body as well?
 	for _, item := range hook.Workflows {
 		log.Printf("[INFO] Running webhook for workflow %s with startnode %s", item, hook.Start)
@@ -1923,12 +2059,24 @@ func handleWebhookCallback(resp http.ResponseWriter, request *http.Request) {
 		workflowExecution, executionResp, err := handleExecution(item, workflow, newRequest, hook.OrgId)
 
 		if err == nil {
-			if hook.Version == "v2" {
+			if len(idempotencyKey) > 0 {
+				setWebhookDelivery(ctx, hook.Id, idempotencyKey, workflowExecution.ExecutionId, hookConf.Idempotency.TtlMinutes)
+			}
+
+			if hook.Version == "v2" || hookConf.Sync.Enabled {
 				timeout := 15
 				//if hook.VersionTimeout != 0 {
 				//	timeout = hook.VersionTimeout
 				//}
 
+				// Sync hooks wait up to their own max_wait
+				if hookConf.Sync.Enabled {
+					timeout = hookConf.Sync.MaxWait
+					if timeout == 0 {
+						timeout = 30
+					}
+				}
+
 				log.Printf("[DEBUG] Waiting for Webhook response from %s for max %d seconds! Checking every 1 second. Hook ID: %s", workflowExecution.ExecutionId, timeout, hook.Id)
 				// Try every second for 15 seconds
 				for i := 0; i < timeout; i++ {
@@ -1941,12 +2089,23 @@ func handleWebhookCallback(resp http.ResponseWriter, request *http.Request) {
 					}
 
 					if newExec.Status != "EXECUTING" {
+						if hookConf.Sync.Enabled {
+							writeWebhookExecutionResult(resp, *newExec, hookConf.Sync.ResultAction)
+							return
+						}
+
 						log.Printf("[INFO] Got response from webhook v2 of length '%d' <- %s", len(newExec.Result), newExec.ExecutionId)
 						resp.WriteHeader(200)
 						resp.Write([]byte(newExec.Result))
 						return
 					}
 				}
+
+				if hookConf.Sync.Enabled {
+					log.Printf("[INFO] Execution %s for sync hook %s didn't finish within %d seconds. Returning 202.", workflowExecution.ExecutionId, hook.Id, timeout)
+					writeWebhookSyncAccepted(ctx, resp, hook.Id, workflowExecution.ExecutionId)
+					return
+				}
 			}
 
 			// Fallback
@@ -1963,6 +2122,9 @@ func handleWebhookCallback(resp http.ResponseWriter, request *http.Request) {
 		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, executionResp)))
 	}
 
+	if len(idempotencyKey) > 0 {
+		releaseWebhookDelivery(ctx, hook.Id, idempotencyKey)
+	}
 }
 
 func executeCloudAction(action shuffle.CloudSyncJob, apikey string) error {
@@ -2517,6 +2679,18 @@ func validateAppYaml(fileLocation string) error {
 		return err
 	}
 
+	if len(apiYaml.Types) == 0 {
+		return errors.New("YAML field types doesn't exist")
+	}
+
+	return validateApiYaml(apiYaml)
+}
+
+// Validates the fields every app needs. Types are optional here, as
+// apps from the app folders and zip uploads don't define them.
+func validateApiYaml(apiYaml ApiYaml) error {
+	var err error
+
 	// Validate fields
 	if apiYaml.Name == "" {
 		return errors.New("YAML field name doesn't exist")
@@ -2533,10 +2707,6 @@ func validateAppYaml(fileLocation string) error {
 		return errors.New("YAML field contact_info.name doesn't exist")
 	}
 
-	if len(apiYaml.Types) == 0 {
-		return errors.New("YAML field types doesn't exist")
-	}
-
 	// Validate types (input/ouput)
 	validTypes := []string{"input", "output"}
 	for _, appType := range apiYaml.Types {
@@ -2660,6 +2830,13 @@ func handleSwaggerValidation(body []byte) (shuffle.ParsedOpenApi, error) {
 	//log.Println(err)
 	//log.Println(string(tmpbody))
 
+	// Postman collections and HAR files are converted to OpenAPI 3 first
+	body, err := convertApiSpec(body)
+	if err != nil {
+		log.Printf("[WARNING] Failed converting API spec: %s", err)
+		return shuffle.ParsedOpenApi{}, err
+	}
+
 	// This has to be done in a weird way because Datastore doesn't
 	// support map[string]interface and similar (openapi3.Swagger)
 	var version versionCheck
@@ -2669,7 +2846,7 @@ func handleSwaggerValidation(body []byte) (shuffle.ParsedOpenApi, error) {
 	idstring := ""
 
 	isJson := false
-	err := json.Unmarshal(body, &version)
+	err = json.Unmarshal(body, &version)
 	if err != nil {
 		//log.Printf("Json err: %s", err)
 		err = yaml.Unmarshal(body, &version)
@@ -2766,6 +2943,9 @@ func buildSwaggerApp(resp http.ResponseWriter, body []byte, user shuffle.User, s
 		Id      string `json:"id" datastore:"id"`
 		Image   string `json:"image" datastore:"image"`
 		Body    string `json:"body" datastore:"body"`
+
+		// Set when rolling back to an earlier version
+		RollbackFrom int `json:"rollback_from" datastore:"rollback_from"`
 	}
 
 	var test Test
@@ -2994,9 +3174,37 @@ func buildSwaggerApp(resp http.ResponseWriter, body []byte, user shuffle.User, s
 	}
 
 	log.Printf("[INFO] API LENGTH FOR %s: %d, ID: %s", api.Name, len(parsed.Body), newmd5)
-	// FIXME: Might cause versioning issues if we re-use the same!!
-	// FIXME: Need a way to track different versions of the same app properly.
-	// Hint: Save API.id somewhere, and use newmd5 to save latest version
+	// The datastore always has the latest spec. Every save is also kept as
+	// an immutable version with its own image tag, which workflows can pin.
+	// The version is made first, so the latest spec is never saved without one.
+	appVersion := openApiAppVersion{}
+	if len(user.Id) > 0 {
+		appVersion = openApiAppVersion{
+			AppId:          api.ID,
+			Name:           api.Name,
+			AppVersion:     api.AppVersion,
+			SpecHash:       getOpenApiSpecHash(body),
+			DockerTags:     dockerTags,
+			RolledBackFrom: test.RollbackFrom,
+			CreatedBy:      user.Id,
+			OrgId:          user.ActiveOrg.Id,
+		}
+
+		appVersion.Version, err = getNextOpenApiAppVersion(ctx, api.ID)
+		if err == nil {
+			appVersion, err = createOpenApiAppVersion(ctx, appVersion, body)
+		}
+
+		if err != nil {
+			log.Printf("[ERROR] Failed creating new version of app %s: %s", api.ID, err)
+			resp.WriteHeader(500)
+			resp.Write([]byte(`{"success": false, "reason": "Failed creating a new version of the app"}`))
+			return
+		}
+
+		dockerTags = appVersion.DockerTags
+		log.Printf("[INFO] Created version %d of app %s (%s)", appVersion.Version, api.Name, api.ID)
+	}
 
 	if len(user.Id) > 0 {
 		err = shuffle.SetOpenApiDatastore(ctx, newmd5, parsed)
@@ -3036,7 +3244,19 @@ func buildSwaggerApp(resp http.ResponseWriter, body []byte, user shuffle.User, s
 
 	// Doing this last to ensure we can copy the docker image over
 	// even though builds fail
-	err = buildImage(dockerTags, dockerLocation)
+	err = buildImage(dockerTags, dockerLocation, user.ActiveOrg.Id)
+	if appVersion.Version > 0 {
+		status := "built"
+		if err != nil {
+			status = "failed"
+		}
+
+		statusErr := setOpenApiAppVersionStatus(ctx, appVersion, status)
+		if statusErr != nil {
+			log.Printf("[WARNING] Failed marking version %d of app %s as %s: %s", appVersion.Version, api.ID, status, statusErr)
+		}
+	}
+
 	if err != nil {
 		log.Printf("[ERROR] Docker build error: %s", err)
 		resp.WriteHeader(500)
@@ -3047,7 +3267,7 @@ func buildSwaggerApp(resp http.ResponseWriter, body []byte, user shuffle.User, s
 	log.Printf("[DEBUG] Successfully built app %s (%s)", api.Name, api.ID)
 	if len(user.Id) > 0 {
 		resp.WriteHeader(200)
-		resp.Write([]byte(fmt.Sprintf(`{"success": true, "id": "%s"}`, api.ID)))
+		resp.Write([]byte(fmt.Sprintf(`{"success": true, "id": "%s", "version": %d}`, api.ID, appVersion.Version)))
 	}
 }
 
@@ -3081,6 +3301,15 @@ func verifySwagger(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	// Postman collections and HAR files are built the same way
+	body, err = convertAppBuilderBody(body)
+	if err != nil {
+		log.Printf("[WARNING] Failed converting API spec in verify swagger: %s", err)
+		resp.WriteHeader(422)
+		resp.Write([]byte(`{"success": false, "reason": "Failed converting the Postman collection or HAR file"}`))
+		return
+	}
+
 	buildSwaggerApp(resp, body, user, false)
 }
 
@@ -3648,37 +3877,21 @@ func runInitEs(ctx context.Context) {
 		time.Sleep(15 * time.Second)
 	}
 
+	// Used for schedules without an org
+	scheduleOrgId := ""
+	if len(activeOrgs) > 0 {
+		scheduleOrgId = activeOrgs[0].Id
+	}
+
 	schedules, err := shuffle.GetAllSchedules(ctx, "ALL")
 	if err != nil {
 		log.Printf("[WARNING] Failed getting schedules during service init: %s", err)
 	} else {
 		log.Printf("[INFO] Setting up %d schedule(s)", len(schedules))
 
-		url := &url.URL{}
-		job := func(schedule shuffle.ScheduleOld) func() {
-			return func() {
-				log.Printf("[INFO] Running schedule %s with interval %d.", schedule.Id, schedule.Seconds)
-
-				request := &http.Request{
-					URL:    url,
-					Method: "POST",
-					Body:   ioutil.NopCloser(strings.NewReader(schedule.WrappedArgument)),
-				}
-
-				orgId := ""
-				if len(activeOrgs) > 0 {
-					orgId = activeOrgs[0].Id
-				}
-
-				if len(schedule.Org) == 36 {
-					orgId = schedule.Org
-				}
-
-				_, _, err := handleExecution(schedule.WorkflowId, shuffle.Workflow{}, request, orgId)
-				if err != nil {
-					log.Printf("[WARNING] Failed to execute %s: %s", schedule.WorkflowId, err)
-				}
-			}
+		allOptions, err := getAllScheduleOptions(ctx)
+		if err != nil {
+			log.Printf("[WARNING] Failed getting schedule options during service init: %s", err)
 		}
 
 		for _, schedule := range schedules {
@@ -3687,23 +3900,48 @@ func runInitEs(ctx context.Context) {
 				continue
 			}
 
-			// FIXME: Add a randomized timer to avoid all schedules running at the same time
-			// Many are at 5 minutes / 1 hour. The point is to spread these out 
-			// a bit instead of all of them starting at the exact same time
+			// Spreads out the first run of interval schedules, as many are at
+			// 5 minutes / 1 hour and would otherwise all start at the same time.
+			// The delay is stored with the schedule so it's the same every restart.
+			options := loadScheduleOptions(ctx, schedule.Id, allOptions)
 
 			//log.Printf("Schedule: %#v", schedule)
 			//log.Printf("Schedule time: every %d seconds", schedule.Seconds)
-			jobret, err := newscheduler.Every(schedule.Seconds).Seconds().NotImmediately().Run(job(schedule))
-			if err != nil {
-				log.Printf("[ERROR] Failed to start schedule for workflow %s: %s", schedule.WorkflowId, err)
+			if !isScheduleActive(options, time.Now()) {
+				log.Printf("[DEBUG] Not starting paused or finished schedule %s for workflow %s", schedule.Id, schedule.WorkflowId)
 			} else {
-				log.Printf("[DEBUG] Successfully started schedule for workflow %s", schedule.WorkflowId)
+				err = startStoredSchedule(schedule, options, scheduleOrgId, false, time.Duration(options.StartupDelay)*time.Second)
+				if err != nil {
+					log.Printf("[ERROR] Failed to start schedule for workflow %s: %s", schedule.WorkflowId, err)
+				} else {
+					log.Printf("[DEBUG] Successfully started schedule for workflow %s", schedule.WorkflowId)
+				}
 			}
 
-			scheduledJobs[schedule.Id] = jobret
+			// Catches up on runs missed while the backend was down.
+			// With leader election, this happens when a backend becomes leader instead.
+			handleScheduleMisfire(schedule, options, scheduleOrgId)
 		}
 	}
 
+	// Syslog and SMTP hooks that are running
+	go startHookListeners(ctx)
+
+	// Expired idempotency keys of webhooks
+	go runWebhookDeliveryCleanup(ctx)
+
+	// Reloads apps in the hotload folder as they're changed
+	if os.Getenv("SHUFFLE_APP_HOTLOAD_WATCH") == "true" {
+		go startAppHotloadWatcher(ctx, os.Getenv("SHUFFLE_APP_HOTLOAD_FOLDER"), scheduleOrgId)
+	}
+
+	// Makes sure only one backend runs each schedule when there are multiple
+	if scheduleLeaderElection {
+		log.Printf("[INFO] Schedule leader election enabled. Only one backend will run schedules at a time.")
+		go runScheduleLeaderElection(ctx, scheduleOrgId)
+		go runScheduleSync(ctx, scheduleOrgId)
+	}
+
 	parsedApikey := ""
 	users, err := shuffle.GetAllUsers(ctx)
 	if len(users) == 0 {
@@ -4647,66 +4885,6 @@ func makeWorkflowPublic(resp http.ResponseWriter, request *http.Request) {
 
 
 
-func handleAppZipUpload(resp http.ResponseWriter, request *http.Request) {
-	cors := shuffle.HandleCors(resp, request)
-	if cors {
-		return
-	}
-
-	//https://stackoverflow.com/questions/22964950/http-request-formfile-handle-zip-files
-	request.ParseMultipartForm(32 << 20)
-	f, _, err := request.FormFile("shuffle_file")
-	if err != nil {
-		log.Printf("[ERROR] Couldn't upload file: %s", err)
-		resp.WriteHeader(401)
-		resp.Write([]byte(`{"success": false, "reason": "Failed uploading file. Correct usage is: shuffle_file=@filepath"}`))
-		return
-	}
-
-	fileSize, err := f.Seek(0, 2) //2 = from end
-	if err != nil {
-		panic(err)
-	}
-	_, err = f.Seek(0, 0)
-	if err != nil {
-		panic(err)
-	}
-
-	buf := new(bytes.Buffer)
-	fileSize, err = io.Copy(buf, f)
-	if err != nil {
-		panic(err)
-	}
-
-	zipdata, err := zip.NewReader(bytes.NewReader(buf.Bytes()), fileSize)
-	if err != nil {
-		panic(err)
-	}
-
-	// https://github.com/alexmullins/zip/blob/master/example_test.go
-	for _, item := range zipdata.File {
-		log.Printf("\n\nName: %s\n\n", item.FileHeader.Name)
-		log.Printf("item: %#v", item)
-
-		rr, err := item.Open()
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		_, err = io.Copy(os.Stdout, rr)
-		if err != nil {
-			log.Fatal(err)
-		}
-		rr.Close()
-
-	}
-
-	resp.WriteHeader(200)
-	resp.Write([]byte("OK"))
-}
-
-
-
 func initHandlers() {
 	var err error
 	ctx := context.Background()
@@ -4792,6 +4970,11 @@ func initHandlers() {
 	// Used by orborus
 	r.HandleFunc("/api/v1/workflows/queue", handleGetWorkflowqueue).Methods("GET", "POST")
 	r.HandleFunc("/api/v1/workflows/queue/confirm", handleGetWorkflowqueueConfirm).Methods("POST")
+	r.HandleFunc("/api/v1/workflows/queue/nack", handleWorkflowqueueNack).Methods("POST")
+	r.HandleFunc("/api/v1/workflows/queue/deadletter", handleWorkflowqueueDeadLetter).Methods("POST")
+	r.HandleFunc("/api/v1/workflows/queue/deadletters", handleGetWorkflowqueueDeadLetters).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/v1/workflows/queue/deadletters/{deadLetterId}", handleWorkflowqueueDeadLetterAction).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/api/v1/workflows/queue/deadletters/{deadLetterId}/retry", handleWorkflowqueueDeadLetterAction).Methods("POST", "OPTIONS")
 
 	// App specific
 	// From here down isnt checked for org specific
@@ -4800,6 +4983,15 @@ func initHandlers() {
 	r.HandleFunc("/api/v1/apps/categories", shuffle.GetActiveCategories).Methods("GET", "OPTIONS")
 	r.HandleFunc("/api/v1/apps/categories/run", shuffle.RunCategoryAction).Methods("POST", "OPTIONS")
 	r.HandleFunc("/api/v1/apps/upload", handleAppZipUpload).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/v1/apps/builds", handleGetAppBuilds).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/v1/apps/builds/{buildId}", handleGetAppBuilds).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/v1/apps/builds/{buildId}/cancel", handleCancelAppBuild).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/v1/apps/{appId}/export", handleAppExport).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/v1/apps/{appId}/versions", handleGetOpenApiVersions).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/v1/apps/{appId}/versions/diff", handleDiffOpenApiVersions).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/v1/apps/{appId}/versions/{version}", handleGetOpenApiVersions).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/v1/apps/{appId}/versions/{version}/rollback", handleRollbackOpenApiVersion).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/v1/apps/{appId}/versions/{version}/pin", handlePinOpenApiVersion).Methods("PUT", "DELETE", "OPTIONS")
 	r.HandleFunc("/api/v1/apps/{appId}/activate", activateWorkflowAppDocker).Methods("GET", "OPTIONS")
 	r.HandleFunc("/api/v1/apps/frameworkConfiguration", shuffle.GetFrameworkConfiguration).Methods("GET", "OPTIONS")
 	r.HandleFunc("/api/v1/apps/frameworkConfiguration", shuffle.SetFrameworkConfiguration).Methods("POST", "OPTIONS")
@@ -4835,7 +5027,8 @@ func initHandlers() {
 	r.HandleFunc("/api/v1/workflows", shuffle.GetWorkflows).Methods("GET", "OPTIONS")
 	r.HandleFunc("/api/v1/workflows", shuffle.SetNewWorkflow).Methods("POST", "OPTIONS")
 	r.HandleFunc("/api/v1/workflows/search", shuffle.HandleWorkflowRunSearch).Methods("POST", "OPTIONS")
-	r.HandleFunc("/api/v1/workflows/schedules", shuffle.HandleGetSchedules).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/v1/workflows/schedules", handleGetSchedules).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/v1/workflows/schedules/stats", handleGetScheduleStats).Methods("GET", "OPTIONS")
 	r.HandleFunc("/api/v1/workflows/{key}/executions", shuffle.GetWorkflowExecutions).Methods("GET", "OPTIONS")
 	r.HandleFunc("/api/v1/workflows/{key}/executions/count", shuffle.HandleGetWorkflowRunCount).Methods("GET", "OPTIONS")
 	r.HandleFunc("/api/v1/workflows/{key}/executions/{key}/rerun", checkUnfinishedExecution).Methods("GET", "POST", "OPTIONS")
@@ -4845,6 +5038,8 @@ func initHandlers() {
 	r.HandleFunc("/api/v1/workflows/{key}/run", executeWorkflow).Methods("GET", "POST", "OPTIONS")
 	r.HandleFunc("/api/v1/workflows/{key}/execute", executeWorkflow).Methods("GET", "POST", "OPTIONS")
 	r.HandleFunc("/api/v1/workflows/{key}/schedule/{schedule}", stopSchedule).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/api/v1/workflows/{key}/schedule/{schedule}/pause", handleScheduleState).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/v1/workflows/{key}/schedule/{schedule}/resume", handleScheduleState).Methods("POST", "OPTIONS")
 	r.HandleFunc("/api/v1/workflows/{key}/stream", shuffle.HandleStreamWorkflow).Methods("GET", "OPTIONS")
 	r.HandleFunc("/api/v1/workflows/{key}/stream", shuffle.HandleStreamWorkflowUpdate).Methods("POST", "OPTIONS")
 	r.HandleFunc("/api/v1/workflows/{key}", deleteWorkflow).Methods("DELETE", "OPTIONS")
@@ -4864,14 +5059,17 @@ func initHandlers() {
 	r.HandleFunc("/api/v1/hooks/new", shuffle.HandleNewHook).Methods("POST", "OPTIONS")
 	r.HandleFunc("/api/v1/hooks", shuffle.HandleNewHook).Methods("POST", "OPTIONS")
 	r.HandleFunc("/api/v1/hooks/{key}", handleWebhookCallback).Methods("POST", "GET", "PATCH", "PUT", "DELETE", "OPTIONS")
-	r.HandleFunc("/api/v1/hooks/{key}/delete", shuffle.HandleDeleteHook).Methods("DELETE", "OPTIONS")
-	r.HandleFunc("/api/v1/hooks/{key}", shuffle.HandleDeleteHook).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/api/v1/hooks/{key}/delete", handleDeleteHook).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/api/v1/hooks/{key}/config", handleHookConfig).Methods("GET", "PUT", "OPTIONS")
+	r.HandleFunc("/api/v1/hooks/{key}/edit", handleSetHook).Methods("PUT", "OPTIONS")
+	r.HandleFunc("/api/v1/hooks/{key}/executions/{execution}", handleGetWebhookExecution).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/v1/hooks/{key}", handleDeleteHook).Methods("DELETE", "OPTIONS")
 
 	// OpenAPI configuration
 	r.HandleFunc("/api/v1/verify_swagger", verifySwagger).Methods("POST", "OPTIONS")
 	r.HandleFunc("/api/v1/verify_openapi", verifySwagger).Methods("POST", "OPTIONS")
 	r.HandleFunc("/api/v1/get_openapi_uri", shuffle.EchoOpenapiData).Methods("POST", "OPTIONS")
-	r.HandleFunc("/api/v1/validate_openapi", shuffle.ValidateSwagger).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/v1/validate_openapi", validateSwagger).Methods("POST", "OPTIONS")
 	r.HandleFunc("/api/v1/get_openapi/{key}", getOpenapi).Methods("GET", "OPTIONS")
 
 	// Specific triggers
@@ -85,7 +85,7 @@ func TestAuthenticationRequired(t *testing.T) {
 		{handler: shuffle.SetNewWorkflow, path: "/api/v1/workflows", method: "POST"},
 		{handler: handleGetWorkflowqueue, path: "/api/v1/workflows/queue", method: "GET"},
 		{handler: handleGetWorkflowqueueConfirm, path: "/api/v1/workflows/queue/confirm", method: "POST"},
-		{handler: shuffle.HandleGetSchedules, path: "/api/v1/workflows/schedules", method: "GET"},
+		{handler: handleGetSchedules, path: "/api/v1/workflows/schedules", method: "GET"},
 		{handler: loadSpecificWorkflows, path: "/api/v1/workflows/download_remote", method: "POST"},
 		{handler: executeWorkflow, path: "/api/v1/workflows/123/execute", method: "GET"},
 		{handler: scheduleWorkflow, path: "/api/v1/workflows/123/schedule", method: "POST"},
@@ -111,7 +111,7 @@ func TestAuthenticationRequired(t *testing.T) {
 		{handler: verifySwagger, path: "/api/v1/verify_openapi", method: "POST"},
 		{handler: shuffle.EchoOpenapiData, path: "/api/v1/get_openapi_uri", method: "POST"},
 		{handler: shuffle.EchoOpenapiData, path: "/api/v1/validate_openapi", method: "POST"},
-		{handler: shuffle.ValidateSwagger, path: "/api/v1/validate_openapi", method: "POST"},
+		{handler: validateSwagger, path: "/api/v1/validate_openapi", method: "POST"},
 		{handler: getOpenapi, path: "/api/v1/get_openapi", method: "GET"},
 
 		//{handler: shuffle.CleanupExecutions, path: "/api/v1/execution_cleanup", method: "GET"},
@@ -243,7 +243,7 @@ func TestCors(t *testing.T) {
 		{handler: shuffle.SetNewWorkflow, path: "/api/v1/workflows", method: "POST"},
 		{handler: handleGetWorkflowqueue, path: "/api/v1/workflows/queue", method: "GET"},
 		{handler: handleGetWorkflowqueueConfirm, path: "/api/v1/workflows/queue/confirm", method: "POST"},
-		{handler: shuffle.HandleGetSchedules, path: "/api/v1/workflows/schedules", method: "GET"},
+		{handler: handleGetSchedules, path: "/api/v1/workflows/schedules", method: "GET"},
 		{handler: loadSpecificWorkflows, path: "/api/v1/workflows/download_remote", method: "POST"},
 		{handler: executeWorkflow, path: "/api/v1/workflows/123/execute", method: "GET"},
 		{handler: scheduleWorkflow, path: "/api/v1/workflows/123/schedule", method: "POST"},
@@ -269,7 +269,7 @@ func TestCors(t *testing.T) {
 		{handler: verifySwagger, path: "/api/v1/verify_openapi", method: "POST"},
 		{handler: echoOpenapiData, path: "/api/v1/get_openapi_uri", method: "POST"},
 		{handler: echoOpenapiData, path: "/api/v1/validate_openapi", method: "POST"},
-		{handler: shuffle.ValidateSwagger, path: "/api/v1/validate_openapi", method: "POST"},
+		{handler: validateSwagger, path: "/api/v1/validate_openapi", method: "POST"},
 		{handler: getOpenapi, path: "/api/v1/get_openapi", method: "GET"},
 
 		//{handler: shuffle.CleanupExecutions, path: "/api/v1/execution_cleanup", method: "GET"},
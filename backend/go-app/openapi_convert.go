@@ -0,0 +1,1237 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/frikky/kin-openapi/openapi3"
+	"github.com/shuffle/shuffle-shared"
+)
+
+// Postman collections and HAR captures are converted to OpenAPI 3 before
+// they're validated, so they go through the same app pipeline as OpenAPI.
+
+var postmanVariablePattern = regexp.MustCompile(`{{\s*([^{}]+?)\s*}}`)
+var openApiIdPattern = regexp.MustCompile(`^([0-9]+|[0-9a-fA-F]{16,}|[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12})$`)
+var harStaticPattern = regexp.MustCompile(`(?i)\.(js|mjs|css|map|png|jpe?g|gif|svg|ico|webp|avif|woff2?|ttf|eot|otf|mp4|webm|mp3|wav|html?)$`)
+
+// Headers a browser or HTTP client sets by itself
+var ignoredSpecHeaders = []string{
+	"accept", "accept-encoding", "accept-language", "authorization", "cache-control",
+	"connection", "content-length", "content-type", "cookie", "dnt", "host", "origin",
+	"pragma", "priority", "referer", "te", "upgrade-insecure-requests", "user-agent",
+	"x-requested-with",
+}
+
+// Header and query names that are treated as API keys in HAR captures
+var apiKeyNames = []string{
+	"x-api-key", "api-key", "apikey", "api_key", "x-auth-token", "x-access-token",
+	"private-token", "access_token", "token",
+}
+
+type postmanKeyValue struct {
+	Key         string      `json:"key"`
+	Value       interface{} `json:"value"`
+	Type        string      `json:"type"`
+	Disabled    bool        `json:"disabled"`
+	Description interface{} `json:"description"`
+}
+
+type postmanUrl struct {
+	Raw      string            `json:"raw"`
+	Query    []postmanKeyValue `json:"query"`
+	Variable []postmanKeyValue `json:"variable"`
+}
+
+type postmanAuth struct {
+	Type   string            `json:"type"`
+	Bearer []postmanKeyValue `json:"bearer"`
+	Basic  []postmanKeyValue `json:"basic"`
+	Apikey []postmanKeyValue `json:"apikey"`
+	Oauth2 []postmanKeyValue `json:"oauth2"`
+}
+
+type postmanBody struct {
+	Mode       string            `json:"mode"`
+	Raw        string            `json:"raw"`
+	Urlencoded []postmanKeyValue `json:"urlencoded"`
+	Formdata   []postmanKeyValue `json:"formdata"`
+	Graphql    struct {
+		Query     string `json:"query"`
+		Variables string `json:"variables"`
+	} `json:"graphql"`
+	Options struct {
+		Raw struct {
+			Language string `json:"language"`
+		} `json:"raw"`
+	} `json:"options"`
+	Disabled bool `json:"disabled"`
+}
+
+type postmanRequest struct {
+	Method      string            `json:"method"`
+	Header      []postmanKeyValue `json:"header"`
+	Url         json.RawMessage   `json:"url"`
+	Body        *postmanBody      `json:"body"`
+	Auth        *postmanAuth      `json:"auth"`
+	Description interface{}       `json:"description"`
+}
+
+type postmanResponse struct {
+	Name   string            `json:"name"`
+	Status string            `json:"status"`
+	Code   int               `json:"code"`
+	Header []postmanKeyValue `json:"header"`
+	Body   string            `json:"body"`
+}
+
+type postmanItem struct {
+	Name        string            `json:"name"`
+	Description interface{}       `json:"description"`
+	Item        []postmanItem     `json:"item"`
+	Request     json.RawMessage   `json:"request"`
+	Response    []postmanResponse `json:"response"`
+	Auth        *postmanAuth      `json:"auth"`
+}
+
+type postmanCollection struct {
+	Info struct {
+		Name        string      `json:"name"`
+		Description interface{} `json:"description"`
+		Schema      string      `json:"schema"`
+		PostmanId   string      `json:"_postman_id"`
+	} `json:"info"`
+	Item     []postmanItem     `json:"item"`
+	Auth     *postmanAuth      `json:"auth"`
+	Variable []postmanKeyValue `json:"variable"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harEntry struct {
+	Request struct {
+		Method      string         `json:"method"`
+		Url         string         `json:"url"`
+		Headers     []harNameValue `json:"headers"`
+		QueryString []harNameValue `json:"queryString"`
+		PostData    *struct {
+			MimeType string         `json:"mimeType"`
+			Text     string         `json:"text"`
+			Params   []harNameValue `json:"params"`
+		} `json:"postData"`
+	} `json:"request"`
+	Response struct {
+		Status     int    `json:"status"`
+		StatusText string `json:"statusText"`
+		Content    struct {
+			MimeType string `json:"mimeType"`
+			Text     string `json:"text"`
+			Encoding string `json:"encoding"`
+		} `json:"content"`
+	} `json:"response"`
+}
+
+type harFile struct {
+	Log struct {
+		Pages []struct {
+			Title string `json:"title"`
+		} `json:"pages"`
+		Entries []harEntry `json:"entries"`
+	} `json:"log"`
+}
+
+// Finds out whether the body is a Postman collection, a HAR file or (most
+// likely) OpenAPI
+func getApiSpecFormat(body []byte) string {
+	var check struct {
+		Info *struct {
+			Schema    string `json:"schema"`
+			PostmanId string `json:"_postman_id"`
+		} `json:"info"`
+		Item []json.RawMessage `json:"item"`
+		Log  *struct {
+			Entries []json.RawMessage `json:"entries"`
+		} `json:"log"`
+	}
+
+	err := json.Unmarshal(body, &check)
+	if err != nil {
+		return "openapi"
+	}
+
+	if check.Info != nil && (strings.Contains(check.Info.Schema, "getpostman.com") || (len(check.Info.PostmanId) > 0 && check.Item != nil)) {
+		return "postman"
+	}
+
+	if check.Log != nil && check.Log.Entries != nil {
+		return "har"
+	}
+
+	return "openapi"
+}
+
+// Converts Postman collections and HAR files to OpenAPI 3. Anything else is
+// returned as is.
+func convertApiSpec(body []byte) ([]byte, error) {
+	var swagger *openapi3.Swagger
+	var err error
+
+	format := getApiSpecFormat(body)
+	if format == "postman" {
+		swagger, err = convertPostmanCollection(body)
+	} else if format == "har" {
+		swagger, err = convertHar(body)
+	} else {
+		return body, nil
+	}
+
+	if err != nil {
+		return body, err
+	}
+
+	log.Printf("[INFO] Converted %s to OpenAPI with %d paths", format, len(swagger.Paths))
+	return json.Marshal(swagger)
+}
+
+// The app builder sends editing, id and image next to the spec itself
+func convertAppBuilderBody(body []byte) ([]byte, error) {
+	if getApiSpecFormat(body) == "openapi" {
+		return body, nil
+	}
+
+	converted, err := convertApiSpec(body)
+	if err != nil {
+		return body, err
+	}
+
+	fields := map[string]json.RawMessage{}
+	spec := map[string]json.RawMessage{}
+	json.Unmarshal(body, &fields)
+	err = json.Unmarshal(converted, &spec)
+	if err != nil {
+		return body, err
+	}
+
+	for _, key := range []string{"editing", "id", "image"} {
+		if value, ok := fields[key]; ok {
+			spec[key] = value
+		}
+	}
+
+	return json.Marshal(spec)
+}
+
+// Converts Postman collections and HAR files before the normal validation
+func validateSwagger(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	_, err := shuffle.HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("Api authentication failed in validate swagger: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Failed reading body"}`))
+		return
+	}
+
+	body, err = convertApiSpec(body)
+	if err != nil {
+		log.Printf("[WARNING] Failed converting API spec: %s", err)
+		resp.WriteHeader(422)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Failed converting spec: %s"}`, strings.Replace(err.Error(), "\"", "\\\"", -1))))
+		return
+	}
+
+	request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	shuffle.ValidateSwagger(resp, request)
+}
+
+// Postman descriptions and values are either strings or objects
+func getPostmanString(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case map[string]interface{}:
+		if content, ok := value["content"].(string); ok {
+			return content
+		}
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return ""
+	}
+
+	return string(data)
+}
+
+func getPostmanValue(values []postmanKeyValue, key string) string {
+	for _, value := range values {
+		if value.Key == key {
+			return getPostmanString(value.Value)
+		}
+	}
+
+	return ""
+}
+
+// Replaces {{variable}} with the collection variables. Variables can use
+// other variables.
+func replacePostmanVariables(value string, variables map[string]string) string {
+	for i := 0; i < 3 && strings.Contains(value, "{{"); i++ {
+		value = postmanVariablePattern.ReplaceAllStringFunc(value, func(match string) string {
+			name := postmanVariablePattern.FindStringSubmatch(match)[1]
+			if replacement, ok := variables[name]; ok {
+				return replacement
+			}
+
+			return match
+		})
+	}
+
+	return value
+}
+
+// Guesses a schema from an example value
+func getSchemaFromExample(value interface{}) *openapi3.Schema {
+	schema := &openapi3.Schema{}
+	switch value := value.(type) {
+	case map[string]interface{}:
+		schema.Type = "object"
+		schema.Properties = map[string]*openapi3.SchemaRef{}
+		for key, property := range value {
+			schema.Properties[key] = &openapi3.SchemaRef{Value: getSchemaFromExample(property)}
+		}
+	case []interface{}:
+		schema.Type = "array"
+		schema.Items = &openapi3.SchemaRef{Value: &openapi3.Schema{}}
+		if len(value) > 0 {
+			schema.Items.Value = getSchemaFromExample(value[0])
+		}
+	case float64:
+		schema.Type = "number"
+		if value == float64(int64(value)) {
+			schema.Type = "integer"
+		}
+	case bool:
+		schema.Type = "boolean"
+	case string:
+		schema.Type = "string"
+	}
+
+	return schema
+}
+
+// Makes the content for an example body. JSON is parsed so the generated app
+// gets one parameter per field.
+func getExampleContent(contentType, text string) openapi3.Content {
+	if len(contentType) == 0 {
+		contentType = "text/plain"
+	}
+
+	mediaType := &openapi3.MediaType{
+		Schema: &openapi3.SchemaRef{Value: &openapi3.Schema{Type: "string"}},
+	}
+
+	if strings.Contains(strings.ToLower(contentType), "json") {
+		var parsed interface{}
+		err := json.Unmarshal([]byte(text), &parsed)
+		if err == nil {
+			mediaType.Schema.Value = getSchemaFromExample(parsed)
+			mediaType.Example = parsed
+			return openapi3.Content{contentType: mediaType}
+		}
+	}
+
+	if len(text) > 0 {
+		mediaType.Example = text
+	}
+
+	return openapi3.Content{contentType: mediaType}
+}
+
+// Form bodies become objects with one property per field
+func getFormContent(contentType string, fields []harNameValue, files map[string]bool) openapi3.Content {
+	schema := &openapi3.Schema{
+		Type:       "object",
+		Properties: map[string]*openapi3.SchemaRef{},
+	}
+
+	example := map[string]interface{}{}
+	for _, field := range fields {
+		property := &openapi3.Schema{Type: "string"}
+		if files[field.Name] {
+			property.Format = "binary"
+		} else {
+			example[field.Name] = field.Value
+		}
+
+		schema.Properties[field.Name] = &openapi3.SchemaRef{Value: property}
+	}
+
+	return openapi3.Content{
+		contentType: &openapi3.MediaType{
+			Schema:  &openapi3.SchemaRef{Value: schema},
+			Example: example,
+		},
+	}
+}
+
+func newSpecParameter(name, in, description string, required bool, example interface{}) *openapi3.ParameterRef {
+	param := &openapi3.Parameter{
+		Name:        name,
+		In:          in,
+		Description: description,
+		Required:    required,
+		Schema:      &openapi3.SchemaRef{Value: &openapi3.Schema{Type: "string"}},
+	}
+
+	if example != nil && example != "" {
+		param.Example = example
+	}
+
+	return &openapi3.ParameterRef{Value: param}
+}
+
+func hasSpecParameter(operation *openapi3.Operation, name, in string) bool {
+	for _, param := range operation.Parameters {
+		if param.Value != nil && param.Value.Name == name && param.Value.In == in {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isIgnoredSpecHeader(name string) bool {
+	name = strings.ToLower(name)
+	if strings.HasPrefix(name, ":") || strings.HasPrefix(name, "sec-") {
+		return true
+	}
+
+	return shuffle.ArrayContains(ignoredSpecHeaders, name)
+}
+
+func isApiKeyName(name string) bool {
+	return shuffle.ArrayContains(apiKeyNames, strings.ToLower(name))
+}
+
+// Splits a url in the server and path parts. Path segments that are only a
+// variable (:name or {{name}}) become path parameters with the variable value
+// as example. Other variables are replaced, and unknown variables in the
+// server become server variables.
+func splitSpecUrl(rawUrl string, variables map[string]string) (string, string, []harNameValue) {
+	if index := strings.IndexAny(rawUrl, "?#"); index >= 0 {
+		rawUrl = rawUrl[:index]
+	}
+
+	// {{baseUrl}}/path is the most common way to set the server
+	server := ""
+	path := rawUrl
+	if match := postmanVariablePattern.FindStringSubmatchIndex(rawUrl); len(match) > 0 && match[0] == 0 {
+		value := replacePostmanVariables(variables[rawUrl[match[2]:match[3]]], variables)
+		if strings.Contains(value, "://") {
+			server = value
+			path = rawUrl[match[1]:]
+		}
+	}
+
+	if len(server) == 0 {
+		hostStart := 0
+		if index := strings.Index(rawUrl, "://"); index >= 0 {
+			hostStart = index + 3
+		}
+
+		if hostStart > 0 || !strings.HasPrefix(rawUrl, "/") {
+			server = rawUrl
+			path = "/"
+			if index := strings.Index(rawUrl[hostStart:], "/"); index >= 0 {
+				server = rawUrl[:hostStart+index]
+				path = rawUrl[hostStart+index:]
+			}
+
+			server = replacePostmanVariables(server, variables)
+			if !strings.Contains(server, "://") {
+				server = fmt.Sprintf("https://%s", server)
+			}
+		}
+	}
+
+	pathParams := []harNameValue{}
+	segments := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	for index, segment := range segments {
+		if strings.HasPrefix(segment, ":") && len(segment) > 1 {
+			segments[index] = fmt.Sprintf("{%s}", segment[1:])
+			pathParams = append(pathParams, harNameValue{Name: segment[1:]})
+			continue
+		}
+
+		if match := postmanVariablePattern.FindStringSubmatch(segment); len(match) > 0 && match[0] == segment {
+			segments[index] = fmt.Sprintf("{%s}", match[1])
+			pathParams = append(pathParams, harNameValue{Name: match[1], Value: replacePostmanVariables(segment, variables)})
+			continue
+		}
+
+		segment = replacePostmanVariables(segment, variables)
+		for _, match := range postmanVariablePattern.FindAllStringSubmatch(segment, -1) {
+			pathParams = append(pathParams, harNameValue{Name: match[1]})
+		}
+
+		segments[index] = postmanVariablePattern.ReplaceAllString(segment, "{$1}")
+	}
+
+	for index, param := range pathParams {
+		if postmanVariablePattern.MatchString(param.Value) {
+			pathParams[index].Value = ""
+		}
+	}
+
+	path = fmt.Sprintf("/%s", strings.Join(segments, "/"))
+	server = strings.TrimSuffix(postmanVariablePattern.ReplaceAllString(server, "{$1}"), "/")
+	return server, path, pathParams
+}
+
+// Adds an operation unless the same method and path already exists
+func addSpecOperation(swagger *openapi3.Swagger, path, method string, operation *openapi3.Operation) bool {
+	pathItem, ok := swagger.Paths[path]
+	if !ok {
+		pathItem = &openapi3.PathItem{}
+		swagger.Paths[path] = pathItem
+	}
+
+	if pathItem.GetOperation(method) != nil {
+		return false
+	}
+
+	pathItem.SetOperation(method, operation)
+	return true
+}
+
+// The server most requests are sent to
+func getSpecServer(servers map[string]int) string {
+	names := []string{}
+	for name := range servers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	server := ""
+	for _, name := range names {
+		if len(server) == 0 || servers[name] > servers[server] {
+			server = name
+		}
+	}
+
+	return server
+}
+
+func setSpecServer(swagger *openapi3.Swagger, server string) {
+	if len(server) == 0 {
+		return
+	}
+
+	newServer := &openapi3.Server{URL: server}
+	for _, match := range regexp.MustCompile(`{([^{}]+)}`).FindAllStringSubmatch(server, -1) {
+		if newServer.Variables == nil {
+			newServer.Variables = map[string]*openapi3.ServerVariable{}
+		}
+
+		newServer.Variables[match[1]] = &openapi3.ServerVariable{Default: ""}
+	}
+
+	swagger.Servers = openapi3.Servers{newServer}
+}
+
+// Maps Postman auth to a security scheme. The credentials themselves are
+// never copied, as they're filled in from the app authentication.
+func getPostmanSecurityScheme(auth *postmanAuth, variables map[string]string) (string, *openapi3.SecurityScheme) {
+	switch strings.ToLower(auth.Type) {
+	case "bearer":
+		return "BearerAuth", &openapi3.SecurityScheme{Type: "http", Scheme: "bearer"}
+	case "basic":
+		return "BasicAuth", &openapi3.SecurityScheme{Type: "http", Scheme: "basic"}
+	case "apikey":
+		in := getPostmanValue(auth.Apikey, "in")
+		if in != "query" {
+			in = "header"
+		}
+
+		key := replacePostmanVariables(getPostmanValue(auth.Apikey, "key"), variables)
+		if len(key) == 0 {
+			key = "X-API-Key"
+		}
+
+		return fmt.Sprintf("ApiKeyAuth_%s_%s", in, key), &openapi3.SecurityScheme{Type: "apiKey", In: in, Name: key}
+	case "oauth2":
+		grantType := getPostmanValue(auth.Oauth2, "grant_type")
+		tokenUrl := replacePostmanVariables(getPostmanValue(auth.Oauth2, "accessTokenUrl"), variables)
+		if grantType != "client_credentials" || len(tokenUrl) == 0 {
+			log.Printf("[WARNING] Skipping unsupported Postman OAuth2 grant type %#v", grantType)
+			return "", nil
+		}
+
+		scopes := map[string]string{}
+		for _, scope := range strings.Fields(replacePostmanVariables(getPostmanValue(auth.Oauth2, "scope"), variables)) {
+			scopes[scope] = scope
+		}
+
+		return "OAuth2", &openapi3.SecurityScheme{
+			Type: "oauth2",
+			Flows: &openapi3.OAuthFlows{
+				ClientCredentials: &openapi3.OAuthFlow{
+					TokenURL: tokenUrl,
+					Scopes:   scopes,
+				},
+			},
+		}
+	case "noauth", "":
+		return "", nil
+	}
+
+	log.Printf("[WARNING] Skipping unsupported Postman auth type %s", auth.Type)
+	return "", nil
+}
+
+func addSpecSecurityScheme(swagger *openapi3.Swagger, name string, scheme *openapi3.SecurityScheme) {
+	if swagger.Components.SecuritySchemes == nil {
+		swagger.Components.SecuritySchemes = openapi3.SecuritySchemes{}
+	}
+
+	swagger.Components.SecuritySchemes[name] = &openapi3.SecuritySchemeRef{Value: scheme}
+}
+
+// Builds the request body from the Postman body modes
+func getPostmanRequestBody(body *postmanBody, headers []postmanKeyValue, variables map[string]string) *openapi3.RequestBodyRef {
+	if body == nil || body.Disabled {
+		return nil
+	}
+
+	contentType := ""
+	for _, header := range headers {
+		if strings.ToLower(header.Key) == "content-type" && !header.Disabled {
+			contentType = getPostmanString(header.Value)
+		}
+	}
+
+	var content openapi3.Content
+	switch body.Mode {
+	case "raw":
+		if len(strings.TrimSpace(body.Raw)) == 0 {
+			return nil
+		}
+
+		if len(contentType) == 0 {
+			contentType = map[string]string{
+				"json":       "application/json",
+				"xml":        "application/xml",
+				"html":       "text/html",
+				"javascript": "application/javascript",
+			}[body.Options.Raw.Language]
+		}
+
+		if len(contentType) == 0 && json.Valid([]byte(body.Raw)) {
+			contentType = "application/json"
+		}
+
+		content = getExampleContent(contentType, replacePostmanVariables(body.Raw, variables))
+	case "urlencoded", "formdata":
+		if len(contentType) == 0 || body.Mode == "formdata" {
+			contentType = "application/x-www-form-urlencoded"
+			if body.Mode == "formdata" {
+				contentType = "multipart/form-data"
+			}
+		}
+
+		fields := []harNameValue{}
+		files := map[string]bool{}
+		formFields := body.Urlencoded
+		if body.Mode == "formdata" {
+			formFields = body.Formdata
+		}
+
+		for _, field := range formFields {
+			if field.Disabled {
+				continue
+			}
+
+			fields = append(fields, harNameValue{Name: field.Key, Value: replacePostmanVariables(getPostmanString(field.Value), variables)})
+			files[field.Key] = field.Type == "file"
+		}
+
+		content = getFormContent(contentType, fields, files)
+	case "graphql":
+		example := map[string]interface{}{
+			"query": body.Graphql.Query,
+		}
+
+		var graphqlVariables interface{}
+		if json.Unmarshal([]byte(body.Graphql.Variables), &graphqlVariables) == nil {
+			example["variables"] = graphqlVariables
+		}
+
+		content = openapi3.Content{
+			"application/json": &openapi3.MediaType{
+				Schema:  &openapi3.SchemaRef{Value: getSchemaFromExample(example)},
+				Example: example,
+			},
+		}
+	case "file":
+		content = openapi3.Content{
+			"application/octet-stream": &openapi3.MediaType{
+				Schema: &openapi3.SchemaRef{Value: &openapi3.Schema{Type: "string", Format: "binary"}},
+			},
+		}
+	default:
+		return nil
+	}
+
+	return &openapi3.RequestBodyRef{Value: &openapi3.RequestBody{Content: content}}
+}
+
+// Saved Postman responses become the example responses
+func getPostmanResponses(responses []postmanResponse) openapi3.Responses {
+	specResponses := openapi3.Responses{}
+	for _, response := range responses {
+		code := "default"
+		if response.Code > 0 {
+			code = fmt.Sprintf("%d", response.Code)
+		}
+
+		if _, ok := specResponses[code]; ok {
+			continue
+		}
+
+		description := response.Name
+		if len(description) == 0 {
+			description = response.Status
+		}
+
+		specResponse := &openapi3.Response{Description: &description}
+		if len(response.Body) > 0 {
+			specResponse.Content = getExampleContent(getPostmanValue(response.Header, "Content-Type"), response.Body)
+		}
+
+		specResponses[code] = &openapi3.ResponseRef{Value: specResponse}
+	}
+
+	if len(specResponses) == 0 {
+		description := "default"
+		specResponses["default"] = &openapi3.ResponseRef{Value: &openapi3.Response{Description: &description}}
+	}
+
+	return specResponses
+}
+
+type postmanConverter struct {
+	Swagger     *openapi3.Swagger
+	Variables   map[string]string
+	Servers     map[string]int
+	PathServers map[string]string
+	GlobalAuth  string
+}
+
+func (converter *postmanConverter) getSecurity(auth *postmanAuth) string {
+	if auth == nil {
+		return ""
+	}
+
+	name, scheme := getPostmanSecurityScheme(auth, converter.Variables)
+	if scheme != nil {
+		addSpecSecurityScheme(converter.Swagger, name, scheme)
+	}
+
+	return name
+}
+
+// Walks the folders. Auth is inherited from the parent folders unless it's
+// set on the request itself.
+func (converter *postmanConverter) addItems(items []postmanItem, tags []string, auth string) {
+	for _, item := range items {
+		itemAuth := auth
+		if item.Auth != nil {
+			itemAuth = converter.getSecurity(item.Auth)
+		}
+
+		if item.Item != nil {
+			converter.addItems(item.Item, append(append([]string{}, tags...), item.Name), itemAuth)
+			continue
+		}
+
+		if len(item.Request) == 0 {
+			continue
+		}
+
+		converter.addRequest(item, tags, itemAuth)
+	}
+}
+
+func (converter *postmanConverter) addRequest(item postmanItem, tags []string, auth string) {
+	request := postmanRequest{Method: "GET"}
+
+	// Requests can be only the url
+	var rawRequest string
+	if err := json.Unmarshal(item.Request, &rawRequest); err == nil {
+		request.Url, _ = json.Marshal(rawRequest)
+	} else if err := json.Unmarshal(item.Request, &request); err != nil {
+		log.Printf("[WARNING] Failed parsing Postman request %s: %s", item.Name, err)
+		return
+	}
+
+	requestUrl := postmanUrl{}
+	var rawUrl string
+	if err := json.Unmarshal(request.Url, &rawUrl); err == nil {
+		requestUrl.Raw = rawUrl
+	} else {
+		json.Unmarshal(request.Url, &requestUrl)
+	}
+
+	raw := strings.TrimSpace(requestUrl.Raw)
+	server, path, pathParams := splitSpecUrl(raw, converter.Variables)
+	if request.Auth != nil {
+		auth = converter.getSecurity(request.Auth)
+	}
+
+	if len(server) > 0 {
+		converter.Servers[server] += 1
+	}
+
+	method := strings.ToUpper(request.Method)
+	if len(method) == 0 {
+		method = "GET"
+	}
+
+	operation := &openapi3.Operation{
+		Summary:     item.Name,
+		Description: getPostmanString(request.Description),
+		Tags:        tags,
+		Parameters:  openapi3.Parameters{},
+		Responses:   getPostmanResponses(item.Response),
+	}
+
+	for _, param := range pathParams {
+		description := ""
+		example := param.Value
+		for _, variable := range requestUrl.Variable {
+			if variable.Key == param.Name {
+				description = getPostmanString(variable.Description)
+				example = replacePostmanVariables(getPostmanString(variable.Value), converter.Variables)
+			}
+		}
+
+		if !hasSpecParameter(operation, param.Name, openapi3.ParameterInPath) {
+			operation.Parameters = append(operation.Parameters, newSpecParameter(param.Name, openapi3.ParameterInPath, description, true, example))
+		}
+	}
+
+	queries := requestUrl.Query
+	if queries == nil {
+		if index := strings.Index(raw, "?"); index >= 0 {
+			parsed, _ := url.ParseQuery(raw[index+1:])
+			for key, values := range parsed {
+				queries = append(queries, postmanKeyValue{Key: key, Value: values[0]})
+			}
+
+			sort.Slice(queries, func(i, j int) bool {
+				return queries[i].Key < queries[j].Key
+			})
+		}
+	}
+
+	apiKey := converter.Swagger.Components.SecuritySchemes[auth]
+	for _, query := range queries {
+		if len(query.Key) == 0 || hasSpecParameter(operation, query.Key, openapi3.ParameterInQuery) {
+			continue
+		}
+
+		if apiKey != nil && apiKey.Value.In == "query" && apiKey.Value.Name == query.Key {
+			continue
+		}
+
+		example := replacePostmanVariables(getPostmanString(query.Value), converter.Variables)
+		if postmanVariablePattern.MatchString(example) {
+			example = ""
+		}
+
+		operation.Parameters = append(operation.Parameters, newSpecParameter(query.Key, openapi3.ParameterInQuery, getPostmanString(query.Description), false, example))
+	}
+
+	for _, header := range request.Header {
+		if header.Disabled || len(header.Key) == 0 || isIgnoredSpecHeader(header.Key) {
+			continue
+		}
+
+		if apiKey != nil && apiKey.Value.In == "header" && strings.EqualFold(apiKey.Value.Name, header.Key) {
+			continue
+		}
+
+		example := replacePostmanVariables(getPostmanString(header.Value), converter.Variables)
+		if postmanVariablePattern.MatchString(example) {
+			example = ""
+		}
+
+		operation.Parameters = append(operation.Parameters, newSpecParameter(header.Key, openapi3.ParameterInHeader, getPostmanString(header.Description), false, example))
+	}
+
+	operation.RequestBody = getPostmanRequestBody(request.Body, request.Header, converter.Variables)
+
+	if auth != converter.GlobalAuth {
+		security := openapi3.SecurityRequirements{}
+		if len(auth) > 0 {
+			security = append(security, openapi3.SecurityRequirement{auth: []string{}})
+		}
+
+		operation.Security = &security
+	}
+
+	if !addSpecOperation(converter.Swagger, path, method, operation) {
+		log.Printf("[DEBUG] Skipping duplicate Postman request %s %s (%s)", method, path, item.Name)
+	} else if _, ok := converter.PathServers[path]; !ok {
+		converter.PathServers[path] = server
+	}
+}
+
+// Paths sent to another server than the main one are moved below it if
+// possible, and otherwise get their own server
+func (converter *postmanConverter) setServers() {
+	server := getSpecServer(converter.Servers)
+	setSpecServer(converter.Swagger, server)
+
+	for path, pathServer := range converter.PathServers {
+		if pathServer == server || len(pathServer) == 0 {
+			continue
+		}
+
+		pathItem := converter.Swagger.Paths[path]
+		fullPath := fmt.Sprintf("%s%s", pathServer, path)
+		if strings.HasPrefix(fullPath, fmt.Sprintf("%s/", server)) {
+			newPath := strings.TrimPrefix(fullPath, server)
+			if _, ok := converter.Swagger.Paths[newPath]; !ok {
+				delete(converter.Swagger.Paths, path)
+				converter.Swagger.Paths[newPath] = pathItem
+				continue
+			}
+		}
+
+		pathItem.Servers = openapi3.Servers{&openapi3.Server{URL: pathServer}}
+	}
+}
+
+// Converts a Postman v2.1 collection. Collection variables are resolved,
+// folders become tags and auth becomes security schemes.
+func convertPostmanCollection(body []byte) (*openapi3.Swagger, error) {
+	var collection postmanCollection
+	err := json.Unmarshal(body, &collection)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(collection.Info.Schema) > 0 && !strings.Contains(collection.Info.Schema, "v2.1") {
+		return nil, errors.New(fmt.Sprintf("Unsupported Postman collection schema %s. Export the collection as v2.1", collection.Info.Schema))
+	}
+
+	if len(collection.Info.Name) == 0 {
+		return nil, errors.New("The Postman collection needs a name")
+	}
+
+	converter := postmanConverter{
+		Swagger: &openapi3.Swagger{
+			OpenAPI: "3.0.0",
+			Info: &openapi3.Info{
+				Title:       collection.Info.Name,
+				Description: getPostmanString(collection.Info.Description),
+				Version:     "1.0.0",
+			},
+			Paths: openapi3.Paths{},
+		},
+		Variables:   map[string]string{},
+		Servers:     map[string]int{},
+		PathServers: map[string]string{},
+	}
+
+	for _, variable := range collection.Variable {
+		if !variable.Disabled && len(variable.Key) > 0 {
+			converter.Variables[variable.Key] = getPostmanString(variable.Value)
+		}
+	}
+
+	converter.GlobalAuth = converter.getSecurity(collection.Auth)
+	if len(converter.GlobalAuth) > 0 {
+		converter.Swagger.Security = openapi3.SecurityRequirements{{converter.GlobalAuth: []string{}}}
+	}
+
+	converter.addItems(collection.Item, []string{}, converter.GlobalAuth)
+	if len(converter.Swagger.Paths) == 0 {
+		return nil, errors.New("No requests found in the Postman collection")
+	}
+
+	converter.setServers()
+	return converter.Swagger, nil
+}
+
+// Concrete IDs in captured paths become path parameters, named after the
+// segment before them
+func getHarPath(path string, operation *openapi3.Operation) string {
+	segments := strings.Split(path, "/")
+	for index, segment := range segments {
+		if !openApiIdPattern.MatchString(segment) {
+			continue
+		}
+
+		name := "id"
+		if index > 0 && len(segments[index-1]) > 0 && !strings.HasPrefix(segments[index-1], "{") {
+			name = fmt.Sprintf("%s_id", strings.TrimSuffix(strings.ToLower(segments[index-1]), "s"))
+		}
+
+		baseName := name
+		for i := 2; hasSpecParameter(operation, name, openapi3.ParameterInPath); i++ {
+			name = fmt.Sprintf("%s%d", baseName, i)
+		}
+
+		segments[index] = fmt.Sprintf("{%s}", name)
+		operation.Parameters = append(operation.Parameters, newSpecParameter(name, openapi3.ParameterInPath, "", true, segment))
+	}
+
+	return strings.Join(segments, "/")
+}
+
+// Static files and page loads are skipped, as only the API calls matter
+func isHarApiEntry(entry harEntry, parsedUrl *url.URL) bool {
+	if parsedUrl.Scheme != "http" && parsedUrl.Scheme != "https" {
+		return false
+	}
+
+	method := strings.ToUpper(entry.Request.Method)
+	if method == "OPTIONS" || method == "HEAD" || method == "CONNECT" || method == "TRACE" {
+		return false
+	}
+
+	if entry.Request.PostData != nil {
+		return true
+	}
+
+	if harStaticPattern.MatchString(parsedUrl.Path) {
+		return false
+	}
+
+	mimeType := strings.ToLower(entry.Response.Content.MimeType)
+	if len(mimeType) == 0 || strings.Contains(mimeType, "json") || strings.Contains(mimeType, "xml") || strings.HasPrefix(mimeType, "text/plain") {
+		return true
+	}
+
+	return false
+}
+
+// Finds auth in the captured request. Cookies are skipped, as a browser
+// session can't be reused by an app.
+func getHarSecurity(swagger *openapi3.Swagger, entry harEntry) string {
+	for _, header := range entry.Request.Headers {
+		value := strings.ToLower(strings.TrimSpace(header.Value))
+		if strings.ToLower(header.Name) == "authorization" {
+			if strings.HasPrefix(value, "bearer ") {
+				addSpecSecurityScheme(swagger, "BearerAuth", &openapi3.SecurityScheme{Type: "http", Scheme: "bearer"})
+				return "BearerAuth"
+			} else if strings.HasPrefix(value, "basic ") {
+				addSpecSecurityScheme(swagger, "BasicAuth", &openapi3.SecurityScheme{Type: "http", Scheme: "basic"})
+				return "BasicAuth"
+			}
+		}
+
+		if isApiKeyName(header.Name) {
+			name := fmt.Sprintf("ApiKeyAuth_header_%s", header.Name)
+			addSpecSecurityScheme(swagger, name, &openapi3.SecurityScheme{Type: "apiKey", In: "header", Name: header.Name})
+			return name
+		}
+	}
+
+	for _, query := range entry.Request.QueryString {
+		if isApiKeyName(query.Name) {
+			name := fmt.Sprintf("ApiKeyAuth_query_%s", query.Name)
+			addSpecSecurityScheme(swagger, name, &openapi3.SecurityScheme{Type: "apiKey", In: "query", Name: query.Name})
+			return name
+		}
+	}
+
+	return ""
+}
+
+func getHarRequestBody(entry harEntry) *openapi3.RequestBodyRef {
+	postData := entry.Request.PostData
+	if postData == nil || (len(postData.Text) == 0 && len(postData.Params) == 0) {
+		return nil
+	}
+
+	contentType := strings.TrimSpace(strings.Split(postData.MimeType, ";")[0])
+	var content openapi3.Content
+	if strings.Contains(contentType, "x-www-form-urlencoded") || strings.Contains(contentType, "form-data") {
+		fields := postData.Params
+		if len(fields) == 0 {
+			parsed, _ := url.ParseQuery(postData.Text)
+			for key, values := range parsed {
+				fields = append(fields, harNameValue{Name: key, Value: values[0]})
+			}
+		}
+
+		sort.Slice(fields, func(i, j int) bool {
+			return fields[i].Name < fields[j].Name
+		})
+
+		content = getFormContent(contentType, fields, map[string]bool{})
+	} else {
+		content = getExampleContent(contentType, postData.Text)
+	}
+
+	return &openapi3.RequestBodyRef{Value: &openapi3.RequestBody{Content: content}}
+}
+
+func getHarResponses(entry harEntry) openapi3.Responses {
+	code := "default"
+	if entry.Response.Status > 0 {
+		code = fmt.Sprintf("%d", entry.Response.Status)
+	}
+
+	description := entry.Response.StatusText
+	if len(description) == 0 {
+		description = "default"
+	}
+
+	response := &openapi3.Response{Description: &description}
+	content := entry.Response.Content
+	if len(content.Text) > 0 && content.Encoding != "base64" && strings.Contains(strings.ToLower(content.MimeType), "json") {
+		response.Content = getExampleContent(strings.TrimSpace(strings.Split(content.MimeType, ";")[0]), content.Text)
+	}
+
+	return openapi3.Responses{code: &openapi3.ResponseRef{Value: response}}
+}
+
+// Converts a HAR capture. Only the API calls to the most used server are
+// kept, IDs in paths become parameters and captured bodies become examples.
+// Header values aren't kept as examples, as they often hold session data.
+func convertHar(body []byte) (*openapi3.Swagger, error) {
+	var har harFile
+	err := json.Unmarshal(body, &har)
+	if err != nil {
+		return nil, err
+	}
+
+	servers := map[string]int{}
+	entries := []harEntry{}
+	for _, entry := range har.Log.Entries {
+		parsedUrl, err := url.Parse(entry.Request.Url)
+		if err != nil || !isHarApiEntry(entry, parsedUrl) {
+			continue
+		}
+
+		servers[fmt.Sprintf("%s://%s", parsedUrl.Scheme, parsedUrl.Host)] += 1
+		entries = append(entries, entry)
+	}
+
+	server := getSpecServer(servers)
+	if len(server) == 0 {
+		return nil, errors.New("No API requests found in the HAR file")
+	}
+
+	serverUrl, _ := url.Parse(server)
+	title := serverUrl.Hostname()
+	if len(har.Log.Pages) > 0 && len(har.Log.Pages[0].Title) > 0 && !strings.Contains(har.Log.Pages[0].Title, "://") {
+		title = har.Log.Pages[0].Title
+	}
+
+	swagger := &openapi3.Swagger{
+		OpenAPI: "3.0.0",
+		Info: &openapi3.Info{
+			Title:       title,
+			Description: fmt.Sprintf("Generated from a HAR capture of %s", serverUrl.Host),
+			Version:     "1.0.0",
+		},
+		Paths: openapi3.Paths{},
+	}
+
+	setSpecServer(swagger, server)
+
+	skipped := 0
+	securityNames := []string{}
+	for _, entry := range entries {
+		parsedUrl, _ := url.Parse(entry.Request.Url)
+		if fmt.Sprintf("%s://%s", parsedUrl.Scheme, parsedUrl.Host) != server {
+			skipped += 1
+			continue
+		}
+
+		method := strings.ToUpper(entry.Request.Method)
+		operation := &openapi3.Operation{
+			Parameters: openapi3.Parameters{},
+			Responses:  getHarResponses(entry),
+		}
+
+		path := getHarPath(parsedUrl.Path, operation)
+		if len(path) == 0 {
+			path = "/"
+		}
+
+		security := getHarSecurity(swagger, entry)
+		if len(security) > 0 {
+			operation.Security = &openapi3.SecurityRequirements{{security: []string{}}}
+			if !shuffle.ArrayContains(securityNames, security) {
+				securityNames = append(securityNames, security)
+			}
+		}
+
+		// The same call is often captured many times
+		if existing := swagger.Paths[path]; existing != nil && existing.GetOperation(method) != nil {
+			operation = existing.GetOperation(method)
+		} else {
+			operation.Summary = fmt.Sprintf("%s %s", method, path)
+			operation.RequestBody = getHarRequestBody(entry)
+			addSpecOperation(swagger, path, method, operation)
+		}
+
+		for _, query := range entry.Request.QueryString {
+			if isApiKeyName(query.Name) || hasSpecParameter(operation, query.Name, openapi3.ParameterInQuery) {
+				continue
+			}
+
+			operation.Parameters = append(operation.Parameters, newSpecParameter(query.Name, openapi3.ParameterInQuery, "", false, query.Value))
+		}
+
+		for _, header := range entry.Request.Headers {
+			if isIgnoredSpecHeader(header.Name) || isApiKeyName(header.Name) || hasSpecParameter(operation, header.Name, openapi3.ParameterInHeader) {
+				continue
+			}
+
+			operation.Parameters = append(operation.Parameters, newSpecParameter(header.Name, openapi3.ParameterInHeader, "", false, nil))
+		}
+	}
+
+	for _, name := range securityNames {
+		swagger.Security = append(swagger.Security, openapi3.SecurityRequirement{name: []string{}})
+	}
+
+	if skipped > 0 {
+		log.Printf("[INFO] Skipped %d HAR requests to other servers than %s", skipped, server)
+	}
+
+	return swagger, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/frikky/kin-openapi/openapi3"
+)
+
+func getConvertedTestSpec(t *testing.T, body string) *openapi3.Swagger {
+	converted, err := convertApiSpec([]byte(body))
+	if err != nil {
+		t.Fatalf("failed converting: %s", err)
+	}
+
+	swagger, err := openapi3.NewSwaggerLoader().LoadSwaggerFromData(converted)
+	if err != nil {
+		t.Fatalf("failed loading converted spec: %s", err)
+	}
+
+	return swagger
+}
+
+func TestConvertPostmanCollection(t *testing.T) {
+	swagger := getConvertedTestSpec(t, `{
+		"info": {"name": "Vendor", "schema": "https://schema.getpostman.com/json/collection/v2.1.0/collection.json"},
+		"auth": {"type": "bearer", "bearer": [{"key": "token", "value": "secret"}]},
+		"variable": [{"key": "baseUrl", "value": "https://api.vendor.io/v{{version}}"}, {"key": "version", "value": "2"}],
+		"item": [
+			{"name": "Users", "item": [
+				{"name": "List users", "request": {"method": "GET", "url": {"raw": "{{baseUrl}}/users"}}},
+				{"name": "Update user", "request": {
+					"method": "PATCH",
+					"url": {"raw": "{{baseUrl}}/users/:id?notify=true", "query": [{"key": "notify", "value": "true"}], "variable": [{"key": "id", "value": "7"}]},
+					"body": {"mode": "raw", "raw": "{\"name\": \"x\"}", "options": {"raw": {"language": "json"}}}
+				}}
+			]},
+			{"name": "Login", "request": {
+				"auth": {"type": "noauth"},
+				"method": "POST",
+				"url": "https://api.vendor.io/v2/login",
+				"body": {"mode": "urlencoded", "urlencoded": [{"key": "username", "value": "u"}]}
+			}}
+		]
+	}`)
+
+	if swagger.Info.Title != "Vendor" || len(swagger.Servers) != 1 || swagger.Servers[0].URL != "https://api.vendor.io/v2" {
+		t.Fatalf("unexpected info or servers: %#v %#v", swagger.Info, swagger.Servers)
+	}
+
+	if swagger.Components.SecuritySchemes["BearerAuth"] == nil || len(swagger.Security) != 1 {
+		t.Errorf("expected global bearer auth")
+	}
+
+	update := swagger.Paths["/users/{id}"]
+	if update == nil || update.Patch == nil {
+		t.Fatalf("missing PATCH /users/{id}, got paths %#v", swagger.Paths)
+	}
+
+	if len(update.Patch.Parameters) != 2 || update.Patch.Parameters[0].Value.Example != "7" {
+		t.Errorf("unexpected parameters: %#v", update.Patch.Parameters)
+	}
+
+	body := update.Patch.RequestBody.Value.Content["application/json"]
+	if body == nil || body.Schema.Value.Properties["name"] == nil {
+		t.Errorf("expected JSON body with a name property")
+	}
+
+	login := swagger.Paths["/login"]
+	if login == nil || login.Post == nil {
+		t.Fatalf("expected /login below the main server")
+	}
+
+	if login.Post.Security == nil || len(*login.Post.Security) != 0 {
+		t.Errorf("expected login without auth")
+	}
+
+	if login.Post.RequestBody.Value.Content["application/x-www-form-urlencoded"] == nil {
+		t.Errorf("expected form body for login")
+	}
+}
+
+func TestConvertHar(t *testing.T) {
+	swagger := getConvertedTestSpec(t, `{"log": {"entries": [
+		{"request": {"method": "GET", "url": "https://tool.internal/app.js", "headers": [], "queryString": []}, "response": {"status": 200, "content": {"mimeType": "application/javascript"}}},
+		{"request": {"method": "GET", "url": "https://tool.internal/api/tickets?api_key=secret", "headers": [], "queryString": [{"name": "api_key", "value": "secret"}]}, "response": {"status": 200, "content": {"mimeType": "application/json", "text": "[]"}}},
+		{"request": {"method": "PUT", "url": "https://tool.internal/api/tickets/123", "headers": [{"name": "Authorization", "value": "Bearer abc"}], "queryString": [],
+			"postData": {"mimeType": "application/json", "text": "{\"status\": \"closed\"}"}}, "response": {"status": 204, "content": {}}},
+		{"request": {"method": "GET", "url": "https://cdn.other.io/api/x", "headers": [], "queryString": []}, "response": {"status": 200, "content": {"mimeType": "application/json"}}}
+	]}}`)
+
+	if len(swagger.Servers) != 1 || swagger.Servers[0].URL != "https://tool.internal" {
+		t.Fatalf("unexpected servers: %#v", swagger.Servers)
+	}
+
+	if len(swagger.Paths) != 2 {
+		t.Errorf("expected 2 paths, got %d", len(swagger.Paths))
+	}
+
+	tickets := swagger.Paths["/api/tickets"]
+	if tickets == nil || tickets.Get == nil || len(tickets.Get.Parameters) != 0 {
+		t.Errorf("expected GET /api/tickets without the API key parameter")
+	}
+
+	ticket := swagger.Paths["/api/tickets/{ticket_id}"]
+	if ticket == nil || ticket.Put == nil || ticket.Put.RequestBody == nil {
+		t.Fatalf("expected PUT /api/tickets/{ticket_id} with a body")
+	}
+
+	if swagger.Components.SecuritySchemes["BearerAuth"] == nil || swagger.Components.SecuritySchemes["ApiKeyAuth_query_api_key"] == nil {
+		t.Errorf("expected bearer and API key auth")
+	}
+}
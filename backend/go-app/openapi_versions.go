@@ -0,0 +1,811 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shuffle/shuffle-shared"
+)
+
+// Fields buildSwaggerApp reads from the request body. They aren't part of the spec.
+var openApiRequestFields = []string{"editing", "id", "image", "rollback_from"}
+
+const maxOpenApiDiffChanges = 500
+
+// Without a shared cache (memcached), backends pick up pins changed on
+// another backend after this long
+const workflowAppPinsCacheMinutes = 5
+
+// One immutable version of an OpenAPI app. Every verify/save in buildSwaggerApp
+// creates a new one. The spec itself is stored separately, as it can be large.
+// Status is "building", "built" or "failed". Only built versions can be pinned.
+type openApiAppVersion struct {
+	Id             string   `json:"id"`
+	AppId          string   `json:"app_id"`
+	Version        int      `json:"version"`
+	Name           string   `json:"name"`
+	AppVersion     string   `json:"app_version"`
+	PinnedVersion  string   `json:"pinned_version"`
+	SpecHash       string   `json:"spec_hash"`
+	DockerTags     []string `json:"docker_tags"`
+	RolledBackFrom int      `json:"rolled_back_from,omitempty"`
+	Status         string   `json:"status"`
+	CreatedBy      string   `json:"created_by"`
+	OrgId          string   `json:"org_id"`
+	Created        int64    `json:"created"`
+}
+
+type openApiAppVersionSpec struct {
+	Id      string `json:"id"`
+	AppId   string `json:"app_id"`
+	Version int    `json:"version"`
+	Body    string `json:"body"`
+}
+
+// Workflows pinned to specific versions of OpenAPI apps. Applied to the
+// workflow in handleExecution, so the stored workflow is never changed.
+type workflowAppPins struct {
+	WorkflowId string           `json:"workflow_id"`
+	OrgId      string           `json:"org_id"`
+	Pins       []workflowAppPin `json:"pins"`
+}
+
+type workflowAppPin struct {
+	AppId         string `json:"app_id"`
+	Version       int    `json:"version"`
+	PinnedVersion string `json:"pinned_version"`
+	Edited        int64  `json:"edited"`
+}
+
+type openApiSpecChange struct {
+	Path   string      `json:"path"`
+	Type   string      `json:"type"`
+	Before interface{} `json:"before,omitempty"`
+	After  interface{} `json:"after,omitempty"`
+}
+
+type openApiSpecDiff struct {
+	Success           bool                `json:"success"`
+	From              int                 `json:"from"`
+	To                int                 `json:"to"`
+	OperationsAdded   []string            `json:"operations_added"`
+	OperationsRemoved []string            `json:"operations_removed"`
+	OperationsChanged []string            `json:"operations_changed"`
+	Changes           []openApiSpecChange `json:"changes"`
+	Truncated         bool                `json:"truncated"`
+}
+
+func getOpenApiVersionId(appId string, version int) string {
+	return fmt.Sprintf("%s_%d", appId, version)
+}
+
+// The app_version used by pinned workflows. Makes the worker run the
+// image tagged <baseDockerName>:<name>_<app_version>-v<version>
+func getOpenApiPinnedVersion(appVersion string, version int) string {
+	return fmt.Sprintf("%s-v%d", appVersion, version)
+}
+
+// Sorted by version, oldest first
+func getOpenApiAppVersions(ctx context.Context, appId string) ([]openApiAppVersion, error) {
+	query := map[string]interface{}{
+		"term": map[string]interface{}{
+			"app_id.keyword": appId,
+		},
+	}
+
+	versions := []openApiAppVersion{}
+	documents, err := searchEsDocuments(ctx, "openapi_app_versions", query, 10000)
+	if err != nil {
+		return versions, err
+	}
+
+	for _, document := range documents {
+		version := openApiAppVersion{}
+		err = json.Unmarshal(document.Source, &version)
+		if err != nil {
+			log.Printf("[WARNING] Failed unmarshalling OpenAPI app version %s: %s", document.Id, err)
+			continue
+		}
+
+		versions = append(versions, version)
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Version < versions[j].Version
+	})
+
+	return versions, nil
+}
+
+func getOpenApiAppVersion(ctx context.Context, appId string, version int) (openApiAppVersion, error) {
+	appVersion := openApiAppVersion{}
+	document, err := getEsDocument(ctx, "openapi_app_versions", getOpenApiVersionId(appId, version))
+	if err != nil {
+		return appVersion, err
+	}
+
+	err = json.Unmarshal(document.Source, &appVersion)
+	return appVersion, err
+}
+
+func getOpenApiAppVersionSpec(ctx context.Context, appId string, version int) (openApiAppVersionSpec, error) {
+	spec := openApiAppVersionSpec{}
+	document, err := getEsDocument(ctx, "openapi_app_version_specs", getOpenApiVersionId(appId, version))
+	if err != nil {
+		return spec, err
+	}
+
+	err = json.Unmarshal(document.Source, &spec)
+	return spec, err
+}
+
+// Returns the next version number for an app
+func getNextOpenApiAppVersion(ctx context.Context, appId string) (int, error) {
+	versions, err := getOpenApiAppVersions(ctx, appId)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(versions) == 0 {
+		return 1, nil
+	}
+
+	return versions[len(versions)-1].Version + 1, nil
+}
+
+// Stores a new immutable version and adds its image tag to the docker tags.
+// Versions are only ever created, never overwritten, so two saves racing
+// for the same number retry with the next one.
+func createOpenApiAppVersion(ctx context.Context, appVersion openApiAppVersion, body []byte) (openApiAppVersion, error) {
+	baseTags := appVersion.DockerTags
+	imageName := strings.ToLower(strings.ReplaceAll(appVersion.Name, " ", "-"))
+	for attempt := 0; attempt < 5; attempt++ {
+		appVersion.Id = getOpenApiVersionId(appVersion.AppId, appVersion.Version)
+		appVersion.PinnedVersion = getOpenApiPinnedVersion(appVersion.AppVersion, appVersion.Version)
+		appVersion.DockerTags = append(append([]string{}, baseTags...), fmt.Sprintf("%s:%s_%s", baseDockerName, imageName, appVersion.PinnedVersion))
+		appVersion.Status = "building"
+		appVersion.Created = time.Now().Unix()
+
+		err := createEsDocument(ctx, "openapi_app_versions", appVersion.Id, appVersion)
+		if err == errEsConflict {
+			appVersion.Version += 1
+			continue
+		}
+
+		if err != nil {
+			return appVersion, err
+		}
+
+		spec := openApiAppVersionSpec{
+			Id:      appVersion.Id,
+			AppId:   appVersion.AppId,
+			Version: appVersion.Version,
+			Body:    string(body),
+		}
+
+		err = createEsDocument(ctx, "openapi_app_version_specs", spec.Id, spec)
+		if err != nil {
+			// A version without its spec can't be diffed or rolled back to
+			deleteErr := deleteEsDocument(ctx, "openapi_app_versions", appVersion.Id)
+			if deleteErr != nil {
+				log.Printf("[WARNING] Failed removing version %d of app %s without a spec: %s", appVersion.Version, appVersion.AppId, deleteErr)
+			}
+		}
+
+		return appVersion, err
+	}
+
+	return appVersion, errors.New(fmt.Sprintf("Failed finding a free version number for app %s", appVersion.AppId))
+}
+
+// Records the result of building a version's image
+func setOpenApiAppVersionStatus(ctx context.Context, appVersion openApiAppVersion, status string) error {
+	appVersion.Status = status
+	return setEsDocument(ctx, "openapi_app_versions", appVersion.Id, appVersion)
+}
+
+// Versions stored before builds were tracked have no status
+func isOpenApiAppVersionBuilt(appVersion openApiAppVersion) bool {
+	return appVersion.Status == "built" || len(appVersion.Status) == 0
+}
+
+// Removes the request fields so only the spec is compared and hashed
+func getOpenApiSpecData(body []byte) (map[string]interface{}, error) {
+	spec := map[string]interface{}{}
+	err := json.Unmarshal(body, &spec)
+	if err != nil {
+		return spec, err
+	}
+
+	for _, field := range openApiRequestFields {
+		delete(spec, field)
+	}
+
+	return spec, nil
+}
+
+func getOpenApiSpecHash(body []byte) string {
+	spec, err := getOpenApiSpecData(body)
+	if err == nil {
+		newBody, err := json.Marshal(spec)
+		if err == nil {
+			body = newBody
+		}
+	}
+
+	hasher := md5.New()
+	hasher.Write(body)
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+func escapeOpenApiDiffKey(key string) string {
+	key = strings.ReplaceAll(key, "~", "~0")
+	return strings.ReplaceAll(key, "/", "~1")
+}
+
+// Walks two JSON documents and records the differences as JSON pointers
+func diffOpenApiValues(path string, before, after interface{}, changes *[]openApiSpecChange) {
+	if reflect.DeepEqual(before, after) {
+		return
+	}
+
+	beforeMap, beforeIsMap := before.(map[string]interface{})
+	afterMap, afterIsMap := after.(map[string]interface{})
+	if beforeIsMap && afterIsMap {
+		keys := []string{}
+		for key := range beforeMap {
+			keys = append(keys, key)
+		}
+
+		for key := range afterMap {
+			if _, ok := beforeMap[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+
+		sort.Strings(keys)
+		for _, key := range keys {
+			childPath := fmt.Sprintf("%s/%s", path, escapeOpenApiDiffKey(key))
+			beforeValue, beforeOk := beforeMap[key]
+			afterValue, afterOk := afterMap[key]
+			if !beforeOk {
+				*changes = append(*changes, openApiSpecChange{Path: childPath, Type: "added", After: afterValue})
+			} else if !afterOk {
+				*changes = append(*changes, openApiSpecChange{Path: childPath, Type: "removed", Before: beforeValue})
+			} else {
+				diffOpenApiValues(childPath, beforeValue, afterValue, changes)
+			}
+		}
+
+		return
+	}
+
+	beforeList, beforeIsList := before.([]interface{})
+	afterList, afterIsList := after.([]interface{})
+	if beforeIsList && afterIsList {
+		for index := 0; index < len(beforeList) || index < len(afterList); index++ {
+			childPath := fmt.Sprintf("%s/%d", path, index)
+			if index >= len(beforeList) {
+				*changes = append(*changes, openApiSpecChange{Path: childPath, Type: "added", After: afterList[index]})
+			} else if index >= len(afterList) {
+				*changes = append(*changes, openApiSpecChange{Path: childPath, Type: "removed", Before: beforeList[index]})
+			} else {
+				diffOpenApiValues(childPath, beforeList[index], afterList[index], changes)
+			}
+		}
+
+		return
+	}
+
+	*changes = append(*changes, openApiSpecChange{Path: path, Type: "changed", Before: before, After: after})
+}
+
+var openApiOperationMethods = []string{"get", "put", "post", "delete", "options", "head", "patch", "trace"}
+
+func getOpenApiOperations(spec map[string]interface{}) map[string]interface{} {
+	operations := map[string]interface{}{}
+	paths, ok := spec["paths"].(map[string]interface{})
+	if !ok {
+		return operations
+	}
+
+	for path, pathItem := range paths {
+		methods, ok := pathItem.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		for _, method := range openApiOperationMethods {
+			if operation, ok := methods[method]; ok {
+				operations[fmt.Sprintf("%s %s", strings.ToUpper(method), path)] = operation
+			}
+		}
+	}
+
+	return operations
+}
+
+// Diffs two stored specs. Operations are summarized as "METHOD /path"
+func diffOpenApiSpecs(beforeBody, afterBody []byte) (openApiSpecDiff, error) {
+	diff := openApiSpecDiff{
+		OperationsAdded:   []string{},
+		OperationsRemoved: []string{},
+		OperationsChanged: []string{},
+		Changes:           []openApiSpecChange{},
+	}
+
+	before, err := getOpenApiSpecData(beforeBody)
+	if err != nil {
+		return diff, err
+	}
+
+	after, err := getOpenApiSpecData(afterBody)
+	if err != nil {
+		return diff, err
+	}
+
+	beforeOperations := getOpenApiOperations(before)
+	afterOperations := getOpenApiOperations(after)
+	for name, operation := range afterOperations {
+		if beforeOperation, ok := beforeOperations[name]; !ok {
+			diff.OperationsAdded = append(diff.OperationsAdded, name)
+		} else if !reflect.DeepEqual(beforeOperation, operation) {
+			diff.OperationsChanged = append(diff.OperationsChanged, name)
+		}
+	}
+
+	for name := range beforeOperations {
+		if _, ok := afterOperations[name]; !ok {
+			diff.OperationsRemoved = append(diff.OperationsRemoved, name)
+		}
+	}
+
+	sort.Strings(diff.OperationsAdded)
+	sort.Strings(diff.OperationsRemoved)
+	sort.Strings(diff.OperationsChanged)
+
+	diffOpenApiValues("", before, after, &diff.Changes)
+	if len(diff.Changes) > maxOpenApiDiffChanges {
+		diff.Changes = diff.Changes[:maxOpenApiDiffChanges]
+		diff.Truncated = true
+	}
+
+	diff.Success = true
+	return diff, nil
+}
+
+func getWorkflowAppPins(ctx context.Context, workflowId string) (workflowAppPins, error) {
+	pins := workflowAppPins{}
+	document, err := getEsDocument(ctx, "workflow_app_pins", workflowId)
+	if err != nil {
+		return pins, err
+	}
+
+	err = json.Unmarshal(document.Source, &pins)
+	return pins, err
+}
+
+func getWorkflowAppPinsCacheKey(workflowId string) string {
+	return fmt.Sprintf("workflow_app_pins_%s", workflowId)
+}
+
+func setWorkflowAppPins(ctx context.Context, pins workflowAppPins) error {
+	err := setEsDocument(ctx, "workflow_app_pins", pins.WorkflowId, pins)
+	shuffle.DeleteCache(ctx, getWorkflowAppPinsCacheKey(pins.WorkflowId))
+	return err
+}
+
+// Pins are needed for every execution, so they're cached. Workflows without
+// pins are cached as well, as that's most of them.
+func getCachedWorkflowAppPins(ctx context.Context, workflowId string) (workflowAppPins, error) {
+	pins := workflowAppPins{}
+	cacheKey := getWorkflowAppPinsCacheKey(workflowId)
+	cache, err := shuffle.GetCache(ctx, cacheKey)
+	if err == nil {
+		cacheData := []byte(cache.([]uint8))
+		err = json.Unmarshal(cacheData, &pins)
+		if err == nil {
+			return pins, nil
+		}
+	}
+
+	pins, err = getWorkflowAppPins(ctx, workflowId)
+	if err != nil && err != errEsNotFound {
+		return pins, err
+	}
+
+	cacheData, err := json.Marshal(pins)
+	if err == nil {
+		err = shuffle.SetCache(ctx, cacheKey, cacheData, workflowAppPinsCacheMinutes)
+		if err != nil {
+			log.Printf("[WARNING] Failed caching app pins for workflow %s: %s", workflowId, err)
+		}
+	}
+
+	return pins, nil
+}
+
+// Points the actions of pinned apps at their pinned image
+func applyWorkflowAppPins(ctx context.Context, workflow shuffle.Workflow) shuffle.Workflow {
+	pins, err := getCachedWorkflowAppPins(ctx, workflow.ID)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting app pins for workflow %s: %s", workflow.ID, err)
+		return workflow
+	}
+
+	for _, pin := range pins.Pins {
+		for actionIndex, action := range workflow.Actions {
+			if action.AppID != pin.AppId {
+				continue
+			}
+
+			workflow.Actions[actionIndex].AppVersion = pin.PinnedVersion
+		}
+	}
+
+	return workflow
+}
+
+// Shared access check for the version endpoints. Returns the app ID and version from
+// /api/v1/apps/{appId}/versions[/{version}[/action]]
+func getOpenApiVersionRequest(resp http.ResponseWriter, request *http.Request, write bool) (shuffle.User, *shuffle.WorkflowApp, int, bool) {
+	user, err := shuffle.HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in OpenAPI app versions: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return user, nil, 0, false
+	}
+
+	if write && user.Role == "org-reader" {
+		log.Printf("[WARNING] Org-reader doesn't have access to change app versions: %s (%s)", user.Username, user.Id)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Read only user"}`))
+		return user, nil, 0, false
+	}
+
+	location := strings.Split(request.URL.Path, "/")
+	if len(location) < 6 || location[1] != "api" {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return user, nil, 0, false
+	}
+
+	ctx := shuffle.GetContext(request)
+	app, err := shuffle.GetApp(ctx, location[4], user, false)
+	if err != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "App doesn't exist"}`))
+		return user, nil, 0, false
+	}
+
+	if !app.Generated {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Only OpenAPI apps have versions"}`))
+		return user, nil, 0, false
+	}
+
+	hasAccess := user.Id == app.Owner || user.Role == "admin"
+	if !write && app.ReferenceOrg == user.ActiveOrg.Id {
+		hasAccess = true
+	}
+
+	if !hasAccess {
+		log.Printf("[WARNING] Wrong user (%s) for app versions of %s", user.Username, app.ID)
+		resp.WriteHeader(403)
+		resp.Write([]byte(`{"success": false, "reason": "You don't have access to this app"}`))
+		return user, nil, 0, false
+	}
+
+	version := 0
+	if len(location) > 6 && location[6] != "diff" {
+		version, err = strconv.Atoi(location[6])
+		if err != nil || version <= 0 {
+			resp.WriteHeader(400)
+			resp.Write([]byte(`{"success": false, "reason": "Version has to be a positive number"}`))
+			return user, nil, 0, false
+		}
+	}
+
+	return user, app, version, true
+}
+
+// GET /api/v1/apps/{appId}/versions
+// GET /api/v1/apps/{appId}/versions/{version} (includes the spec)
+func handleGetOpenApiVersions(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	_, app, version, ok := getOpenApiVersionRequest(resp, request, false)
+	if !ok {
+		return
+	}
+
+	ctx := shuffle.GetContext(request)
+	var result interface{}
+	if version == 0 {
+		versions, err := getOpenApiAppVersions(ctx, app.ID)
+		if err != nil {
+			log.Printf("[WARNING] Failed getting versions of app %s: %s", app.ID, err)
+			resp.WriteHeader(500)
+			resp.Write([]byte(`{"success": false, "reason": "Failed getting app versions"}`))
+			return
+		}
+
+		result = struct {
+			Success  bool                `json:"success"`
+			Versions []openApiAppVersion `json:"versions"`
+		}{
+			Success:  true,
+			Versions: versions,
+		}
+	} else {
+		appVersion, err := getOpenApiAppVersion(ctx, app.ID, version)
+		if err != nil {
+			resp.WriteHeader(404)
+			resp.Write([]byte(`{"success": false, "reason": "Version doesn't exist"}`))
+			return
+		}
+
+		spec, err := getOpenApiAppVersionSpec(ctx, app.ID, version)
+		if err != nil {
+			log.Printf("[WARNING] Failed getting spec of %s version %d: %s", app.ID, version, err)
+		}
+
+		result = struct {
+			Success bool              `json:"success"`
+			Version openApiAppVersion `json:"version"`
+			Body    string            `json:"body"`
+		}{
+			Success: true,
+			Version: appVersion,
+			Body:    spec.Body,
+		}
+	}
+
+	newjson, err := json.Marshal(result)
+	if err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed marshalling app versions"}`))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write(newjson)
+}
+
+// GET /api/v1/apps/{appId}/versions/diff?from=1&to=2
+// "to" defaults to the latest version
+func handleDiffOpenApiVersions(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	_, app, _, ok := getOpenApiVersionRequest(resp, request, false)
+	if !ok {
+		return
+	}
+
+	ctx := shuffle.GetContext(request)
+	from, err := strconv.Atoi(request.URL.Query().Get("from"))
+	if err != nil || from <= 0 {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "from has to be a positive version number"}`))
+		return
+	}
+
+	to := 0
+	if len(request.URL.Query().Get("to")) > 0 {
+		to, err = strconv.Atoi(request.URL.Query().Get("to"))
+		if err != nil || to <= 0 {
+			resp.WriteHeader(400)
+			resp.Write([]byte(`{"success": false, "reason": "to has to be a positive version number"}`))
+			return
+		}
+	} else {
+		to, err = getNextOpenApiAppVersion(ctx, app.ID)
+		to -= 1
+		if err != nil || to <= 0 {
+			resp.WriteHeader(404)
+			resp.Write([]byte(`{"success": false, "reason": "App has no versions"}`))
+			return
+		}
+	}
+
+	fromSpec, err := getOpenApiAppVersionSpec(ctx, app.ID, from)
+	if err != nil {
+		resp.WriteHeader(404)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Version %d doesn't exist"}`, from)))
+		return
+	}
+
+	toSpec, err := getOpenApiAppVersionSpec(ctx, app.ID, to)
+	if err != nil {
+		resp.WriteHeader(404)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Version %d doesn't exist"}`, to)))
+		return
+	}
+
+	diff, err := diffOpenApiSpecs([]byte(fromSpec.Body), []byte(toSpec.Body))
+	if err != nil {
+		log.Printf("[WARNING] Failed diffing %s version %d and %d: %s", app.ID, from, to, err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Failed parsing specs"}`))
+		return
+	}
+
+	diff.From = from
+	diff.To = to
+	newjson, err := json.Marshal(diff)
+	if err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed marshalling diff"}`))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write(newjson)
+}
+
+// POST /api/v1/apps/{appId}/versions/{version}/rollback
+// Rolling back builds the old spec as a new version, so history is never rewritten.
+func handleRollbackOpenApiVersion(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, app, version, ok := getOpenApiVersionRequest(resp, request, true)
+	if !ok {
+		return
+	}
+
+	ctx := shuffle.GetContext(request)
+	spec, err := getOpenApiAppVersionSpec(ctx, app.ID, version)
+	if err != nil {
+		resp.WriteHeader(404)
+		resp.Write([]byte(`{"success": false, "reason": "Version doesn't exist"}`))
+		return
+	}
+
+	body, err := getOpenApiSpecData([]byte(spec.Body))
+	if err != nil {
+		log.Printf("[WARNING] Failed parsing spec of %s version %d for rollback: %s", app.ID, version, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed parsing stored spec"}`))
+		return
+	}
+
+	body["editing"] = true
+	body["id"] = app.ID
+	body["rollback_from"] = version
+	newBody, err := json.Marshal(body)
+	if err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed marshalling stored spec"}`))
+		return
+	}
+
+	log.Printf("[AUDIT] User %s (%s) is rolling back app %s to version %d", user.Username, user.Id, app.ID, version)
+	buildSwaggerApp(resp, newBody, user, false)
+}
+
+// PUT /api/v1/apps/{appId}/versions/{version}/pin with {"workflow_id": "..."}
+// DELETE on the same path unpins the app, making the workflow follow the latest version
+func handlePinOpenApiVersion(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, app, version, ok := getOpenApiVersionRequest(resp, request, true)
+	if !ok {
+		return
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Failed reading body"}`))
+		return
+	}
+
+	var pinRequest struct {
+		WorkflowId string `json:"workflow_id"`
+	}
+
+	err = json.Unmarshal(body, &pinRequest)
+	if err != nil || len(pinRequest.WorkflowId) != 36 {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Provide a valid workflow_id"}`))
+		return
+	}
+
+	ctx := shuffle.GetContext(request)
+	workflow, err := shuffle.GetWorkflow(ctx, pinRequest.WorkflowId)
+	if err != nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Workflow doesn't exist"}`))
+		return
+	}
+
+	if workflow.OrgId != user.ActiveOrg.Id {
+		log.Printf("[WARNING] User %s (%s) tried to pin app versions in workflow %s without access", user.Username, user.Id, workflow.ID)
+		resp.WriteHeader(403)
+		resp.Write([]byte(`{"success": false, "reason": "You don't have access to this workflow"}`))
+		return
+	}
+
+	appVersion, err := getOpenApiAppVersion(ctx, app.ID, version)
+	if err != nil {
+		resp.WriteHeader(404)
+		resp.Write([]byte(`{"success": false, "reason": "Version doesn't exist"}`))
+		return
+	}
+
+	if request.Method == "PUT" && !isOpenApiAppVersionBuilt(appVersion) {
+		log.Printf("[WARNING] User %s tried pinning version %d of app %s, which is %s", user.Username, version, app.ID, appVersion.Status)
+		resp.WriteHeader(409)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Version %d can't be pinned as its image is %s"}`, version, appVersion.Status)))
+		return
+	}
+
+	pins, err := getWorkflowAppPins(ctx, workflow.ID)
+	if err != nil && err != errEsNotFound {
+		log.Printf("[WARNING] Failed getting app pins for workflow %s: %s", workflow.ID, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed getting pins"}`))
+		return
+	}
+
+	pins.WorkflowId = workflow.ID
+	pins.OrgId = workflow.OrgId
+	newPins := []workflowAppPin{}
+	for _, pin := range pins.Pins {
+		if pin.AppId != app.ID {
+			newPins = append(newPins, pin)
+		}
+	}
+
+	if request.Method == "PUT" {
+		newPins = append(newPins, workflowAppPin{
+			AppId:         app.ID,
+			Version:       appVersion.Version,
+			PinnedVersion: appVersion.PinnedVersion,
+			Edited:        time.Now().Unix(),
+		})
+	}
+
+	pins.Pins = newPins
+	err = setWorkflowAppPins(ctx, pins)
+	if err != nil {
+		log.Printf("[WARNING] Failed setting app pins for workflow %s: %s", workflow.ID, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed saving pins"}`))
+		return
+	}
+
+	if request.Method == "PUT" {
+		log.Printf("[AUDIT] User %s (%s) pinned app %s to version %d in workflow %s", user.Username, user.Id, app.ID, appVersion.Version, workflow.ID)
+	} else {
+		log.Printf("[AUDIT] User %s (%s) unpinned app %s in workflow %s", user.Username, user.Id, app.ID, workflow.ID)
+	}
+
+	resp.WriteHeader(200)
+	resp.Write([]byte(`{"success": true}`))
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffOpenApiSpecs(t *testing.T) {
+	before := []byte(`{
+		"editing": true,
+		"id": "1234",
+		"info": {"title": "Test", "version": "1.0"},
+		"paths": {
+			"/users": {"get": {"summary": "List users"}},
+			"/users/{id}": {"get": {"summary": "Get user"}, "delete": {"summary": "Delete user"}}
+		}
+	}`)
+
+	after := []byte(`{
+		"editing": false,
+		"info": {"title": "Test", "version": "1.1"},
+		"paths": {
+			"/users": {"get": {"summary": "List all users"}, "post": {"summary": "Create user"}},
+			"/users/{id}": {"get": {"summary": "Get user"}}
+		}
+	}`)
+
+	diff, err := diffOpenApiSpecs(before, after)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if !reflect.DeepEqual(diff.OperationsAdded, []string{"POST /users"}) {
+		t.Errorf("unexpected added operations: %#v", diff.OperationsAdded)
+	}
+
+	if !reflect.DeepEqual(diff.OperationsRemoved, []string{"DELETE /users/{id}"}) {
+		t.Errorf("unexpected removed operations: %#v", diff.OperationsRemoved)
+	}
+
+	if !reflect.DeepEqual(diff.OperationsChanged, []string{"GET /users"}) {
+		t.Errorf("unexpected changed operations: %#v", diff.OperationsChanged)
+	}
+
+	paths := []string{}
+	for _, change := range diff.Changes {
+		paths = append(paths, change.Path)
+	}
+
+	expected := []string{
+		"/info/version",
+		"/paths/~1users/get/summary",
+		"/paths/~1users/post",
+		"/paths/~1users~1{id}/delete",
+	}
+
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("unexpected changes: %#v", paths)
+	}
+
+	if getOpenApiSpecHash(before) == getOpenApiSpecHash(after) {
+		t.Errorf("expected different spec hashes")
+	}
+
+	if getOpenApiSpecHash([]byte(`{"editing": true, "a": 1}`)) != getOpenApiSpecHash([]byte(`{"a": 1, "id": "x"}`)) {
+		t.Errorf("expected request fields to be ignored in spec hash")
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+// Small Opensearch client for the indexes the backend owns itself
+// (leases, schedule options etc.). Everything else goes through shuffle-shared.
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+var errEsConflict = errors.New("Document version conflict")
+var errEsNotFound = errors.New("Document not found")
+
+var esHttpClient *http.Client
+
+type esDocument struct {
+	Id          string          `json:"_id"`
+	SeqNo       int64           `json:"_seq_no"`
+	PrimaryTerm int64           `json:"_primary_term"`
+	Found       bool            `json:"found"`
+	Source      json.RawMessage `json:"_source"`
+}
+
+type esSearchResult struct {
+	Hits struct {
+		Hits []esDocument `json:"hits"`
+	} `json:"hits"`
+}
+
+// Same prefixing as shuffle-shared uses for its indexes
+func getEsIndex(index string) string {
+	prefix := os.Getenv("SHUFFLE_OPENSEARCH_INDEX_PREFIX")
+	if len(prefix) > 0 {
+		return strings.ToLower(fmt.Sprintf("%s_%s", prefix, index))
+	}
+
+	return strings.ToLower(index)
+}
+
+func getEsClient() *http.Client {
+	if esHttpClient != nil {
+		return esHttpClient
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{}
+	if strings.ToLower(os.Getenv("SHUFFLE_OPENSEARCH_SKIPSSL_VERIFY")) == "true" {
+		transport.TLSClientConfig.InsecureSkipVerify = true
+	}
+
+	certificateFile := os.Getenv("SHUFFLE_OPENSEARCH_CERTIFICATE_FILE")
+	if len(certificateFile) > 0 {
+		certificate, err := ioutil.ReadFile(certificateFile)
+		if err != nil {
+			log.Printf("[WARNING] Failed reading Opensearch certificate file %s: %s", certificateFile, err)
+		} else {
+			pool := x509.NewCertPool()
+			pool.AppendCertsFromPEM(certificate)
+			transport.TLSClientConfig.RootCAs = pool
+		}
+	}
+
+	proxy := os.Getenv("SHUFFLE_OPENSEARCH_PROXY")
+	if len(proxy) > 0 {
+		proxyUrl, err := url.Parse(proxy)
+		if err == nil {
+			transport.Proxy = http.ProxyURL(proxyUrl)
+		}
+	} else {
+		transport.Proxy = nil
+	}
+
+	esHttpClient = &http.Client{
+		Transport: transport,
+		Timeout:   15 * time.Second,
+	}
+
+	return esHttpClient
+}
+
+func esRequest(ctx context.Context, method, path string, body []byte) ([]byte, int, error) {
+	baseUrl := os.Getenv("SHUFFLE_OPENSEARCH_URL")
+	if len(baseUrl) == 0 {
+		baseUrl = "http://shuffle-opensearch:9200"
+	}
+
+	req, err := http.NewRequestWithContext(
+		ctx,
+		method,
+		fmt.Sprintf("%s/%s", strings.TrimRight(baseUrl, "/"), strings.TrimLeft(path, "/")),
+		bytes.NewReader(body),
+	)
+	if err != nil {
+		return []byte{}, 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	apikey := os.Getenv("SHUFFLE_OPENSEARCH_APIKEY")
+	if len(apikey) > 0 {
+		req.Header.Set("Authorization", fmt.Sprintf("ApiKey %s", apikey))
+	} else if len(os.Getenv("SHUFFLE_OPENSEARCH_USERNAME")) > 0 {
+		req.SetBasicAuth(os.Getenv("SHUFFLE_OPENSEARCH_USERNAME"), os.Getenv("SHUFFLE_OPENSEARCH_PASSWORD"))
+	}
+
+	newresp, err := getEsClient().Do(req)
+	if err != nil {
+		return []byte{}, 0, err
+	}
+
+	defer newresp.Body.Close()
+	respBody, err := ioutil.ReadAll(newresp.Body)
+	if err != nil {
+		return []byte{}, newresp.StatusCode, err
+	}
+
+	if newresp.StatusCode == 409 {
+		return respBody, newresp.StatusCode, errEsConflict
+	}
+
+	if newresp.StatusCode == 404 {
+		return respBody, newresp.StatusCode, errEsNotFound
+	}
+
+	if newresp.StatusCode >= 300 {
+		return respBody, newresp.StatusCode, errors.New(fmt.Sprintf("Bad status code %d from Opensearch: %s", newresp.StatusCode, string(respBody)))
+	}
+
+	return respBody, newresp.StatusCode, nil
+}
+
+// Returns errEsNotFound if the document or index doesn't exist
+func getEsDocument(ctx context.Context, index, id string) (*esDocument, error) {
+	respBody, _, err := esRequest(ctx, "GET", fmt.Sprintf("%s/_doc/%s", getEsIndex(index), url.PathEscape(id)), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	document := &esDocument{}
+	err = json.Unmarshal(respBody, document)
+	if err != nil {
+		return nil, err
+	}
+
+	if !document.Found {
+		return nil, errEsNotFound
+	}
+
+	return document, nil
+}
+
+// Creates or overwrites a document
+func setEsDocument(ctx context.Context, index, id string, data interface{}) error {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	_, _, err = esRequest(ctx, "PUT", fmt.Sprintf("%s/_doc/%s?refresh=true", getEsIndex(index), url.PathEscape(id)), body)
+	return err
+}
+
+// Only creates the document if it doesn't exist. Returns errEsConflict otherwise.
+func createEsDocument(ctx context.Context, index, id string, data interface{}) error {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	_, _, err = esRequest(ctx, "PUT", fmt.Sprintf("%s/_create/%s?refresh=true", getEsIndex(index), url.PathEscape(id)), body)
+	return err
+}
+
+// Only overwrites the document if nobody else changed it since it was read.
+// Returns errEsConflict otherwise.
+func updateEsDocumentIfUnchanged(ctx context.Context, index string, document *esDocument, data interface{}) error {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	path := fmt.Sprintf("%s/_doc/%s?refresh=true&if_seq_no=%d&if_primary_term=%d", getEsIndex(index), url.PathEscape(document.Id), document.SeqNo, document.PrimaryTerm)
+	_, _, err = esRequest(ctx, "PUT", path, body)
+	return err
+}
+
+func deleteEsDocument(ctx context.Context, index, id string) error {
+	_, _, err := esRequest(ctx, "DELETE", fmt.Sprintf("%s/_doc/%s?refresh=true", getEsIndex(index), url.PathEscape(id)), nil)
+	return err
+}
+
+// Only deletes the document if nobody else changed it since it was read.
+// Returns errEsConflict otherwise.
+func deleteEsDocumentIfUnchanged(ctx context.Context, index string, document *esDocument) error {
+	path := fmt.Sprintf("%s/_doc/%s?refresh=true&if_seq_no=%d&if_primary_term=%d", getEsIndex(index), url.PathEscape(document.Id), document.SeqNo, document.PrimaryTerm)
+	_, _, err := esRequest(ctx, "DELETE", path, nil)
+	return err
+}
+
+// Runs a query against an index. A missing index returns no documents.
+func searchEsDocuments(ctx context.Context, index string, query map[string]interface{}, size int) ([]esDocument, error) {
+	search := map[string]interface{}{
+		"size":                size,
+		"seq_no_primary_term": true,
+	}
+
+	if query != nil {
+		search["query"] = query
+	}
+
+	body, err := json.Marshal(search)
+	if err != nil {
+		return []esDocument{}, err
+	}
+
+	respBody, _, err := esRequest(ctx, "POST", fmt.Sprintf("%s/_search", getEsIndex(index)), body)
+	if err == errEsNotFound {
+		return []esDocument{}, nil
+	} else if err != nil {
+		return []esDocument{}, err
+	}
+
+	result := esSearchResult{}
+	err = json.Unmarshal(respBody, &result)
+	if err != nil {
+		return []esDocument{}, err
+	}
+
+	return result.Hits.Hits, nil
+}
@@ -0,0 +1,1429 @@
+package main
+
+import (
+	uuid "github.com/satori/go.uuid"
+	"github.com/shuffle/shuffle-shared"
+
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Enable with SHUFFLE_SCHEDULER_LEADER_ELECTION=true when running multiple backends.
+// Without it, every backend runs every schedule.
+var scheduleLeaderElection = strings.ToLower(os.Getenv("SHUFFLE_SCHEDULER_LEADER_ELECTION")) == "true"
+var scheduleLeaseHolder = uuid.NewV4().String()
+var scheduleLeaderUntil int64
+
+var scheduledJobsLock sync.Mutex
+
+// A parsed cron expression. Each field is a bitmask of the allowed values.
+// Supports both the 5-field (minute precision) and 6-field (second precision)
+// formats, as well as a CRON_TZ=<timezone> or TZ=<timezone> prefix.
+type cronSchedule struct {
+	Expression string
+
+	second   uint64
+	minute   uint64
+	hour     uint64
+	dom      uint64
+	month    uint64
+	dow      uint64
+	location *time.Location
+
+	// Cron uses OR between day of month and day of week
+	// if both are restricted, and AND otherwise
+	domRestricted bool
+	dowRestricted bool
+}
+
+type cronBounds struct {
+	min   int
+	max   int
+	names map[string]int
+}
+
+var cronSeconds = cronBounds{0, 59, nil}
+var cronMinutes = cronBounds{0, 59, nil}
+var cronHours = cronBounds{0, 23, nil}
+var cronDom = cronBounds{1, 31, nil}
+var cronMonths = cronBounds{1, 12, map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}}
+
+// 7 is accepted as sunday and folded into 0 after parsing
+var cronDow = cronBounds{0, 7, map[string]int{
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}}
+
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 0 1 1 *",
+	"@annually": "0 0 0 1 1 *",
+	"@monthly":  "0 0 0 1 * *",
+	"@weekly":   "0 0 0 * * 0",
+	"@daily":    "0 0 0 * * *",
+	"@midnight": "0 0 0 * * *",
+	"@hourly":   "0 0 * * * *",
+}
+
+// Interval schedules are stored as a plain number of seconds.
+// Anything else is treated as a cron expression.
+func isCronFrequency(frequency string) bool {
+	frequency = strings.TrimSpace(frequency)
+	if len(frequency) == 0 {
+		return false
+	}
+
+	_, err := strconv.Atoi(frequency)
+	return err != nil
+}
+
+func parseCronSchedule(expression string) (*cronSchedule, error) {
+	schedule := &cronSchedule{
+		Expression: strings.TrimSpace(expression),
+		location:   time.Local,
+	}
+
+	fields := strings.Fields(schedule.Expression)
+	if len(fields) == 0 {
+		return nil, errors.New("Empty cron expression")
+	}
+
+	if strings.HasPrefix(fields[0], "CRON_TZ=") || strings.HasPrefix(fields[0], "TZ=") {
+		timezone := fields[0][strings.Index(fields[0], "=")+1:]
+		location, err := time.LoadLocation(timezone)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid timezone '%s': %s", timezone, err))
+		}
+
+		schedule.location = location
+		fields = fields[1:]
+	}
+
+	if len(fields) == 1 && strings.HasPrefix(fields[0], "@") {
+		descriptor, ok := cronDescriptors[strings.ToLower(fields[0])]
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("Unknown cron descriptor '%s'", fields[0]))
+		}
+
+		fields = strings.Fields(descriptor)
+	}
+
+	if len(fields) == 5 {
+		fields = append([]string{"0"}, fields...)
+	} else if len(fields) != 6 {
+		return nil, errors.New(fmt.Sprintf("Cron expression needs 5 or 6 fields, got %d", len(fields)))
+	}
+
+	var err error
+	if schedule.second, err = parseCronField(fields[0], cronSeconds); err != nil {
+		return nil, errors.New(fmt.Sprintf("Bad seconds field: %s", err))
+	}
+	if schedule.minute, err = parseCronField(fields[1], cronMinutes); err != nil {
+		return nil, errors.New(fmt.Sprintf("Bad minutes field: %s", err))
+	}
+	if schedule.hour, err = parseCronField(fields[2], cronHours); err != nil {
+		return nil, errors.New(fmt.Sprintf("Bad hours field: %s", err))
+	}
+	if schedule.dom, err = parseCronField(fields[3], cronDom); err != nil {
+		return nil, errors.New(fmt.Sprintf("Bad day of month field: %s", err))
+	}
+	if schedule.month, err = parseCronField(fields[4], cronMonths); err != nil {
+		return nil, errors.New(fmt.Sprintf("Bad month field: %s", err))
+	}
+	if schedule.dow, err = parseCronField(fields[5], cronDow); err != nil {
+		return nil, errors.New(fmt.Sprintf("Bad day of week field: %s", err))
+	}
+
+	if schedule.dow&(1<<7) > 0 {
+		schedule.dow = (schedule.dow | 1) &^ (1 << 7)
+	}
+
+	schedule.domRestricted = fields[3] != "*" && fields[3] != "?"
+	schedule.dowRestricted = fields[5] != "*" && fields[5] != "?"
+	return schedule, nil
+}
+
+// Parses a single field such as "*/5", "1-5", "MON-FRI" or "0,15,30"
+func parseCronField(field string, bounds cronBounds) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		if len(part) == 0 {
+			return 0, errors.New("empty list item")
+		}
+
+		step := 1
+		rangePart := part
+		if strings.Contains(part, "/") {
+			split := strings.SplitN(part, "/", 2)
+			rangePart = split[0]
+
+			parsedStep, err := strconv.Atoi(split[1])
+			if err != nil || parsedStep < 1 {
+				return 0, errors.New(fmt.Sprintf("invalid step '%s'", split[1]))
+			}
+
+			step = parsedStep
+		}
+
+		start, end := bounds.min, bounds.max
+		if rangePart != "*" && rangePart != "?" {
+			if strings.Contains(rangePart, "-") {
+				split := strings.SplitN(rangePart, "-", 2)
+
+				var err error
+				if start, err = parseCronValue(split[0], bounds); err != nil {
+					return 0, err
+				}
+				if end, err = parseCronValue(split[1], bounds); err != nil {
+					return 0, err
+				}
+			} else {
+				value, err := parseCronValue(rangePart, bounds)
+				if err != nil {
+					return 0, err
+				}
+
+				start = value
+				end = value
+
+				// "5/15" means every 15 starting at 5
+				if strings.Contains(part, "/") {
+					end = bounds.max
+				}
+			}
+		}
+
+		if start > end {
+			return 0, errors.New(fmt.Sprintf("invalid range '%s'", rangePart))
+		}
+
+		for i := start; i <= end; i += step {
+			bits |= 1 << uint(i)
+		}
+	}
+
+	return bits, nil
+}
+
+func parseCronValue(value string, bounds cronBounds) (int, error) {
+	if bounds.names != nil {
+		if parsed, ok := bounds.names[strings.ToLower(value)]; ok {
+			return parsed, nil
+		}
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("invalid value '%s'", value))
+	}
+
+	if parsed < bounds.min || parsed > bounds.max {
+		return 0, errors.New(fmt.Sprintf("value %d out of range %d-%d", parsed, bounds.min, bounds.max))
+	}
+
+	return parsed, nil
+}
+
+func (schedule *cronSchedule) dayMatches(t time.Time) bool {
+	domMatch := schedule.dom&(1<<uint(t.Day())) > 0
+	dowMatch := schedule.dow&(1<<uint(t.Weekday())) > 0
+	if schedule.domRestricted && schedule.dowRestricted {
+		return domMatch || dowMatch
+	}
+
+	return domMatch && dowMatch
+}
+
+// Next returns the first time after t matching the schedule,
+// or a zero time if nothing matches within the next five years.
+func (schedule *cronSchedule) Next(t time.Time) time.Time {
+	origLocation := t.Location()
+	t = t.In(schedule.location).Add(1*time.Second - time.Duration(t.Nanosecond()))
+	yearLimit := t.Year() + 5
+
+WRAP:
+	if t.Year() > yearLimit {
+		return time.Time{}
+	}
+
+	for schedule.month&(1<<uint(t.Month())) == 0 {
+		t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, schedule.location)
+		if t.Month() == time.January {
+			goto WRAP
+		}
+	}
+
+	for !schedule.dayMatches(t) {
+		t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, schedule.location)
+		if t.Day() == 1 {
+			goto WRAP
+		}
+	}
+
+	for schedule.hour&(1<<uint(t.Hour())) == 0 {
+		t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, schedule.location)
+		if t.Hour() == 0 {
+			goto WRAP
+		}
+	}
+
+	for schedule.minute&(1<<uint(t.Minute())) == 0 {
+		t = t.Truncate(time.Minute).Add(1 * time.Minute)
+		if t.Minute() == 0 {
+			goto WRAP
+		}
+	}
+
+	for schedule.second&(1<<uint(t.Second())) == 0 {
+		t = t.Truncate(time.Second).Add(1 * time.Second)
+		if t.Second() == 0 {
+			goto WRAP
+		}
+	}
+
+	return t.In(origLocation)
+}
+
+// A running schedule. Replaces newscheduler for workflow schedules,
+// as that one only handles fixed intervals.
+type scheduleJob struct {
+	Id       string
+	Interval int
+	Cron     *cronSchedule
+	NextRun  time.Time
+	Started  time.Time
+
+	// Added to every cron run, and to the first interval run
+	Offset time.Duration
+
+	// Set for one-off schedules, which only run once
+	RunAt time.Time
+
+	fn      func()
+	quit    chan bool
+	running bool
+	sync.Mutex
+}
+
+// Runs fn every interval seconds, or on the cron expression if cron is set
+func newScheduleJob(id string, interval int, cron *cronSchedule, fn func()) (*scheduleJob, error) {
+	if cron == nil && interval < 1 {
+		return nil, errors.New("Frequency has to be more than 0")
+	}
+
+	return &scheduleJob{
+		Id:       id,
+		Interval: interval,
+		Cron:     cron,
+		fn:       fn,
+		quit:     make(chan bool, 1),
+	}, nil
+}
+
+// Runs fn once at runAt
+func newOneOffScheduleJob(id string, runAt time.Time, fn func()) *scheduleJob {
+	return &scheduleJob{
+		Id:    id,
+		RunAt: runAt,
+		fn:    fn,
+		quit:  make(chan bool, 1),
+	}
+}
+
+// Runs once immediately if immediately is true. Delay pushes the
+// first interval run back, and is used to spread out startup.
+func (job *scheduleJob) Start(immediately bool, delay time.Duration) error {
+	job.Started = time.Now()
+	next := job.nextRun(job.Started)
+	if !job.RunAt.IsZero() {
+		next = job.RunAt
+	}
+
+	if next.IsZero() {
+		return errors.New("Schedule never runs")
+	}
+
+	if job.Cron == nil {
+		next = next.Add(job.Offset + delay)
+	}
+
+	if immediately {
+		go job.run()
+	}
+
+	go func() {
+		for {
+			job.Lock()
+			job.NextRun = next
+			job.Unlock()
+
+			select {
+			case <-job.quit:
+				return
+			case <-time.After(time.Until(next)):
+				go job.run()
+			}
+
+			next = job.nextRun(time.Now())
+			if next.IsZero() {
+				if job.RunAt.IsZero() {
+					log.Printf("[WARNING] Schedule %s has no more runs. Stopping.", job.Id)
+				}
+
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (job *scheduleJob) nextRun(from time.Time) time.Time {
+	if !job.RunAt.IsZero() {
+		if from.Before(job.RunAt) {
+			return job.RunAt
+		}
+
+		return time.Time{}
+	}
+
+	if job.Cron != nil {
+		next := job.Cron.Next(from.Add(-job.Offset))
+		if next.IsZero() {
+			return next
+		}
+
+		return next.Add(job.Offset)
+	}
+
+	return from.Add(time.Duration(job.Interval) * time.Second)
+}
+
+// Skips the run if the previous one is still going
+func (job *scheduleJob) run() {
+	job.Lock()
+	if job.running {
+		job.Unlock()
+		return
+	}
+
+	job.running = true
+	job.Unlock()
+
+	job.fn()
+
+	job.Lock()
+	job.running = false
+	job.Unlock()
+}
+
+func (job *scheduleJob) Stop() {
+	select {
+	case job.quit <- true:
+	default:
+	}
+}
+
+func (job *scheduleJob) GetNextRun() time.Time {
+	job.Lock()
+	defer job.Unlock()
+
+	return job.NextRun
+}
+
+// Options for onprem schedules that don't fit in shuffle.ScheduleOld.
+// Stored in their own index with the same ID as the schedule.
+type scheduleOptions struct {
+	ScheduleId string `json:"schedule_id"`
+
+	// Jitter is the window in seconds a run can be pushed back. The actual
+	// offset is derived from the schedule ID, so it stays the same across restarts.
+	Jitter int `json:"jitter"`
+	Offset int `json:"offset"`
+
+	// How long to wait before starting an interval schedule when it's restored
+	StartupDelay int `json:"startup_delay"`
+
+	// What to do with runs missed while no backend was running the schedule.
+	// skip, once or all. MaxCatchup caps how many runs "all" does.
+	MisfirePolicy string `json:"misfire_policy"`
+	MaxCatchup    int    `json:"max_catchup"`
+
+	// Paused schedules stay stored, but don't run until resumed
+	Paused   bool  `json:"paused"`
+	PausedAt int64 `json:"paused_at"`
+
+	// One-off schedules run once at RunAt (unix) and are then finished
+	RunAt    int64 `json:"run_at"`
+	Finished bool  `json:"finished"`
+}
+
+// Whether a schedule should be running on the backends. One-offs that
+// are past their time are left to the misfire policy.
+func isScheduleActive(options scheduleOptions, now time.Time) bool {
+	if options.Paused {
+		return false
+	}
+
+	if options.RunAt > 0 {
+		return !options.Finished && options.RunAt > now.Unix()
+	}
+
+	return true
+}
+
+const (
+	scheduleMisfireSkip = "skip"
+	scheduleMisfireOnce = "once"
+	scheduleMisfireAll  = "all"
+)
+
+func isValidMisfirePolicy(policy string) bool {
+	return policy == scheduleMisfireSkip || policy == scheduleMisfireOnce || policy == scheduleMisfireAll
+}
+
+func getDefaultMisfirePolicy() string {
+	policy := strings.ToLower(os.Getenv("SHUFFLE_SCHEDULE_MISFIRE_POLICY"))
+	if len(policy) == 0 {
+		return scheduleMisfireSkip
+	}
+
+	if !isValidMisfirePolicy(policy) {
+		log.Printf("[WARNING] Invalid value for SHUFFLE_SCHEDULE_MISFIRE_POLICY: %s. Using %s", policy, scheduleMisfireSkip)
+		return scheduleMisfireSkip
+	}
+
+	return policy
+}
+
+// Deterministic number between 0 and max based on the input
+func getScheduleHash(input string, max int) int {
+	if max <= 0 {
+		return 0
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(input))
+	return int(h.Sum32() % uint32(max))
+}
+
+func getScheduleEnvInt(key string, defaultValue int) int {
+	if len(os.Getenv(key)) == 0 {
+		return defaultValue
+	}
+
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || value < 0 {
+		log.Printf("[WARNING] Invalid value for %s: %s. Using %d", key, os.Getenv(key), defaultValue)
+		return defaultValue
+	}
+
+	return value
+}
+
+// Jitter of -1 means the default from SHUFFLE_SCHEDULE_JITTER
+func newScheduleOptions(scheduleId string, jitter int) scheduleOptions {
+	if jitter < 0 {
+		jitter = getScheduleEnvInt("SHUFFLE_SCHEDULE_JITTER", 0)
+	}
+
+	spread := getScheduleEnvInt("SHUFFLE_SCHEDULE_STARTUP_SPREAD", 60)
+	return scheduleOptions{
+		ScheduleId:    scheduleId,
+		Jitter:        jitter,
+		Offset:        getScheduleHash(scheduleId, jitter),
+		StartupDelay:  getScheduleHash(fmt.Sprintf("%s_startup", scheduleId), spread),
+		MisfirePolicy: getDefaultMisfirePolicy(),
+		MaxCatchup:    getScheduleEnvInt("SHUFFLE_SCHEDULE_MAX_CATCHUP", 10),
+	}
+}
+
+func getScheduleOptions(ctx context.Context, scheduleId string) (scheduleOptions, error) {
+	options := scheduleOptions{}
+	document, err := getEsDocument(ctx, "schedule_options", scheduleId)
+	if err != nil {
+		return options, err
+	}
+
+	err = json.Unmarshal(document.Source, &options)
+	return options, err
+}
+
+func setScheduleOptions(ctx context.Context, options scheduleOptions) error {
+	return setEsDocument(ctx, "schedule_options", options.ScheduleId, options)
+}
+
+func deleteScheduleOptions(ctx context.Context, scheduleId string) error {
+	err := deleteEsDocument(ctx, "schedule_options", scheduleId)
+	if err == errEsNotFound {
+		return nil
+	}
+
+	return err
+}
+
+func getAllScheduleOptions(ctx context.Context) (map[string]scheduleOptions, error) {
+	allOptions := map[string]scheduleOptions{}
+	documents, err := searchEsDocuments(ctx, "schedule_options", nil, 10000)
+	if err != nil {
+		return allOptions, err
+	}
+
+	for _, document := range documents {
+		options := scheduleOptions{}
+		err = json.Unmarshal(document.Source, &options)
+		if err != nil {
+			log.Printf("[WARNING] Failed unmarshalling schedule options %s: %s", document.Id, err)
+			continue
+		}
+
+		allOptions[document.Id] = options
+	}
+
+	return allOptions, nil
+}
+
+// Gets the options for a schedule, storing defaults if it has none yet.
+// Preloaded can be nil.
+func loadScheduleOptions(ctx context.Context, scheduleId string, preloaded map[string]scheduleOptions) scheduleOptions {
+	if options, exists := preloaded[scheduleId]; exists {
+		return options
+	}
+
+	options, err := getScheduleOptions(ctx, scheduleId)
+	if err == nil {
+		return options
+	}
+
+	options = newScheduleOptions(scheduleId, -1)
+	if err == errEsNotFound {
+		err = setScheduleOptions(ctx, options)
+	}
+
+	if err != nil {
+		log.Printf("[WARNING] Failed loading options for schedule %s: %s", scheduleId, err)
+	}
+
+	return options
+}
+
+// Counts how many schedules run in each second, for the last hour
+var scheduleRunCounts = map[int64]int{}
+var scheduleRunTotal int64
+var scheduleRunLock sync.Mutex
+
+func recordScheduleRun(runTime time.Time) {
+	scheduleRunLock.Lock()
+	defer scheduleRunLock.Unlock()
+
+	timestamp := runTime.Unix()
+	scheduleRunCounts[timestamp] += 1
+	scheduleRunTotal += 1
+
+	for key := range scheduleRunCounts {
+		if key < timestamp-3600 {
+			delete(scheduleRunCounts, key)
+		}
+	}
+}
+
+// Runs a stored schedule. Skipped if another backend holds the schedule lease.
+func getScheduleRunner(schedule shuffle.ScheduleOld, defaultOrgId string) func() {
+	return func() {
+		if !isScheduleLeader() {
+			log.Printf("[DEBUG] Skipping schedule %s as another backend is the schedule leader", schedule.Id)
+			return
+		}
+
+		// Options are read again, as the schedule may have been paused on another backend
+		ctx := context.Background()
+		options, optionsErr := getScheduleOptions(ctx, schedule.Id)
+		if optionsErr == nil {
+			if options.Paused {
+				log.Printf("[DEBUG] Skipping schedule %s as it's paused", schedule.Id)
+				return
+			}
+
+			if options.RunAt > 0 {
+				if options.Finished {
+					return
+				}
+
+				// Marked before running, so a one-off never runs twice
+				options.Finished = true
+				err := setScheduleOptions(ctx, options)
+				if err != nil {
+					log.Printf("[WARNING] Failed marking one-off schedule %s as finished. Skipping run: %s", schedule.Id, err)
+					return
+				}
+			}
+		}
+
+		runTime := time.Now()
+		recordScheduleRun(runTime)
+
+		// Used to find missed runs after downtime
+		err := updateScheduleLastRuntime(ctx, schedule.Id, runTime.Unix())
+		if err != nil {
+			log.Printf("[WARNING] Failed updating last runtime for schedule %s: %s", schedule.Id, err)
+		}
+
+		if optionsErr == nil && options.RunAt > 0 {
+			log.Printf("[INFO] Running one-off schedule %s.", schedule.Id)
+		} else if len(schedule.Frequency) > 0 {
+			log.Printf("[INFO] Running schedule %s with cron '%s'.", schedule.Id, schedule.Frequency)
+		} else {
+			log.Printf("[INFO] Running schedule %s with interval %d.", schedule.Id, schedule.Seconds)
+		}
+
+		request := &http.Request{
+			URL:    &url.URL{},
+			Method: "POST",
+			Body:   ioutil.NopCloser(strings.NewReader(schedule.WrappedArgument)),
+		}
+
+		orgId := defaultOrgId
+		if len(schedule.Org) == 36 {
+			orgId = schedule.Org
+		}
+
+		_, _, err = handleExecution(schedule.WorkflowId, shuffle.Workflow{}, request, orgId)
+		if err != nil {
+			log.Printf("[WARNING] Failed to execute %s: %s", schedule.WorkflowId, err)
+		}
+	}
+}
+
+func updateScheduleLastRuntime(ctx context.Context, scheduleId string, runtime int64) error {
+	schedule, err := shuffle.GetSchedule(ctx, scheduleId)
+	if err != nil {
+		return err
+	}
+
+	schedule.LastRuntime = runtime
+	return shuffle.SetSchedule(ctx, *schedule)
+}
+
+// Counts the runs that should have happened between the schedule's
+// last runtime and now, up to limit.
+func getMissedScheduleRuns(schedule shuffle.ScheduleOld, options scheduleOptions, now time.Time, limit int) int {
+	if options.Paused || limit < 1 {
+		return 0
+	}
+
+	if options.RunAt > 0 {
+		if !options.Finished && options.RunAt <= now.Unix() {
+			return 1
+		}
+
+		return 0
+	}
+
+	if schedule.LastRuntime <= 0 {
+		return 0
+	}
+
+	var cron *cronSchedule
+	if isCronFrequency(schedule.Frequency) {
+		var err error
+		cron, err = parseCronSchedule(schedule.Frequency)
+		if err != nil {
+			return 0
+		}
+	}
+
+	job, err := newScheduleJob(schedule.Id, schedule.Seconds, cron, nil)
+	if err != nil {
+		return 0
+	}
+
+	job.Offset = time.Duration(options.Offset) * time.Second
+
+	missed := 0
+	next := job.nextRun(time.Unix(schedule.LastRuntime, 0))
+	for !next.IsZero() && !next.After(now) && missed < limit {
+		missed += 1
+		next = job.nextRun(next)
+	}
+
+	return missed
+}
+
+// How many missed runs to make up for. A one-off that was missed would
+// otherwise never run, so it runs once late whatever the policy is.
+func getScheduleMisfireRuns(options scheduleOptions, policy string, missed, maxCatchup int) int {
+	if options.RunAt > 0 || policy == scheduleMisfireOnce {
+		return 1
+	}
+
+	if policy == scheduleMisfireAll {
+		if missed > maxCatchup {
+			return maxCatchup
+		}
+
+		return missed
+	}
+
+	return 0
+}
+
+// Applies the schedule's misfire policy to runs missed since its last runtime,
+// e.g. after a maintenance window. Only the schedule leader catches up.
+func handleScheduleMisfire(schedule shuffle.ScheduleOld, options scheduleOptions, defaultOrgId string) {
+	if !isScheduleLeader() {
+		return
+	}
+
+	policy := options.MisfirePolicy
+	if len(policy) == 0 {
+		policy = getDefaultMisfirePolicy()
+	}
+
+	maxCatchup := options.MaxCatchup
+	if maxCatchup <= 0 {
+		maxCatchup = getScheduleEnvInt("SHUFFLE_SCHEDULE_MAX_CATCHUP", 10)
+	}
+
+	// One more than the cap, so the log shows that runs were dropped
+	missed := getMissedScheduleRuns(schedule, options, time.Now(), maxCatchup+1)
+	if missed == 0 {
+		return
+	}
+
+	runs := getScheduleMisfireRuns(options, policy, missed, maxCatchup)
+	missedText := fmt.Sprintf("%d", missed)
+	if missed > maxCatchup {
+		missedText = fmt.Sprintf("more than %d", maxCatchup)
+	}
+
+	if options.RunAt > 0 {
+		log.Printf("[AUDIT] One-off schedule %s for workflow %s missed its run at %s. Running it now.", schedule.Id, schedule.WorkflowId, time.Unix(options.RunAt, 0).UTC().Format(time.RFC3339))
+	} else {
+		log.Printf("[AUDIT] Schedule %s for workflow %s missed %s run(s) since %s. Misfire policy '%s': running %d now.", schedule.Id, schedule.WorkflowId, missedText, time.Unix(schedule.LastRuntime, 0).UTC().Format(time.RFC3339), policy, runs)
+	}
+
+	if runs == 0 {
+		// Gap is recorded so it isn't reported again on the next restart
+		err := updateScheduleLastRuntime(context.Background(), schedule.Id, time.Now().Unix())
+		if err != nil {
+			log.Printf("[WARNING] Failed updating last runtime for schedule %s: %s", schedule.Id, err)
+		}
+
+		return
+	}
+
+	runner := getScheduleRunner(schedule, defaultOrgId)
+	go func() {
+		for i := 0; i < runs; i++ {
+			runner()
+		}
+	}()
+}
+
+// Checks all stored schedules for missed runs
+func handleScheduleMisfires(ctx context.Context, defaultOrgId string) {
+	schedules, err := shuffle.GetAllSchedules(ctx, "ALL")
+	if err != nil {
+		log.Printf("[WARNING] Failed getting schedules to check for missed runs: %s", err)
+		return
+	}
+
+	allOptions, err := getAllScheduleOptions(ctx)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting schedule options to check for missed runs: %s", err)
+	}
+
+	for _, schedule := range schedules {
+		if strings.ToLower(schedule.Environment) == "cloud" {
+			continue
+		}
+
+		handleScheduleMisfire(schedule, loadScheduleOptions(ctx, schedule.Id, allOptions), defaultOrgId)
+	}
+}
+
+// Starts (or restarts) a schedule that is stored in the database.
+// Delay pushes back the first run of interval schedules.
+func startStoredSchedule(schedule shuffle.ScheduleOld, options scheduleOptions, defaultOrgId string, immediately bool, delay time.Duration) error {
+	if options.RunAt > 0 {
+		jobret := newOneOffScheduleJob(schedule.Id, time.Unix(options.RunAt, 0), getScheduleRunner(schedule, defaultOrgId))
+		err := jobret.Start(false, 0)
+		if err != nil {
+			return err
+		}
+
+		setStoredScheduleJob(schedule.Id, jobret)
+		return nil
+	}
+
+	var cron *cronSchedule
+	if isCronFrequency(schedule.Frequency) {
+		var err error
+		cron, err = parseCronSchedule(schedule.Frequency)
+		if err != nil {
+			return err
+		}
+	}
+
+	jobret, err := newScheduleJob(schedule.Id, schedule.Seconds, cron, getScheduleRunner(schedule, defaultOrgId))
+	if err != nil {
+		return err
+	}
+
+	jobret.Offset = time.Duration(options.Offset) * time.Second
+	err = jobret.Start(immediately, delay)
+	if err != nil {
+		return err
+	}
+
+	setStoredScheduleJob(schedule.Id, jobret)
+	return nil
+}
+
+// Replaces the running job for a schedule, stopping the old one
+func setStoredScheduleJob(id string, job *scheduleJob) {
+	scheduledJobsLock.Lock()
+	defer scheduledJobsLock.Unlock()
+
+	if existing, exists := scheduledJobs[id]; exists {
+		existing.Stop()
+	}
+
+	scheduledJobs[id] = job
+}
+
+// Returns false if the schedule isn't running on this server
+func stopStoredSchedule(id string) bool {
+	scheduledJobsLock.Lock()
+	defer scheduledJobsLock.Unlock()
+
+	job, exists := scheduledJobs[id]
+	if !exists {
+		return false
+	}
+
+	job.Stop()
+	delete(scheduledJobs, id)
+	return true
+}
+
+func getStoredScheduleJob(id string) (*scheduleJob, bool) {
+	scheduledJobsLock.Lock()
+	defer scheduledJobsLock.Unlock()
+
+	job, exists := scheduledJobs[id]
+	return job, exists
+}
+
+// Stored in Opensearch. Whoever holds an unexpired lease runs the schedules.
+type scheduleLease struct {
+	Holder   string `json:"holder"`
+	Hostname string `json:"hostname"`
+	Expires  int64  `json:"expires"`
+	Updated  int64  `json:"updated"`
+}
+
+func isScheduleLeader() bool {
+	if !scheduleLeaderElection {
+		return true
+	}
+
+	return time.Now().Unix() < atomic.LoadInt64(&scheduleLeaderUntil)
+}
+
+// Takes or renews the leader lease. Returns false if another backend holds it.
+func renewScheduleLease(ctx context.Context, ttl int64) (bool, error) {
+	hostname, _ := os.Hostname()
+	timeNow := time.Now().Unix()
+	lease := scheduleLease{
+		Holder:   scheduleLeaseHolder,
+		Hostname: hostname,
+		Expires:  timeNow + ttl,
+		Updated:  timeNow,
+	}
+
+	document, err := getEsDocument(ctx, "schedule_leases", "leader")
+	if err == errEsNotFound {
+		err = createEsDocument(ctx, "schedule_leases", "leader", lease)
+	} else if err == nil {
+		existing := scheduleLease{}
+		err = json.Unmarshal(document.Source, &existing)
+		if err != nil {
+			return false, err
+		}
+
+		if existing.Holder != scheduleLeaseHolder && existing.Expires > timeNow {
+			return false, nil
+		}
+
+		// Fails if someone else took it in the meantime
+		err = updateEsDocumentIfUnchanged(ctx, "schedule_leases", document, lease)
+	}
+
+	if err == errEsConflict {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Keeps trying to become or stay the schedule leader. If the leader dies,
+// another backend takes over when its lease runs out.
+func runScheduleLeaderElection(ctx context.Context, defaultOrgId string) {
+	ttl := int64(30)
+	if len(os.Getenv("SHUFFLE_SCHEDULER_LEASE_SECONDS")) > 0 {
+		newTtl, err := strconv.Atoi(os.Getenv("SHUFFLE_SCHEDULER_LEASE_SECONDS"))
+		if err == nil && newTtl >= 10 {
+			ttl = int64(newTtl)
+		}
+	}
+
+	log.Printf("[DEBUG] Starting schedule leader election with lease of %d seconds. Holder ID: %s", ttl, scheduleLeaseHolder)
+	for {
+		wasLeader := isScheduleLeader()
+		leader, err := renewScheduleLease(ctx, ttl)
+		if err != nil {
+			// Keeps the current lease until it runs out by itself
+			log.Printf("[WARNING] Failed renewing schedule lease: %s", err)
+		} else if leader {
+			// Stops a bit before the lease runs out in case the next renewal fails
+			atomic.StoreInt64(&scheduleLeaderUntil, time.Now().Unix()+ttl-(ttl/3))
+			if !wasLeader {
+				log.Printf("[INFO] This backend is now the schedule leader")
+
+				// Runs missed while the previous leader was down
+				go handleScheduleMisfires(ctx, defaultOrgId)
+			}
+		} else {
+			atomic.StoreInt64(&scheduleLeaderUntil, 0)
+			if wasLeader {
+				log.Printf("[INFO] This backend is no longer the schedule leader")
+			}
+		}
+
+		time.Sleep(time.Duration(ttl/3) * time.Second)
+	}
+}
+
+// Schedules are only started on the backend that got the request.
+// This makes every backend pick up schedules created or deleted elsewhere,
+// so the current leader always has all of them.
+func runScheduleSync(ctx context.Context, defaultOrgId string) {
+	for {
+		time.Sleep(60 * time.Second)
+
+		syncStarted := time.Now()
+		schedules, err := shuffle.GetAllSchedules(ctx, "ALL")
+		if err != nil {
+			log.Printf("[WARNING] Failed getting schedules during schedule sync: %s", err)
+			continue
+		}
+
+		allOptions, err := getAllScheduleOptions(ctx)
+		if err != nil {
+			log.Printf("[WARNING] Failed getting schedule options during schedule sync: %s", err)
+			continue
+		}
+
+		found := map[string]bool{}
+		for _, schedule := range schedules {
+			if strings.ToLower(schedule.Environment) == "cloud" {
+				continue
+			}
+
+			// Paused and finished schedules are stopped below
+			options := loadScheduleOptions(ctx, schedule.Id, allOptions)
+			if !isScheduleActive(options, syncStarted) {
+				// One-offs created on another backend right before their time
+				if isScheduleLeader() && options.RunAt > 0 && !options.Paused && !options.Finished && options.RunAt > syncStarted.Unix()-120 {
+					go getScheduleRunner(schedule, defaultOrgId)()
+				}
+
+				continue
+			}
+
+			found[schedule.Id] = true
+			if _, exists := getStoredScheduleJob(schedule.Id); exists {
+				continue
+			}
+
+			err = startStoredSchedule(schedule, options, defaultOrgId, false, time.Duration(options.StartupDelay)*time.Second)
+			if err != nil {
+				log.Printf("[WARNING] Failed starting schedule %s during sync: %s", schedule.Id, err)
+			} else {
+				log.Printf("[DEBUG] Started schedule %s for workflow %s from sync", schedule.Id, schedule.WorkflowId)
+			}
+		}
+
+		scheduledJobsLock.Lock()
+		for id, job := range scheduledJobs {
+			// Could have been created after the schedules were loaded
+			if found[id] || job.Started.After(syncStarted) {
+				continue
+			}
+
+			log.Printf("[DEBUG] Stopping schedule %s as it was removed, paused or finished", id)
+			job.Stop()
+			delete(scheduledJobs, id)
+		}
+		scheduledJobsLock.Unlock()
+	}
+}
+
+// Returns the next runtime for a stored schedule, whether it's
+// running on this server or not.
+func getScheduleNextRun(schedule shuffle.ScheduleOld, options scheduleOptions) int64 {
+	if options.Paused || (options.RunAt > 0 && options.Finished) {
+		return 0
+	}
+
+	if options.RunAt > 0 {
+		return options.RunAt
+	}
+
+	if value, exists := getStoredScheduleJob(schedule.Id); exists {
+		return value.GetNextRun().Unix()
+	}
+
+	if isCronFrequency(schedule.Frequency) {
+		cron, err := parseCronSchedule(schedule.Frequency)
+		if err != nil {
+			return 0
+		}
+
+		return cron.Next(time.Now()).Unix()
+	}
+
+	if schedule.Seconds > 0 {
+		return time.Now().Unix() + int64(schedule.Seconds)
+	}
+
+	return 0
+}
+
+// Returned from GET /api/v1/workflows/schedules
+type scheduleInfo struct {
+	shuffle.ScheduleOld
+	Type        string          `json:"type"`
+	Status      string          `json:"status"`
+	Cron        string          `json:"cron"`
+	Timezone    string          `json:"timezone"`
+	NextRuntime int64           `json:"next_runtime"`
+	Options     scheduleOptions `json:"options"`
+}
+
+func handleGetSchedules(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := shuffle.HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in get schedules: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if user.Role != "admin" {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Admin required"}`))
+		return
+	}
+
+	ctx := shuffle.GetContext(request)
+	schedules, err := shuffle.GetAllSchedules(ctx, user.ActiveOrg.Id)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting schedules for org %s: %s", user.ActiveOrg.Id, err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Couldn't get schedules"}`))
+		return
+	}
+
+	allOptions, err := getAllScheduleOptions(ctx)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting schedule options: %s", err)
+	}
+
+	parsedSchedules := []scheduleInfo{}
+	for _, schedule := range schedules {
+		options := allOptions[schedule.Id]
+		info := scheduleInfo{
+			ScheduleOld: schedule,
+			Type:        "interval",
+			Status:      "running",
+			Options:     options,
+		}
+
+		if options.RunAt > 0 {
+			info.Type = "one_off"
+		} else if isCronFrequency(schedule.Frequency) {
+			info.Type = "cron"
+		}
+
+		if options.Paused {
+			info.Status = "paused"
+		} else if options.RunAt > 0 && options.Finished {
+			info.Status = "finished"
+		}
+
+		if schedule.Environment != "cloud" {
+			info.NextRuntime = getScheduleNextRun(schedule, options)
+			if isCronFrequency(schedule.Frequency) {
+				cron, err := parseCronSchedule(schedule.Frequency)
+				if err == nil {
+					info.Cron = cron.Expression
+					info.Timezone = cron.location.String()
+				}
+			}
+		}
+
+		parsedSchedules = append(parsedSchedules, info)
+	}
+
+	newjson, err := json.Marshal(parsedSchedules)
+	if err != nil {
+		log.Printf("[WARNING] Failed marshalling schedules: %s", err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed unpacking schedules"}`))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write(newjson)
+}
+
+type scheduleTick struct {
+	Timestamp int64 `json:"timestamp"`
+	Runs      int   `json:"runs"`
+}
+
+// Shows how many schedules ran per second on this backend in the last hour.
+// Used to check whether jitter is spreading them out.
+func handleGetScheduleStats(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := shuffle.HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in get schedule stats: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if user.Role != "admin" {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Admin required"}`))
+		return
+	}
+
+	scheduledJobsLock.Lock()
+	runningSchedules := len(scheduledJobs)
+	scheduledJobsLock.Unlock()
+
+	scheduleRunLock.Lock()
+	ticks := []scheduleTick{}
+	maxRuns := 0
+	for timestamp, runs := range scheduleRunCounts {
+		ticks = append(ticks, scheduleTick{
+			Timestamp: timestamp,
+			Runs:      runs,
+		})
+
+		if runs > maxRuns {
+			maxRuns = runs
+		}
+	}
+	totalRuns := scheduleRunTotal
+	scheduleRunLock.Unlock()
+
+	sort.Slice(ticks, func(i, j int) bool {
+		return ticks[i].Timestamp < ticks[j].Timestamp
+	})
+
+	stats := struct {
+		Success          bool           `json:"success"`
+		Leader           bool           `json:"leader"`
+		RunningSchedules int            `json:"running_schedules"`
+		TotalRuns        int64          `json:"total_runs"`
+		MaxRunsPerTick   int            `json:"max_runs_per_tick"`
+		Ticks            []scheduleTick `json:"ticks"`
+	}{
+		Success:          true,
+		Leader:           isScheduleLeader(),
+		RunningSchedules: runningSchedules,
+		TotalRuns:        totalRuns,
+		MaxRunsPerTick:   maxRuns,
+		Ticks:            ticks,
+	}
+
+	newjson, err := json.Marshal(stats)
+	if err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed unpacking stats"}`))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write(newjson)
+}
+
+// Pauses or resumes a schedule without removing it.
+// POST /api/v1/workflows/{key}/schedule/{schedule}/pause|resume
+func handleScheduleState(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := shuffle.HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in schedule pause/resume: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if user.Role == "org-reader" {
+		log.Printf("[WARNING] Org-reader doesn't have access to pause schedule: %s (%s)", user.Username, user.Id)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Read only user"}`))
+		return
+	}
+
+	location := strings.Split(request.URL.String(), "/")
+	if location[1] != "api" || len(location) <= 7 {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	fileId := location[4]
+	scheduleId := location[6]
+	action := strings.Split(location[7], "?")[0]
+	if len(fileId) != 36 {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Workflow ID is not valid"}`))
+		return
+	}
+
+	if len(scheduleId) != 36 {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Schedule ID not valid"}`))
+		return
+	}
+
+	ctx := shuffle.GetContext(request)
+	workflow, err := shuffle.GetWorkflow(ctx, fileId)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting the workflow locally (schedule %s): %s", action, err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if user.Id != workflow.Owner || len(user.Id) == 0 {
+		if workflow.OrgId == user.ActiveOrg.Id && user.Role == "admin" {
+			log.Printf("[AUDIT] User %s is accessing workflow %s as admin (schedule %s)", user.Username, workflow.ID, action)
+		} else {
+			log.Printf("[WARNING] Wrong user (%s) for workflow %s (schedule %s)", user.Username, workflow.ID, action)
+			resp.WriteHeader(401)
+			resp.Write([]byte(`{"success": false}`))
+			return
+		}
+	}
+
+	schedule, err := shuffle.GetSchedule(ctx, scheduleId)
+	if err != nil || schedule.WorkflowId != workflow.ID {
+		log.Printf("[WARNING] Failed finding schedule %s for workflow %s", scheduleId, workflow.ID)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Schedule not found"}`))
+		return
+	}
+
+	if schedule.Environment == "cloud" {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Cloud schedules can't be paused. Stop the schedule instead."}`))
+		return
+	}
+
+	options := loadScheduleOptions(ctx, scheduleId, nil)
+	if action == "pause" {
+		if !options.Paused {
+			options.Paused = true
+			options.PausedAt = time.Now().Unix()
+			err = setScheduleOptions(ctx, options)
+			if err != nil {
+				log.Printf("[WARNING] Failed pausing schedule %s: %s", scheduleId, err)
+				resp.WriteHeader(500)
+				resp.Write([]byte(`{"success": false, "reason": "Failed pausing schedule"}`))
+				return
+			}
+		}
+
+		stopStoredSchedule(scheduleId)
+		log.Printf("[AUDIT] User %s (%s) paused schedule %s for workflow %s", user.Username, user.Id, scheduleId, workflow.ID)
+	} else if action == "resume" {
+		if options.RunAt > 0 && (options.Finished || options.RunAt <= time.Now().Unix()) {
+			resp.WriteHeader(400)
+			resp.Write([]byte(`{"success": false, "reason": "One-off schedule has already passed its time"}`))
+			return
+		}
+
+		options.Paused = false
+		options.PausedAt = 0
+		err = setScheduleOptions(ctx, options)
+		if err != nil {
+			log.Printf("[WARNING] Failed resuming schedule %s: %s", scheduleId, err)
+			resp.WriteHeader(500)
+			resp.Write([]byte(`{"success": false, "reason": "Failed resuming schedule"}`))
+			return
+		}
+
+		// Runs skipped while paused aren't misfires
+		err = updateScheduleLastRuntime(ctx, scheduleId, time.Now().Unix())
+		if err != nil {
+			log.Printf("[WARNING] Failed updating last runtime for schedule %s: %s", scheduleId, err)
+		}
+
+		err = startStoredSchedule(*schedule, options, user.ActiveOrg.Id, false, 0)
+		if err != nil {
+			log.Printf("[WARNING] Failed starting schedule %s after resume: %s", scheduleId, err)
+			resp.WriteHeader(500)
+			resp.Write([]byte(`{"success": false, "reason": "Failed starting schedule"}`))
+			return
+		}
+
+		log.Printf("[AUDIT] User %s (%s) resumed schedule %s for workflow %s", user.Username, user.Id, scheduleId, workflow.ID)
+	} else {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Action has to be pause or resume"}`))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write([]byte(fmt.Sprintf(`{"success": true, "paused": %t}`, options.Paused)))
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shuffle/shuffle-shared"
+)
+
+func TestParseCronSchedule(t *testing.T) {
+	tests := []struct {
+		expression string
+		from       string
+		expected   string
+	}{
+		{"*/15 * * * *", "2024-01-01T10:07:30Z", "2024-01-01T10:15:00Z"},
+		{"0 8 * * 1-5", "2024-01-05T09:00:00Z", "2024-01-08T08:00:00Z"},
+		{"CRON_TZ=Europe/Oslo 0 8 * * MON-FRI", "2024-01-05T09:00:00Z", "2024-01-08T07:00:00Z"},
+		{"CRON_TZ=Europe/Oslo 0 8 * * MON-FRI", "2024-07-05T05:00:00Z", "2024-07-05T06:00:00Z"},
+		{"0 0 29 2 *", "2023-03-01T00:00:00Z", "2024-02-29T00:00:00Z"},
+		{"*/10 * * * * *", "2024-01-01T10:07:31Z", "2024-01-01T10:07:40Z"},
+		{"@daily", "2024-01-01T10:07:31Z", "2024-01-02T00:00:00Z"},
+		{"0 0 1 * 0", "2024-01-02T00:00:00Z", "2024-01-07T00:00:00Z"},
+		{"0 0 * * 7", "2024-01-02T00:00:00Z", "2024-01-07T00:00:00Z"},
+		{"5/20 * * * *", "2024-01-01T10:00:00Z", "2024-01-01T10:05:00Z"},
+	}
+
+	for _, test := range tests {
+		schedule, err := parseCronSchedule(test.expression)
+		if err != nil {
+			t.Errorf("Failed parsing cron '%s': %s", test.expression, err)
+			continue
+		}
+
+		from, _ := time.Parse(time.RFC3339, test.from)
+		next := schedule.Next(from).UTC().Format(time.RFC3339)
+		if next != test.expected {
+			t.Errorf("Cron '%s' from %s: got %s, expected %s", test.expression, test.from, next, test.expected)
+		}
+	}
+
+	invalid := []string{"", "* * *", "61 * * * *", "TZ=Nowhere/Land * * * * *", "*/0 * * * *", "5-1 * * * *", "@sometimes"}
+	for _, expression := range invalid {
+		if _, err := parseCronSchedule(expression); err == nil {
+			t.Errorf("Expected error for cron '%s'", expression)
+		}
+	}
+}
+
+func TestGetMissedScheduleRuns(t *testing.T) {
+	now, _ := time.Parse(time.RFC3339, "2024-01-01T12:00:00Z")
+	tests := []struct {
+		schedule shuffle.ScheduleOld
+		limit    int
+		expected int
+	}{
+		{shuffle.ScheduleOld{Seconds: 600, LastRuntime: now.Add(-5 * time.Minute).Unix()}, 10, 0},
+		{shuffle.ScheduleOld{Seconds: 600, LastRuntime: now.Add(-35 * time.Minute).Unix()}, 10, 3},
+		{shuffle.ScheduleOld{Seconds: 60, LastRuntime: now.Add(-24 * time.Hour).Unix()}, 10, 10},
+		{shuffle.ScheduleOld{Frequency: "0 * * * *", LastRuntime: now.Add(-150 * time.Minute).Unix()}, 10, 3},
+		{shuffle.ScheduleOld{Frequency: "0 * * * *", LastRuntime: 0}, 10, 0},
+	}
+
+	for _, test := range tests {
+		missed := getMissedScheduleRuns(test.schedule, scheduleOptions{}, now, test.limit)
+		if missed != test.expected {
+			t.Errorf("Schedule %#v: got %d missed runs, expected %d", test.schedule, missed, test.expected)
+		}
+	}
+}
+
+func TestRenewScheduleLease(t *testing.T) {
+	documents := startFakeOpensearch(t)
+	ctx := context.Background()
+
+	// Another backend holds the lease
+	documents["schedule_leases/leader"], _ = json.Marshal(scheduleLease{Holder: "other-backend", Expires: time.Now().Unix() + 30})
+	leader, err := renewScheduleLease(ctx, 30)
+	if err != nil || leader {
+		t.Fatalf("Expected the lease of another backend to be kept, got leader=%t: %v", leader, err)
+	}
+
+	// The other backend died and its lease ran out
+	documents["schedule_leases/leader"], _ = json.Marshal(scheduleLease{Holder: "other-backend", Expires: time.Now().Unix() - 1})
+	leader, err = renewScheduleLease(ctx, 30)
+	if err != nil || !leader {
+		t.Fatalf("Expected the expired lease to be taken over, got leader=%t: %v", leader, err)
+	}
+
+	lease := scheduleLease{}
+	json.Unmarshal(documents["schedule_leases/leader"], &lease)
+	if lease.Holder != scheduleLeaseHolder || lease.Expires <= time.Now().Unix() {
+		t.Errorf("Expected this backend to hold the lease, got %#v", lease)
+	}
+
+	leader, err = renewScheduleLease(ctx, 30)
+	if err != nil || !leader {
+		t.Errorf("Expected the holder to renew its own lease, got leader=%t: %v", leader, err)
+	}
+}
+
+func TestScheduleOffsetPersistence(t *testing.T) {
+	documents := startFakeOpensearch(t)
+	ctx := context.Background()
+
+	t.Setenv("SHUFFLE_SCHEDULE_JITTER", "300")
+	options := loadScheduleOptions(ctx, "schedule-1", nil)
+	if options.Jitter != 300 || options.Offset < 0 || options.Offset >= 300 {
+		t.Fatalf("Expected an offset within the 300 second jitter, got %#v", options)
+	}
+
+	if _, found := documents["schedule_options/schedule-1"]; !found {
+		t.Fatalf("Expected the options to be stored")
+	}
+
+	if newScheduleOptions("schedule-1", 300).Offset != options.Offset {
+		t.Errorf("Expected the offset to be derived from the schedule ID")
+	}
+
+	// A new default doesn't move schedules that already have options
+	t.Setenv("SHUFFLE_SCHEDULE_JITTER", "10")
+	reloaded := loadScheduleOptions(ctx, "schedule-1", nil)
+	if reloaded.Jitter != 300 || reloaded.Offset != options.Offset {
+		t.Errorf("Expected the stored jitter and offset after a restart, got %#v", reloaded)
+	}
+
+	// Added to every cron run
+	cron, _ := parseCronSchedule("0 * * * *")
+	job, _ := newScheduleJob("schedule-1", 0, cron, nil)
+	job.Offset = 90 * time.Second
+
+	from, _ := time.Parse(time.RFC3339, "2024-01-01T10:00:30Z")
+	next := job.nextRun(from)
+	if next.UTC().Format(time.RFC3339) != "2024-01-01T10:01:30Z" {
+		t.Errorf("Expected the first run with the offset at 10:01:30, got %s", next.UTC().Format(time.RFC3339))
+	}
+
+	next = job.nextRun(next)
+	if next.UTC().Format(time.RFC3339) != "2024-01-01T11:01:30Z" {
+		t.Errorf("Expected the next run with the offset at 11:01:30, got %s", next.UTC().Format(time.RFC3339))
+	}
+}
+
+func TestPausedOneOffSchedule(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tests := []struct {
+		options scheduleOptions
+		active  bool
+		missed  int
+	}{
+		{scheduleOptions{RunAt: now.Unix() + 60}, true, 0},
+		{scheduleOptions{RunAt: now.Unix() + 60, Paused: true}, false, 0},
+		{scheduleOptions{RunAt: now.Unix() - 60}, false, 1},
+		{scheduleOptions{RunAt: now.Unix() - 60, Paused: true}, false, 0},
+		{scheduleOptions{RunAt: now.Unix() - 60, Finished: true}, false, 0},
+	}
+
+	for _, test := range tests {
+		if active := isScheduleActive(test.options, now); active != test.active {
+			t.Errorf("Options %#v: got active=%t, expected %t", test.options, active, test.active)
+		}
+
+		if missed := getMissedScheduleRuns(shuffle.ScheduleOld{}, test.options, now, 10); missed != test.missed {
+			t.Errorf("Options %#v: got %d missed runs, expected %d", test.options, missed, test.missed)
+		}
+	}
+
+	// Paused before its time, then resumed. It only runs once.
+	runs := int32(0)
+	runAt := time.Now().Add(200 * time.Millisecond)
+	paused := newOneOffScheduleJob("schedule-1", runAt, func() { atomic.AddInt32(&runs, 1) })
+	paused.Start(false, 0)
+	paused.Stop()
+
+	resumed := newOneOffScheduleJob("schedule-1", runAt, func() { atomic.AddInt32(&runs, 1) })
+	err := resumed.Start(false, 0)
+	if err != nil {
+		t.Fatalf("Failed starting resumed schedule: %s", err)
+	}
+
+	time.Sleep(500 * time.Millisecond)
+	if atomic.LoadInt32(&runs) != 1 {
+		t.Errorf("Expected the one-off schedule to run once, got %d runs", atomic.LoadInt32(&runs))
+	}
+
+	if !resumed.nextRun(time.Now()).IsZero() {
+		t.Errorf("Expected no runs after the one-off time")
+	}
+}
+
+func TestGetScheduleMisfireRuns(t *testing.T) {
+	tests := []struct {
+		options scheduleOptions
+		policy  string
+		missed  int
+		runs    int
+	}{
+		{scheduleOptions{}, scheduleMisfireSkip, 3, 0},
+		{scheduleOptions{}, scheduleMisfireOnce, 3, 1},
+		{scheduleOptions{}, scheduleMisfireAll, 3, 3},
+		{scheduleOptions{}, scheduleMisfireAll, 20, 10},
+		{scheduleOptions{RunAt: 1}, scheduleMisfireSkip, 1, 1},
+		{scheduleOptions{RunAt: 1}, scheduleMisfireAll, 1, 1},
+	}
+
+	for _, test := range tests {
+		if runs := getScheduleMisfireRuns(test.options, test.policy, test.missed, 10); runs != test.runs {
+			t.Errorf("Policy %s with %d missed (run at %d): got %d runs, expected %d", test.policy, test.missed, test.options.RunAt, runs, test.runs)
+		}
+	}
+}
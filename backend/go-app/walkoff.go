@@ -13,7 +13,6 @@ import (
 	"log"
 	"math/rand"
 	"net/http"
-	"net/url"
 	"os"
 	"sort"
 	"strconv"
@@ -50,75 +49,44 @@ var baseEnvironment = "onprem"
 
 var cloudname = "cloud"
 
-var scheduledJobs = map[string]*newscheduler.Job{}
+var scheduledJobs = map[string]*scheduleJob{}
 var scheduledOrgs = map[string]*newscheduler.Job{}
 
-// Frequency = cronjob OR minutes between execution
-func createSchedule(ctx context.Context, scheduleId, workflowId, name, startNode, frequency, orgId string, body []byte) error {
+// Frequency = cronjob OR seconds between execution
+func createSchedule(ctx context.Context, scheduleId, workflowId, name, startNode, frequency, orgId string, body []byte, options scheduleOptions) error {
 	var err error
-	testSplit := strings.Split(frequency, "*")
-	cronJob := ""
+	var cron *cronSchedule
 	newfrequency := 0
 
-	if len(testSplit) > 5 {
-		cronJob = frequency
+	if options.RunAt > 0 {
+		if options.RunAt <= time.Now().Unix() {
+			return errors.New("Run at time has to be in the future")
+		}
+	} else if isCronFrequency(frequency) {
+		cron, err = parseCronSchedule(frequency)
+		if err != nil {
+			log.Printf("[WARNING] Failed to parse cron '%s': %s", frequency, err)
+			return err
+		}
 	} else {
-		newfrequency, err = strconv.Atoi(frequency)
+		newfrequency, err = strconv.Atoi(strings.TrimSpace(frequency))
 		if err != nil {
 			log.Printf("Failed to parse time: %s", err)
 			return err
 		}
 
-		//if int(newfrequency) < 60 {
-		//	cronJob = fmt.Sprintf("*/%s * * * *")
-		//} else if int(newfrequency) <
-	}
-
-	// Reverse. Can't handle CRON, only numbers
-	if len(cronJob) > 0 {
-		return errors.New("cronJob isn't formatted correctly")
-	}
-
-	if newfrequency < 1 {
-		return errors.New("Frequency has to be more than 0")
+		if newfrequency < 1 {
+			return errors.New("Frequency has to be more than 0")
+		}
 	}
 
-	//log.Printf("CRON: %s, body: %s", cronJob, string(body))
-
-	// FIXME:
-	// This may run multiple places if multiple servers,
-	// but that's a future problem
 	//log.Printf("BODY: %s", string(body))
 	parsedArgument := strings.Replace(string(body), "\"", "\\\"", -1)
 	bodyWrapper := fmt.Sprintf(`{"start": "%s", "execution_source": "schedule", "execution_argument": "%s"}`, startNode, parsedArgument)
 	log.Printf("[INFO] Body for schedule %s in workflow %s: \n%s", scheduleId, workflowId, bodyWrapper)
-	job := func() {
-		request := &http.Request{
-			URL:    &url.URL{},
-			Method: "POST",
-			Body:   ioutil.NopCloser(strings.NewReader(bodyWrapper)),
-		}
-
-		_, _, err := handleExecution(workflowId, shuffle.Workflow{ExecutingOrg: shuffle.OrgMini{Id: orgId}}, request, orgId)
-		if err != nil {
-			log.Printf("Failed to execute %s: %s", workflowId, err)
-		}
-	}
-
-	log.Printf("[INFO] Starting frequency for execution: %d", newfrequency)
-	
-
-	//jobret, err := newscheduler.Every(newfrequency).Seconds().NotImmediately().Run(job)
-	jobret, err := newscheduler.Every(newfrequency).Seconds().Run(job)
-	if err != nil {
-		log.Printf("Failed to schedule workflow: %s", err)
-		return err
-	}
-
-	//scheduledJobs = append(scheduledJobs, jobret)
-	scheduledJobs[scheduleId] = jobret
 
 	// Doesn't need running/not running. If stopped, we just delete it.
+	// Frequency is only set for cron, as the frontend shows it in place of seconds
 	timeNow := int64(time.Now().Unix())
 	schedule := shuffle.ScheduleOld{
 		Id:                   scheduleId,
@@ -134,15 +102,40 @@ func createSchedule(ctx context.Context, scheduleId, workflowId, name, startNode
 		Environment:          "onprem",
 	}
 
+	if options.RunAt > 0 {
+		log.Printf("[INFO] Starting one-off schedule for execution at %s", time.Unix(options.RunAt, 0).UTC().Format(time.RFC3339))
+	} else if cron != nil {
+		log.Printf("[INFO] Starting cron schedule for execution: %s", cron.Expression)
+		schedule.Frequency = cron.Expression
+	} else {
+		log.Printf("[INFO] Starting frequency for execution: %d", newfrequency)
+	}
+
+	// Stored first so other backends can pick it up
 	err = shuffle.SetSchedule(ctx, schedule)
 	if err != nil {
 		log.Printf("Failed to set schedule: %s", err)
 		return err
 	}
 
-	// FIXME - Create a real schedule based on cron:
-	// 1. Parse the cron in a function to match this schedule
-	// 2. Make main init check for schedules that aren't running
+	// Without its options, the schedule would run with the wrong misfire policy,
+	// timezone or end time
+	options.ScheduleId = scheduleId
+	err = setScheduleOptions(ctx, options)
+	if err != nil {
+		log.Printf("[WARNING] Failed to set options for schedule %s: %s", scheduleId, err)
+		shuffle.DeleteKey(ctx, "schedules", scheduleId)
+		return err
+	}
+
+	// Interval schedules run once immediately, cron and one-off ones wait for their time
+	err = startStoredSchedule(schedule, options, orgId, cron == nil && options.RunAt == 0, 0)
+	if err != nil {
+		log.Printf("Failed to schedule workflow: %s", err)
+		shuffle.DeleteKey(ctx, "schedules", scheduleId)
+		deleteScheduleOptions(ctx, scheduleId)
+		return err
+	}
 
 	return nil
 }
@@ -218,6 +211,10 @@ func handleGetWorkflowqueueConfirm(resp http.ResponseWriter, request *http.Reque
 		log.Printf("[ERROR] Failed deleting %d execution keys for org %s: %s", len(ids), id, err)
 	} else {
 		//log.Printf("[INFO] Deleted %d keys from org %s", len(ids), parsedId)
+
+		if request.Header.Get("X-Orborus-Lease") == "true" {
+			ackWorkflowQueue(ctx, id, ids)
+		}
 	}
 
 	//var newExecutionRequests ExecutionRequestWrapper
@@ -456,7 +453,34 @@ func handleGetWorkflowqueue(resp http.ResponseWriter, request *http.Request) {
 		}
 	}
 
-	executionRequests, err := shuffle.GetWorkflowQueue(ctx, orgId, 100)
+	// With leases, executions leased by another request are left out
+	leasing := request.Header.Get("X-Orborus-Lease") == "true"
+	leases := []workflowQueueLease{}
+	limit := getWorkflowQueueLimit(request)
+	readQueue := func() (shuffle.ExecutionRequestWrapper, error) {
+		executionRequests, err := shuffle.GetWorkflowQueue(ctx, orgId, 100)
+		if err != nil || !leasing || len(executionRequests.Data) == 0 {
+			return executionRequests, err
+		}
+
+		executionRequests.Data, leases = leaseWorkflowQueue(ctx, orgId, sortWorkflowQueue(orgId, executionRequests.Data), limit)
+		return executionRequests, nil
+	}
+
+	if leasing {
+		resp.Header().Set("X-Shuffle-Queue-Lease", strconv.FormatInt(workflowQueueVisibilityTimeout, 10))
+	}
+
+	var executionRequests shuffle.ExecutionRequestWrapper
+	wait := getWorkflowQueueWait(request)
+	if wait > 0 {
+		// Lets Orborus know long-polling works, so it doesn't sleep between requests
+		resp.Header().Set("X-Shuffle-Queue-Wait", strconv.Itoa(int(wait.Seconds())))
+		executionRequests, err = waitForWorkflowQueue(request.Context().Done(), orgId, wait, readQueue)
+	} else {
+		executionRequests, err = readQueue()
+	}
+
 	if err != nil {
 		// Skipping as this comes up over and over
 		//log.Printf("(2) Failed reading body for workflowqueue: %s", err)
@@ -504,12 +528,27 @@ func handleGetWorkflowqueue(resp http.ResponseWriter, request *http.Request) {
 			}
 		}
 
+		// Highest priority first, so they aren't cut off below
+		executionRequests.Data = sortWorkflowQueue(orgId, executionRequests.Data)
 		if len(executionRequests.Data) > 50 {
 			executionRequests.Data = executionRequests.Data[0:49]
 		}
+
+		if len(executionRequests.Data) > limit {
+			executionRequests.Data = executionRequests.Data[0:limit]
+		}
+	}
+
+	var newjson []byte
+	if leasing {
+		newjson, err = json.Marshal(workflowQueueLeaseResponse{
+			ExecutionRequestWrapper: executionRequests,
+			Leases:                  leases,
+		})
+	} else {
+		newjson, err = json.Marshal(executionRequests)
 	}
 
-	newjson, err := json.Marshal(executionRequests)
 	if err != nil {
 		resp.WriteHeader(401)
 		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Failed unpacking workflow execution"}`)))
@@ -1007,6 +1046,8 @@ func handleExecution(id string, workflow shuffle.Workflow, request *http.Request
 		workflow = *tmpworkflow
 	}
 
+	workflow = applyWorkflowAppPins(ctx, workflow)
+
 	/*
 		if len(workflow.ExecutingOrg.Id) == 0 {
 			if len(orgId) > 0 {
@@ -1708,6 +1749,8 @@ func handleExecution(id string, workflow shuffle.Workflow, request *http.Request
 			err = shuffle.SetWorkflowQueue(ctx, executionRequest, environment)
 			if err != nil {
 				log.Printf("[ERROR] Failed adding execution to db: %s", err)
+			} else {
+				notifyWorkflowQueue(environment)
 			}
 		}
 	}
@@ -2169,12 +2212,14 @@ func deleteSchedule(ctx context.Context, id string) error {
 		log.Printf("[ERROR] Failed to delete schedule: %s", err)
 		return err
 	} else {
-		if value, exists := scheduledJobs[id]; exists {
-			// Stops the schedule properly
-			value.Lock()
-		} else {
-			// FIXME - allow it to kind of stop anyway?
-			return errors.New("Can't find the schedule.")
+		err = deleteScheduleOptions(ctx, id)
+		if err != nil {
+			log.Printf("[WARNING] Failed to delete options for schedule %s: %s", id, err)
+		}
+
+		// Paused and finished schedules aren't running, so this can't fail
+		if !stopStoredSchedule(id) {
+			log.Printf("[DEBUG] Schedule %s wasn't running on this backend", id)
 		}
 	}
 
@@ -2271,6 +2316,15 @@ func scheduleWorkflow(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	// Onprem only options that aren't part of shuffle.Schedule
+	extraOptions := struct {
+		Jitter        *int   `json:"jitter"`
+		MisfirePolicy string `json:"misfire_policy"`
+		MaxCatchup    *int   `json:"max_catchup"`
+		RunAt         int64  `json:"run_at"`
+	}{}
+	json.Unmarshal(body, &extraOptions)
+
 	// Finds the startnode for the specific schedule
 	startNode := ""
 	if schedule.Start != "" {
@@ -2304,13 +2358,20 @@ func scheduleWorkflow(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	if len(schedule.Frequency) == 0 {
+	// One-off schedules run once at run_at instead of on a frequency
+	if len(schedule.Frequency) == 0 && extraOptions.RunAt == 0 {
 		log.Printf("Empty frequency.")
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false, "reason": "Frequency can't be empty"}`))
 		return
 	}
 
+	if extraOptions.RunAt != 0 && schedule.Environment == "cloud" {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "One-off schedules can't run in the cloud"}`))
+		return
+	}
+
 	scheduleArg, err := json.Marshal(schedule.ExecutionArgument)
 	if err != nil {
 		log.Printf("Failed scheduleArg marshal: %s", err)
@@ -2390,6 +2451,47 @@ func scheduleWorkflow(resp http.ResponseWriter, request *http.Request) {
 	}
 
 	//log.Printf("Schedulearg: %s", parsedBody)
+	jitter := -1
+	if extraOptions.Jitter != nil {
+		jitter = *extraOptions.Jitter
+		if jitter < 0 || jitter > 86400 {
+			resp.WriteHeader(400)
+			resp.Write([]byte(`{"success": false, "reason": "Jitter has to be between 0 and 86400 seconds"}`))
+			return
+		}
+	}
+
+	options := newScheduleOptions(schedule.Id, jitter)
+	if len(extraOptions.MisfirePolicy) > 0 {
+		if !isValidMisfirePolicy(extraOptions.MisfirePolicy) {
+			resp.WriteHeader(400)
+			resp.Write([]byte(`{"success": false, "reason": "Misfire policy has to be one of skip, once or all"}`))
+			return
+		}
+
+		options.MisfirePolicy = extraOptions.MisfirePolicy
+	}
+
+	if extraOptions.MaxCatchup != nil {
+		if *extraOptions.MaxCatchup < 1 || *extraOptions.MaxCatchup > 1000 {
+			resp.WriteHeader(400)
+			resp.Write([]byte(`{"success": false, "reason": "Max catchup has to be between 1 and 1000 runs"}`))
+			return
+		}
+
+		options.MaxCatchup = *extraOptions.MaxCatchup
+	}
+
+	if extraOptions.RunAt != 0 {
+		if extraOptions.RunAt <= time.Now().Unix() {
+			resp.WriteHeader(400)
+			resp.Write([]byte(`{"success": false, "reason": "run_at has to be a unix timestamp in the future"}`))
+			return
+		}
+
+		options.RunAt = extraOptions.RunAt
+		schedule.Frequency = ""
+	}
 
 	err = createSchedule(
 		ctx,
@@ -2400,13 +2502,24 @@ func scheduleWorkflow(resp http.ResponseWriter, request *http.Request) {
 		schedule.Frequency,
 		user.ActiveOrg.Id,
 		[]byte(parsedBody),
+		options,
 	)
 
-	// FIXME - real error message lol
 	if err != nil {
 		log.Printf("Failed creating schedule: %s", err)
+		ret := shuffle.ResultChecker{
+			Success: false,
+			Reason:  fmt.Sprintf("Invalid frequency '%s': %s. Use seconds (e.g. 60) or cron (e.g. CRON_TZ=Europe/Oslo 0 8 * * 1-5)", schedule.Frequency, err),
+		}
+
 		resp.WriteHeader(401)
-		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Invalid argument. Try cron */15 * * * *"}`)))
+		b, err := json.Marshal(ret)
+		if err != nil {
+			resp.Write([]byte(`{"success": false, "reason": "Invalid frequency"}`))
+			return
+		}
+
+		resp.Write(b)
 		return
 	}
 
@@ -3427,6 +3540,7 @@ func executeSingleAction(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	notifyWorkflowQueue(environment)
 	time.Sleep(2 * time.Second)
 	log.Printf("[INFO] Starting validation of execution %s", workflowExecution.ExecutionId)
 
@@ -3657,53 +3771,7 @@ func IterateAppGithubFolders(ctx context.Context, fs billy.Filesystem, dir []os.
 					continue
 				}
 
-				// Fixes (appends) authentication parameters if they're required
-				if workflowapp.Authentication.Required {
-					//log.Printf("[INFO] Checking authentication fields and appending for %s!", workflowapp.Name)
-					// FIXME:
-					// Might require reflection into the python code to append the fields as well
-					for index, action := range workflowapp.Actions {
-						if action.AuthNotRequired {
-							log.Printf("Skipping auth setup: %s", action.Name)
-							continue
-						}
-
-						// 1. Check if authentication params exists at all
-						// 2. Check if they're present in the action
-						// 3. Add them IF they DONT exist
-						// 4. Fix python code with reflection (FIXME)
-						appendParams := []shuffle.WorkflowAppActionParameter{}
-						for _, fieldname := range workflowapp.Authentication.Parameters {
-							found := false
-							for index, param := range action.Parameters {
-								if param.Name == fieldname.Name {
-									found = true
-
-									action.Parameters[index].Configuration = true
-									//log.Printf("Set config to true for field %s!", param.Name)
-									break
-								}
-							}
-
-							if !found {
-								appendParams = append(appendParams, shuffle.WorkflowAppActionParameter{
-									Name:          fieldname.Name,
-									Description:   fieldname.Description,
-									Example:       fieldname.Example,
-									Required:      fieldname.Required,
-									Configuration: true,
-									Schema:        fieldname.Schema,
-								})
-							}
-						}
-
-						if len(appendParams) > 0 {
-							//log.Printf("[AUTH] Appending %d params to the START of %s", len(appendParams), action.Name)
-							workflowapp.Actions[index].Parameters = append(appendParams, workflowapp.Actions[index].Parameters...)
-						}
-
-					}
-				}
+				workflowapp = appendAuthenticationParameters(workflowapp)
 
 				err = checkWorkflowApp(workflowapp)
 				if err != nil {
@@ -3718,6 +3786,8 @@ func IterateAppGithubFolders(ctx context.Context, fs billy.Filesystem, dir []os.
 						if err != nil {
 							log.Printf("[ERROR] Failed deleting duplicate %s: %s", item, err)
 						}
+
+						deleteAppSource(ctx, item)
 					}
 				}
 
@@ -3735,6 +3805,12 @@ func IterateAppGithubFolders(ctx context.Context, fs billy.Filesystem, dir []os.
 					continue
 				}
 
+				// Kept for exporting the app later
+				err = setAppSource(ctx, workflowapp, fs, extra, "folder")
+				if err != nil {
+					log.Printf("[DEBUG] Failed storing source of %s:%s: %s", workflowapp.Name, workflowapp.AppVersion, err)
+				}
+
 				/*
 					err = increaseStatisticsField(ctx, "total_apps_created", workflowapp.ID, 1, "")
 					if err != nil {
@@ -3817,7 +3893,7 @@ func IterateAppGithubFolders(ctx context.Context, fs billy.Filesystem, dir []os.
 	if len(extra) == 0 {
 		log.Printf("[INFO] Starting build of %d containers (FIRST)", len(buildLaterFirst))
 		for _, item := range buildLaterFirst {
-			err = buildImageMemory(fs, item.Tags, item.Extra, true)
+			err = buildImageMemory(fs, item.Tags, item.Extra, true, "")
 			if err != nil {
 				orgId := ""
 
@@ -3847,7 +3923,7 @@ func IterateAppGithubFolders(ctx context.Context, fs billy.Filesystem, dir []os.
 		if len(buildLaterList) > 0 {
 			log.Printf("[INFO] Starting build of %d skipped docker images", len(buildLaterList))
 			for _, item := range buildLaterList {
-				err = buildImageMemory(fs, item.Tags, item.Extra, true)
+				err = buildImageMemory(fs, item.Tags, item.Extra, true, "")
 				if err != nil {
 					log.Printf("[INFO] Failed image build memory: %s", err)
 				} else {
@@ -4013,6 +4089,58 @@ func LoadSpecificApps(resp http.ResponseWriter, request *http.Request) {
 	resp.Write([]byte(fmt.Sprintf(`{"success": true}`)))
 }
 
+// Fixes (appends) authentication parameters if they're required
+func appendAuthenticationParameters(workflowapp shuffle.WorkflowApp) shuffle.WorkflowApp {
+	if workflowapp.Authentication.Required {
+		//log.Printf("[INFO] Checking authentication fields and appending for %s!", workflowapp.Name)
+		// FIXME:
+		// Might require reflection into the python code to append the fields as well
+		for index, action := range workflowapp.Actions {
+			if action.AuthNotRequired {
+				log.Printf("Skipping auth setup: %s", action.Name)
+				continue
+			}
+
+			// 1. Check if authentication params exists at all
+			// 2. Check if they're present in the action
+			// 3. Add them IF they DONT exist
+			// 4. Fix python code with reflection (FIXME)
+			appendParams := []shuffle.WorkflowAppActionParameter{}
+			for _, fieldname := range workflowapp.Authentication.Parameters {
+				found := false
+				for index, param := range action.Parameters {
+					if param.Name == fieldname.Name {
+						found = true
+
+						action.Parameters[index].Configuration = true
+						//log.Printf("Set config to true for field %s!", param.Name)
+						break
+					}
+				}
+
+				if !found {
+					appendParams = append(appendParams, shuffle.WorkflowAppActionParameter{
+						Name:          fieldname.Name,
+						Description:   fieldname.Description,
+						Example:       fieldname.Example,
+						Required:      fieldname.Required,
+						Configuration: true,
+						Schema:        fieldname.Schema,
+					})
+				}
+			}
+
+			if len(appendParams) > 0 {
+				//log.Printf("[AUTH] Appending %d params to the START of %s", len(appendParams), action.Name)
+				workflowapp.Actions[index].Parameters = append(appendParams, workflowapp.Actions[index].Parameters...)
+			}
+
+		}
+	}
+
+	return workflowapp
+}
+
 // Bad check for workflowapps :)
 // FIXME - use tags and struct reflection
 func checkWorkflowApp(workflowApp shuffle.WorkflowApp) error {
@@ -4185,6 +4313,8 @@ func checkUnfinishedExecution(resp http.ResponseWriter, request *http.Request) {
 	err = shuffle.SetWorkflowQueue(ctx, executionRequest, parsedEnv)
 	if err != nil {
 		log.Printf("[ERROR] Failed adding execution to db: %s", err)
+	} else {
+		notifyWorkflowQueue(parsedEnv)
 	}
 
 
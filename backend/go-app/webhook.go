@@ -0,0 +1,1259 @@
+package main
+
+// Per-hook configuration for incoming webhooks that doesn't fit in shuffle.Hook.
+// Stored in its own index with the same ID as the hook.
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shuffle/shuffle-shared"
+)
+
+// Shown instead of secrets when the config is read back
+var hookSecretPlaceholder = "********"
+
+// Signs the status URLs of sync hooks. Without SHUFFLE_ENCRYPTION_MODIFIER
+// a random secret is stored in Opensearch, so status URLs keep working after
+// a restart and on other backends. Loaded by getWebhookStatusSecret.
+var webhookStatusSecret []byte
+var webhookStatusSecretLock sync.Mutex
+
+type webhookSecret struct {
+	Secret string `json:"secret"`
+}
+
+type hookVerification struct {
+	// none, hmac, basic or bearer
+	Type string `json:"type"`
+
+	// hmac: github, stripe, slack or generic
+	Provider string `json:"provider"`
+
+	// Header holding the signature for generic hmac. If TimestampHeader is
+	// set, the signature is of "<timestamp>.<body>" instead of just the body.
+	Header          string `json:"header"`
+	TimestampHeader string `json:"timestamp_header"`
+
+	// Max age in seconds of signed timestamps. 0 uses the default of
+	// 300 seconds, and a negative value turns replay checks off.
+	ReplayWindow int `json:"replay_window"`
+
+	// hmac secret or bearer token
+	Secret string `json:"secret"`
+
+	Username string `json:"username"`
+	Password string `json:"password"`
+
+	// IPs or CIDRs. Checked in addition to the type.
+	AllowedIps []string `json:"allowed_ips"`
+}
+
+// Deduplicates retried deliveries. The key is read from Header, or from
+// JsonPath in the body (e.g. $.event.id).
+type hookIdempotency struct {
+	Header   string `json:"header"`
+	JsonPath string `json:"json_path"`
+
+	// How long a key is remembered. Default 60, max 1440.
+	TtlMinutes int `json:"ttl_minutes"`
+}
+
+// Makes the webhook wait for the execution to finish and respond with its
+// result. ResultAction is the ID or label of the action whose result is
+// returned. Without it, the execution's last result is used.
+type hookSync struct {
+	Enabled      bool   `json:"enabled"`
+	MaxWait      int    `json:"max_wait"`
+	ResultAction string `json:"result_action"`
+}
+
+// Sets Key in the execution argument. Value is either a JSONPath into the
+// event (e.g. $.body.alert.id), which keeps the type, or a template where
+// each {{ $.path }} is replaced, e.g. "{{ $.headers.x-source }}: {{ $.body.title }}".
+// The event is {"body": ..., "headers": {...}, "query": {...}}, with lowercase header names.
+type hookTransform struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Condition an event has to match to start an execution
+type hookFilter struct {
+	Path string `json:"path"`
+
+	// equals, not_equals, contains, not_contains, exists, not_exists, regex, gt or lt
+	Operator string `json:"operator"`
+	Value    string `json:"value"`
+}
+
+type hookConfig struct {
+	HookId  string `json:"hook_id"`
+	OrgId   string `json:"org_id"`
+	Updated int64  `json:"updated"`
+
+	// Same as the hook's type. Listener is used by syslog and smtp hooks.
+	Type     string             `json:"type"`
+	Listener hookListenerConfig `json:"listener"`
+
+	Verification hookVerification `json:"verification"`
+	Idempotency  hookIdempotency  `json:"idempotency"`
+	Sync         hookSync         `json:"sync"`
+	Transforms   []hookTransform  `json:"transforms"`
+	Filters      []hookFilter     `json:"filters"`
+
+	// all (default) or any of the filters have to match
+	FilterMode string `json:"filter_mode"`
+}
+
+func getHookConfig(ctx context.Context, hookId string) (hookConfig, error) {
+	config := hookConfig{}
+	document, err := getEsDocument(ctx, "hook_configs", hookId)
+	if err != nil {
+		return config, err
+	}
+
+	err = json.Unmarshal(document.Source, &config)
+	return config, err
+}
+
+func setHookConfig(ctx context.Context, config hookConfig) error {
+	return setEsDocument(ctx, "hook_configs", config.HookId, config)
+}
+
+func deleteHookConfig(ctx context.Context, hookId string) error {
+	err := deleteEsDocument(ctx, "hook_configs", hookId)
+	if err == errEsNotFound {
+		return nil
+	}
+
+	return err
+}
+
+// Hooks without a config don't have any extra verification
+func loadHookConfig(ctx context.Context, hookId string) (hookConfig, error) {
+	config, err := getHookConfig(ctx, hookId)
+	if err == errEsNotFound {
+		return hookConfig{HookId: hookId}, nil
+	}
+
+	return config, err
+}
+
+// Only trusts proxy headers if told to, as they can be set by anyone otherwise
+func getWebhookClientIp(request *http.Request) string {
+	if os.Getenv("SHUFFLE_WEBHOOK_TRUST_PROXY_HEADERS") == "true" {
+		forwarded := request.Header.Get("X-Forwarded-For")
+		if len(forwarded) > 0 {
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+
+		if len(request.Header.Get("X-Real-Ip")) > 0 {
+			return strings.TrimSpace(request.Header.Get("X-Real-Ip"))
+		}
+	}
+
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return request.RemoteAddr
+	}
+
+	return host
+}
+
+func isWebhookIpAllowed(clientIp string, allowed []string) bool {
+	ip := net.ParseIP(clientIp)
+	if ip == nil {
+		return false
+	}
+
+	for _, item := range allowed {
+		item = strings.TrimSpace(item)
+		if strings.Contains(item, "/") {
+			_, network, err := net.ParseCIDR(item)
+			if err == nil && network.Contains(ip) {
+				return true
+			}
+
+			continue
+		}
+
+		allowedIp := net.ParseIP(item)
+		if allowedIp != nil && allowedIp.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func getHmacSha256(secret string, data []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func isEqualSecret(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// Checks the signature of the body. Returns the unix timestamp that was
+// signed along with the body, or 0 if the provider doesn't sign one.
+func verifyWebhookSignature(verification hookVerification, header http.Header, body []byte) (int64, error) {
+	if len(verification.Secret) == 0 {
+		return 0, errors.New("No secret configured")
+	}
+
+	switch verification.Provider {
+	case "github":
+		// X-Hub-Signature-256: sha256=<hex>
+		signature := header.Get("X-Hub-Signature-256")
+		if !strings.HasPrefix(signature, "sha256=") {
+			return 0, errors.New("Missing X-Hub-Signature-256 header")
+		}
+
+		if !isEqualSecret(signature[7:], getHmacSha256(verification.Secret, body)) {
+			return 0, errors.New("Bad signature")
+		}
+
+		return 0, nil
+	case "stripe":
+		// Stripe-Signature: t=<timestamp>,v1=<hex>[,v1=<hex>]
+		timestamp := ""
+		signatures := []string{}
+		for _, item := range strings.Split(header.Get("Stripe-Signature"), ",") {
+			parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+
+			if parts[0] == "t" {
+				timestamp = parts[1]
+			} else if parts[0] == "v1" {
+				signatures = append(signatures, parts[1])
+			}
+		}
+
+		parsedTimestamp, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil || len(signatures) == 0 {
+			return 0, errors.New("Missing or invalid Stripe-Signature header")
+		}
+
+		expected := getHmacSha256(verification.Secret, []byte(fmt.Sprintf("%s.%s", timestamp, string(body))))
+		for _, signature := range signatures {
+			if isEqualSecret(signature, expected) {
+				return parsedTimestamp, nil
+			}
+		}
+
+		return 0, errors.New("Bad signature")
+	case "slack":
+		// X-Slack-Signature: v0=<hex> of v0:<timestamp>:<body>
+		timestamp := header.Get("X-Slack-Request-Timestamp")
+		signature := header.Get("X-Slack-Signature")
+		parsedTimestamp, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil || !strings.HasPrefix(signature, "v0=") {
+			return 0, errors.New("Missing or invalid X-Slack-Signature / X-Slack-Request-Timestamp headers")
+		}
+
+		expected := getHmacSha256(verification.Secret, []byte(fmt.Sprintf("v0:%s:%s", timestamp, string(body))))
+		if !isEqualSecret(signature[3:], expected) {
+			return 0, errors.New("Bad signature")
+		}
+
+		return parsedTimestamp, nil
+	}
+
+	// Generic: hex digest in a custom header, with or without sha256= in front
+	headerName := verification.Header
+	if len(headerName) == 0 {
+		headerName = "X-Shuffle-Signature"
+	}
+
+	signature := strings.TrimPrefix(strings.TrimSpace(header.Get(headerName)), "sha256=")
+	if len(signature) == 0 {
+		return 0, errors.New(fmt.Sprintf("Missing %s header", headerName))
+	}
+
+	signed := body
+	parsedTimestamp := int64(0)
+	if len(verification.TimestampHeader) > 0 {
+		timestamp := header.Get(verification.TimestampHeader)
+		var err error
+		parsedTimestamp, err = strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return 0, errors.New(fmt.Sprintf("Missing or invalid %s header", verification.TimestampHeader))
+		}
+
+		signed = []byte(fmt.Sprintf("%s.%s", timestamp, string(body)))
+	}
+
+	if !isEqualSecret(strings.ToLower(signature), getHmacSha256(verification.Secret, signed)) {
+		return 0, errors.New("Bad signature")
+	}
+
+	return parsedTimestamp, nil
+}
+
+// Rejects signed timestamps that are too old (or too far in the future),
+// so a captured request can't be sent again later.
+func checkWebhookReplay(verification hookVerification, timestamp int64, now time.Time) error {
+	if timestamp == 0 || verification.ReplayWindow < 0 {
+		return nil
+	}
+
+	window := int64(verification.ReplayWindow)
+	if window == 0 {
+		window = 300
+	}
+
+	age := now.Unix() - timestamp
+	if age > window || age < -window {
+		return errors.New(fmt.Sprintf("Signed timestamp %d is outside the replay window of %d seconds", timestamp, window))
+	}
+
+	return nil
+}
+
+// Runs the configured verification for a webhook call. Returns the signed
+// timestamp for hmac hooks that have one.
+func verifyWebhookRequest(verification hookVerification, request *http.Request, body []byte) (int64, error) {
+	if len(verification.AllowedIps) > 0 {
+		clientIp := getWebhookClientIp(request)
+		if !isWebhookIpAllowed(clientIp, verification.AllowedIps) {
+			return 0, errors.New(fmt.Sprintf("IP %s is not in the allowlist", clientIp))
+		}
+	}
+
+	switch verification.Type {
+	case "", "none":
+		return 0, nil
+	case "hmac":
+		timestamp, err := verifyWebhookSignature(verification, request.Header, body)
+		if err != nil {
+			return 0, err
+		}
+
+		return timestamp, checkWebhookReplay(verification, timestamp, time.Now())
+	case "basic":
+		username, password, ok := request.BasicAuth()
+		if !ok {
+			return 0, errors.New("Missing basic auth")
+		}
+
+		// Both are checked to not leak which one was wrong
+		usernameOk := isEqualSecret(username, verification.Username)
+		passwordOk := isEqualSecret(password, verification.Password)
+		if !usernameOk || !passwordOk {
+			return 0, errors.New("Bad basic auth credentials")
+		}
+
+		return 0, nil
+	case "bearer":
+		authorization := request.Header.Get("Authorization")
+		if !strings.HasPrefix(authorization, "Bearer ") {
+			return 0, errors.New("Missing bearer token")
+		}
+
+		if len(verification.Secret) == 0 || !isEqualSecret(strings.TrimSpace(authorization[7:]), verification.Secret) {
+			return 0, errors.New("Bad bearer token")
+		}
+
+		return 0, nil
+	}
+
+	return 0, errors.New(fmt.Sprintf("Unknown verification type %s", verification.Type))
+}
+
+func validateHookIdempotency(idempotency hookIdempotency) error {
+	if len(idempotency.JsonPath) > 0 {
+		if _, err := parseJsonPath(idempotency.JsonPath); err != nil {
+			return errors.New(fmt.Sprintf("Invalid idempotency json_path: %s", err))
+		}
+	}
+
+	if idempotency.TtlMinutes < 0 || idempotency.TtlMinutes > 1440 {
+		return errors.New("Idempotency ttl_minutes has to be between 0 and 1440")
+	}
+
+	return nil
+}
+
+func validateHookTransforms(config hookConfig) error {
+	for _, transform := range config.Transforms {
+		if len(transform.Key) == 0 {
+			return errors.New("Transforms need a key")
+		}
+
+		if !strings.Contains(transform.Value, "{{") {
+			if _, err := parseJsonPath(transform.Value); err != nil {
+				return errors.New(fmt.Sprintf("Invalid path in transform %s: %s", transform.Key, err))
+			}
+		}
+	}
+
+	for _, filter := range config.Filters {
+		if _, err := parseJsonPath(filter.Path); err != nil {
+			return errors.New(fmt.Sprintf("Invalid filter path %s: %s", filter.Path, err))
+		}
+
+		switch filter.Operator {
+		case "equals", "not_equals", "contains", "not_contains", "exists", "not_exists", "gt", "lt":
+		case "regex":
+			if _, err := regexp.Compile(filter.Value); err != nil {
+				return errors.New(fmt.Sprintf("Invalid filter regex %s: %s", filter.Value, err))
+			}
+		default:
+			return errors.New(fmt.Sprintf("Invalid filter operator %s", filter.Operator))
+		}
+	}
+
+	if config.FilterMode != "" && config.FilterMode != "all" && config.FilterMode != "any" {
+		return errors.New("Filter mode has to be all or any")
+	}
+
+	return nil
+}
+
+func validateHookSync(sync hookSync) error {
+	if sync.MaxWait < 0 || sync.MaxWait > 300 {
+		return errors.New("Sync max_wait has to be between 0 and 300 seconds")
+	}
+
+	return nil
+}
+
+func validateHookVerification(verification hookVerification) error {
+	switch verification.Type {
+	case "", "none":
+	case "hmac":
+		if verification.Provider != "" && verification.Provider != "github" && verification.Provider != "stripe" && verification.Provider != "slack" && verification.Provider != "generic" {
+			return errors.New("Provider has to be one of github, stripe, slack or generic")
+		}
+
+		if len(verification.Secret) == 0 {
+			return errors.New("A secret is required for hmac verification")
+		}
+	case "basic":
+		if len(verification.Username) == 0 || len(verification.Password) == 0 {
+			return errors.New("Username and password are required for basic auth")
+		}
+	case "bearer":
+		if len(verification.Secret) == 0 {
+			return errors.New("A secret (token) is required for bearer verification")
+		}
+	default:
+		return errors.New("Type has to be one of none, hmac, basic or bearer")
+	}
+
+	for _, item := range verification.AllowedIps {
+		item = strings.TrimSpace(item)
+		if strings.Contains(item, "/") {
+			if _, _, err := net.ParseCIDR(item); err != nil {
+				return errors.New(fmt.Sprintf("Invalid CIDR %s in allowed_ips", item))
+			}
+		} else if net.ParseIP(item) == nil {
+			return errors.New(fmt.Sprintf("Invalid IP %s in allowed_ips", item))
+		}
+	}
+
+	return nil
+}
+
+// Keeps stored secrets when the placeholder from a GET is sent back
+func mergeHookSecrets(newConfig, oldConfig hookConfig) hookConfig {
+	if newConfig.Verification.Secret == hookSecretPlaceholder {
+		newConfig.Verification.Secret = oldConfig.Verification.Secret
+	}
+
+	if newConfig.Verification.Password == hookSecretPlaceholder {
+		newConfig.Verification.Password = oldConfig.Verification.Password
+	}
+
+	return newConfig
+}
+
+func redactHookConfig(config hookConfig) hookConfig {
+	if len(config.Verification.Secret) > 0 {
+		config.Verification.Secret = hookSecretPlaceholder
+	}
+
+	if len(config.Verification.Password) > 0 {
+		config.Verification.Password = hookSecretPlaceholder
+	}
+
+	return config
+}
+
+// Writes a failed response where the message can contain user input, so it
+// has to be escaped. handleSetHook uses "message" for it, the config "reason".
+func writeHookFailure(resp http.ResponseWriter, status int, field, message string) {
+	b, err := json.Marshal(map[string]interface{}{
+		"success": false,
+		field:     message,
+	})
+	if err != nil {
+		b = []byte(`{"success": false}`)
+	}
+
+	resp.WriteHeader(status)
+	resp.Write(b)
+}
+
+// GET/PUT /api/v1/hooks/{key}/config
+func handleHookConfig(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := shuffle.HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in hook config: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	location := strings.Split(request.URL.String(), "/")
+	if location[1] != "api" || len(location) <= 5 {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	hookId := strings.TrimPrefix(location[4], "webhook_")
+	if len(hookId) != 36 {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Hook ID not valid"}`))
+		return
+	}
+
+	ctx := shuffle.GetContext(request)
+	hook, err := shuffle.GetHook(ctx, hookId)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting hook %s (config): %s", hookId, err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Hook not found"}`))
+		return
+	}
+
+	if hook.OrgId != user.ActiveOrg.Id || (user.Id != hook.Owner && user.Role != "admin") {
+		log.Printf("[WARNING] Wrong user (%s) for hook %s (config)", user.Username, hook.Id)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	config, err := loadHookConfig(ctx, hookId)
+	if err != nil {
+		log.Printf("[WARNING] Failed loading config for hook %s: %s", hookId, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed loading hook config"}`))
+		return
+	}
+
+	if request.Method == "PUT" || request.Method == "POST" {
+		if user.Role == "org-reader" {
+			resp.WriteHeader(401)
+			resp.Write([]byte(`{"success": false, "reason": "Read only user"}`))
+			return
+		}
+
+		if isListenerHookType(hook.Type) && user.Role != "admin" {
+			log.Printf("[AUDIT] User %s (%s) tried to change config of %s listener hook %s without being admin", user.Username, user.Id, hook.Type, hookId)
+			resp.WriteHeader(401)
+			resp.Write([]byte(`{"success": false, "reason": "Only admins can configure syslog and SMTP hooks"}`))
+			return
+		}
+
+		body, err := ioutil.ReadAll(request.Body)
+		if err != nil {
+			resp.WriteHeader(400)
+			resp.Write([]byte(`{"success": false, "reason": "Failed reading body"}`))
+			return
+		}
+
+		newConfig := hookConfig{}
+		err = json.Unmarshal(body, &newConfig)
+		if err != nil {
+			resp.WriteHeader(400)
+			resp.Write([]byte(`{"success": false, "reason": "Failed unmarshalling hook config"}`))
+			return
+		}
+
+		newConfig = mergeHookSecrets(newConfig, config)
+		err = validateHookVerification(newConfig.Verification)
+		if err == nil {
+			err = validateHookIdempotency(newConfig.Idempotency)
+		}
+
+		if err == nil {
+			err = validateHookSync(newConfig.Sync)
+		}
+
+		if err == nil {
+			err = validateHookTransforms(newConfig)
+		}
+
+		if err == nil && isListenerHookType(hook.Type) {
+			err = validateHookListener(hook.Type, newConfig.Listener)
+		}
+
+		if err != nil {
+			writeHookFailure(resp, 400, "reason", err.Error())
+			return
+		}
+
+		newConfig.HookId = hookId
+		newConfig.OrgId = hook.OrgId
+		newConfig.Type = hook.Type
+		newConfig.Updated = time.Now().Unix()
+		err = setHookConfig(ctx, newConfig)
+		if err != nil {
+			log.Printf("[WARNING] Failed setting config for hook %s: %s", hookId, err)
+			resp.WriteHeader(500)
+			resp.Write([]byte(`{"success": false, "reason": "Failed saving hook config"}`))
+			return
+		}
+
+		log.Printf("[AUDIT] User %s (%s) updated config for hook %s. Verification: '%s'", user.Username, user.Id, hookId, newConfig.Verification.Type)
+		config = newConfig
+
+		if isListenerHookType(hook.Type) {
+			err = syncHookListener(*hook, config)
+			if err != nil {
+				log.Printf("[WARNING] Failed restarting %s listener for hook %s: %s", hook.Type, hookId, err)
+				writeHookFailure(resp, 400, "reason", fmt.Sprintf("Config saved, but the listener failed to start: %s", err))
+				return
+			}
+		}
+	}
+
+	newjson, err := json.Marshal(redactHookConfig(config))
+	if err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed marshalling hook config"}`))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write(newjson)
+}
+
+// Splits a JSONPath like $.event.items[0]['some key'] into keys and indexes.
+// Only plain child access is supported - no filters, wildcards or slices.
+func parseJsonPath(path string) ([]interface{}, error) {
+	path = strings.TrimSpace(path)
+	path = strings.TrimPrefix(path, "$")
+	parts := []interface{}{}
+
+	for len(path) > 0 {
+		if path[0] == '.' {
+			path = path[1:]
+			end := strings.IndexAny(path, ".[")
+			if end == -1 {
+				end = len(path)
+			}
+
+			if end == 0 {
+				return parts, errors.New("Empty key")
+			}
+
+			parts = append(parts, path[:end])
+			path = path[end:]
+		} else if path[0] == '[' {
+			end := strings.Index(path, "]")
+			if end == -1 {
+				return parts, errors.New("Missing ]")
+			}
+
+			inner := strings.TrimSpace(path[1:end])
+			path = path[end+1:]
+			if len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0] {
+				parts = append(parts, inner[1:len(inner)-1])
+				continue
+			}
+
+			index, err := strconv.Atoi(inner)
+			if err != nil {
+				return parts, errors.New(fmt.Sprintf("Invalid index %s", inner))
+			}
+
+			parts = append(parts, index)
+		} else if len(parts) == 0 {
+			// Allows "event.id" without the $. in front
+			path = "." + path
+		} else {
+			return parts, errors.New(fmt.Sprintf("Unexpected character %c", path[0]))
+		}
+	}
+
+	return parts, nil
+}
+
+// Returns the value at path in data parsed from JSON
+func getJsonPathValue(data interface{}, path string) (interface{}, bool) {
+	parts, err := parseJsonPath(path)
+	if err != nil {
+		return nil, false
+	}
+
+	current := data
+	for _, part := range parts {
+		switch key := part.(type) {
+		case string:
+			object, ok := current.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+
+			current, ok = object[key]
+			if !ok {
+				return nil, false
+			}
+		case int:
+			list, ok := current.([]interface{})
+			if !ok {
+				return nil, false
+			}
+
+			if key < 0 {
+				key += len(list)
+			}
+
+			if key < 0 || key >= len(list) {
+				return nil, false
+			}
+
+			current = list[key]
+		}
+	}
+
+	return current, true
+}
+
+// Strings are returned as is, everything else as JSON
+func getJsonValueString(value interface{}) string {
+	if parsed, ok := value.(string); ok {
+		return parsed
+	}
+
+	marshalled, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+
+	return string(marshalled)
+}
+
+// Returns an empty key if idempotency isn't configured or the key isn't in the request
+func getWebhookIdempotencyKey(idempotency hookIdempotency, header http.Header, body []byte) string {
+	if len(idempotency.Header) > 0 {
+		value := strings.TrimSpace(header.Get(idempotency.Header))
+		if len(value) > 0 {
+			return value
+		}
+	}
+
+	if len(idempotency.JsonPath) > 0 {
+		var parsed interface{}
+		err := json.Unmarshal(body, &parsed)
+		if err != nil {
+			return ""
+		}
+
+		value, found := getJsonPathValue(parsed, idempotency.JsonPath)
+		if found && value != nil {
+			return getJsonValueString(value)
+		}
+	}
+
+	return ""
+}
+
+// How often expired idempotency keys are removed, and how many at a time
+const (
+	webhookDeliveryCleanupInterval = 10 * time.Minute
+	webhookDeliveryCleanupBatch    = 1000
+)
+
+// Remembers the execution started for an idempotency key. The execution ID
+// is empty while the first delivery is still starting it.
+type webhookDelivery struct {
+	HookId      string `json:"hook_id"`
+	ExecutionId string `json:"execution_id"`
+	Expires     int64  `json:"expires"`
+}
+
+func getWebhookDeliveryId(hookId, key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return fmt.Sprintf("%s_%s", hookId, hex.EncodeToString(hash[:]))
+}
+
+func getWebhookDeliveryExpiry(ttlMinutes int) int64 {
+	if ttlMinutes <= 0 {
+		ttlMinutes = 60
+	}
+
+	return time.Now().Unix() + int64(ttlMinutes*60)
+}
+
+// Reserves the key before an execution is started, so concurrent retries
+// can't start it twice. Returns false and the execution of the delivery that
+// holds the key otherwise. Expired keys are taken over.
+func reserveWebhookDelivery(ctx context.Context, hookId, key string, ttlMinutes int) (string, bool) {
+	id := getWebhookDeliveryId(hookId, key)
+	delivery := webhookDelivery{
+		HookId:  hookId,
+		Expires: getWebhookDeliveryExpiry(ttlMinutes),
+	}
+
+	err := createEsDocument(ctx, "webhook_deliveries", id, delivery)
+	if err == nil {
+		return "", true
+	} else if err != errEsConflict {
+		log.Printf("[WARNING] Failed reserving delivery for hook %s. Running it without idempotency: %s", hookId, err)
+		return "", true
+	}
+
+	document, err := getEsDocument(ctx, "webhook_deliveries", id)
+	if err == errEsNotFound {
+		// Released by a failed delivery in the meantime
+		err = createEsDocument(ctx, "webhook_deliveries", id, delivery)
+		return "", err != errEsConflict
+	} else if err != nil {
+		log.Printf("[WARNING] Failed getting delivery for hook %s. Running it without idempotency: %s", hookId, err)
+		return "", true
+	}
+
+	existing := webhookDelivery{}
+	err = json.Unmarshal(document.Source, &existing)
+	if err == nil && existing.Expires >= time.Now().Unix() {
+		return existing.ExecutionId, false
+	}
+
+	err = updateEsDocumentIfUnchanged(ctx, "webhook_deliveries", document, delivery)
+	if err == errEsConflict {
+		// Taken over by another delivery
+		return "", false
+	} else if err != nil {
+		log.Printf("[WARNING] Failed taking over delivery for hook %s. Running it without idempotency: %s", hookId, err)
+	}
+
+	return "", true
+}
+
+// Stores the execution started for a reserved key
+func setWebhookDelivery(ctx context.Context, hookId, key, executionId string, ttlMinutes int) {
+	delivery := webhookDelivery{
+		HookId:      hookId,
+		ExecutionId: executionId,
+		Expires:     getWebhookDeliveryExpiry(ttlMinutes),
+	}
+
+	err := setEsDocument(ctx, "webhook_deliveries", getWebhookDeliveryId(hookId, key), delivery)
+	if err != nil {
+		log.Printf("[WARNING] Failed storing delivery for hook %s: %s", hookId, err)
+	}
+}
+
+// Frees a reserved key when no execution could be started, so the sender's
+// retry isn't dropped
+func releaseWebhookDelivery(ctx context.Context, hookId, key string) {
+	err := deleteEsDocument(ctx, "webhook_deliveries", getWebhookDeliveryId(hookId, key))
+	if err != nil && err != errEsNotFound {
+		log.Printf("[WARNING] Failed releasing delivery for hook %s: %s", hookId, err)
+	}
+}
+
+// Removes expired keys. They're taken over by the next delivery anyway, so
+// this only keeps the index from growing. Returns the amount removed.
+func cleanupWebhookDeliveries(ctx context.Context) (int, error) {
+	removed := 0
+	for {
+		now := time.Now().Unix()
+		documents, err := searchEsDocuments(ctx, "webhook_deliveries", map[string]interface{}{
+			"range": map[string]interface{}{
+				"expires": map[string]interface{}{
+					"lt": now,
+				},
+			},
+		}, webhookDeliveryCleanupBatch)
+		if err != nil {
+			return removed, err
+		}
+
+		batchRemoved := 0
+		for i := range documents {
+			delivery := webhookDelivery{}
+			err = json.Unmarshal(documents[i].Source, &delivery)
+			if err != nil || delivery.Expires >= now {
+				continue
+			}
+
+			// A delivery may have taken the key over since the search
+			err = deleteEsDocumentIfUnchanged(ctx, "webhook_deliveries", &documents[i])
+			if err == nil {
+				batchRemoved += 1
+			} else if err != errEsConflict && err != errEsNotFound {
+				log.Printf("[WARNING] Failed removing expired delivery %s: %s", documents[i].Id, err)
+			}
+		}
+
+		removed += batchRemoved
+		if len(documents) < webhookDeliveryCleanupBatch || batchRemoved == 0 {
+			return removed, nil
+		}
+	}
+}
+
+func runWebhookDeliveryCleanup(ctx context.Context) {
+	for {
+		time.Sleep(webhookDeliveryCleanupInterval)
+
+		removed, err := cleanupWebhookDeliveries(ctx)
+		if err != nil {
+			log.Printf("[WARNING] Failed removing expired webhook deliveries: %s", err)
+		} else if removed > 0 {
+			log.Printf("[DEBUG] Removed %d expired webhook deliveries", removed)
+		}
+	}
+}
+
+// Picks the result to return for a finished execution
+func getWebhookExecutionResult(execution shuffle.WorkflowExecution, resultAction string) string {
+	if len(resultAction) > 0 {
+		for _, result := range execution.Results {
+			if result.Action.ID == resultAction || result.Action.Label == resultAction {
+				return result.Result
+			}
+		}
+
+		log.Printf("[WARNING] Action %s not found in results of execution %s. Returning the last result.", resultAction, execution.ExecutionId)
+	}
+
+	return execution.Result
+}
+
+func writeWebhookExecutionResult(resp http.ResponseWriter, execution shuffle.WorkflowExecution, resultAction string) {
+	result := getWebhookExecutionResult(execution, resultAction)
+	if JSONCheck(result) {
+		resp.Header().Set("Content-Type", "application/json")
+	}
+
+	resp.Header().Set("X-Shuffle-Execution-Id", execution.ExecutionId)
+	resp.Header().Set("X-Shuffle-Execution-Status", execution.Status)
+	resp.WriteHeader(200)
+	resp.Write([]byte(result))
+}
+
+// The first backend to need the secret makes it. The others read it back
+// when they lose the race to create it.
+func getWebhookStatusSecret(ctx context.Context) ([]byte, error) {
+	if secret := os.Getenv("SHUFFLE_ENCRYPTION_MODIFIER"); len(secret) > 0 {
+		return []byte(secret), nil
+	}
+
+	webhookStatusSecretLock.Lock()
+	defer webhookStatusSecretLock.Unlock()
+	if len(webhookStatusSecret) > 0 {
+		return webhookStatusSecret, nil
+	}
+
+	document, err := getEsDocument(ctx, "webhook_secrets", "status")
+	if err == errEsNotFound {
+		secret := make([]byte, 32)
+		_, err = rand.Read(secret)
+		if err != nil {
+			return nil, err
+		}
+
+		err = createEsDocument(ctx, "webhook_secrets", "status", webhookSecret{Secret: hex.EncodeToString(secret)})
+		if err == nil {
+			webhookStatusSecret = secret
+			return secret, nil
+		} else if err == errEsConflict {
+			document, err = getEsDocument(ctx, "webhook_secrets", "status")
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	stored := webhookSecret{}
+	err = json.Unmarshal(document.Source, &stored)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := hex.DecodeString(stored.Secret)
+	if err != nil || len(secret) == 0 {
+		return nil, errors.New("Stored webhook status secret isn't valid")
+	}
+
+	webhookStatusSecret = secret
+	return secret, nil
+}
+
+// Read-only token for one execution of a hook. The execution's own
+// authorization is what workers post results with, so it's never handed out.
+func getWebhookStatusToken(ctx context.Context, hookId, executionId string) (string, error) {
+	secret, err := getWebhookStatusSecret(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return getHmacSha256(string(secret), []byte(fmt.Sprintf("%s:%s", hookId, executionId))), nil
+}
+
+// The 202 for sync hooks that didn't finish in time, with a status URL the
+// caller can poll for the result. Without a stable secret the URL would stop
+// working, so the sync response fails instead.
+func writeWebhookSyncAccepted(ctx context.Context, resp http.ResponseWriter, hookId, executionId string) {
+	token, err := getWebhookStatusToken(ctx, hookId, executionId)
+	if err != nil {
+		log.Printf("[ERROR] Failed getting the secret for the status URL of execution %s: %s. Set SHUFFLE_ENCRYPTION_MODIFIER.", executionId, err)
+		resp.Header().Set("Content-Type", "application/json")
+		resp.WriteHeader(500)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Execution didn't finish in time, and no status URL could be made", "execution_id": "%s"}`, executionId)))
+		return
+	}
+
+	statusUrl := fmt.Sprintf("/api/v1/hooks/webhook_%s/executions/%s?token=%s", hookId, executionId, token)
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Header().Set("Location", statusUrl)
+	resp.WriteHeader(202)
+	resp.Write([]byte(fmt.Sprintf(`{"success": true, "status": "EXECUTING", "execution_id": "%s", "status_url": "%s"}`, executionId, statusUrl)))
+}
+
+// GET /api/v1/hooks/{key}/executions/{execution_id}?token=<token>
+// Status URL for sync hooks that timed out. The token is from getWebhookStatusToken.
+func handleGetWebhookExecution(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	location := strings.Split(strings.Split(request.URL.String(), "?")[0], "/")
+	if location[1] != "api" || len(location) <= 6 {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	hookId := strings.TrimPrefix(location[4], "webhook_")
+	executionId := location[6]
+	if len(hookId) != 36 || len(executionId) != 36 {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Hook or execution ID not valid"}`))
+		return
+	}
+
+	ctx := shuffle.GetContext(request)
+	token, err := getWebhookStatusToken(ctx, hookId, executionId)
+	if err != nil {
+		log.Printf("[ERROR] Failed getting the secret for status URLs: %s", err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed verifying the token"}`))
+		return
+	}
+
+	if !isEqualSecret(token, request.URL.Query().Get("token")) {
+		log.Printf("[WARNING] Bad token when getting execution %s for hook %s", executionId, hookId)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Bad token or execution_id might not exist."}`))
+		return
+	}
+
+	hook, err := shuffle.GetHook(ctx, hookId)
+	if err != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Bad token or execution_id might not exist."}`))
+		return
+	}
+
+	execution, err := shuffle.GetWorkflowExecution(ctx, executionId)
+	if err != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Bad token or execution_id might not exist."}`))
+		return
+	}
+
+	found := false
+	for _, workflowId := range hook.Workflows {
+		if workflowId == execution.Workflow.ID {
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Bad token or execution_id might not exist."}`))
+		return
+	}
+
+	if execution.Status == "EXECUTING" {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.WriteHeader(202)
+		resp.Write([]byte(fmt.Sprintf(`{"success": true, "status": "EXECUTING", "execution_id": "%s"}`, executionId)))
+		return
+	}
+
+	config, err := loadHookConfig(ctx, hookId)
+	if err != nil {
+		log.Printf("[WARNING] Failed loading config for hook %s: %s", hookId, err)
+	}
+
+	writeWebhookExecutionResult(resp, *execution, config.Sync.ResultAction)
+}
+
+// What transforms and filters are evaluated against. The body is parsed
+// as JSON if possible, otherwise kept as a string.
+func getWebhookEvent(header http.Header, queries string, body []byte) map[string]interface{} {
+	var parsedBody interface{}
+	err := json.Unmarshal(body, &parsedBody)
+	if err != nil {
+		parsedBody = string(body)
+	}
+
+	headers := map[string]interface{}{}
+	for key, values := range header {
+		if len(values) > 0 {
+			headers[strings.ToLower(key)] = values[0]
+		}
+	}
+
+	query := map[string]interface{}{}
+	parsedQuery, err := url.ParseQuery(queries)
+	if err == nil {
+		for key, values := range parsedQuery {
+			if len(values) > 0 {
+				query[key] = values[0]
+			}
+		}
+	}
+
+	return map[string]interface{}{
+		"body":    parsedBody,
+		"headers": headers,
+		"query":   query,
+	}
+}
+
+func matchWebhookFilter(event map[string]interface{}, filter hookFilter) bool {
+	value, found := getJsonPathValue(event, filter.Path)
+	if filter.Operator == "exists" {
+		return found
+	}
+
+	if filter.Operator == "not_exists" {
+		return !found
+	}
+
+	parsedValue := ""
+	if found {
+		parsedValue = getJsonValueString(value)
+	}
+
+	switch filter.Operator {
+	case "equals":
+		return found && parsedValue == filter.Value
+	case "not_equals":
+		return !found || parsedValue != filter.Value
+	case "contains":
+		return found && strings.Contains(parsedValue, filter.Value)
+	case "not_contains":
+		return !found || !strings.Contains(parsedValue, filter.Value)
+	case "regex":
+		matched, err := regexp.MatchString(filter.Value, parsedValue)
+		return found && err == nil && matched
+	case "gt", "lt":
+		number, err := strconv.ParseFloat(parsedValue, 64)
+		if !found || err != nil {
+			return false
+		}
+
+		compare, err := strconv.ParseFloat(filter.Value, 64)
+		if err != nil {
+			return false
+		}
+
+		if filter.Operator == "gt" {
+			return number > compare
+		}
+
+		return number < compare
+	}
+
+	return false
+}
+
+// Returns false if the event should be dropped
+func matchWebhookFilters(event map[string]interface{}, filters []hookFilter, mode string) bool {
+	if len(filters) == 0 {
+		return true
+	}
+
+	for _, filter := range filters {
+		matched := matchWebhookFilter(event, filter)
+		if mode == "any" && matched {
+			return true
+		}
+
+		if mode != "any" && !matched {
+			return false
+		}
+	}
+
+	return mode != "any"
+}
+
+var webhookTemplatePattern = regexp.MustCompile(`{{\s*([^}]+?)\s*}}`)
+
+// Builds the execution argument from the transforms
+func getWebhookTransformedArgument(event map[string]interface{}, transforms []hookTransform) (string, error) {
+	argument := map[string]interface{}{}
+	for _, transform := range transforms {
+		if !strings.Contains(transform.Value, "{{") {
+			value, _ := getJsonPathValue(event, transform.Value)
+			argument[transform.Key] = value
+			continue
+		}
+
+		argument[transform.Key] = webhookTemplatePattern.ReplaceAllStringFunc(transform.Value, func(match string) string {
+			path := webhookTemplatePattern.FindStringSubmatch(match)[1]
+			value, found := getJsonPathValue(event, path)
+			if !found || value == nil {
+				return ""
+			}
+
+			return getJsonValueString(value)
+		})
+	}
+
+	parsed, err := json.Marshal(argument)
+	if err != nil {
+		return "", err
+	}
+
+	return string(parsed), nil
+}
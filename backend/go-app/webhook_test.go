@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shuffle/shuffle-shared"
+)
+
+func TestVerifyWebhookSignature(t *testing.T) {
+	body := []byte(`{"event": "alert"}`)
+	secret := "supersecret"
+
+	github := http.Header{}
+	github.Set("X-Hub-Signature-256", "sha256="+getHmacSha256(secret, body))
+
+	stripe := http.Header{}
+	stripe.Set("Stripe-Signature", fmt.Sprintf("t=1700000000,v1=%s", getHmacSha256(secret, []byte(fmt.Sprintf("1700000000.%s", body)))))
+
+	slack := http.Header{}
+	slack.Set("X-Slack-Request-Timestamp", "1700000000")
+	slack.Set("X-Slack-Signature", "v0="+getHmacSha256(secret, []byte(fmt.Sprintf("v0:1700000000:%s", body))))
+
+	generic := http.Header{}
+	generic.Set("X-Signature", getHmacSha256(secret, body))
+
+	tests := []struct {
+		provider  string
+		header    http.Header
+		secret    string
+		timestamp int64
+		valid     bool
+	}{
+		{"github", github, secret, 0, true},
+		{"github", github, "wrong", 0, false},
+		{"stripe", stripe, secret, 1700000000, true},
+		{"stripe", github, secret, 0, false},
+		{"slack", slack, secret, 1700000000, true},
+		{"slack", slack, "wrong", 0, false},
+		{"generic", generic, secret, 0, true},
+		{"generic", http.Header{}, secret, 0, false},
+	}
+
+	for _, test := range tests {
+		verification := hookVerification{Type: "hmac", Provider: test.provider, Secret: test.secret, Header: "X-Signature"}
+		timestamp, err := verifyWebhookSignature(verification, test.header, body)
+		if (err == nil) != test.valid {
+			t.Errorf("Provider %s with secret %s: expected valid=%t, got error %v", test.provider, test.secret, test.valid, err)
+		}
+
+		if timestamp != test.timestamp {
+			t.Errorf("Provider %s: expected timestamp %d, got %d", test.provider, test.timestamp, timestamp)
+		}
+	}
+}
+
+func TestIsWebhookIpAllowed(t *testing.T) {
+	allowed := []string{"10.0.0.0/8", "192.168.1.10", "2001:db8::/32"}
+	tests := map[string]bool{
+		"10.1.2.3":     true,
+		"192.168.1.10": true,
+		"192.168.1.11": false,
+		"2001:db8::1":  true,
+		"not-an-ip":    false,
+	}
+
+	for ip, expected := range tests {
+		if isWebhookIpAllowed(ip, allowed) != expected {
+			t.Errorf("IP %s: expected %t", ip, expected)
+		}
+	}
+}
+
+func TestGetJsonPathValue(t *testing.T) {
+	data := map[string]interface{}{
+		"event": map[string]interface{}{
+			"id":    "abc",
+			"items": []interface{}{map[string]interface{}{"name": "first"}, 5.0},
+			"a key": true,
+		},
+	}
+
+	tests := []struct {
+		path     string
+		expected interface{}
+		found    bool
+	}{
+		{"$.event.id", "abc", true},
+		{"event.id", "abc", true},
+		{"$.event.items[0].name", "first", true},
+		{"$.event.items[-1]", 5.0, true},
+		{"$['event']['a key']", true, true},
+		{"$.event.missing", nil, false},
+		{"$.event.items[5]", nil, false},
+		{"$.event.id.nested", nil, false},
+	}
+
+	for _, test := range tests {
+		value, found := getJsonPathValue(data, test.path)
+		if found != test.found || value != test.expected {
+			t.Errorf("Path %s: got %v (found=%t), expected %v (found=%t)", test.path, value, found, test.expected, test.found)
+		}
+	}
+}
+
+func TestCheckWebhookReplay(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tests := []struct {
+		window    int
+		timestamp int64
+		valid     bool
+	}{
+		{0, 1700000000 - 100, true},
+		{0, 1700000000 - 301, false},
+		{0, 1700000000 + 301, false},
+		{60, 1700000000 - 61, false},
+		{-1, 1600000000, true},
+		{0, 0, true},
+	}
+
+	for _, test := range tests {
+		err := checkWebhookReplay(hookVerification{ReplayWindow: test.window}, test.timestamp, now)
+		if (err == nil) != test.valid {
+			t.Errorf("Window %d, timestamp %d: expected valid=%t, got %v", test.window, test.timestamp, test.valid, err)
+		}
+	}
+}
+
+func TestReserveWebhookDelivery(t *testing.T) {
+	documents := startFakeOpensearch(t)
+	ctx := context.Background()
+
+	if _, reserved := reserveWebhookDelivery(ctx, "hook", "key", 60); !reserved {
+		t.Fatalf("Expected the first delivery to reserve the key")
+	}
+
+	executionId, reserved := reserveWebhookDelivery(ctx, "hook", "key", 60)
+	if reserved || len(executionId) > 0 {
+		t.Errorf("Expected a retry to be rejected while the first delivery is starting, got %q (reserved=%t)", executionId, reserved)
+	}
+
+	if _, reserved := reserveWebhookDelivery(ctx, "other-hook", "key", 60); !reserved {
+		t.Errorf("Expected keys to be scoped to their hook")
+	}
+
+	setWebhookDelivery(ctx, "hook", "key", "execution", 60)
+	executionId, reserved = reserveWebhookDelivery(ctx, "hook", "key", 60)
+	if reserved || executionId != "execution" {
+		t.Errorf("Expected a retry to get the existing execution, got %q (reserved=%t)", executionId, reserved)
+	}
+
+	// Expired keys are taken over
+	key := fmt.Sprintf("webhook_deliveries/%s", getWebhookDeliveryId("hook", "key"))
+	documents[key] = json.RawMessage(`{"hook_id": "hook", "execution_id": "execution", "expires": 1}`)
+	if _, reserved := reserveWebhookDelivery(ctx, "hook", "key", 60); !reserved {
+		t.Errorf("Expected an expired key to be reserved again")
+	}
+
+	releaseWebhookDelivery(ctx, "hook", "key")
+	if _, found := documents[key]; found {
+		t.Errorf("Expected the released key to be removed")
+	}
+}
+
+func TestCleanupWebhookDeliveries(t *testing.T) {
+	documents := startFakeOpensearch(t)
+	ctx := context.Background()
+
+	expired := fmt.Sprintf("webhook_deliveries/%s", getWebhookDeliveryId("hook", "expired"))
+	documents[expired] = json.RawMessage(`{"hook_id": "hook", "execution_id": "execution", "expires": 1}`)
+	reserveWebhookDelivery(ctx, "hook", "active", 60)
+
+	removed, err := cleanupWebhookDeliveries(ctx)
+	if err != nil || removed != 1 {
+		t.Fatalf("Expected one expired delivery to be removed, got %d (%v)", removed, err)
+	}
+
+	if _, found := documents[expired]; found {
+		t.Errorf("Expected the expired key to be removed")
+	}
+
+	if _, found := documents[fmt.Sprintf("webhook_deliveries/%s", getWebhookDeliveryId("hook", "active"))]; !found {
+		t.Errorf("Expected the active key to be kept")
+	}
+}
+
+func TestWebhookFiltersAndTransforms(t *testing.T) {
+	header := http.Header{}
+	header.Set("X-Source", "siem")
+	event := getWebhookEvent(header, "env=prod", []byte(`{"alert": {"id": 12, "severity": 7, "title": "Login"}}`))
+
+	filters := []hookFilter{
+		{Path: "$.headers.x-source", Operator: "equals", Value: "siem"},
+		{Path: "$.body.alert.severity", Operator: "gt", Value: "5"},
+	}
+
+	if !matchWebhookFilters(event, filters, "all") {
+		t.Errorf("Expected event to match all filters")
+	}
+
+	filters = append(filters, hookFilter{Path: "$.body.alert.title", Operator: "regex", Value: "^Logout"})
+	if matchWebhookFilters(event, filters, "all") {
+		t.Errorf("Expected event to not match all filters")
+	}
+
+	if !matchWebhookFilters(event, filters, "any") {
+		t.Errorf("Expected event to match any filter")
+	}
+
+	argument, err := getWebhookTransformedArgument(event, []hookTransform{
+		{Key: "id", Value: "$.body.alert.id"},
+		{Key: "summary", Value: "{{ $.query.env }}/{{$.headers.x-source}}: {{ $.body.alert.title }}"},
+	})
+
+	expected := `{"id":12,"summary":"prod/siem: Login"}`
+	if err != nil || argument != expected {
+		t.Errorf("Got argument %s (%v), expected %s", argument, err, expected)
+	}
+}
+
+func TestWebhookSyncResponses(t *testing.T) {
+	startFakeOpensearch(t)
+	ctx := context.Background()
+	execution := shuffle.WorkflowExecution{
+		ExecutionId:   "a1b2c3d4-0000-4000-8000-000000000002",
+		Status:        "FINISHED",
+		Authorization: "worker-authorization",
+		Result:        "last result",
+		Results: []shuffle.ActionResult{
+			{Action: shuffle.Action{ID: "action-1", Label: "lookup"}, Result: `{"verdict": "malicious"}`},
+		},
+	}
+
+	finished := httptest.NewRecorder()
+	writeWebhookExecutionResult(finished, execution, "lookup")
+	if finished.Code != 200 || finished.Body.String() != `{"verdict": "malicious"}` || finished.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("Expected the lookup result as JSON, got %d: %s", finished.Code, finished.Body.String())
+	}
+
+	hookId := "a1b2c3d4-0000-4000-8000-000000000001"
+	accepted := httptest.NewRecorder()
+	writeWebhookSyncAccepted(ctx, accepted, hookId, execution.ExecutionId)
+
+	statusUrl := accepted.Header().Get("Location")
+	if accepted.Code != 202 || !strings.Contains(accepted.Body.String(), statusUrl) {
+		t.Fatalf("Expected a 202 with the status URL, got %d: %s", accepted.Code, accepted.Body.String())
+	}
+
+	token, _ := getWebhookStatusToken(ctx, hookId, execution.ExecutionId)
+	if strings.Contains(statusUrl, execution.Authorization) || !strings.Contains(statusUrl, "token="+token) {
+		t.Errorf("Expected the status URL to hold a status token and not the authorization: %s", statusUrl)
+	}
+
+	if otherToken, _ := getWebhookStatusToken(ctx, hookId, "a1b2c3d4-0000-4000-8000-000000000003"); token == otherToken {
+		t.Errorf("Expected status tokens to differ between executions")
+	}
+
+	forged := httptest.NewRecorder()
+	handleGetWebhookExecution(forged, httptest.NewRequest("GET", strings.Split(statusUrl, "?")[0]+"?token="+execution.Authorization, nil))
+	if forged.Code != 401 {
+		t.Errorf("Expected the execution authorization to be refused as a status token, got %d", forged.Code)
+	}
+}
+
+func TestGetWebhookStatusSecret(t *testing.T) {
+	documents := startFakeOpensearch(t)
+	ctx := context.Background()
+	webhookStatusSecret = nil
+	defer func() {
+		webhookStatusSecret = nil
+	}()
+
+	secret, err := getWebhookStatusSecret(ctx)
+	if err != nil || len(secret) != 32 {
+		t.Fatalf("Expected a new 32 byte secret, got %d bytes (%v)", len(secret), err)
+	}
+
+	if _, found := documents["webhook_secrets/status"]; !found {
+		t.Fatalf("Expected the secret to be stored")
+	}
+
+	// Same as a restart, or another backend
+	webhookStatusSecret = nil
+	stored, err := getWebhookStatusSecret(ctx)
+	if err != nil || string(stored) != string(secret) {
+		t.Errorf("Expected the stored secret to be read back, got %x (%v)", stored, err)
+	}
+
+	os.Setenv("SHUFFLE_ENCRYPTION_MODIFIER", "modifier")
+	defer os.Unsetenv("SHUFFLE_ENCRYPTION_MODIFIER")
+	if secret, _ := getWebhookStatusSecret(ctx); string(secret) != "modifier" {
+		t.Errorf("Expected SHUFFLE_ENCRYPTION_MODIFIER to be used when set, got %s", string(secret))
+	}
+}
+
+func TestWriteHookFailure(t *testing.T) {
+	resp := httptest.NewRecorder()
+	writeHookFailure(resp, 400, "reason", `Invalid json_path "$.a\b": unexpected character`)
+
+	parsed := map[string]interface{}{}
+	err := json.Unmarshal(resp.Body.Bytes(), &parsed)
+	if err != nil {
+		t.Fatalf("Expected valid JSON, got %s: %s", resp.Body.String(), err)
+	}
+
+	if resp.Code != 400 || parsed["success"] != false || parsed["reason"] != `Invalid json_path "$.a\b": unexpected character` {
+		t.Errorf("Expected the reason to be kept as is, got %d: %s", resp.Code, resp.Body.String())
+	}
+}
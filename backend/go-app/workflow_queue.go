@@ -0,0 +1,203 @@
+package main
+
+// Ordering of the workflow queue handed to Orborus. Executions are returned
+// by priority, and executions gain a point of priority for every
+// SHUFFLE_QUEUE_AGING seconds they wait, so bulk runs still progress while
+// higher priority executions keep coming in.
+//
+// Orborus can also long-poll the queue with ?wait=<seconds>. The request is
+// then held until an execution is queued for the environment or the wait is
+// over, instead of Orborus asking every few seconds.
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shuffle/shuffle-shared"
+)
+
+// Seconds in the queue per extra point of priority
+var workflowQueueAging int64 = 60
+
+// When executions were first and last seen in a queue, by environment and
+// execution ID. Executions that haven't been seen for an hour are removed.
+type workflowQueueSeen struct {
+	FirstSeen int64
+	LastSeen  int64
+}
+
+var workflowQueueSeenItems = map[string]workflowQueueSeen{}
+var workflowQueueSeenLock sync.Mutex
+
+// The longest a long-poll is held. Orborus asks for less by default.
+var maxWorkflowQueueWait = 30 * time.Second
+
+// The most executions handed out per request. Orborus asks for its free
+// slots with ?limit=<amount>.
+var maxWorkflowQueueLimit = 49
+
+// How often a long-poll checks the queue itself, for executions queued by
+// another backend or from inside shuffle-shared
+var workflowQueueRecheck = 5 * time.Second
+
+// Closed when an execution is queued for the environment
+var workflowQueueSignals = map[string]chan bool{}
+var workflowQueueSignalsLock sync.Mutex
+
+func init() {
+	if aging, err := strconv.Atoi(os.Getenv("SHUFFLE_QUEUE_AGING")); err == nil && aging > 0 {
+		workflowQueueAging = int64(aging)
+	}
+}
+
+// The priority an execution is handled with after waiting
+func getQueuePriority(priority int, waited int64) int64 {
+	if waited < 0 {
+		waited = 0
+	}
+
+	return int64(priority) + waited/workflowQueueAging
+}
+
+// Orders executions by their aged priority. Executions with the same
+// priority keep the order they were first seen in.
+func sortExecutionRequests(requests []shuffle.ExecutionRequest, firstSeen map[string]int64, now int64) []shuffle.ExecutionRequest {
+	sort.SliceStable(requests, func(i, j int) bool {
+		first := getQueuePriority(requests[i].Priority, now-firstSeen[requests[i].ExecutionId])
+		second := getQueuePriority(requests[j].Priority, now-firstSeen[requests[j].ExecutionId])
+		if first != second {
+			return first > second
+		}
+
+		return firstSeen[requests[i].ExecutionId] < firstSeen[requests[j].ExecutionId]
+	})
+
+	return requests
+}
+
+// Records when the executions in an environment's queue were first seen, then
+// orders them
+func sortWorkflowQueue(environment string, requests []shuffle.ExecutionRequest) []shuffle.ExecutionRequest {
+	now := time.Now().Unix()
+	firstSeen := map[string]int64{}
+
+	workflowQueueSeenLock.Lock()
+	for _, request := range requests {
+		key := fmt.Sprintf("%s_%s", environment, request.ExecutionId)
+		seen, ok := workflowQueueSeenItems[key]
+		if !ok {
+			seen.FirstSeen = now
+		}
+
+		seen.LastSeen = now
+		workflowQueueSeenItems[key] = seen
+		firstSeen[request.ExecutionId] = seen.FirstSeen
+	}
+
+	for key, seen := range workflowQueueSeenItems {
+		if seen.LastSeen < now-3600 {
+			delete(workflowQueueSeenItems, key)
+		}
+	}
+	workflowQueueSeenLock.Unlock()
+
+	return sortExecutionRequests(requests, firstSeen, now)
+}
+
+func getWorkflowQueueSignalKey(environment string) string {
+	return strings.ToLower(strings.TrimSpace(environment))
+}
+
+func getWorkflowQueueSignal(environment string) chan bool {
+	key := getWorkflowQueueSignalKey(environment)
+
+	workflowQueueSignalsLock.Lock()
+	defer workflowQueueSignalsLock.Unlock()
+
+	signal, ok := workflowQueueSignals[key]
+	if !ok {
+		signal = make(chan bool)
+		workflowQueueSignals[key] = signal
+	}
+
+	return signal
+}
+
+// Wakes up the long-polls waiting for the environment. Call this after
+// shuffle.SetWorkflowQueue.
+func notifyWorkflowQueue(environment string) {
+	key := getWorkflowQueueSignalKey(environment)
+
+	workflowQueueSignalsLock.Lock()
+	defer workflowQueueSignalsLock.Unlock()
+
+	if signal, ok := workflowQueueSignals[key]; ok {
+		close(signal)
+		delete(workflowQueueSignals, key)
+	}
+}
+
+// How long the request wants to wait for executions. 0 means don't wait.
+func getWorkflowQueueWait(request *http.Request) time.Duration {
+	wait, err := strconv.Atoi(request.URL.Query().Get("wait"))
+	if err != nil || wait <= 0 {
+		return 0
+	}
+
+	if time.Duration(wait)*time.Second > maxWorkflowQueueWait {
+		return maxWorkflowQueueWait
+	}
+
+	return time.Duration(wait) * time.Second
+}
+
+// How many executions the request wants at most
+func getWorkflowQueueLimit(request *http.Request) int {
+	limit, err := strconv.Atoi(request.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 || limit > maxWorkflowQueueLimit {
+		return maxWorkflowQueueLimit
+	}
+
+	return limit
+}
+
+// Reads the queue with readQueue, waiting up to wait for executions if it's
+// empty. Returns early with an empty queue when done is closed, e.g. when
+// Orborus goes away.
+func waitForWorkflowQueue(done <-chan struct{}, environment string, wait time.Duration, readQueue func() (shuffle.ExecutionRequestWrapper, error)) (shuffle.ExecutionRequestWrapper, error) {
+	deadline := time.Now().Add(wait)
+	for {
+		// Before reading, so executions queued in between aren't missed
+		signal := getWorkflowQueueSignal(environment)
+
+		executionRequests, err := readQueue()
+		if err != nil || len(executionRequests.Data) > 0 {
+			return executionRequests, err
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return executionRequests, nil
+		}
+
+		if remaining > workflowQueueRecheck {
+			remaining = workflowQueueRecheck
+		}
+
+		timer := time.NewTimer(remaining)
+		select {
+		case <-signal:
+		case <-timer.C:
+		case <-done:
+			timer.Stop()
+			return executionRequests, nil
+		}
+
+		timer.Stop()
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+// Dead-letters for the workflow queue. Executions end up here when Orborus
+// couldn't deploy them after SHUFFLE_QUEUE_MAX_ATTEMPTS deliveries, or right
+// away when a deployment fails with at-most-once delivery. Admins can list
+// them, put them back in the queue or discard them, and see the amount in
+// each environment.
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/shuffle/shuffle-shared"
+)
+
+type workflowQueueDeadLetter struct {
+	Id          string                   `json:"id"`
+	ExecutionId string                   `json:"execution_id"`
+	WorkflowId  string                   `json:"workflow_id"`
+	OrgId       string                   `json:"org_id"`
+	Environment string                   `json:"environment"`
+	Attempts    int                      `json:"attempts"`
+	Reason      string                   `json:"reason"`
+	Request     shuffle.ExecutionRequest `json:"request"`
+	Created     int64                    `json:"created"`
+}
+
+// A failed deployment reported by Orborus. The execution itself is read from
+// the queue, never from the report.
+type workflowQueueDeadLetterReport struct {
+	ExecutionId string `json:"execution_id"`
+	Reason      string `json:"reason"`
+}
+
+// Moves an execution from the queue to the dead-letter index
+func deadLetterWorkflowQueue(ctx context.Context, environment string, request shuffle.ExecutionRequest, attempts int, reason string) {
+	// Stored lowercased like the lease ID, so it's compared the same way everywhere
+	environment = strings.ToLower(environment)
+	id := getWorkflowQueueLeaseId(environment, request.ExecutionId)
+	log.Printf("[WARNING] Moving execution %s in %s to the dead-letter queue after %d attempts: %s", request.ExecutionId, environment, attempts, reason)
+
+	deadLetter := workflowQueueDeadLetter{
+		Id:          id,
+		ExecutionId: request.ExecutionId,
+		WorkflowId:  request.WorkflowId,
+		Environment: environment,
+		Attempts:    attempts,
+		Reason:      reason,
+		Request:     request,
+		Created:     time.Now().Unix(),
+	}
+
+	// The org decides who can see it
+	execution, err := shuffle.GetWorkflowExecution(ctx, request.ExecutionId)
+	if err == nil && len(execution.ExecutionOrg) > 0 {
+		deadLetter.OrgId = execution.ExecutionOrg
+	} else if env, err := shuffle.GetEnvironment(ctx, environment, ""); err == nil {
+		deadLetter.OrgId = env.OrgId
+	}
+
+	err = setEsDocument(ctx, "workflowqueue_deadletters", id, deadLetter)
+	if err != nil {
+		// Kept in the queue, so it isn't lost
+		log.Printf("[ERROR] Failed storing dead-letter for execution %s: %s", request.ExecutionId, err)
+		return
+	}
+
+	err = shuffle.DeleteKeys(ctx, fmt.Sprintf("workflowqueue-%s", environment), []string{request.ExecutionId})
+	if err != nil {
+		log.Printf("[ERROR] Failed removing dead-lettered execution %s from the queue: %s", request.ExecutionId, err)
+	}
+
+	ackWorkflowQueue(ctx, environment, []string{request.ExecutionId})
+}
+
+// The dead-letters of an org, newest first. An empty environment means all.
+func getWorkflowQueueDeadLetters(ctx context.Context, orgId, environment string) ([]workflowQueueDeadLetter, error) {
+	documents, err := searchEsDocuments(ctx, "workflowqueue_deadletters", map[string]interface{}{
+		"term": map[string]interface{}{
+			"org_id.keyword": orgId,
+		},
+	}, 1000)
+	if err != nil {
+		return []workflowQueueDeadLetter{}, err
+	}
+
+	deadLetters := []workflowQueueDeadLetter{}
+	for _, document := range documents {
+		deadLetter := workflowQueueDeadLetter{}
+		err = json.Unmarshal(document.Source, &deadLetter)
+		if err != nil {
+			log.Printf("[WARNING] Failed unmarshalling dead-letter %s: %s", document.Id, err)
+			continue
+		}
+
+		deadLetters = append(deadLetters, deadLetter)
+	}
+
+	sort.Slice(deadLetters, func(i, j int) bool {
+		return deadLetters[i].Created > deadLetters[j].Created
+	})
+
+	return filterWorkflowQueueDeadLetters(deadLetters, environment), nil
+}
+
+func filterWorkflowQueueDeadLetters(deadLetters []workflowQueueDeadLetter, environment string) []workflowQueueDeadLetter {
+	if len(environment) == 0 {
+		return deadLetters
+	}
+
+	filtered := []workflowQueueDeadLetter{}
+	for _, deadLetter := range deadLetters {
+		if deadLetter.Environment == strings.ToLower(environment) {
+			filtered = append(filtered, deadLetter)
+		}
+	}
+
+	return filtered
+}
+
+// The amount of dead-letters in each environment, by lowercased name
+func countWorkflowQueueDeadLetters(deadLetters []workflowQueueDeadLetter) map[string]int {
+	counts := map[string]int{}
+	for _, deadLetter := range deadLetters {
+		counts[deadLetter.Environment] += 1
+	}
+
+	return counts
+}
+
+// Gets a dead-letter the user's org owns
+func getWorkflowQueueDeadLetter(ctx context.Context, user shuffle.User, id string) (workflowQueueDeadLetter, error) {
+	deadLetter := workflowQueueDeadLetter{}
+	document, err := getEsDocument(ctx, "workflowqueue_deadletters", id)
+	if err != nil {
+		return deadLetter, err
+	}
+
+	err = json.Unmarshal(document.Source, &deadLetter)
+	if err != nil {
+		return deadLetter, err
+	}
+
+	if deadLetter.OrgId != user.ActiveOrg.Id {
+		return workflowQueueDeadLetter{}, errEsNotFound
+	}
+
+	return deadLetter, nil
+}
+
+// Only admins can see and handle failed deployments
+func getWorkflowQueueDeadLetterRequestUser(resp http.ResponseWriter, request *http.Request) (shuffle.User, bool) {
+	user, err := shuffle.HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in workflow queue dead-letters: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return user, false
+	}
+
+	if user.Role != "admin" {
+		log.Printf("[WARNING] Not admin during workflow queue dead-letters: %s (%s).", user.Username, user.Id)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Must be admin to handle failed deployments"}`))
+		return user, false
+	}
+
+	return user, true
+}
+
+// The queued execution Orborus reports as failed. With at-most-once delivery
+// it's confirmed, and gone from the queue, before it's deployed, so it's then
+// made from the execution the same way it was queued.
+func getDeadLetterExecutionRequest(ctx context.Context, environment shuffle.Environment, executionId string) (shuffle.ExecutionRequest, error) {
+	executionRequests, err := shuffle.GetWorkflowQueue(ctx, environment.Name, 1000)
+	if err == nil {
+		for _, executionRequest := range executionRequests.Data {
+			if executionRequest.ExecutionId == executionId {
+				return executionRequest, nil
+			}
+		}
+	}
+
+	execution, err := shuffle.GetWorkflowExecution(ctx, executionId)
+	if err != nil {
+		return shuffle.ExecutionRequest{}, err
+	}
+
+	if execution.ExecutionOrg != environment.OrgId {
+		return shuffle.ExecutionRequest{}, errEsNotFound
+	}
+
+	return shuffle.ExecutionRequest{
+		ExecutionId:   execution.ExecutionId,
+		WorkflowId:    execution.Workflow.ID,
+		Authorization: execution.Authorization,
+		Environments:  []string{environment.Name},
+		Priority:      execution.Priority,
+	}, nil
+}
+
+// POST /api/v1/workflows/queue/deadletter from Orborus, for an execution that
+// won't be delivered again
+func handleWorkflowqueueDeadLetter(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	// Same as getting the queue: the environment's name
+	id := request.Header.Get("Org-Id")
+	if len(id) == 0 {
+		log.Printf("[ERROR] No Org-Id header set - deadletter")
+		resp.WriteHeader(401)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Specify the org-id header."}`)))
+		return
+	}
+
+	ctx := shuffle.GetContext(request)
+	env, err := shuffle.GetEnvironment(ctx, id, "")
+	if err != nil || len(env.Id) == 0 || len(env.OrgId) == 0 {
+		log.Printf("[WARNING] No environment found matching %s - deadletter: %v", id, err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "No environment found matching the org-id header."}`))
+		return
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		log.Println("[WARNING] Failed reading body for workflow queue dead-letter")
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed reading body"}`))
+		return
+	}
+
+	var report workflowQueueDeadLetterReport
+	err = json.Unmarshal(body, &report)
+	if err != nil || len(report.ExecutionId) == 0 {
+		log.Printf("[WARNING] Failed workflow queue dead-letter unmarshaling: %v", err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Specify the execution_id to dead-letter"}`))
+		return
+	}
+
+	executionRequest, err := getDeadLetterExecutionRequest(ctx, *env, report.ExecutionId)
+	if err != nil {
+		log.Printf("[WARNING] Execution %s reported as failed in %s isn't queued there: %s", report.ExecutionId, id, err)
+		resp.WriteHeader(404)
+		resp.Write([]byte(`{"success": false, "reason": "Execution not found"}`))
+		return
+	}
+
+	attempts := 1
+	document, err := getEsDocument(ctx, "workflowqueue_leases", getWorkflowQueueLeaseId(id, report.ExecutionId))
+	if err == nil {
+		lease := workflowQueueLease{}
+		if json.Unmarshal(document.Source, &lease) == nil && lease.Attempts > 0 {
+			attempts = lease.Attempts
+		}
+	}
+
+	deadLetterWorkflowQueue(ctx, id, executionRequest, attempts, report.Reason)
+
+	resp.WriteHeader(200)
+	resp.Write([]byte(`{"success": true}`))
+}
+
+// GET /api/v1/workflows/queue/deadletters?environment=<name>. The counts
+// are for every environment, whichever one is listed.
+func handleGetWorkflowqueueDeadLetters(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, ok := getWorkflowQueueDeadLetterRequestUser(resp, request)
+	if !ok {
+		return
+	}
+
+	deadLetters, err := getWorkflowQueueDeadLetters(shuffle.GetContext(request), user.ActiveOrg.Id, "")
+	if err != nil {
+		log.Printf("[WARNING] Failed getting dead-letters for org %s: %s", user.ActiveOrg.Id, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed getting failed deployments"}`))
+		return
+	}
+
+	counts := countWorkflowQueueDeadLetters(deadLetters)
+	deadLetters = filterWorkflowQueueDeadLetters(deadLetters, request.URL.Query().Get("environment"))
+
+	// The authorization is only for the worker
+	for i := range deadLetters {
+		deadLetters[i].Request.Authorization = ""
+	}
+
+	newjson, err := json.Marshal(struct {
+		Success     bool                      `json:"success"`
+		DeadLetters []workflowQueueDeadLetter `json:"dead_letters"`
+		Counts      map[string]int            `json:"counts"`
+	}{
+		Success:     true,
+		DeadLetters: deadLetters,
+		Counts:      counts,
+	})
+	if err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed marshalling failed deployments"}`))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write(newjson)
+}
+
+// POST /api/v1/workflows/queue/deadletters/{id}/retry puts the execution back
+// in the queue with its attempts reset.
+// DELETE /api/v1/workflows/queue/deadletters/{id} discards it.
+func handleWorkflowqueueDeadLetterAction(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, ok := getWorkflowQueueDeadLetterRequestUser(resp, request)
+	if !ok {
+		return
+	}
+
+	location := strings.Split(request.URL.Path, "/")
+	if len(location) < 7 || len(location[6]) == 0 {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Dead-letter ID is missing"}`))
+		return
+	}
+
+	ctx := shuffle.GetContext(request)
+	deadLetter, err := getWorkflowQueueDeadLetter(ctx, user, location[6])
+	if err != nil {
+		resp.WriteHeader(404)
+		resp.Write([]byte(`{"success": false, "reason": "Failed deployment doesn't exist"}`))
+		return
+	}
+
+	if request.Method == "POST" {
+		err = shuffle.SetWorkflowQueue(ctx, deadLetter.Request, deadLetter.Environment)
+		if err != nil {
+			log.Printf("[ERROR] Failed re-adding dead-lettered execution %s to the queue: %s", deadLetter.ExecutionId, err)
+			resp.WriteHeader(500)
+			resp.Write([]byte(`{"success": false, "reason": "Failed adding the execution to the queue"}`))
+			return
+		}
+
+		// Starts the attempts over
+		ackWorkflowQueue(ctx, deadLetter.Environment, []string{deadLetter.ExecutionId})
+		notifyWorkflowQueue(deadLetter.Environment)
+		log.Printf("[AUDIT] User %s (%s) retried dead-lettered execution %s in %s", user.Username, user.Id, deadLetter.ExecutionId, deadLetter.Environment)
+	} else {
+		log.Printf("[AUDIT] User %s (%s) discarded dead-lettered execution %s in %s", user.Username, user.Id, deadLetter.ExecutionId, deadLetter.Environment)
+	}
+
+	err = deleteEsDocument(ctx, "workflowqueue_deadletters", deadLetter.Id)
+	if err != nil && err != errEsNotFound {
+		log.Printf("[WARNING] Failed removing dead-letter %s: %s", deadLetter.Id, err)
+	}
+
+	resp.WriteHeader(200)
+	resp.Write([]byte(fmt.Sprintf(`{"success": true, "id": "%s", "execution_id": "%s"}`, deadLetter.Id, deadLetter.ExecutionId)))
+}
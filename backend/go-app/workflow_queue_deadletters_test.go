@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func TestGetWorkflowQueueDeadLetters(t *testing.T) {
+	documents := startFakeOpensearch(t)
+	for _, deadLetter := range []workflowQueueDeadLetter{
+		{Id: "shuffle_old", ExecutionId: "old", OrgId: "org", Environment: "shuffle", Created: 1},
+		{Id: "shuffle_new", ExecutionId: "new", OrgId: "org", Environment: "shuffle", Created: 2},
+		{Id: "cloud_other", ExecutionId: "other", OrgId: "org", Environment: "cloud", Created: 3},
+	} {
+		documents["workflowqueue_deadletters/"+deadLetter.Id], _ = json.Marshal(deadLetter)
+	}
+
+	deadLetters, err := getWorkflowQueueDeadLetters(context.Background(), "org", "Shuffle")
+	if err != nil {
+		t.Fatalf("failed getting dead-letters: %s", err)
+	}
+
+	if len(deadLetters) != 2 || deadLetters[0].ExecutionId != "new" || deadLetters[1].ExecutionId != "old" {
+		t.Errorf("expected the environment's dead-letters newest first, got %#v", deadLetters)
+	}
+
+	deadLetters, _ = getWorkflowQueueDeadLetters(context.Background(), "org", "")
+	counts := countWorkflowQueueDeadLetters(deadLetters)
+	if len(counts) != 2 || counts["shuffle"] != 2 || counts["cloud"] != 1 {
+		t.Errorf("expected 2 dead-letters in shuffle and 1 in cloud, got %#v", counts)
+	}
+}
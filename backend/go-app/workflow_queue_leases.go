@@ -0,0 +1,291 @@
+package main
+
+// Leases for the workflow queue, used when Orborus sends X-Orborus-Lease.
+// Executions handed out are invisible to other requests until the lease runs
+// out after SHUFFLE_QUEUE_VISIBILITY_TIMEOUT seconds. Orborus acks them with
+// /queue/confirm when the worker is deployed, or nacks them with /queue/nack
+// to have them redelivered. Nacks for executions Orborus had no room for are
+// marked throttled and don't count as attempts. Executions delivered SHUFFLE_QUEUE_MAX_ATTEMPTS
+// times without an ack are dead-lettered (workflow_queue_deadletters.go).
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shuffle/shuffle-shared"
+)
+
+var workflowQueueVisibilityTimeout int64 = 120
+var workflowQueueMaxAttempts = 5
+
+// Seconds a nacked execution waits per attempt before it's redelivered
+var workflowQueueNackDelay int64 = 5
+
+type workflowQueueLease struct {
+	ExecutionId string `json:"execution_id"`
+	WorkflowId  string `json:"workflow_id"`
+	Environment string `json:"environment"`
+	Attempts    int    `json:"attempts"`
+	LeasedUntil int64  `json:"leased_until"`
+	Reason      string `json:"reason,omitempty"`
+	Created     int64  `json:"created"`
+	Updated     int64  `json:"updated"`
+}
+
+// The queue with the lease of each execution in it
+type workflowQueueLeaseResponse struct {
+	shuffle.ExecutionRequestWrapper
+	Leases []workflowQueueLease `json:"leases"`
+}
+
+// A nack from Orborus, with why the executions couldn't be handled.
+// Throttled is set when Orborus was full rather than failing.
+type workflowQueueNack struct {
+	Data      []shuffle.ExecutionRequest `json:"data"`
+	Reason    string                     `json:"reason"`
+	Throttled bool                       `json:"throttled"`
+}
+
+func init() {
+	if timeout, err := strconv.Atoi(os.Getenv("SHUFFLE_QUEUE_VISIBILITY_TIMEOUT")); err == nil && timeout > 0 {
+		workflowQueueVisibilityTimeout = int64(timeout)
+	}
+
+	if attempts, err := strconv.Atoi(os.Getenv("SHUFFLE_QUEUE_MAX_ATTEMPTS")); err == nil && attempts > 0 {
+		workflowQueueMaxAttempts = attempts
+	}
+}
+
+func getWorkflowQueueLeaseId(environment, executionId string) string {
+	return fmt.Sprintf("%s_%s", strings.ToLower(environment), executionId)
+}
+
+// The leases in an environment by lease ID
+func getWorkflowQueueLeases(ctx context.Context, environment string) (map[string]esDocument, error) {
+	leases := map[string]esDocument{}
+	documents, err := searchEsDocuments(ctx, "workflowqueue_leases", map[string]interface{}{
+		"term": map[string]interface{}{
+			"environment.keyword": strings.ToLower(environment),
+		},
+	}, 1000)
+	if err != nil {
+		return leases, err
+	}
+
+	for _, document := range documents {
+		leases[document.Id] = document
+	}
+
+	return leases, nil
+}
+
+// Leases up to limit executions that aren't leased already. If another
+// request leases an execution at the same time, only one of them gets it.
+// Returns the executions to deliver with their leases.
+func leaseWorkflowQueue(ctx context.Context, environment string, requests []shuffle.ExecutionRequest, limit int) ([]shuffle.ExecutionRequest, []workflowQueueLease) {
+	delivered := []shuffle.ExecutionRequest{}
+	leases := []workflowQueueLease{}
+
+	existingLeases, err := getWorkflowQueueLeases(ctx, environment)
+	if err != nil {
+		// Better delivering twice than not at all
+		log.Printf("[WARNING] Failed getting workflow queue leases for %s. Delivering without leases: %s", environment, err)
+		if len(requests) > limit {
+			requests = requests[:limit]
+		}
+
+		return requests, leases
+	}
+
+	timeNow := time.Now().Unix()
+	queued := map[string]bool{}
+	for _, request := range requests {
+		id := getWorkflowQueueLeaseId(environment, request.ExecutionId)
+		queued[id] = true
+		if len(delivered) >= limit {
+			continue
+		}
+
+		lease := workflowQueueLease{
+			ExecutionId: request.ExecutionId,
+			WorkflowId:  request.WorkflowId,
+			Environment: strings.ToLower(environment),
+			Created:     timeNow,
+		}
+
+		document, found := existingLeases[id]
+		if found {
+			err = json.Unmarshal(document.Source, &lease)
+			if err != nil {
+				log.Printf("[WARNING] Failed unmarshalling workflow queue lease %s: %s", id, err)
+			}
+
+			if lease.LeasedUntil > timeNow {
+				continue
+			}
+		}
+
+		if lease.Attempts >= workflowQueueMaxAttempts {
+			reason := lease.Reason
+			if len(reason) == 0 {
+				reason = fmt.Sprintf("Not confirmed after %d deliveries", lease.Attempts)
+			}
+
+			deadLetterWorkflowQueue(ctx, environment, request, lease.Attempts, reason)
+			continue
+		}
+
+		lease.Attempts += 1
+		lease.LeasedUntil = timeNow + workflowQueueVisibilityTimeout
+		lease.Updated = timeNow
+		if found {
+			err = updateEsDocumentIfUnchanged(ctx, "workflowqueue_leases", &document, lease)
+		} else {
+			err = createEsDocument(ctx, "workflowqueue_leases", id, lease)
+		}
+
+		if err == errEsConflict {
+			// Leased by another request in the meantime
+			continue
+		} else if err != nil {
+			log.Printf("[WARNING] Failed leasing execution %s in %s. Delivering without lease: %s", request.ExecutionId, environment, err)
+		}
+
+		if lease.Attempts > 1 {
+			log.Printf("[INFO] Redelivering execution %s to %s (attempt %d of %d)", request.ExecutionId, environment, lease.Attempts, workflowQueueMaxAttempts)
+		}
+
+		delivered = append(delivered, request)
+		leases = append(leases, lease)
+	}
+
+	// Leases for executions that left the queue some other way
+	for id, document := range existingLeases {
+		if queued[id] {
+			continue
+		}
+
+		lease := workflowQueueLease{}
+		err = json.Unmarshal(document.Source, &lease)
+		if err == nil && lease.LeasedUntil < timeNow-3600 {
+			deleteEsDocument(ctx, "workflowqueue_leases", id)
+		}
+	}
+
+	return delivered, leases
+}
+
+// Removes the leases of executions that were acked
+func ackWorkflowQueue(ctx context.Context, environment string, executionIds []string) {
+	for _, executionId := range executionIds {
+		err := deleteEsDocument(ctx, "workflowqueue_leases", getWorkflowQueueLeaseId(environment, executionId))
+		if err != nil && err != errEsNotFound {
+			log.Printf("[WARNING] Failed removing workflow queue lease for %s in %s: %s", executionId, environment, err)
+		}
+	}
+}
+
+// Makes executions visible again after a delay that grows with the attempts.
+// Executions out of attempts are dead-lettered right away. Throttled
+// executions get their attempt back and are redelivered after the base delay.
+func nackWorkflowQueue(ctx context.Context, environment string, requests []shuffle.ExecutionRequest, reason string, throttled bool) {
+	timeNow := time.Now().Unix()
+	for _, request := range requests {
+		id := getWorkflowQueueLeaseId(environment, request.ExecutionId)
+		document, err := getEsDocument(ctx, "workflowqueue_leases", id)
+		if err != nil {
+			if err != errEsNotFound {
+				log.Printf("[WARNING] Failed getting workflow queue lease %s: %s", id, err)
+			}
+
+			continue
+		}
+
+		lease := workflowQueueLease{}
+		err = json.Unmarshal(document.Source, &lease)
+		if err != nil {
+			log.Printf("[WARNING] Failed unmarshalling workflow queue lease %s: %s", id, err)
+			continue
+		}
+
+		delay := workflowQueueNackDelay
+		if throttled {
+			if lease.Attempts > 0 {
+				lease.Attempts -= 1
+			}
+		} else {
+			if len(reason) > 0 {
+				lease.Reason = reason
+			}
+
+			if lease.Attempts >= workflowQueueMaxAttempts {
+				deadLetterWorkflowQueue(ctx, environment, request, lease.Attempts, lease.Reason)
+				continue
+			}
+
+			delay = int64(lease.Attempts) * workflowQueueNackDelay
+		}
+
+		if delay > workflowQueueVisibilityTimeout {
+			delay = workflowQueueVisibilityTimeout
+		}
+
+		lease.LeasedUntil = timeNow + delay
+		lease.Updated = timeNow
+		err = updateEsDocumentIfUnchanged(ctx, "workflowqueue_leases", document, lease)
+		if err != nil {
+			log.Printf("[WARNING] Failed nacking execution %s in %s: %s", request.ExecutionId, environment, err)
+		}
+	}
+}
+
+func handleWorkflowqueueNack(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	// Same as confirm: the environment's name
+	id := request.Header.Get("Org-Id")
+	if len(id) == 0 {
+		log.Printf("[ERROR] No Org-Id header set - nack")
+		resp.WriteHeader(401)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Specify the org-id header."}`)))
+		return
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		log.Println("[WARNING] Failed reading body for workflow queue nack")
+		resp.WriteHeader(500)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+		return
+	}
+
+	var nack workflowQueueNack
+	err = json.Unmarshal(body, &nack)
+	if err != nil {
+		log.Printf("[WARNING] Failed workflow queue nack unmarshaling: %s", err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+		return
+	}
+
+	if len(nack.Data) == 0 {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "No executions to nack"}`))
+		return
+	}
+
+	nackWorkflowQueue(shuffle.GetContext(request), id, nack.Data, nack.Reason, nack.Throttled)
+
+	resp.WriteHeader(200)
+	resp.Write([]byte(`{"success": true}`))
+}
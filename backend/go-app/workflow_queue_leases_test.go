@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/shuffle/shuffle-shared"
+)
+
+// Keeps documents in memory, with just enough of the Opensearch API for leases
+func startFakeOpensearch(t *testing.T) map[string]json.RawMessage {
+	documents := map[string]json.RawMessage{}
+	var lock sync.Mutex
+
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, request *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		body, _ := ioutil.ReadAll(request.Body)
+		parts := strings.Split(strings.Trim(request.URL.Path, "/"), "/")
+		if len(parts) == 2 && parts[1] == "_search" {
+			hits := []map[string]interface{}{}
+			for key, source := range documents {
+				if strings.HasPrefix(key, parts[0]+"/") {
+					hits = append(hits, map[string]interface{}{"_id": strings.TrimPrefix(key, parts[0]+"/"), "_source": source})
+				}
+			}
+
+			json.NewEncoder(resp).Encode(map[string]interface{}{"hits": map[string]interface{}{"hits": hits}})
+			return
+		}
+
+		if len(parts) != 3 {
+			resp.WriteHeader(400)
+			return
+		}
+
+		key := fmt.Sprintf("%s/%s", parts[0], parts[2])
+		_, exists := documents[key]
+		switch {
+		case request.Method == "PUT" && parts[1] == "_create" && exists:
+			resp.WriteHeader(409)
+		case request.Method == "PUT":
+			documents[key] = body
+		case request.Method == "DELETE":
+			delete(documents, key)
+		case !exists:
+			resp.WriteHeader(404)
+		default:
+			json.NewEncoder(resp).Encode(map[string]interface{}{"_id": parts[2], "found": true, "_source": documents[key]})
+		}
+	}))
+
+	os.Setenv("SHUFFLE_OPENSEARCH_URL", server.URL)
+	t.Cleanup(func() {
+		os.Unsetenv("SHUFFLE_OPENSEARCH_URL")
+		server.Close()
+	})
+
+	return documents
+}
+
+func TestLeaseWorkflowQueue(t *testing.T) {
+	documents := startFakeOpensearch(t)
+	ctx := context.Background()
+	requests := []shuffle.ExecutionRequest{
+		{ExecutionId: "first", WorkflowId: "workflow"},
+		{ExecutionId: "second", WorkflowId: "workflow"},
+	}
+
+	delivered, leases := leaseWorkflowQueue(ctx, "Shuffle", requests, 1)
+	if len(delivered) != 1 || delivered[0].ExecutionId != "first" || len(leases) != 1 || leases[0].Attempts != 1 {
+		t.Fatalf("expected only the first execution on its first attempt, got %#v", leases)
+	}
+
+	delivered, _ = leaseWorkflowQueue(ctx, "Shuffle", requests, 10)
+	if len(delivered) != 1 || delivered[0].ExecutionId != "second" {
+		t.Fatalf("expected the leased execution to be invisible, got %#v", delivered)
+	}
+
+	// Makes it visible again right away
+	nackWorkflowQueue(ctx, "Shuffle", requests[:1], "Failed deploying", false)
+	lease := workflowQueueLease{}
+	json.Unmarshal(documents["workflowqueue_leases/shuffle_first"], &lease)
+	lease.LeasedUntil = 0
+	documents["workflowqueue_leases/shuffle_first"], _ = json.Marshal(lease)
+
+	delivered, leases = leaseWorkflowQueue(ctx, "Shuffle", requests, 10)
+	if len(delivered) != 1 || leases[0].Attempts != 2 || leases[0].Reason != "Failed deploying" {
+		t.Fatalf("expected the nacked execution to be redelivered, got %#v", leases)
+	}
+
+	ackWorkflowQueue(ctx, "Shuffle", []string{"first", "second"})
+	if len(documents) != 0 {
+		t.Errorf("expected acked leases to be removed, got %d", len(documents))
+	}
+}
+
+// Orborus being full isn't a failure, so the execution is never dead-lettered
+func TestNackThrottledWorkflowQueue(t *testing.T) {
+	documents := startFakeOpensearch(t)
+	ctx := context.Background()
+	requests := []shuffle.ExecutionRequest{{ExecutionId: "busy", WorkflowId: "workflow"}}
+
+	for i := 0; i < workflowQueueMaxAttempts+2; i++ {
+		delivered, leases := leaseWorkflowQueue(ctx, "Shuffle", requests, 10)
+		if len(delivered) != 1 || leases[0].Attempts != 1 {
+			t.Fatalf("expected delivery %d to be the first attempt, got %#v", i, leases)
+		}
+
+		nackWorkflowQueue(ctx, "Shuffle", requests, "At capacity", true)
+
+		lease := workflowQueueLease{}
+		json.Unmarshal(documents["workflowqueue_leases/shuffle_busy"], &lease)
+		if lease.Attempts != 0 || len(lease.Reason) > 0 {
+			t.Fatalf("expected the throttled nack to give the attempt back, got %#v", lease)
+		}
+
+		lease.LeasedUntil = 0
+		documents["workflowqueue_leases/shuffle_busy"], _ = json.Marshal(lease)
+	}
+
+	for key := range documents {
+		if strings.HasPrefix(key, "workflowqueue_deadletters/") {
+			t.Errorf("expected no dead-letters for throttled executions, got %s", key)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/shuffle/shuffle-shared"
+)
+
+func TestSortExecutionRequests(t *testing.T) {
+	now := int64(10000)
+	requests := []shuffle.ExecutionRequest{
+		{ExecutionId: "bulk-new", Priority: 10},
+		{ExecutionId: "incident", Priority: 20},
+		{ExecutionId: "bulk-old", Priority: 10},
+		{ExecutionId: "bulk-waiting", Priority: 10},
+	}
+
+	firstSeen := map[string]int64{
+		"bulk-new":     now,
+		"incident":     now,
+		"bulk-old":     now - workflowQueueAging*15,
+		"bulk-waiting": now - workflowQueueAging*2,
+	}
+
+	requests = sortExecutionRequests(requests, firstSeen, now)
+	expected := []string{"bulk-old", "incident", "bulk-waiting", "bulk-new"}
+	for i, executionId := range expected {
+		if requests[i].ExecutionId != executionId {
+			t.Fatalf("expected %s at %d, got %s", executionId, i, requests[i].ExecutionId)
+		}
+	}
+}
+
+func TestGetWorkflowQueueWait(t *testing.T) {
+	for path, expected := range map[string]time.Duration{
+		"/api/v1/workflows/queue":           0,
+		"/api/v1/workflows/queue?wait=abc":  0,
+		"/api/v1/workflows/queue?wait=10":   10 * time.Second,
+		"/api/v1/workflows/queue?wait=3600": maxWorkflowQueueWait,
+	} {
+		if wait := getWorkflowQueueWait(httptest.NewRequest("GET", path, nil)); wait != expected {
+			t.Errorf("expected %s for %s, got %s", expected, path, wait)
+		}
+	}
+}
+
+func TestGetWorkflowQueueLimit(t *testing.T) {
+	for path, expected := range map[string]int{
+		"/api/v1/workflows/queue":          maxWorkflowQueueLimit,
+		"/api/v1/workflows/queue?limit=0":  maxWorkflowQueueLimit,
+		"/api/v1/workflows/queue?limit=3":  3,
+		"/api/v1/workflows/queue?limit=99": maxWorkflowQueueLimit,
+	} {
+		if limit := getWorkflowQueueLimit(httptest.NewRequest("GET", path, nil)); limit != expected {
+			t.Errorf("expected %d for %s, got %d", expected, path, limit)
+		}
+	}
+}
+
+func TestNotifyWorkflowQueue(t *testing.T) {
+	signal := getWorkflowQueueSignal("Shuffle")
+	notifyWorkflowQueue("other")
+
+	select {
+	case <-signal:
+		t.Fatalf("expected only the other environment to be notified")
+	default:
+	}
+
+	notifyWorkflowQueue("shuffle")
+	select {
+	case <-signal:
+	case <-time.After(time.Second):
+		t.Fatalf("expected the environment to be notified")
+	}
+
+	if getWorkflowQueueSignal("Shuffle") == signal {
+		t.Errorf("expected a new signal after notifying")
+	}
+}
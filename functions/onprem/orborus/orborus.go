@@ -25,6 +25,7 @@ import (
 	"os"
 	"os/exec"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -76,6 +77,18 @@ var dockerSwarmBridgeInterface = os.Getenv("SHUFFLE_SWARM_BRIDGE_DEFAULT_INTERFA
 var isKubernetes = os.Getenv("IS_KUBERNETES")
 var maxCPUPercent = 95
 
+// Executions with at least this priority may use the slots reserved for
+// high priority, and executions gain a point of priority for every
+// queueAging seconds they've been seen in the queue
+var highPriority = 11
+var reservedPrioritySlots = 0
+var queueAging int64 = 60
+
+// Seconds the backend may hold a queue request until executions come in.
+// Backends that don't support it answer right away, and Orborus sleeps
+// between requests like before.
+var longPollWait = 20
+
 // var baseimagename = "docker.pkg.github.com/shuffle/shuffle"
 // var baseimagename = "ghcr.io/frikky"
 // var baseimagename = "shuffle/shuffle"
@@ -102,7 +115,48 @@ var swarmNetworkName = os.Getenv("SHUFFLE_SWARM_NETWORK_NAME")
 var orborusLabel = os.Getenv("SHUFFLE_ORBORUS_LABEL")
 var memcached = os.Getenv("SHUFFLE_MEMCACHED")
 
-var executionIds = []string{}
+// When executions were deployed. Executions delivered again within the
+// worker timeout are only confirmed again, so a confirmation that failed
+// doesn't lead to a second worker.
+var deployedExecutions = map[string]int64{}
+
+// With leases, the backend hides delivered executions until they're
+// confirmed (acked) or nacked, and redelivers them if neither happens.
+// queueDelivery is "at-least-once" to confirm after the worker is deployed,
+// or "at-most-once" to confirm before, so an execution is never deployed
+// twice but is lost if the deployment fails.
+var queueLease = strings.ToLower(os.Getenv("SHUFFLE_ORBORUS_QUEUE_LEASE")) != "false"
+var queueDelivery = strings.ToLower(os.Getenv("SHUFFLE_ORBORUS_QUEUE_DELIVERY"))
+
+// When executions were first seen in the queue, for aging
+var queueFirstSeen = map[string]int64{}
+
+// Prometheus metrics, served on /metrics at SHUFFLE_ORBORUS_METRICS_PORT
+// when it's set. They're written in the text format by hand, so Orborus doesn't need the
+// Prometheus client.
+type orborusMetrics struct {
+	lock sync.Mutex
+
+	// Counters by series, e.g. shuffle_orborus_backend_errors_total{type="request"}
+	counters map[string]uint64
+
+	pollBuckets []float64
+	pollCounts  []uint64
+	pollSum     float64
+	pollCount   uint64
+}
+
+var metrics = &orborusMetrics{
+	counters:    map[string]uint64{},
+	pollBuckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	pollCounts:  make([]uint64, 9),
+}
+
+// Off unless SHUFFLE_ORBORUS_METRICS_PORT is set. Either a port or host:port
+var metricsPort = ""
+
+// Used when getting the running workers for a scrape
+var metricsWorkerTimeout = 600
 
 var dockercli *dockerclient.Client
 var containerId string
@@ -1229,6 +1283,291 @@ func cleanup() {
 }
 
 // Initial loop etc
+// Orders executions by their priority, including what they've gained from
+// waiting. Executions with the same priority keep the order they were first
+// seen in.
+func sortExecutionRequests(requests []shuffle.ExecutionRequest) []shuffle.ExecutionRequest {
+	now := time.Now().Unix()
+	for _, execution := range requests {
+		if _, ok := queueFirstSeen[execution.ExecutionId]; !ok {
+			queueFirstSeen[execution.ExecutionId] = now
+		}
+	}
+
+	// Executions not seen for a while are no longer queued
+	for executionId, firstSeen := range queueFirstSeen {
+		if firstSeen < now-3600 && !executionRequestsContain(requests, executionId) {
+			delete(queueFirstSeen, executionId)
+		}
+	}
+
+	getPriority := func(execution shuffle.ExecutionRequest) int64 {
+		return int64(execution.Priority) + (now-queueFirstSeen[execution.ExecutionId])/queueAging
+	}
+
+	sort.SliceStable(requests, func(i, j int) bool {
+		first := getPriority(requests[i])
+		second := getPriority(requests[j])
+		if first != second {
+			return first > second
+		}
+
+		return queueFirstSeen[requests[i].ExecutionId] < queueFirstSeen[requests[j].ExecutionId]
+	})
+
+	return requests
+}
+
+func executionRequestsContain(requests []shuffle.ExecutionRequest, executionId string) bool {
+	for _, execution := range requests {
+		if execution.ExecutionId == executionId {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Picks the executions to start when running workers are already running.
+// Executions below highPriority can't use the reservedPrioritySlots.
+func admitExecutionRequests(requests []shuffle.ExecutionRequest, running int) []shuffle.ExecutionRequest {
+	admitted := []shuffle.ExecutionRequest{}
+	for _, execution := range requests {
+		limit := maxConcurrency
+		if execution.Priority < highPriority {
+			limit = maxConcurrency - reservedPrioritySlots
+		}
+
+		if running+len(admitted) >= limit {
+			continue
+		}
+
+		admitted = append(admitted, execution)
+	}
+
+	return admitted
+}
+
+func (m *orborusMetrics) add(series string, value uint64) {
+	m.lock.Lock()
+	m.counters[series] += value
+	m.lock.Unlock()
+}
+
+func (m *orborusMetrics) addBackendError(errorType string) {
+	m.add(fmt.Sprintf(`shuffle_orborus_backend_errors_total{type="%s"}`, errorType), 1)
+}
+
+func (m *orborusMetrics) observePoll(duration time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	seconds := duration.Seconds()
+	for i, bucket := range m.pollBuckets {
+		if seconds <= bucket {
+			m.pollCounts[i] += 1
+		}
+	}
+
+	m.pollSum += seconds
+	m.pollCount += 1
+}
+
+// Writes the metrics in the Prometheus text format
+func (m *orborusMetrics) write(writer io.Writer, runningWorkers int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	fmt.Fprintf(writer, "# HELP shuffle_orborus_queue_poll_duration_seconds Time to get the queue from the backend, including long-polls held by the backend.\n")
+	fmt.Fprintf(writer, "# TYPE shuffle_orborus_queue_poll_duration_seconds histogram\n")
+	for i, bucket := range m.pollBuckets {
+		fmt.Fprintf(writer, "shuffle_orborus_queue_poll_duration_seconds_bucket{le=\"%s\"} %d\n", strconv.FormatFloat(bucket, 'f', -1, 64), m.pollCounts[i])
+	}
+	fmt.Fprintf(writer, "shuffle_orborus_queue_poll_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.pollCount)
+	fmt.Fprintf(writer, "shuffle_orborus_queue_poll_duration_seconds_sum %s\n", strconv.FormatFloat(m.pollSum, 'f', -1, 64))
+	fmt.Fprintf(writer, "shuffle_orborus_queue_poll_duration_seconds_count %d\n", m.pollCount)
+
+	families := []struct {
+		name string
+		help string
+	}{
+		{"shuffle_orborus_backend_errors_total", "Failed requests to the backend by type."},
+		{"shuffle_orborus_executions_dequeued_total", "Executions taken from the queue to be deployed."},
+		{"shuffle_orborus_executions_deployed_total", "Executions deployed as workers."},
+		{"shuffle_orborus_executions_failed_total", "Executions that failed to deploy."},
+		{"shuffle_orborus_cpu_throttled_total", "Polls skipped because CPU usage was above SHUFFLE_MAX_CPU."},
+		{"shuffle_orborus_zombie_containers_removed_total", "Containers removed by the zombie check."},
+	}
+
+	series := []string{}
+	for key := range m.counters {
+		series = append(series, key)
+	}
+	sort.Strings(series)
+
+	for _, family := range families {
+		fmt.Fprintf(writer, "# HELP %s %s\n", family.name, family.help)
+		fmt.Fprintf(writer, "# TYPE %s counter\n", family.name)
+
+		found := false
+		for _, key := range series {
+			if key == family.name || strings.HasPrefix(key, family.name+"{") {
+				fmt.Fprintf(writer, "%s %d\n", key, m.counters[key])
+				found = true
+			}
+		}
+
+		// Counters without labels start at 0
+		if !found && family.name != "shuffle_orborus_backend_errors_total" {
+			fmt.Fprintf(writer, "%s 0\n", family.name)
+		}
+	}
+
+	fmt.Fprintf(writer, "# HELP shuffle_orborus_running_workers Workers running right now.\n")
+	fmt.Fprintf(writer, "# TYPE shuffle_orborus_running_workers gauge\n")
+	fmt.Fprintf(writer, "shuffle_orborus_running_workers %d\n", runningWorkers)
+	fmt.Fprintf(writer, "# HELP shuffle_orborus_max_concurrency The most workers Orborus runs at once.\n")
+	fmt.Fprintf(writer, "# TYPE shuffle_orborus_max_concurrency gauge\n")
+	fmt.Fprintf(writer, "shuffle_orborus_max_concurrency %d\n", maxConcurrency)
+}
+
+func handleMetrics(resp http.ResponseWriter, request *http.Request) {
+	ctx, cancel := context.WithTimeout(request.Context(), 10*time.Second)
+	defer cancel()
+
+	runningWorkers := getRunningWorkers(ctx, metricsWorkerTimeout)
+	resp.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics.write(resp, runningWorkers)
+}
+
+// Serves /metrics for Prometheus to scrape
+func startMetricsServer() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", handleMetrics)
+
+	address := metricsPort
+	if !strings.Contains(address, ":") {
+		address = fmt.Sprintf(":%s", metricsPort)
+	}
+
+	log.Printf("[INFO] Serving Prometheus metrics on %s at /metrics", address)
+	err := http.ListenAndServe(address, mux)
+	if err != nil {
+		log.Printf("[ERROR] Metrics server stopped: %s", err)
+	}
+}
+
+// Posts executions to /api/v1/workflows/queue/<endpoint>
+func sendQueueRequest(client *http.Client, endpoint string, data []byte) (err error) {
+	defer func() {
+		if err != nil {
+			metrics.addBackendError(endpoint)
+		}
+	}()
+
+	queueUrl := fmt.Sprintf("%s/api/v1/workflows/queue/%s", baseUrl, endpoint)
+	req, err := http.NewRequest(
+		"POST",
+		queueUrl,
+		bytes.NewBuffer(data),
+	)
+
+	if err != nil {
+		return err
+	}
+
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Org-Id", environment)
+
+	if len(auth) > 0 {
+		req.Header.Add("Authorization", auth)
+	}
+
+	if len(org) > 0 {
+		req.Header.Add("Org", org)
+	}
+
+	if len(orborusLabel) > 0 {
+		req.Header.Add("X-Orborus-Label", orborusLabel)
+	}
+
+	if queueLease {
+		req.Header.Add("X-Orborus-Lease", "true")
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != 200 {
+		return errors.New(fmt.Sprintf("Bad status code %d from %s: %s", resp.StatusCode, queueUrl, string(body)))
+	}
+
+	return nil
+}
+
+// Removes executions from the queue (ack)
+func confirmExecutionRequests(client *http.Client, requests shuffle.ExecutionRequestWrapper) error {
+	data, err := json.Marshal(requests)
+	if err != nil {
+		return err
+	}
+
+	return sendQueueRequest(client, "confirm", data)
+}
+
+// Has the backend redeliver executions (nack). Only works with leases.
+// Throttled executions weren't deployed because Orborus was full, and don't
+// count as failed attempts.
+func nackExecutionRequests(client *http.Client, requests []shuffle.ExecutionRequest, reason string, throttled bool) error {
+	data, err := json.Marshal(map[string]interface{}{
+		"data":      requests,
+		"reason":    reason,
+		"throttled": throttled,
+	})
+	if err != nil {
+		return err
+	}
+
+	return sendQueueRequest(client, "nack", data)
+}
+
+// The query for the queue: how long the backend may wait for executions, and
+// how many there's room for. 0 leaves the limit to the backend.
+func getQueueQuery(limit int) string {
+	query := []string{}
+	if longPollWait > 0 {
+		query = append(query, fmt.Sprintf("wait=%d", longPollWait))
+	}
+
+	if limit > 0 {
+		query = append(query, fmt.Sprintf("limit=%d", limit))
+	}
+
+	return strings.Join(query, "&")
+}
+
+// Records an execution that won't be delivered again as a failed deployment,
+// so it can be retried from the backend
+func deadLetterExecutionRequest(client *http.Client, executionId string, reason string) error {
+	data, err := json.Marshal(map[string]string{
+		"execution_id": executionId,
+		"reason":       reason,
+	})
+	if err != nil {
+		return err
+	}
+
+	return sendQueueRequest(client, "deadletter", data)
+}
+
 func main() {
 	//sigCh := make(chan os.Signal, 1)
 	//signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
@@ -1357,16 +1696,36 @@ func main() {
 
 	zombiecheck(ctx, workerTimeout)
 
+	metricsWorkerTimeout = workerTimeout
+	metricsPort = strings.TrimSpace(os.Getenv("SHUFFLE_ORBORUS_METRICS_PORT"))
+	if len(metricsPort) > 0 && metricsPort != "0" && metricsPort != "false" {
+		go startMetricsServer()
+	}
+
+	if len(os.Getenv("SHUFFLE_ORBORUS_LONG_POLL")) > 0 {
+		tmpInt, err := strconv.Atoi(os.Getenv("SHUFFLE_ORBORUS_LONG_POLL"))
+		if err == nil && tmpInt >= 0 {
+			longPollWait = tmpInt
+		} else {
+			log.Printf("[WARNING] Env SHUFFLE_ORBORUS_LONG_POLL must be a number of seconds, not %s. Defaulted to %d", os.Getenv("SHUFFLE_ORBORUS_LONG_POLL"), longPollWait)
+		}
+	}
+
 	client := shuffle.GetExternalClient(baseUrl)
 	fullUrl := fmt.Sprintf("%s/api/v1/workflows/queue", baseUrl)
 	log.Printf("[INFO] Finished configuring docker environment. Connecting to %s", fullUrl)
 
+	requestUrl := fullUrl
+	if query := getQueueQuery(0); len(query) > 0 {
+		requestUrl = fmt.Sprintf("%s?%s", fullUrl, query)
+	}
+
 	forwardData := bytes.NewBuffer([]byte{})
 	forwardMethod := "POST"
 
 	req, err := http.NewRequest(
 		forwardMethod,
-		fullUrl,
+		requestUrl,
 		forwardData,
 	)
 
@@ -1392,6 +1751,15 @@ func main() {
 		req.Header.Add("X-Orborus-Label", orborusLabel)
 	}
 
+	if queueLease {
+		req.Header.Add("X-Orborus-Lease", "true")
+	}
+
+	if queueDelivery != "at-most-once" {
+		queueDelivery = "at-least-once"
+	}
+	log.Printf("[INFO] Delivering executions %s", queueDelivery)
+
 	if swarmConfig != "run" && swarmConfig != "swarm" {
 		req.Header.Add("X-Orborus-Runmode", "Default")
 	} else {
@@ -1406,6 +1774,32 @@ func main() {
 		}
 	}
 
+	if len(os.Getenv("SHUFFLE_ORBORUS_HIGH_PRIORITY")) > 0 {
+		tmpInt, err := strconv.Atoi(os.Getenv("SHUFFLE_ORBORUS_HIGH_PRIORITY"))
+		if err == nil {
+			highPriority = tmpInt
+		} else {
+			log.Printf("[WARNING] Env SHUFFLE_ORBORUS_HIGH_PRIORITY must be a number, not %s. Defaulted to %d", os.Getenv("SHUFFLE_ORBORUS_HIGH_PRIORITY"), highPriority)
+		}
+	}
+
+	if len(os.Getenv("SHUFFLE_ORBORUS_RESERVED_SLOTS")) > 0 {
+		tmpInt, err := strconv.Atoi(os.Getenv("SHUFFLE_ORBORUS_RESERVED_SLOTS"))
+		if err == nil && tmpInt >= 0 && tmpInt < maxConcurrency {
+			reservedPrioritySlots = tmpInt
+			log.Printf("[INFO] Reserving %d of %d concurrent executions for priority %d and above", reservedPrioritySlots, maxConcurrency, highPriority)
+		} else {
+			log.Printf("[WARNING] Env SHUFFLE_ORBORUS_RESERVED_SLOTS must be a number below the max concurrency (%d), not %s", maxConcurrency, os.Getenv("SHUFFLE_ORBORUS_RESERVED_SLOTS"))
+		}
+	}
+
+	if len(os.Getenv("SHUFFLE_QUEUE_AGING")) > 0 {
+		tmpInt, err := strconv.Atoi(os.Getenv("SHUFFLE_QUEUE_AGING"))
+		if err == nil && tmpInt > 0 {
+			queueAging = int64(tmpInt)
+		}
+	}
+
 	swarmPollingTime := time.Now()
 	swarmRequestsMade := 0
 	swarmControlMode := false
@@ -1415,6 +1809,11 @@ func main() {
 
 	log.Printf("[INFO] Waiting for executions at %s with Environment %#v", fullUrl, environment)
 	hasStarted := false
+	longPolling := false
+	leased := false
+
+	// Confirmations that failed, sent again with the next ones
+	var pendingConfirms shuffle.ExecutionRequestWrapper
 	for {
 		if req.Method == "POST" {
 			// Should find data to send (memory etc.)
@@ -1433,16 +1832,44 @@ func main() {
 			}
 
 			if int(orborusStats.CPUPercent) > maxCPUPercent {
+				metrics.add("shuffle_orborus_cpu_throttled_total", 1)
 				log.Printf("[DEBUG] CPU usage is at %f%%. This is more than the max limit the machine should be running at (%d). Waiting before continue.", orborusStats.CPUPercent, maxCPUPercent)
 				time.Sleep(time.Duration(sleepTime) * time.Second)
 				continue
 			}
 		}
 
+		// Only asks for executions there's room for, so none are leased just
+		// to wait for the lease to run out
+		if queueLease && swarmConfig != "run" && swarmConfig != "swarm" {
+			executionCount = getRunningWorkers(ctx, workerTimeout)
+			if executionCount >= maxConcurrency {
+				zombiecounter += 1
+				if zombiecounter*sleepTime > workerTimeout {
+					go zombiecheck(ctx, workerTimeout)
+					zombiecounter = 0
+				}
+				time.Sleep(time.Duration(sleepTime) * time.Second)
+				continue
+			}
+
+			req.URL.RawQuery = getQueueQuery(maxConcurrency - executionCount)
+		}
+
+		pollStart := time.Now()
 		newresp, err := client.Do(req)
 		if err != nil {
+			metrics.addBackendError("request")
 			log.Printf("[WARNING] Failed making request to %s: %s", fullUrl, err)
 
+			// E.g. a proxy or client timeout shorter than the wait
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() && longPolling {
+				log.Printf("[WARNING] Long-polling timed out. Falling back to polling every %d seconds. Set SHUFFLE_ORBORUS_LONG_POLL to a lower number to keep long-polling.", sleepTime)
+				longPollWait = 0
+				req.URL.RawQuery = getQueueQuery(0)
+				longPolling = false
+			}
+
 			zombiecounter += 1
 			if zombiecounter*sleepTime > workerTimeout {
 				go zombiecheck(ctx, workerTimeout)
@@ -1463,8 +1890,18 @@ func main() {
 			continue
 		}
 
+		// Only long-poll with backends that say they support it
+		longPolling = longPollWait > 0 && len(newresp.Header.Get("X-Shuffle-Queue-Wait")) > 0
+		if queueLease && !leased && len(newresp.Header.Get("X-Shuffle-Queue-Lease")) > 0 {
+			log.Printf("[INFO] The backend leases executions for %s seconds until they're confirmed", newresp.Header.Get("X-Shuffle-Queue-Lease"))
+		}
+		leased = queueLease && len(newresp.Header.Get("X-Shuffle-Queue-Lease")) > 0
+
 		body, err := ioutil.ReadAll(newresp.Body)
+		newresp.Body.Close()
+		metrics.observePoll(time.Since(pollStart))
 		if err != nil {
+			metrics.addBackendError("read")
 			log.Printf("[ERROR] Failed reading body from Shuffle: %s", err)
 			zombiecounter += 1
 			if zombiecounter*sleepTime > workerTimeout {
@@ -1477,6 +1914,7 @@ func main() {
 
 		// FIXME - add check for StatusCode
 		if newresp.StatusCode != 200 {
+			metrics.addBackendError("status")
 			log.Printf("[ERROR] Backend connection failed, or is missing (%d): %s", newresp.StatusCode, string(body))
 		} else {
 			if !hasStarted {
@@ -1489,6 +1927,7 @@ func main() {
 		var executionRequests shuffle.ExecutionRequestWrapper
 		err = json.Unmarshal(body, &executionRequests)
 		if err != nil {
+			metrics.addBackendError("parse")
 			log.Printf("[WARNING] Failed executionrequest in queue unmarshaling: %s", err)
 			sleepTime = 10
 			zombiecounter += 1
@@ -1505,21 +1944,41 @@ func main() {
 			// Type string `json:"type"`
 		}
 
+		// Highest priority first, so throttling cuts the lower priority ones
+		executionRequests.Data = sortExecutionRequests(executionRequests.Data)
+
 		// Skipping throttling with swarm
 		if swarmConfig != "run" && swarmConfig != "swarm" {
 			if len(executionRequests.Data) == 0 {
 				zombiecounter += 1
+				if longPolling && sleepTime > 0 {
+					// The counter is in sleeps, and the backend waited instead
+					zombiecounter += longPollWait / sleepTime
+				}
+
 				if zombiecounter*sleepTime > workerTimeout {
 					go zombiecheck(ctx, workerTimeout)
 					zombiecounter = 0
 				}
-				time.Sleep(time.Duration(sleepTime) * time.Second)
+
+				// The backend already waited for executions
+				if !longPolling {
+					time.Sleep(time.Duration(sleepTime) * time.Second)
+				}
 				continue
 			}
 
 			// Anything below here verifies concurrency
 			executionCount = getRunningWorkers(ctx, workerTimeout)
 			if executionCount >= maxConcurrency {
+				// Redelivered when there's room again
+				if leased {
+					err = nackExecutionRequests(client, executionRequests.Data, "Orborus at max concurrency", true)
+					if err != nil {
+						log.Printf("[WARNING] Failed returning %d executions to the queue at max concurrency: %s", len(executionRequests.Data), err)
+					}
+				}
+
 				if zombiecounter*sleepTime > workerTimeout {
 					go zombiecheck(ctx, workerTimeout)
 					zombiecounter = 0
@@ -1528,10 +1987,24 @@ func main() {
 				continue
 			}
 
-			allowed := maxConcurrency - executionCount
-			if len(executionRequests.Data) > allowed {
-				log.Printf("[WARNING] Throttle - Cutting down requests from %d to %d (MAX: %d, CUR: %d)", len(executionRequests.Data), allowed, maxConcurrency, executionCount)
-				executionRequests.Data = executionRequests.Data[0:allowed]
+			admitted := admitExecutionRequests(executionRequests.Data, executionCount)
+			if len(executionRequests.Data) > len(admitted) {
+				log.Printf("[WARNING] Throttle - Cutting down requests from %d to %d (MAX: %d, CUR: %d, RESERVED: %d)", len(executionRequests.Data), len(admitted), maxConcurrency, executionCount, reservedPrioritySlots)
+				if leased {
+					throttled := []shuffle.ExecutionRequest{}
+					for _, execution := range executionRequests.Data {
+						if !executionRequestsContain(admitted, execution.ExecutionId) {
+							throttled = append(throttled, execution)
+						}
+					}
+
+					err = nackExecutionRequests(client, throttled, "Orborus at max concurrency", true)
+					if err != nil {
+						log.Printf("[WARNING] Failed returning %d throttled executions to the queue: %s", len(throttled), err)
+					}
+				}
+
+				executionRequests.Data = admitted
 			}
 		} else if (swarmControlMode && (swarmConfig == "run" || swarmConfig == "swarm")) {
 			if len(executionRequests.Data) > 50 {
@@ -1549,6 +2022,25 @@ func main() {
 			swarmRequestsMade += len(executionRequests.Data)
 		}
 
+		for executionId, deployed := range deployedExecutions {
+			if deployed < time.Now().Unix()-int64(workerTimeout) {
+				delete(deployedExecutions, executionId)
+			}
+		}
+
+		metrics.add("shuffle_orborus_executions_dequeued_total", uint64(len(executionRequests.Data)))
+
+		// Confirms before deploying. Failed confirmations are delivered again
+		// later, so nothing is deployed this time.
+		if queueDelivery == "at-most-once" && len(executionRequests.Data) > 0 {
+			err = confirmExecutionRequests(client, executionRequests)
+			if err != nil {
+				log.Printf("[ERROR] Failed confirming %d executions before deploying them: %s", len(executionRequests.Data), err)
+				time.Sleep(time.Duration(sleepTime) * time.Second)
+				continue
+			}
+		}
+
 		// New, abortable version. Should check executionid and remove everything else
 		var toBeRemoved shuffle.ExecutionRequestWrapper
 		for _, execution := range executionRequests.Data {
@@ -1565,16 +2057,10 @@ func main() {
 				log.Printf("[INFO] Executionstatus issue: ", execution.Status)
 			}
 
-			if shuffle.ArrayContains(executionIds, execution.ExecutionId) {
+			if _, ok := deployedExecutions[execution.ExecutionId]; ok {
 				log.Printf("[INFO] Execution already handled (rerun of old executions?): %s", execution.ExecutionId)
 				toBeRemoved.Data = append(toBeRemoved.Data, execution)
-
-				// Should check when last this was ran, and if it's more than 10 minutes ago and it's not finished, we should run it again?
-				/*
-					if swarmConfig != "run" && swarmConfig != "swarm" {
-						continue
-					}
-				*/
+				continue
 			}
 
 			// Now, how do I execute this one?
@@ -1655,77 +2141,61 @@ func main() {
 			if err == nil {
 				//log.Printf("[DEBUG] ExecutionID %s was deployed and to be removed from queue.", execution.ExecutionId)
 				toBeRemoved.Data = append(toBeRemoved.Data, execution)
-				executionIds = append(executionIds, execution.ExecutionId)
+				deployedExecutions[execution.ExecutionId] = time.Now().Unix()
+				metrics.add("shuffle_orborus_executions_deployed_total", 1)
+			} else if queueDelivery == "at-most-once" {
+				metrics.add("shuffle_orborus_executions_failed_total", 1)
+				log.Printf("[ERROR] Execution ID %s failed to deploy and won't be retried (at-most-once): %s", execution.ExecutionId, err)
+
+				err = deadLetterExecutionRequest(client, execution.ExecutionId, err.Error())
+				if err != nil {
+					log.Printf("[WARNING] Failed recording the failed deployment of %s: %s", execution.ExecutionId, err)
+				}
 			} else {
+				metrics.add("shuffle_orborus_executions_failed_total", 1)
 				log.Printf("[WARNING] Execution ID %s failed to deploy: %s", execution.ExecutionId, err)
+
+				if leased {
+					err = nackExecutionRequests(client, []shuffle.ExecutionRequest{execution}, err.Error(), false)
+					if err != nil {
+						log.Printf("[WARNING] Failed nacking execution %s. It's redelivered when the lease runs out: %s", execution.ExecutionId, err)
+					}
+				}
 			}
 		}
 
 		// Removes handled workflows (worker is made)
-		//log.Printf("\n\n[INFO] Removing %d executions from queue\n\n", len(toBeRemoved.Data))
-		if len(toBeRemoved.Data) > 0 {
-			confirmUrl := fmt.Sprintf("%s/api/v1/workflows/queue/confirm", baseUrl)
-
-			data, err := json.Marshal(toBeRemoved)
-			if err != nil {
-				log.Printf("[WARNING] Failed removal marshalling: %s", err)
-				time.Sleep(time.Duration(sleepTime) * time.Second)
-				continue
-			}
-
-			result, err := http.NewRequest(
-				"POST",
-				confirmUrl,
-				bytes.NewBuffer([]byte(data)),
-			)
-
-			if err != nil {
-				log.Printf("[ERROR] Failed building confirm request: %s", err)
-				time.Sleep(time.Duration(sleepTime) * time.Second)
-				continue
-			}
-
-			result.Header.Add("Content-Type", "application/json")
-			result.Header.Add("Org-Id", environment)
-
-			if len(auth) > 0 {
-				result.Header.Add("Authorization", auth)
-			}
-
-			if len(org) > 0 {
-				result.Header.Add("Org", org)
-			}
+		if queueDelivery == "at-least-once" {
+			for _, execution := range pendingConfirms.Data {
+				found := false
+				for _, removed := range toBeRemoved.Data {
+					if removed.ExecutionId == execution.ExecutionId {
+						found = true
+						break
+					}
+				}
 
-			if len(orborusLabel) > 0 {
-				result.Header.Add("X-Orborus-Label", orborusLabel)
+				if !found {
+					toBeRemoved.Data = append(toBeRemoved.Data, execution)
+				}
 			}
 
-			resultResp, err := client.Do(result)
-			if err != nil {
-				log.Printf("[ERROR] Failed making confirm request: %s", err)
-				time.Sleep(time.Duration(sleepTime) * time.Second)
-				continue
-			}
+			pendingConfirms.Data = []shuffle.ExecutionRequest{}
+		}
 
-			defer resultResp.Body.Close()
-			body, err := ioutil.ReadAll(resultResp.Body)
+		//log.Printf("\n\n[INFO] Removing %d executions from queue\n\n", len(toBeRemoved.Data))
+		if queueDelivery == "at-least-once" && len(toBeRemoved.Data) > 0 {
+			err = confirmExecutionRequests(client, toBeRemoved)
 			if err != nil {
-				log.Printf("[ERROR] Failed reading confirm body: %s", err)
+				log.Printf("[ERROR] Failed confirming %d executions. Trying again with the next ones: %s", len(toBeRemoved.Data), err)
+				pendingConfirms = toBeRemoved
 				time.Sleep(time.Duration(sleepTime) * time.Second)
 				continue
 			}
+		}
 
-			_ = body
-			//log.Println(string(body))
-
-			// FIXME - remove these
-			//log.Println(string(body))
-			//log.Println(resultResp)
-			if len(toBeRemoved.Data) == len(executionRequests.Data) {
-				//log.Println("Should remove ALL!")
-			} else {
-				//log.Printf("[INFO] NOT IMPLEMENTED: Should remove %d workflows from backend because they're executed!", len(toBeRemoved.Data))
-			}
+		if longPolling && len(executionRequests.Data) == 0 {
+			continue
 		}
 
 		time.Sleep(time.Duration(sleepTime) * time.Second)
@@ -1824,7 +2294,6 @@ func getRunningWorkers(ctx context.Context, workerTimeout int) int {
 func zombiecheck(ctx context.Context, workerTimeout int) error {
 	isK8s := isKubernetes == "true"
 
-	executionIds = []string{}
 	if swarmConfig == "run" || swarmConfig == "swarm" || isK8s {
 		//log.Printf("[DEBUG] Skipping Zombie check due to new execution model (swarm)")
 		return nil
@@ -1912,7 +2381,10 @@ func zombiecheck(ctx context.Context, workerTimeout int) error {
 
 	log.Printf("[INFO] Should REMOVE %d containers.", len(removeContainers))
 	for _, containername := range removeContainers {
-		dockercli.ContainerRemove(ctx, containername, removeOptions)
+		err = dockercli.ContainerRemove(ctx, containername, removeOptions)
+		if err == nil {
+			metrics.add("shuffle_orborus_zombie_containers_removed_total", 1)
+		}
 	}
 
 	return nil
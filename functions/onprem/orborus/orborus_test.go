@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	testMetrics := &orborusMetrics{
+		counters:    map[string]uint64{},
+		pollBuckets: []float64{0.1, 1, 10},
+		pollCounts:  make([]uint64, 3),
+	}
+
+	testMetrics.add("shuffle_orborus_executions_deployed_total", 2)
+	testMetrics.addBackendError("status")
+	testMetrics.addBackendError("status")
+	testMetrics.observePoll(500 * time.Millisecond)
+	testMetrics.observePoll(5 * time.Second)
+
+	buf := new(bytes.Buffer)
+	testMetrics.write(buf, 3)
+	output := buf.String()
+
+	expected := []string{
+		"# TYPE shuffle_orborus_queue_poll_duration_seconds histogram",
+		`shuffle_orborus_queue_poll_duration_seconds_bucket{le="0.1"} 0`,
+		`shuffle_orborus_queue_poll_duration_seconds_bucket{le="1"} 1`,
+		`shuffle_orborus_queue_poll_duration_seconds_bucket{le="10"} 2`,
+		`shuffle_orborus_queue_poll_duration_seconds_bucket{le="+Inf"} 2`,
+		"shuffle_orborus_queue_poll_duration_seconds_sum 5.5",
+		"shuffle_orborus_queue_poll_duration_seconds_count 2",
+		`shuffle_orborus_backend_errors_total{type="status"} 2`,
+		"shuffle_orborus_executions_deployed_total 2",
+		"shuffle_orborus_executions_failed_total 0",
+		"# TYPE shuffle_orborus_running_workers gauge",
+		"shuffle_orborus_running_workers 3",
+	}
+
+	lines := strings.Split(output, "\n")
+	for _, line := range expected {
+		found := false
+		for _, outputLine := range lines {
+			if outputLine == line {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			t.Errorf("Expected line %q in the metrics:\n%s", line, output)
+		}
+	}
+}